@@ -0,0 +1,307 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// BGBackup is the Schema for the bgbackups API
+// It takes a single base backup of a BGCluster with continuous WAL archiving configured
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=bgbackups,scope=Namespaced,shortName=bgbk
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.bgCluster`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.status.backupId`
+// +kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.storedSizeBytes`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +groupName=bestgres.io
+type BGBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BGBackupSpec   `json:"spec,omitempty"`
+	Status BGBackupStatus `json:"status,omitempty"`
+}
+
+// BGBackupSpec defines the desired state of BGBackup
+type BGBackupSpec struct {
+	// The BGCluster to back up, it needs spec.backup configured
+	// +kubebuilder:validation:Required
+	BGCluster string `json:"bgCluster"`
+	// full copies the whole cluster, incremental only what changed since the previous backup
+	// (a delta backup with WAL-G, an incr backup with pgBackRest)
+	// +kubebuilder:validation:Enum=full;incremental
+	// +kubebuilder:default=full
+	Type string `json:"type,omitempty"`
+	// Number of full backups to keep in the storage once this backup completed, older backups
+	// and the WAL they need are deleted. Nothing is deleted when unset.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	RetainFull *int32 `json:"retainFull,omitempty"`
+}
+
+// BGBackupStatus defines the observed state of BGBackup
+type BGBackupStatus struct {
+	// Pending, Running, Completed or Failed
+	Phase string `json:"phase,omitempty"`
+	// The BGDbOps running the backup
+	BGDbOps string `json:"bgDbOps,omitempty"`
+	// Why the backup failed
+	Message string `json:"message,omitempty"`
+	// When the backup started
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// When the backup completed or failed
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	BackupResult   `json:",inline"`
+}
+
+// BackupResult describes a base backup in the backup storage
+type BackupResult struct {
+	// The tool that took the backup, walg or pgbackrest
+	Method string `json:"method,omitempty"`
+	// The name of the backup in the storage
+	BackupID string `json:"backupId,omitempty"`
+	// The WAL location the backup starts at
+	StartLSN string `json:"startLsn,omitempty"`
+	// The WAL location the backup is consistent at
+	StopLSN string `json:"stopLsn,omitempty"`
+	// Size of the backed up data
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// Size of the backup in the storage
+	StoredSizeBytes int64 `json:"storedSizeBytes,omitempty"`
+	// How long the backup took
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	// Number of files in a filesystem repository whose checksum was verified after the backup
+	VerifiedFiles int32 `json:"verifiedFiles,omitempty"`
+	// Files in a filesystem repository whose content no longer matches their checksum
+	CorruptFiles []string `json:"corruptFiles,omitempty"`
+}
+
+// BackupSpec configures continuous WAL archiving and base backups of a BGCluster
+type BackupSpec struct {
+	// The tool used for WAL archiving and base backups, the image has to ship it
+	// +kubebuilder:validation:Enum=walg;pgbackrest
+	// +kubebuilder:default=walg
+	Method string `json:"method,omitempty"`
+	// Where base backups and archived WAL are stored
+	// +kubebuilder:validation:Required
+	Storage BackupStorage `json:"storage"`
+	// Seconds after which postgres switches to a new WAL segment so idle clusters still
+	// archive regularly, 0 disables it
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=60
+	ArchiveTimeout int32 `json:"archiveTimeout,omitempty"`
+}
+
+// BackupStorage is the location backups are stored in
+type BackupStorage struct {
+	// S3 compatible object storage
+	// +kubebuilder:validation:Optional
+	S3 *S3Storage `json:"s3,omitempty"`
+	// A PersistentVolumeClaim mounted on every member, for installations without object storage
+	// +kubebuilder:validation:Optional
+	Filesystem *FilesystemStorage `json:"filesystem,omitempty"`
+}
+
+// FilesystemStorage is a directory on a PersistentVolumeClaim mounted on every member
+type FilesystemStorage struct {
+	// Name of an existing PersistentVolumeClaim, e.g. a ReadWriteMany volume shared by several
+	// clusters. The operator creates <cluster>-backup when empty, it is kept when the cluster is
+	// deleted so the cluster can be restored from it.
+	ClaimName string `json:"claimName,omitempty"`
+	// Path inside the volume, defaults to the name of the BGCluster
+	Prefix string `json:"prefix,omitempty"`
+	// Size of the claim the operator creates
+	// +kubebuilder:default="10Gi"
+	Size string `json:"size,omitempty"`
+	// Storage class of the claim the operator creates, defaults to the storage class of the
+	// cluster's volumes
+	StorageClass string `json:"storageClass,omitempty"`
+	// Access mode of the claim the operator creates, the members on different nodes all mount it
+	// so ReadWriteOnce is only accepted for a single instance
+	// +kubebuilder:validation:Enum=ReadWriteMany;ReadWriteOnce
+	// +kubebuilder:default=ReadWriteMany
+	AccessMode string `json:"accessMode,omitempty"`
+}
+
+// S3Storage is a bucket in S3 compatible object storage
+type S3Storage struct {
+	// +kubebuilder:validation:Required
+	Bucket string `json:"bucket"`
+	// Path inside the bucket, defaults to the name of the BGCluster
+	Prefix string `json:"prefix,omitempty"`
+	// Endpoint of S3 compatible storage such as MinIO, e.g. http://minio:9000
+	// pgBackRest only talks https
+	Endpoint string `json:"endpoint,omitempty"`
+	// +kubebuilder:default="us-east-1"
+	Region string `json:"region,omitempty"`
+	// Use path style requests, which most S3 compatible storage requires
+	ForcePathStyle bool `json:"forcePathStyle,omitempty"`
+	// Name of a Secret in the namespace of the BGCluster with the accessKeyId and
+	// secretAccessKey keys
+	// +kubebuilder:validation:Required
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// BGBackup phases
+const (
+	BGBackupPhasePending   = "Pending"
+	BGBackupPhaseRunning   = "Running"
+	BGBackupPhaseCompleted = "Completed"
+	BGBackupPhaseFailed    = "Failed"
+)
+
+// Backup types
+const (
+	BackupTypeFull        = "full"
+	BackupTypeIncremental = "incremental"
+)
+
+// Backup methods
+const (
+	BackupMethodWALG       = "walg"
+	BackupMethodPgBackRest = "pgbackrest"
+)
+
+// +kubebuilder:object:root=true
+
+// BGBackupList contains a list of BGBackup
+type BGBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BGBackup `json:"items"`
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackup) DeepCopyInto(out *BGBackup) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackupSpec) DeepCopyInto(out *BGBackupSpec) {
+	*out = *in
+	if in.RetainFull != nil {
+		in, out := &in.RetainFull, &out.RetainFull
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackupStatus) DeepCopyInto(out *BGBackupStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	in.BackupResult.DeepCopyInto(&out.BackupResult)
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupResult) DeepCopyInto(out *BackupResult) {
+	*out = *in
+	if in.Duration != nil {
+		in, out := &in.Duration, &out.Duration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.CorruptFiles != nil {
+		in, out := &in.CorruptFiles, &out.CorruptFiles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupResult.
+func (in *BackupResult) DeepCopy() *BackupResult {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupSpec) DeepCopyInto(out *BackupSpec) {
+	*out = *in
+	in.Storage.DeepCopyInto(&out.Storage)
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupStorage) DeepCopyInto(out *BackupStorage) {
+	*out = *in
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(S3Storage)
+		**out = **in
+	}
+	if in.Filesystem != nil {
+		in, out := &in.Filesystem, &out.Filesystem
+		*out = new(FilesystemStorage)
+		**out = **in
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackupList) DeepCopyInto(out *BGBackupList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]BGBackup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGBackup.
+func (in *BGBackup) DeepCopy() *BGBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(BGBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BGBackup) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGBackupList.
+func (in *BGBackupList) DeepCopy() *BGBackupList {
+	if in == nil {
+		return nil
+	}
+	out := new(BGBackupList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BGBackupList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func init() {
+	SchemeBuilder.Register(&BGBackup{}, &BGBackupList{})
+}
@@ -0,0 +1,177 @@
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// BGBackupSchedule is the Schema for the bgbackupschedules API
+// It creates BGBackups on a cron schedule and prunes the ones past the retention
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=bgbackupschedules,scope=Namespaced,shortName=bgbks
+// +kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.bgCluster`
+// +kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+// +kubebuilder:printcolumn:name="Last Backup",type=date,JSONPath=`.status.lastSuccessfulTime`
+// +kubebuilder:printcolumn:name="Next Backup",type=date,JSONPath=`.status.nextScheduleTime`
+// +groupName=bestgres.io
+type BGBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BGBackupScheduleSpec   `json:"spec,omitempty"`
+	Status BGBackupScheduleStatus `json:"status,omitempty"`
+}
+
+// BGBackupScheduleSpec defines the desired state of BGBackupSchedule
+type BGBackupScheduleSpec struct {
+	// The BGCluster to back up, it needs spec.backup configured
+	// +kubebuilder:validation:Required
+	BGCluster string `json:"bgCluster"`
+	// Cron schedule in UTC, five fields (minute hour day-of-month month day-of-week) or one of
+	// @hourly, @daily, @weekly, @monthly and @yearly
+	// +kubebuilder:validation:Required
+	Schedule string `json:"schedule"`
+	// The type of the scheduled backups, full or incremental
+	// +kubebuilder:validation:Enum=full;incremental
+	// +kubebuilder:default=full
+	Type string `json:"type,omitempty"`
+	// Number of full backups to keep, older backups, the WAL they need and their BGBackups
+	// are deleted
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=7
+	RetainFull int32 `json:"retainFull,omitempty"`
+	// Number of incremental BGBackups to keep, older ones are deleted. The incremental backups
+	// stay in the storage as long as the full backup they build on is retained.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=30
+	RetainIncremental int32 `json:"retainIncremental,omitempty"`
+	// Stop creating backups, the retained ones are kept
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// BGBackupScheduleStatus defines the observed state of BGBackupSchedule
+type BGBackupScheduleStatus struct {
+	// When the last backup was scheduled
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// When the last backup completed
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	// When the next backup is due
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+	// Why backups can't be scheduled
+	Message string `json:"message,omitempty"`
+	// The retained backups of this schedule, newest first
+	Backups []ScheduledBackup `json:"backups,omitempty"`
+}
+
+// ScheduledBackup is a BGBackup created by a BGBackupSchedule
+type ScheduledBackup struct {
+	// Name of the BGBackup
+	Name string `json:"name"`
+	// Type of the backup, full or incremental
+	Type         string `json:"type,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	BackupResult `json:",inline"`
+}
+
+// +kubebuilder:object:root=true
+
+// BGBackupScheduleList contains a list of BGBackupSchedule
+type BGBackupScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []BGBackupSchedule `json:"items"`
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackupSchedule) DeepCopyInto(out *BGBackupSchedule) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackupScheduleStatus) DeepCopyInto(out *BGBackupScheduleStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessfulTime != nil {
+		in, out := &in.LastSuccessfulTime, &out.LastSuccessfulTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextScheduleTime != nil {
+		in, out := &in.NextScheduleTime, &out.NextScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = make([]ScheduledBackup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScheduledBackup) DeepCopyInto(out *ScheduledBackup) {
+	*out = *in
+	in.BackupResult.DeepCopyInto(&out.BackupResult)
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BGBackupScheduleList) DeepCopyInto(out *BGBackupScheduleList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]BGBackupSchedule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGBackupSchedule.
+func (in *BGBackupSchedule) DeepCopy() *BGBackupSchedule {
+	if in == nil {
+		return nil
+	}
+	out := new(BGBackupSchedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BGBackupSchedule) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGBackupScheduleList.
+func (in *BGBackupScheduleList) DeepCopy() *BGBackupScheduleList {
+	if in == nil {
+		return nil
+	}
+	out := new(BGBackupScheduleList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *BGBackupScheduleList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func init() {
+	SchemeBuilder.Register(&BGBackupSchedule{}, &BGBackupScheduleList{})
+}
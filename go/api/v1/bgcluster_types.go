@@ -9,6 +9,11 @@ import (
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:path=bgclusters,scope=Namespaced,shortName=bgclu
+// +kubebuilder:printcolumn:name="Instances",type=integer,JSONPath=`.spec.instances`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Primary",type=string,JSONPath=`.status.primary`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 // +groupName=bestgres.io
 
 // BGCluster is the Schema for the bgclusters API
@@ -35,6 +40,139 @@ type BGClusterSpec struct {
 	PatroniLogLevel string `json:"patroniLogLevel,omitempty"`
 	// +kubebuilder:default={}
 	BootstrapSQL []string `json:"bootstrapSQL,omitempty"`
+	// +kubebuilder:default={}
+	Services ServicesSpec `json:"services,omitempty"`
+	// +kubebuilder:default={}
+	Postgresql PostgresqlSpec `json:"postgresql,omitempty"`
+	// +kubebuilder:default={}
+	Patroni PatroniSpec `json:"patroni,omitempty"`
+	// pg_hba.conf rules, e.g. "host all all 0.0.0.0/0 scram-sha-256"
+	// Defaults to scram-sha-256 for every host connection and trust for the local socket
+	// Sharded clusters always get a rule for the internal Citus user ahead of these
+	// Changes are applied with a Patroni reload
+	PgHBA []string `json:"pgHBA,omitempty"`
+	// Networks the nodes of a sharded cluster reach each other from, the internal Citus user
+	// can only log in from these. Defaults to the private address ranges pod IPs come from,
+	// set the pod CIDR of the Kubernetes cluster to narrow it down
+	CitusNetworks []string `json:"citusNetworks,omitempty"`
+	// What happens to the volumes when the cluster is deleted: Retain keeps them, Delete removes
+	// them and Snapshot takes a VolumeSnapshot of each pgdata volume before removing them
+	// +kubebuilder:validation:Enum=Retain;Delete;Snapshot
+	// +kubebuilder:default=Retain
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	// What happens to the volumes of the instances removed by lowering instances: Retain keeps
+	// them for a later scale up, Delete removes them once their pods are gone
+	// +kubebuilder:validation:Enum=Retain;Delete
+	// +kubebuilder:default=Retain
+	ScaleDownPolicy string `json:"scaleDownPolicy,omitempty"`
+	// Seconds Patroni gets to stop postgres when a pod is stopped before the in-pod controller
+	// kills it, the pod's termination grace period adds a few seconds on top
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=60
+	ShutdownGracePeriodSeconds int64 `json:"shutdownGracePeriodSeconds,omitempty"`
+	// Continuous WAL archiving and the storage BGBackups are written to
+	// +kubebuilder:validation:Optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+	// How a new cluster is initialized, initdb creates an empty cluster when unset
+	// Only read when the cluster is created
+	// +kubebuilder:validation:Optional
+	Bootstrap *BootstrapSpec `json:"bootstrap,omitempty"`
+}
+
+// BootstrapSpec configures how a new cluster is initialized
+type BootstrapSpec struct {
+	// Restore a backup into the new cluster instead of running initdb
+	// The first member restores the backup through a Patroni custom bootstrap, replays WAL up
+	// to the target and is promoted, the other members replicate from it. The source is only
+	// ever read from. Not supported for the clusters of a BGShardedCluster.
+	// +kubebuilder:validation:Optional
+	Recovery *RecoverySpec `json:"recovery,omitempty"`
+}
+
+// RecoverySpec selects the backup a new cluster is restored from, either a BGBackup or a
+// backup storage location
+type RecoverySpec struct {
+	// A completed BGBackup to restore, read from the backup storage of its BGCluster
+	BGBackup string `json:"bgBackup,omitempty"`
+	// A backup storage location to restore from, e.g. the one of a deleted cluster
+	// +kubebuilder:validation:Optional
+	Source *RecoverySource `json:"source,omitempty"`
+	// Where WAL replay stops, at most one of time, lsn and name can be set
+	// Replay continues to the end of the archived WAL when unset
+	// +kubebuilder:validation:Optional
+	Target *RecoveryTarget `json:"target,omitempty"`
+}
+
+// RecoverySource is a backup storage location written by another cluster
+type RecoverySource struct {
+	// Name of the BGCluster that wrote the backups, it names the pgBackRest stanza and is the
+	// default prefix inside the storage
+	// +kubebuilder:validation:Required
+	BGCluster string `json:"bgCluster"`
+	// The tool that wrote the backups
+	// +kubebuilder:validation:Enum=walg;pgbackrest
+	// +kubebuilder:default=walg
+	Method string `json:"method,omitempty"`
+	// +kubebuilder:validation:Required
+	Storage BackupStorage `json:"storage"`
+	// The backup to restore, defaults to the newest backup that completed before the target
+	BackupID string `json:"backupId,omitempty"`
+}
+
+// RecoveryTarget is the point WAL replay stops at
+type RecoveryTarget struct {
+	// Stop at the first transaction committed after this time
+	// +kubebuilder:validation:Optional
+	Time *metav1.Time `json:"time,omitempty"`
+	// Stop at this WAL location, e.g. 0/3000060
+	LSN string `json:"lsn,omitempty"`
+	// Stop at a restore point created with pg_create_restore_point()
+	Name string `json:"name,omitempty"`
+	// Stop just before the target time or location instead of just after it
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// PostgresqlSpec defines the PostgreSQL configuration of the cluster
+// It is written to the Patroni DCS, changes to a running cluster are applied by Patroni
+type PostgresqlSpec struct {
+	// postgresql.conf parameters, e.g. max_connections: "200"
+	// Parameters that need a restart are reported in status.pendingRestart until the members are restarted
+	Parameters map[string]string `json:"parameters,omitempty"`
+	// Libraries to preload, defaults to the Spilo set
+	// Sharded clusters always preload citus first, set this when the image is not Spilo
+	SharedPreloadLibraries []string `json:"sharedPreloadLibraries,omitempty"`
+	// Major version whose binaries Patroni runs, e.g. "16", Spilo picks them when empty
+	// Upgrade BGDbOps set it once the data directory was upgraded, changing it by hand
+	// doesn't upgrade the data directory
+	// +kubebuilder:validation:Pattern=`^[0-9]+$`
+	Version string `json:"version,omitempty"`
+}
+
+// PatroniSpec defines the Patroni dynamic configuration of the cluster
+// Unset fields keep the Patroni defaults
+type PatroniSpec struct {
+	// Seconds the Patroni loop sleeps between iterations
+	// +kubebuilder:validation:Minimum=1
+	LoopWait *int32 `json:"loopWait,omitempty"`
+	// TTL of the leader lock in seconds
+	// +kubebuilder:validation:Minimum=20
+	TTL *int32 `json:"ttl,omitempty"`
+	// Seconds DCS and PostgreSQL operations are retried before the leader demotes itself
+	// +kubebuilder:validation:Minimum=1
+	RetryTimeout *int32 `json:"retryTimeout,omitempty"`
+	// Maximum lag in bytes a replica can have to be promoted on failover
+	// +kubebuilder:validation:Minimum=0
+	MaximumLagOnFailover *int64 `json:"maximumLagOnFailover,omitempty"`
+	// Only promote replicas that were replicating synchronously
+	SynchronousMode *bool `json:"synchronousMode,omitempty"`
+}
+
+// ServicesSpec defines the optional client Services created for the cluster
+// The <name> Service always targets the primary and <name>-repl the replicas
+type ServicesSpec struct {
+	// Create a <name>-any Service that targets every member regardless of role
+	// +kubebuilder:default=false
+	Any bool `json:"any,omitempty"`
 }
 
 // ImageSpec defines the Image-specific configuration
@@ -57,17 +195,204 @@ type VolumeSpec struct {
 	// The storage class to use for the persistent volume
 	// +kubebuilder:validation:Required
 	StorageClass string `json:"storageClass"`
+	// The VolumeSnapshotClass used by the Snapshot deletion policy, the cluster default when unset
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
 }
 
 // BGClusterStatus defines the observed state of BGCluster
 type BGClusterStatus struct {
 	Nodes []string `json:"nodes"`
+	// The generation of the spec this status was observed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// A summary of the conditions: Creating, Initializing, Running, Updating, Degraded or Stopped
+	Phase string `json:"phase,omitempty"`
+	// The pod currently holding the Patroni leader lock
+	Primary string `json:"primary,omitempty"`
+	// The members as reported by Patroni
+	Members []MemberStatus `json:"members,omitempty"`
+	// Members running with settings that only take effect after a restart
+	PendingRestart []PendingRestart `json:"pendingRestart,omitempty"`
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// The restore of a cluster bootstrapped from a backup
+	Recovery *RecoveryStatus `json:"recovery,omitempty"`
+	// The last rollout of a changed pod template
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+}
+
+// RolloutStatus reports the rollout of a changed pod template. The operator replaces the pods
+// one at a time, the replicas first and the primary last after a switchover, and waits for every
+// member to be healthy between the steps.
+type RolloutStatus struct {
+	// RollingOut while pods are replaced, Paused when a step failed and Completed once every
+	// pod runs the revision. A paused rollout resumes when the pod template changes again.
+	Phase string `json:"phase"`
+	// The StatefulSet revision the pods are updated to
+	Revision string `json:"revision"`
+	// Number of pods running the revision
+	UpdatedPods int32 `json:"updatedPods"`
+	// The pod being replaced
+	CurrentPod string `json:"currentPod,omitempty"`
+	// When the current pod was deleted
+	CurrentPodDeletedAt *metav1.Time `json:"currentPodDeletedAt,omitempty"`
+	// What the rollout waits for, or why it paused
+	Message        string       `json:"message,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// RecoveryStatus reports the restore of a cluster bootstrapped from a backup
+type RecoveryStatus struct {
+	// Pending while the source can't be used yet, Restoring until the first member was
+	// promoted, then Promoted
+	Phase string `json:"phase,omitempty"`
+	// The BGBackup or backup storage location the cluster is restored from
+	Source string `json:"source,omitempty"`
+	// Why the restore can't start
+	Message string `json:"message,omitempty"`
+	// The backup that was restored
+	BackupID string `json:"backupId,omitempty"`
+	// The last WAL location replayed before promotion
+	ReplayedLSN string `json:"replayedLsn,omitempty"`
+	// Commit time of the last transaction replayed before promotion
+	LastReplayedTransactionTime *metav1.Time `json:"lastReplayedTransactionTime,omitempty"`
+	// The timeline the cluster continued on after promotion
+	Timeline int64 `json:"timeline,omitempty"`
+	// When the restored member was found promoted. Postgres only promotes once the recovery
+	// target was reached, it stops with an error otherwise.
+	PromotionTime *metav1.Time `json:"promotionTime,omitempty"`
+}
+
+// MemberStatus is the state of a single member of the cluster
+type MemberStatus struct {
+	Name string `json:"name"`
+	// The Patroni role, e.g. leader, replica or sync_standby
+	Role string `json:"role"`
+	// The Patroni state, e.g. running, streaming or starting
+	State    string `json:"state"`
+	Timeline int64  `json:"timeline,omitempty"`
+	// Replication lag in bytes, unset for the leader or when Patroni can't determine it
+	LagBytes *int64 `json:"lagBytes,omitempty"`
+}
+
+// BGCluster condition types
+const (
+	// BGClusterReady is true when every instance is running and a primary is elected
+	BGClusterReady = "Ready"
+	// BGClusterInitialized is true once the bootstrap of every pod completed
+	BGClusterInitialized = "Initialized"
+	// BGClusterPrimaryElected is true while a member holds the leader lock
+	BGClusterPrimaryElected = "PrimaryElected"
+	// BGClusterProgressing is true while the StatefulSet is rolling out or scaling
+	BGClusterProgressing = "Progressing"
+	// BGClusterDegraded is true when an initialized cluster lost members or its primary
+	BGClusterDegraded = "Degraded"
+)
+
+// BGCluster phases
+const (
+	BGClusterPhaseCreating     = "Creating"
+	BGClusterPhaseInitializing = "Initializing"
+	BGClusterPhaseRunning      = "Running"
+	BGClusterPhaseUpdating     = "Updating"
+	BGClusterPhaseDegraded     = "Degraded"
+	BGClusterPhaseStopped      = "Stopped"
+	BGClusterPhaseDeleting     = "Deleting"
+)
+
+// Rollout phases
+const (
+	RolloutPhaseRollingOut = "RollingOut"
+	RolloutPhasePaused     = "Paused"
+	RolloutPhaseCompleted  = "Completed"
+)
+
+// Recovery phases
+const (
+	RecoveryPhasePending   = "Pending"
+	RecoveryPhaseRestoring = "Restoring"
+	RecoveryPhasePromoted  = "Promoted"
+)
+
+// BGCluster deletion policies
+const (
+	DeletionPolicyRetain   = "Retain"
+	DeletionPolicyDelete   = "Delete"
+	DeletionPolicySnapshot = "Snapshot"
+)
+
+// BGCluster scale down policies
+const (
+	ScaleDownPolicyRetain = "Retain"
+	ScaleDownPolicyDelete = "Delete"
+)
+
+// PendingRestart is a member waiting for a restart to apply its configuration
+type PendingRestart struct {
+	Member string `json:"member"`
+	// The parameters waiting for the restart, only reported by Patroni 4 and newer
+	Parameters []string `json:"parameters,omitempty"`
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BGClusterSpec) DeepCopyInto(out *BGClusterSpec) {
 	*out = *in
 	out.Image = in.Image.DeepCopy()
+	in.Postgresql.DeepCopyInto(&out.Postgresql)
+	in.Patroni.DeepCopyInto(&out.Patroni)
+	if in.PgHBA != nil {
+		out.PgHBA = make([]string, len(in.PgHBA))
+		copy(out.PgHBA, in.PgHBA)
+	}
+	if in.CitusNetworks != nil {
+		out.CitusNetworks = make([]string, len(in.CitusNetworks))
+		copy(out.CitusNetworks, in.CitusNetworks)
+	}
+	if in.Backup != nil {
+		out.Backup = new(BackupSpec)
+		in.Backup.DeepCopyInto(out.Backup)
+	}
+	if in.Bootstrap != nil {
+		out.Bootstrap = new(BootstrapSpec)
+		in.Bootstrap.DeepCopyInto(out.Bootstrap)
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BootstrapSpec) DeepCopyInto(out *BootstrapSpec) {
+	*out = *in
+	if in.Recovery != nil {
+		out.Recovery = new(RecoverySpec)
+		in.Recovery.DeepCopyInto(out.Recovery)
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RecoverySpec) DeepCopyInto(out *RecoverySpec) {
+	*out = *in
+	if in.Source != nil {
+		out.Source = new(RecoverySource)
+		in.Source.DeepCopyInto(out.Source)
+	}
+	if in.Target != nil {
+		out.Target = new(RecoveryTarget)
+		in.Target.DeepCopyInto(out.Target)
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RecoverySource) DeepCopyInto(out *RecoverySource) {
+	*out = *in
+	in.Storage.DeepCopyInto(&out.Storage)
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RecoveryTarget) DeepCopyInto(out *RecoveryTarget) {
+	*out = *in
+	if in.Time != nil {
+		out.Time = in.Time.DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGClusterSpec.
@@ -90,6 +415,46 @@ func (in *ImageSpec) DeepCopy() ImageSpec {
 	return out
 }
 
+// DeepCopyInto is a deepcopy function for PostgresqlSpec
+func (in *PostgresqlSpec) DeepCopyInto(out *PostgresqlSpec) {
+	*out = *in
+	if in.Parameters != nil {
+		out.Parameters = make(map[string]string, len(in.Parameters))
+		for key, value := range in.Parameters {
+			out.Parameters[key] = value
+		}
+	}
+	if in.SharedPreloadLibraries != nil {
+		out.SharedPreloadLibraries = make([]string, len(in.SharedPreloadLibraries))
+		copy(out.SharedPreloadLibraries, in.SharedPreloadLibraries)
+	}
+}
+
+// DeepCopyInto is a deepcopy function for PatroniSpec
+func (in *PatroniSpec) DeepCopyInto(out *PatroniSpec) {
+	*out = *in
+	if in.LoopWait != nil {
+		out.LoopWait = new(int32)
+		*out.LoopWait = *in.LoopWait
+	}
+	if in.TTL != nil {
+		out.TTL = new(int32)
+		*out.TTL = *in.TTL
+	}
+	if in.RetryTimeout != nil {
+		out.RetryTimeout = new(int32)
+		*out.RetryTimeout = *in.RetryTimeout
+	}
+	if in.MaximumLagOnFailover != nil {
+		out.MaximumLagOnFailover = new(int64)
+		*out.MaximumLagOnFailover = *in.MaximumLagOnFailover
+	}
+	if in.SynchronousMode != nil {
+		out.SynchronousMode = new(bool)
+		*out.SynchronousMode = *in.SynchronousMode
+	}
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BGClusterStatus) DeepCopyInto(out *BGClusterStatus) {
 	*out = *in
@@ -98,6 +463,74 @@ func (in *BGClusterStatus) DeepCopyInto(out *BGClusterStatus) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.Members != nil {
+		out.Members = make([]MemberStatus, len(in.Members))
+		for i := range in.Members {
+			out.Members[i] = in.Members[i]
+			if in.Members[i].LagBytes != nil {
+				out.Members[i].LagBytes = new(int64)
+				*out.Members[i].LagBytes = *in.Members[i].LagBytes
+			}
+		}
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	if in.PendingRestart != nil {
+		out.PendingRestart = make([]PendingRestart, len(in.PendingRestart))
+		for i := range in.PendingRestart {
+			out.PendingRestart[i] = in.PendingRestart[i]
+			if in.PendingRestart[i].Parameters != nil {
+				out.PendingRestart[i].Parameters = make([]string, len(in.PendingRestart[i].Parameters))
+				copy(out.PendingRestart[i].Parameters, in.PendingRestart[i].Parameters)
+			}
+		}
+	}
+	if in.Recovery != nil {
+		out.Recovery = new(RecoveryStatus)
+		in.Recovery.DeepCopyInto(out.Recovery)
+	}
+	if in.Rollout != nil {
+		out.Rollout = in.Rollout.DeepCopy()
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStatus) DeepCopyInto(out *RolloutStatus) {
+	*out = *in
+	if in.CurrentPodDeletedAt != nil {
+		out.CurrentPodDeletedAt = in.CurrentPodDeletedAt.DeepCopy()
+	}
+	if in.StartTime != nil {
+		out.StartTime = in.StartTime.DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStatus.
+func (in *RolloutStatus) DeepCopy() *RolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RecoveryStatus) DeepCopyInto(out *RecoveryStatus) {
+	*out = *in
+	if in.LastReplayedTransactionTime != nil {
+		out.LastReplayedTransactionTime = in.LastReplayedTransactionTime.DeepCopy()
+	}
+	if in.PromotionTime != nil {
+		out.PromotionTime = in.PromotionTime.DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGClusterStatus.
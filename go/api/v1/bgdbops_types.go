@@ -25,14 +25,19 @@ type BGDbOpsSpec struct {
 	// Reference to the BGCluster
 	// +kubebuilder:validation:Required
 	BGCluster string `json:"bgCluster"`
-	// Operation to perform (e.g., benchmark, repack, restart, vacuum)
+	// Operation to perform (e.g., analyze, backup, benchmark, failover, rebalance, repack, restart, switchover, upgrade, vacuum)
 	// +kubebuilder:validation:Required
-	// +kubebuilder:validation:Enum=benchmark;repack;restart;vacuum
+	// +kubebuilder:validation:Enum=analyze;backup;benchmark;failover;rebalance;repack;restart;switchover;upgrade;vacuum
 	Op string `json:"op"`
 	// Maximum number of retries for the operation
+	// Each pod retries a failing operation with exponential backoff, the operation fails
+	// once any pod used up its retries
 	// +kubebuilder:validation:Minimum=0
 	// +kubebuilder:default=3
 	MaxRetries int `json:"maxRetries,omitempty"`
+	// How long the operation may run before it fails, unlimited when unset
+	// +kubebuilder:validation:Optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
 	// Benchmark operation details
 	// +kubebuilder:validation:Optional
 	Benchmark *BenchmarkSpec `json:"benchmark,omitempty"`
@@ -45,11 +50,34 @@ type BGDbOpsSpec struct {
 	// Vacuum operation details
 	// +kubebuilder:validation:Optional
 	Vacuum *VacuumSpec `json:"vacuum,omitempty"`
+	// Analyze operation details
+	// +kubebuilder:validation:Optional
+	Analyze *AnalyzeSpec `json:"analyze,omitempty"`
+	// Backup operation details, BGBackups create backup operations for themselves
+	// +kubebuilder:validation:Optional
+	Backup *BackupOpSpec `json:"backup,omitempty"`
+	// Rebalance operation details, only for the coordinator of a sharded cluster
+	// +kubebuilder:validation:Optional
+	Rebalance *RebalanceOpSpec `json:"rebalance,omitempty"`
+	// Switchover operation details
+	// +kubebuilder:validation:Optional
+	Switchover *SwitchoverSpec `json:"switchover,omitempty"`
+	// Failover operation details
+	// +kubebuilder:validation:Optional
+	Failover *FailoverSpec `json:"failover,omitempty"`
+	// Major version upgrade details
+	// +kubebuilder:validation:Optional
+	Upgrade *UpgradeSpec `json:"upgrade,omitempty"`
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BGDbOpsSpec) DeepCopyInto(out *BGDbOpsSpec) {
     *out = *in
+    if in.Timeout != nil {
+        in, out := &in.Timeout, &out.Timeout
+        *out = new(metav1.Duration)
+        **out = **in
+    }
     if in.Benchmark != nil {
         in, out := &in.Benchmark, &out.Benchmark
         *out = new(BenchmarkSpec)
@@ -70,6 +98,52 @@ func (in *BGDbOpsSpec) DeepCopyInto(out *BGDbOpsSpec) {
         *out = new(VacuumSpec)
         (*in).DeepCopyInto(*out)
     }
+    if in.Analyze != nil {
+        in, out := &in.Analyze, &out.Analyze
+        *out = new(AnalyzeSpec)
+        (*in).DeepCopyInto(*out)
+    }
+    if in.Backup != nil {
+        in, out := &in.Backup, &out.Backup
+        *out = new(BackupOpSpec)
+        (*in).DeepCopyInto(*out)
+    }
+    if in.Rebalance != nil {
+        in, out := &in.Rebalance, &out.Rebalance
+        *out = new(RebalanceOpSpec)
+        **out = **in
+    }
+    if in.Switchover != nil {
+        in, out := &in.Switchover, &out.Switchover
+        *out = new(SwitchoverSpec)
+        (*in).DeepCopyInto(*out)
+    }
+    if in.Failover != nil {
+        in, out := &in.Failover, &out.Failover
+        *out = new(FailoverSpec)
+        **out = **in
+    }
+    if in.Upgrade != nil {
+        in, out := &in.Upgrade, &out.Upgrade
+        *out = new(UpgradeSpec)
+        **out = **in
+    }
+}
+
+func (in *SwitchoverSpec) DeepCopyInto(out *SwitchoverSpec) {
+    *out = *in
+    if in.ScheduledAt != nil {
+        out.ScheduledAt = in.ScheduledAt.DeepCopy()
+    }
+}
+
+func (in *BackupOpSpec) DeepCopyInto(out *BackupOpSpec) {
+    *out = *in
+    if in.RetainFull != nil {
+        in, out := &in.RetainFull, &out.RetainFull
+        *out = new(int32)
+        **out = **in
+    }
 }
 
 func (in *BenchmarkSpec) DeepCopyInto(out *BenchmarkSpec) {
@@ -84,6 +158,16 @@ func (in *RepackSpec) DeepCopyInto(out *RepackSpec) {
         *out = make([]string, len(*in))
         copy(*out, *in)
     }
+    if in.Databases != nil {
+        in, out := &in.Databases, &out.Databases
+        *out = make([]string, len(*in))
+        copy(*out, *in)
+    }
+    if in.Jobs != nil {
+        in, out := &in.Jobs, &out.Jobs
+        *out = new(int32)
+        **out = **in
+    }
 }
 
 func (in *VacuumSpec) DeepCopyInto(out *VacuumSpec) {
@@ -93,22 +177,53 @@ func (in *VacuumSpec) DeepCopyInto(out *VacuumSpec) {
         *out = make([]string, len(*in))
         copy(*out, *in)
     }
+    if in.Databases != nil {
+        in, out := &in.Databases, &out.Databases
+        *out = make([]string, len(*in))
+        copy(*out, *in)
+    }
+    if in.Parallel != nil {
+        in, out := &in.Parallel, &out.Parallel
+        *out = new(int32)
+        **out = **in
+    }
+}
+
+func (in *AnalyzeSpec) DeepCopyInto(out *AnalyzeSpec) {
+    *out = *in
+    if in.Tables != nil {
+        in, out := &in.Tables, &out.Tables
+        *out = make([]string, len(*in))
+        copy(*out, *in)
+    }
+    if in.Databases != nil {
+        in, out := &in.Databases, &out.Databases
+        *out = make([]string, len(*in))
+        copy(*out, *in)
+    }
 }
 
 // BenchmarkSpec defines the details for a benchmark operation
+// The benchmark runs from the primary pod against a scratch database that is dropped afterwards
 type BenchmarkSpec struct {
 	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=pgbench
 	Type string `json:"type"`
 	// +kubebuilder:validation:Required
 	PgBench PgBenchSpec `json:"pgbench"`
+	// Where the benchmark connects, replicas runs the read-only select-only script
+	// against the <name>-repl Service
 	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Enum=primary;replicas
 	ConnectionType string `json:"connectionType"`
 }
 
 // PgBenchSpec defines the details for a pgbench benchmark
 type PgBenchSpec struct {
+	// The pgbench scale factor (e.g. "100") or an approximate size (e.g. "1Gi")
 	// +kubebuilder:validation:Required
 	DatabaseSize string `json:"databaseSize"`
+	// How long the benchmark runs, in seconds (e.g. "60") or as a duration (e.g. "5m")
 	// +kubebuilder:validation:Required
 	Duration string `json:"duration"`
 	// +kubebuilder:validation:Minimum=1
@@ -118,31 +233,332 @@ type PgBenchSpec struct {
 }
 
 // RepackSpec defines the details for a repack operation
+// Repack only runs on the primary, replicas complete without doing anything
 type RepackSpec struct {
+	// Tables to repack, optionally schema-qualified
+	// Every table over the bloat threshold is repacked when empty
+	// +kubebuilder:validation:Optional
 	Tables []string `json:"tables"`
+	// Databases to repack, defaults to every database that allows connections
+	Databases []string `json:"databases,omitempty"`
+	// Percentage of dead tuples over which a table counts as bloated
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +kubebuilder:default=20
+	BloatThreshold int32 `json:"bloatThreshold,omitempty"`
+	// Create the pg_repack extension in databases that don't have it yet
+	// The operation fails for those databases otherwise
+	CreateExtension bool `json:"createExtension,omitempty"`
+	// Number of parallel jobs rebuilding indexes
+	// +kubebuilder:validation:Minimum=1
+	Jobs *int32 `json:"jobs,omitempty"`
 }
 
 // RestartSpec defines the details for a restart operation
+// The replicas restart one at a time, each waiting for the previous one to stream again, then
+// the primary switches over to a healthy replica and restarts last
 type RestartSpec struct {
+	// Recreate the pods instead of restarting postgres through the Patroni REST API
 	Force bool `json:"force"`
+	// Only restart members Patroni flags as pending restart, e.g. after changing a parameter
+	// that needs a restart
+	PendingRestartOnly bool `json:"pendingRestartOnly,omitempty"`
 }
 
 // VacuumSpec defines the details for a vacuum operation
+// Vacuum only runs on the primary, replicas complete without doing anything
 type VacuumSpec struct {
+	// Tables to vacuum, optionally schema-qualified
+	// Every table of each database is vacuumed when empty
+	// +kubebuilder:validation:Optional
 	Tables []string `json:"tables"`
+	// Databases to vacuum, defaults to every database that allows connections
+	Databases []string `json:"databases,omitempty"`
+	// Rewrite the tables, this takes an exclusive lock on each table
+	Full bool `json:"full,omitempty"`
+	// Aggressively freeze tuples
+	Freeze bool `json:"freeze,omitempty"`
+	// Update planner statistics after vacuuming
+	Analyze bool `json:"analyze,omitempty"`
+	// Log a detailed report for every table
+	Verbose bool `json:"verbose,omitempty"`
+	// Number of parallel workers for index vacuuming, ignored with full
+	// +kubebuilder:validation:Minimum=0
+	Parallel *int32 `json:"parallel,omitempty"`
+}
+
+// AnalyzeSpec defines the details for an analyze operation
+// Analyze only runs on the primary, replicas complete without doing anything
+type AnalyzeSpec struct {
+	// Tables to analyze, optionally schema-qualified
+	// Every table of each database is analyzed when empty
+	Tables []string `json:"tables,omitempty"`
+	// Databases to analyze, defaults to every database that allows connections
+	Databases []string `json:"databases,omitempty"`
+	// Log a detailed report for every table
+	Verbose bool `json:"verbose,omitempty"`
+}
+
+// BackupOpSpec defines the details for a backup operation
+// The backup runs on the primary with the method configured in the BGCluster's spec.backup
+type BackupOpSpec struct {
+	// full or incremental
+	// +kubebuilder:validation:Enum=full;incremental
+	// +kubebuilder:default=full
+	Type string `json:"type,omitempty"`
+	// Number of full backups to keep in the storage after the backup, nothing is deleted when unset
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	RetainFull *int32 `json:"retainFull,omitempty"`
+}
+
+// RebalanceOpSpec defines the details for a rebalance operation
+// The rebalance runs as a Citus background job on the coordinator primary and the operation
+// completes once the job finished
+type RebalanceOpSpec struct {
+	// Name of the rebalance strategy in pg_dist_rebalance_strategy, the Citus default when empty
+	Strategy string `json:"strategy,omitempty"`
+	// How shards are moved, defaults to the shardTransferMode of the sharded cluster
+	// +kubebuilder:validation:Enum=auto;force_logical;block_writes
+	ShardTransferMode string `json:"shardTransferMode,omitempty"`
+	// Only move shards off nodes marked with shouldhaveshards=false
+	DrainOnly bool `json:"drainOnly,omitempty"`
+}
+
+// SwitchoverSpec defines the details for a switchover operation
+// The operator asks the Patroni leader to hand over to a healthy replica, which needs a running
+// leader and at least one replica
+type SwitchoverSpec struct {
+	// The member to promote, Patroni picks the healthiest replica when empty
+	Candidate string `json:"candidate,omitempty"`
+	// When to switch over, right away when unset
+	ScheduledAt *metav1.Time `json:"scheduledAt,omitempty"`
+}
+
+// FailoverSpec defines the details for a failover operation
+// Unlike a switchover a failover also promotes a replica when the cluster has no healthy leader
+type FailoverSpec struct {
+	// The member to promote, the replica with the least replication lag when empty
+	Candidate string `json:"candidate,omitempty"`
+}
+
+// UpgradeSpec defines the details for a major version upgrade
+// The primary runs pg_upgrade --link on its volume while Patroni is paused and every member is
+// stopped, the replicas are rebuilt from the upgraded primary afterwards. The image has to ship
+// the binaries of the current and the new version, as Spilo does. A failure before the upgraded
+// data directory replaces the old one rolls back to the old version.
+type UpgradeSpec struct {
+	// Major version to upgrade to, e.g. "16"
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[0-9]+$`
+	PostgresVersion string `json:"postgresVersion"`
+	// Image the cluster runs after the upgrade, spec.image.tag is kept when empty
+	Image string `json:"image,omitempty"`
+	// Only run the pre-flight checks and pg_upgrade --check, the cluster keeps running
+	CheckOnly bool `json:"checkOnly,omitempty"`
 }
 
 // BGDbOpsStatus defines the observed state of BGDbOps
 type BGDbOpsStatus struct {
-	// Status of the operation
+	// Status of the operation: Running, Completed or Failed
 	Status string `json:"status"`
-	// Number of retries performed
+	// Number of retries performed across all pods
 	// +kubebuilder:validation:Minimum=0
 	Retries int `json:"retries"`
+	// The last error of a failed or retrying operation
+	Message string `json:"message,omitempty"`
+	// The pod that ran the operation, for operations that only run on the primary
+	Pod string `json:"pod,omitempty"`
+	// When the operation started
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// When the operation completed
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Progress of operations that work through tables, e.g. 3/10 tables
+	Progress string `json:"progress,omitempty"`
+	// Per-table results of vacuum, analyze and repack operations
+	Tables []TableResult `json:"tables,omitempty"`
+	// Results of a benchmark operation
+	BenchmarkResult *BenchmarkResult `json:"benchmarkResult,omitempty"`
+	// Results of a backup operation
+	BackupResult *BackupResult `json:"backupResult,omitempty"`
+	// Results of a switchover or failover operation
+	SwitchoverResult *SwitchoverResult `json:"switchoverResult,omitempty"`
+	// Progress and results of an upgrade operation, the primary it runs on is in pod
+	UpgradeResult *UpgradeResult `json:"upgradeResult,omitempty"`
+}
+
+// SwitchoverResult records the leader change of a switchover or failover operation
+type SwitchoverResult struct {
+	OldLeader string `json:"oldLeader"`
+	// Empty until a new leader took over
+	NewLeader   string `json:"newLeader,omitempty"`
+	OldTimeline int64  `json:"oldTimeline"`
+	NewTimeline int64  `json:"newTimeline,omitempty"`
+	// How long no member accepted writes, from the last time the old leader was seen running
+	// to the first time the new one was, measured by polling the members every 100ms
+	WriteUnavailability *metav1.Duration `json:"writeUnavailability,omitempty"`
+}
+
+// UpgradeResult records the progress of an upgrade operation
+type UpgradeResult struct {
+	FromVersion string `json:"fromVersion"`
+	ToVersion   string `json:"toVersion"`
+	// Checked, Stopping, RolledBack, Upgraded or Completed
+	Phase string `json:"phase"`
+	// Extensions updated to the default version of the new binaries, as database.extension
+	ExtensionsUpdated []string `json:"extensionsUpdated,omitempty"`
 }
 
+// UpgradeResult phases
+const (
+	// the pre-flight checks and pg_upgrade --check passed
+	UpgradePhaseChecked = "Checked"
+	// Patroni is paused and the members stop postgres
+	UpgradePhaseStopping = "Stopping"
+	// pg_upgrade failed and the old data directory is back in use
+	UpgradePhaseRolledBack = "RolledBack"
+	// the upgraded data directory replaced the old one, there is no way back from here
+	UpgradePhaseUpgraded = "Upgraded"
+	// the upgraded primary runs and the extensions are updated
+	UpgradePhaseCompleted = "Completed"
+)
+
+// UpgradeIrreversible reports whether the operation is an upgrade that replaced the old data
+// directory, from there on it can only be carried through and is neither cancelled nor timed out
+func (in *BGDbOps) UpgradeIrreversible() bool {
+	result := in.Status.UpgradeResult
+	if in.Spec.Op != "upgrade" || result == nil {
+		return false
+	}
+	return result.Phase == UpgradePhaseUpgraded || result.Phase == UpgradePhaseCompleted
+}
+
+// BenchmarkResult holds the numbers reported by a pgbench run
+type BenchmarkResult struct {
+	// primary or replicas
+	ConnectionType string `json:"connectionType"`
+	// The pgbench scale factor the database was initialized with
+	Scale              int32           `json:"scale"`
+	Clients            int             `json:"clients"`
+	Threads            int             `json:"threads"`
+	Duration           metav1.Duration `json:"duration"`
+	Transactions       int64           `json:"transactions"`
+	FailedTransactions int64           `json:"failedTransactions"`
+	// Transactions per second without the initial connection time
+	TPS            string          `json:"tps"`
+	LatencyAverage metav1.Duration `json:"latencyAverage"`
+	LatencyStddev  metav1.Duration `json:"latencyStddev,omitempty"`
+	LatencyP50     metav1.Duration `json:"latencyP50,omitempty"`
+	LatencyP95     metav1.Duration `json:"latencyP95,omitempty"`
+	LatencyP99     metav1.Duration `json:"latencyP99,omitempty"`
+}
+
+// TableResult is the outcome of an operation on a single table
+type TableResult struct {
+	Database string `json:"database"`
+	// The table, empty when the whole database failed
+	Table string `json:"table,omitempty"`
+	// Succeeded or Failed
+	Result   string          `json:"result"`
+	Duration metav1.Duration `json:"duration"`
+	// The error for failed tables
+	Message string `json:"message,omitempty"`
+	// Total size of the table and its indexes before and after a repack
+	SizeBeforeBytes int64 `json:"sizeBeforeBytes,omitempty"`
+	SizeAfterBytes  int64 `json:"sizeAfterBytes,omitempty"`
+}
+
+// BGDbOps status values
+const (
+	BGDbOpsStatusRunning   = "Running"
+	BGDbOpsStatusCompleted = "Completed"
+	BGDbOpsStatusFailed    = "Failed"
+)
+
+// BGDbOpsAttempts tracks the attempts of a pod at an operation, the in-pod controller keeps
+// it as JSON in the bgdbops.bestgres.io/attempts pod annotation
+type BGDbOpsAttempts struct {
+	// The BGDbOps the attempts belong to
+	BGDbOps  string `json:"bgDbOps"`
+	Attempts int    `json:"attempts"`
+	// Set once the pod used up its retries
+	Failed    bool   `json:"failed,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	// When the pod tries again
+	NextAttempt *metav1.Time `json:"nextAttempt,omitempty"`
+}
+
+// TableResult values
+const (
+	TableResultSucceeded = "Succeeded"
+	TableResultFailed    = "Failed"
+)
+
 func (in *BGDbOpsStatus) DeepCopyInto(out *BGDbOpsStatus) {
     *out = *in
+    if in.StartTime != nil {
+        out.StartTime = in.StartTime.DeepCopy()
+    }
+    if in.CompletionTime != nil {
+        out.CompletionTime = in.CompletionTime.DeepCopy()
+    }
+    if in.Tables != nil {
+        in, out := &in.Tables, &out.Tables
+        *out = make([]TableResult, len(*in))
+        copy(*out, *in)
+    }
+    if in.BenchmarkResult != nil {
+        in, out := &in.BenchmarkResult, &out.BenchmarkResult
+        *out = new(BenchmarkResult)
+        **out = **in
+    }
+    if in.BackupResult != nil {
+        out.BackupResult = in.BackupResult.DeepCopy()
+    }
+    if in.SwitchoverResult != nil {
+        in, out := &in.SwitchoverResult, &out.SwitchoverResult
+        *out = new(SwitchoverResult)
+        (*in).DeepCopyInto(*out)
+    }
+    if in.UpgradeResult != nil {
+        out.UpgradeResult = in.UpgradeResult.DeepCopy()
+    }
+}
+
+func (in *SwitchoverResult) DeepCopyInto(out *SwitchoverResult) {
+    *out = *in
+    if in.WriteUnavailability != nil {
+        in, out := &in.WriteUnavailability, &out.WriteUnavailability
+        *out = new(metav1.Duration)
+        **out = **in
+    }
+}
+
+func (in *SwitchoverResult) DeepCopy() *SwitchoverResult {
+    if in == nil {
+        return nil
+    }
+    out := new(SwitchoverResult)
+    in.DeepCopyInto(out)
+    return out
+}
+
+func (in *UpgradeResult) DeepCopyInto(out *UpgradeResult) {
+    *out = *in
+    if in.ExtensionsUpdated != nil {
+        in, out := &in.ExtensionsUpdated, &out.ExtensionsUpdated
+        *out = make([]string, len(*in))
+        copy(*out, *in)
+    }
+}
+
+func (in *UpgradeResult) DeepCopy() *UpgradeResult {
+    if in == nil {
+        return nil
+    }
+    out := new(UpgradeResult)
+    in.DeepCopyInto(out)
+    return out
 }
 
 // +kubebuilder:object:root=true
@@ -25,14 +25,62 @@ type BGShardedClusterSpec struct {
 	// +kubebuilder:validation:Required
 	// Number of shards in the cluster
 	Shards int32 `json:"shards"`
+	// How workers are registered with the coordinator: operator registers them from the
+	// in-pod controller, patroni-native lets Patroni maintain pg_dist_node, which also
+	// follows worker failovers. The mode can't be changed once the cluster exists.
+	// +kubebuilder:validation:Enum=operator;patroni-native
+	// +kubebuilder:default=operator
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="mode is immutable"
+	Mode string `json:"mode,omitempty"`
 	// +kubebuilder:validation:Required
 	// Coordinator node configuration
 	Coordinator BGClusterSpec `json:"coordinator"`
 	// +kubebuilder:validation:Required
 	// Worker nodes configuration
 	Workers BGClusterSpec `json:"workers"`
+	// How Citus moves shards off workers that are scaled down: auto uses logical replication
+	// and fails for tables without a replica identity, block_writes blocks writes to the
+	// shards while they move
+	// +kubebuilder:validation:Enum=auto;force_logical;block_writes
+	// +kubebuilder:default=auto
+	ShardTransferMode string `json:"shardTransferMode,omitempty"`
+	// Rebalancing of shards onto workers that are added to the cluster
+	// +kubebuilder:validation:Optional
+	Rebalance *RebalanceSpec `json:"rebalance,omitempty"`
 }
 
+// RebalanceSpec defines how shards are rebalanced when workers are added
+type RebalanceSpec struct {
+	// Start a background rebalance on the coordinator when a worker becomes active
+	// +kubebuilder:default=true
+	Auto *bool `json:"auto,omitempty"`
+	// Name of the rebalance strategy in pg_dist_rebalance_strategy, the Citus default when empty
+	Strategy string `json:"strategy,omitempty"`
+	// Number of shard moves running at the same time on each node, sets
+	// citus.max_background_task_executors_per_node on the coordinator
+	// +kubebuilder:validation:Minimum=1
+	MaxConcurrency *int32 `json:"maxConcurrency,omitempty"`
+}
+
+// RebalanceStatus is the progress of the last background rebalance reported by citus_rebalance_status
+type RebalanceStatus struct {
+	// The Citus background job id
+	JobID int64 `json:"jobID"`
+	// State of the job, e.g. scheduled, running, finished, failed or cancelled
+	State string `json:"state"`
+	// Progress of the shard moves, e.g. 3/10 tasks
+	Progress string `json:"progress,omitempty"`
+	StartedAt  *metav1.Time `json:"startedAt,omitempty"`
+	FinishedAt *metav1.Time `json:"finishedAt,omitempty"`
+}
+
+const (
+	// ShardedClusterModeOperator registers workers from the in-pod controller of the coordinator
+	ShardedClusterModeOperator = "operator"
+	// ShardedClusterModePatroniNative runs every BGCluster as a Citus group of one Patroni cluster
+	ShardedClusterModePatroniNative = "patroni-native"
+)
+
 // BGShardedClusterStatus defines the observed state of BGShardedCluster
 type BGShardedClusterStatus struct {
 	// Status of the sharded cluster
@@ -40,6 +88,14 @@ type BGShardedClusterStatus struct {
 	// Names of the coordinator and worker BGClusters
 	CoordinatorCluster string   `json:"coordinatorCluster"`
 	WorkerClusters     []string `json:"workerClusters"`
+	// Worker BGClusters that are scaled down, they are deleted once Citus moved their shards
+	// to the other workers
+	DrainingWorkers []string `json:"drainingWorkers,omitempty"`
+	// Worker BGClusters the coordinator hasn't registered in pg_dist_node yet, the coordinator
+	// keeps retrying until they are
+	UnregisteredWorkers []string `json:"unregisteredWorkers,omitempty"`
+	// The last shard rebalance on the coordinator
+	Rebalance *RebalanceStatus `json:"rebalance,omitempty"`
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
@@ -47,6 +103,49 @@ func (in *BGShardedClusterSpec) DeepCopyInto(out *BGShardedClusterSpec) {
 	*out = *in
 	in.Coordinator.DeepCopyInto(&out.Coordinator)
 	in.Workers.DeepCopyInto(&out.Workers)
+	if in.Rebalance != nil {
+		in, out := &in.Rebalance, &out.Rebalance
+		*out = new(RebalanceSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RebalanceSpec) DeepCopyInto(out *RebalanceSpec) {
+	*out = *in
+	if in.Auto != nil {
+		in, out := &in.Auto, &out.Auto
+		*out = new(bool)
+		**out = **in
+	}
+	if in.MaxConcurrency != nil {
+		in, out := &in.MaxConcurrency, &out.MaxConcurrency
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RebalanceStatus) DeepCopyInto(out *RebalanceStatus) {
+	*out = *in
+	if in.StartedAt != nil {
+		in, out := &in.StartedAt, &out.StartedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.FinishedAt != nil {
+		in, out := &in.FinishedAt, &out.FinishedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RebalanceStatus.
+func (in *RebalanceStatus) DeepCopy() *RebalanceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RebalanceStatus)
+	in.DeepCopyInto(out)
+	return out
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGShardedClusterSpec.
@@ -67,6 +166,19 @@ func (in *BGShardedClusterStatus) DeepCopyInto(out *BGShardedClusterStatus) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.DrainingWorkers != nil {
+		in, out := &in.DrainingWorkers, &out.DrainingWorkers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.UnregisteredWorkers != nil {
+		in, out := &in.UnregisteredWorkers, &out.UnregisteredWorkers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Rebalance != nil {
+		out.Rebalance = in.Rebalance.DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BGShardedClusterStatus.
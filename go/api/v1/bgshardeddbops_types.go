@@ -38,9 +38,10 @@ type BGShardedDbOpsSpec struct {
 // BGDbOpsClusterSpec defines the desired state of a database operation on a sharded cluster
 // This is separate from BGDbOpsSpec to allow for potential differences in sharded operations
 type BGDbOpsClusterSpec struct {
-	// Op specifies the operation to perform (e.g., benchmark, repack, restart, vacuum)
+	// Op specifies the operation to perform (e.g., analyze, benchmark, rebalance, repack, restart, vacuum)
+	// rebalance only runs on the coordinator, every other operation runs on all clusters
 	// +kubebuilder:validation:Required
-	// +kubebuilder:validation:Enum=benchmark;repack;restart;vacuum
+	// +kubebuilder:validation:Enum=analyze;benchmark;rebalance;repack;restart;vacuum
 	Op string `json:"op"`
 
 	// MaxRetries specifies the maximum number of retries for the operation
@@ -48,6 +49,10 @@ type BGDbOpsClusterSpec struct {
 	// +kubebuilder:default=3
 	MaxRetries int `json:"maxRetries,omitempty"`
 
+	// Timeout specifies how long the operation may run on each cluster before it fails
+	// +kubebuilder:validation:Optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
 	// Benchmark operation details, only used when Op is "benchmark"
 	// +kubebuilder:validation:Optional
 	Benchmark *BenchmarkSpec `json:"benchmark,omitempty"`
@@ -63,6 +68,14 @@ type BGDbOpsClusterSpec struct {
 	// Vacuum operation details, only used when Op is "vacuum"
 	// +kubebuilder:validation:Optional
 	Vacuum *VacuumSpec `json:"vacuum,omitempty"`
+
+	// Analyze operation details, only used when Op is "analyze"
+	// +kubebuilder:validation:Optional
+	Analyze *AnalyzeSpec `json:"analyze,omitempty"`
+
+	// Rebalance operation details, only used when Op is "rebalance"
+	// +kubebuilder:validation:Optional
+	Rebalance *RebalanceOpSpec `json:"rebalance,omitempty"`
 }
 
 // BGShardedDbOpsStatus defines the observed state of BGShardedDbOps
@@ -99,6 +112,11 @@ func (in *BGShardedDbOpsSpec) DeepCopyInto(out *BGShardedDbOpsSpec) {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BGDbOpsClusterSpec) DeepCopyInto(out *BGDbOpsClusterSpec) {
 	*out = *in
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
 	if in.Benchmark != nil {
 		in, out := &in.Benchmark, &out.Benchmark
 		*out = new(BenchmarkSpec)
@@ -119,6 +137,16 @@ func (in *BGDbOpsClusterSpec) DeepCopyInto(out *BGDbOpsClusterSpec) {
 		*out = new(VacuumSpec)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Analyze != nil {
+		in, out := &in.Analyze, &out.Analyze
+		*out = new(AnalyzeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Rebalance != nil {
+		in, out := &in.Rebalance, &out.Rebalance
+		*out = new(RebalanceOpSpec)
+		**out = **in
+	}
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
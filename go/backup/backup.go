@@ -0,0 +1,443 @@
+// Package backup builds the WAL-G and pgBackRest invocations for continuous archiving and
+// base backups, it is shared by the operator and the in-pod controller
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+)
+
+const (
+	// ArchiveCommand is the archive_command of clusters with backups configured, the
+	// controller binary pushes the segment with the configured tool
+	ArchiveCommand = `/app/controller archive-wal "%p"`
+
+	// AccessKeyIDEnv and SecretAccessKeyEnv hold the S3 credentials on the pods, they are
+	// set from the credentials Secret of the storage
+	AccessKeyIDEnv     = "BACKUP_S3_ACCESS_KEY_ID"
+	SecretAccessKeyEnv = "BACKUP_S3_SECRET_ACCESS_KEY"
+
+	// RestoreBackupCommand and RestoreWALCommand are the Patroni custom bootstrap of clusters
+	// restored from a backup, Patroni adds the data directory to the former
+	RestoreBackupCommand = "/app/controller restore-backup"
+	RestoreWALCommand    = `/app/controller restore-wal "%f" "%p"`
+
+	// RestoreSourceEnv holds the Source a new cluster is restored from as JSON, the
+	// credentials of its storage are in RestoreAccessKeyIDEnv and RestoreSecretAccessKeyEnv
+	RestoreSourceEnv          = "RESTORE_SOURCE"
+	RestoreAccessKeyIDEnv     = "RESTORE_S3_ACCESS_KEY_ID"
+	RestoreSecretAccessKeyEnv = "RESTORE_S3_SECRET_ACCESS_KEY"
+
+	// BackupMountPath is where the volume of filesystem storage is mounted on the members,
+	// RestoreMountPath is where the one of the storage a new cluster is restored from is
+	BackupMountPath  = "/backup"
+	RestoreMountPath = "/restore"
+
+	// socketDir is where Spilo puts the postgres socket
+	socketDir = "/var/run/postgresql"
+	// walgDeltaMaxSteps is how many incremental backups WAL-G chains before taking a full one
+	walgDeltaMaxSteps = "6"
+)
+
+// Target is a backup storage location and the tool that writes to it
+type Target struct {
+	Method  string
+	Storage bestgresv1.BackupStorage
+	// The cluster the backups belong to, it names the pgBackRest stanza and is the default
+	// prefix inside the storage
+	Cluster string
+	// Restore targets belong to another cluster and are only read from, their credentials
+	// come from the RESTORE_S3_* variables
+	Restore bool
+}
+
+// Source is the backup a new cluster is restored from
+type Source struct {
+	Target
+	// The backup to restore, the newest one before the recovery target when empty
+	BackupID string
+}
+
+// TargetFor returns the backup target configured on the cluster, or nil if backups are
+// not configured
+func TargetFor(bgCluster *bestgresv1.BGCluster) *Target {
+	if bgCluster.Spec.Backup == nil {
+		return nil
+	}
+	method := bgCluster.Spec.Backup.Method
+	if method == "" {
+		method = bestgresv1.BackupMethodWALG
+	}
+	return &Target{Method: method, Storage: bgCluster.Spec.Backup.Storage, Cluster: bgCluster.Name}
+}
+
+// Prefix returns the path of the backups inside the storage
+func (t *Target) Prefix() string {
+	if t.Storage.S3 != nil && t.Storage.S3.Prefix != "" {
+		return strings.Trim(t.Storage.S3.Prefix, "/")
+	}
+	if t.Storage.Filesystem != nil && t.Storage.Filesystem.Prefix != "" {
+		return strings.Trim(t.Storage.Filesystem.Prefix, "/")
+	}
+	return t.Cluster
+}
+
+// ClaimName returns the PersistentVolumeClaim of filesystem storage, the operator creates
+// <cluster>-backup when none is configured
+func (t *Target) ClaimName() string {
+	if t.Storage.Filesystem == nil {
+		return ""
+	}
+	if t.Storage.Filesystem.ClaimName != "" {
+		return t.Storage.Filesystem.ClaimName
+	}
+	return t.Cluster + "-backup"
+}
+
+// Path returns the directory of filesystem storage on the members
+func (t *Target) Path() string {
+	if t.Restore {
+		return RestoreMountPath + "/" + t.Prefix()
+	}
+	return BackupMountPath + "/" + t.Prefix()
+}
+
+// Location describes where the backups are stored, e.g. s3://bucket/prefix
+func (t *Target) Location() string {
+	switch {
+	case t.Storage.S3 != nil:
+		return "s3://" + t.Storage.S3.Bucket + "/" + t.Prefix()
+	case t.Storage.Filesystem != nil:
+		return "pvc://" + t.ClaimName() + "/" + t.Prefix()
+	}
+	return ""
+}
+
+// Env returns the environment of the backup tool, the S3 credentials are read from the
+// environment of the calling process
+func (t *Target) Env(dataDir string) (map[string]string, error) {
+	if (t.Storage.S3 == nil) == (t.Storage.Filesystem == nil) {
+		return nil, fmt.Errorf("set exactly one of s3 and filesystem as the backup storage of %s", t.Cluster)
+	}
+	if t.Storage.Filesystem != nil {
+		return t.filesystemEnv(dataDir)
+	}
+	s3 := t.Storage.S3
+	region := s3.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	accessKeyID, secretAccessKey := os.Getenv(AccessKeyIDEnv), os.Getenv(SecretAccessKeyEnv)
+	if t.Restore {
+		accessKeyID, secretAccessKey = os.Getenv(RestoreAccessKeyIDEnv), os.Getenv(RestoreSecretAccessKeyEnv)
+	}
+
+	switch t.Method {
+	case bestgresv1.BackupMethodWALG:
+		env := map[string]string{
+			"WALG_S3_PREFIX":        "s3://" + s3.Bucket + "/" + t.Prefix(),
+			"AWS_ACCESS_KEY_ID":     accessKeyID,
+			"AWS_SECRET_ACCESS_KEY": secretAccessKey,
+			"AWS_REGION":            region,
+			"WALG_DELTA_MAX_STEPS":  walgDeltaMaxSteps,
+			"PGHOST":                socketDir,
+			"PGUSER":                "postgres",
+			"PGPASSWORD":            os.Getenv("PGPASSWORD_SUPERUSER"),
+			"PGDATA":                dataDir,
+		}
+		if s3.Endpoint != "" {
+			env["AWS_ENDPOINT"] = s3.Endpoint
+		}
+		if s3.ForcePathStyle {
+			env["AWS_S3_FORCE_PATH_STYLE"] = "true"
+		}
+		return env, nil
+	case bestgresv1.BackupMethodPgBackRest:
+		env := map[string]string{
+			"PGBACKREST_STANZA":              t.Cluster,
+			"PGBACKREST_PG1_PATH":            dataDir,
+			"PGBACKREST_PG1_SOCKET_PATH":     socketDir,
+			"PGBACKREST_LOG_LEVEL_FILE":      "off",
+			"PGBACKREST_REPO1_TYPE":          "s3",
+			"PGBACKREST_REPO1_PATH":          "/" + t.Prefix(),
+			"PGBACKREST_REPO1_S3_BUCKET":     s3.Bucket,
+			"PGBACKREST_REPO1_S3_REGION":     region,
+			"PGBACKREST_REPO1_S3_KEY":        accessKeyID,
+			"PGBACKREST_REPO1_S3_KEY_SECRET": secretAccessKey,
+			"PGBACKREST_REPO1_S3_ENDPOINT":   "s3." + region + ".amazonaws.com",
+		}
+		if s3.Endpoint != "" {
+			endpoint, err := url.Parse(s3.Endpoint)
+			if err != nil || endpoint.Hostname() == "" {
+				return nil, fmt.Errorf("invalid S3 endpoint %q", s3.Endpoint)
+			}
+			env["PGBACKREST_REPO1_S3_ENDPOINT"] = endpoint.Hostname()
+			if port := endpoint.Port(); port != "" {
+				env["PGBACKREST_REPO1_STORAGE_PORT"] = port
+			}
+		}
+		if s3.ForcePathStyle {
+			env["PGBACKREST_REPO1_S3_URI_STYLE"] = "path"
+		}
+		return env, nil
+	}
+	return nil, fmt.Errorf("unknown backup method %q", t.Method)
+}
+
+// filesystemEnv returns the environment of the backup tool for filesystem storage
+func (t *Target) filesystemEnv(dataDir string) (map[string]string, error) {
+	switch t.Method {
+	case bestgresv1.BackupMethodWALG:
+		return map[string]string{
+			"WALG_FILE_PREFIX":     t.Path(),
+			"WALG_DELTA_MAX_STEPS": walgDeltaMaxSteps,
+			"PGHOST":               socketDir,
+			"PGUSER":               "postgres",
+			"PGPASSWORD":           os.Getenv("PGPASSWORD_SUPERUSER"),
+			"PGDATA":               dataDir,
+		}, nil
+	case bestgresv1.BackupMethodPgBackRest:
+		return map[string]string{
+			"PGBACKREST_STANZA":          t.Cluster,
+			"PGBACKREST_PG1_PATH":        dataDir,
+			"PGBACKREST_PG1_SOCKET_PATH": socketDir,
+			"PGBACKREST_LOG_LEVEL_FILE":  "off",
+			"PGBACKREST_REPO1_TYPE":      "posix",
+			"PGBACKREST_REPO1_PATH":      t.Path(),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown backup method %q", t.Method)
+}
+
+// WALPushCommand archives a WAL segment
+func (t *Target) WALPushCommand(path string) []string {
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		return []string{"pgbackrest", "archive-push", path}
+	}
+	return []string{"wal-g", "wal-push", path}
+}
+
+// InitCommand prepares the storage for a new cluster, nil if the tool doesn't need it
+func (t *Target) InitCommand() []string {
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		return []string{"pgbackrest", "stanza-create"}
+	}
+	return nil
+}
+
+// BackupCommand takes a base backup of the data directory
+func (t *Target) BackupCommand(backupType, dataDir string) []string {
+	incremental := backupType == bestgresv1.BackupTypeIncremental
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		if incremental {
+			return []string{"pgbackrest", "backup", "--type=incr"}
+		}
+		return []string{"pgbackrest", "backup", "--type=full"}
+	}
+	// WAL-G takes a delta backup unless told otherwise
+	if incremental {
+		return []string{"wal-g", "backup-push", dataDir}
+	}
+	return []string{"wal-g", "backup-push", "--full", dataDir}
+}
+
+// ListCommand lists the backups in the storage as JSON, see ParseBackupList
+func (t *Target) ListCommand() []string {
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		return []string{"pgbackrest", "info", "--output=json"}
+	}
+	return []string{"wal-g", "backup-list", "--detail", "--json"}
+}
+
+// PruneCommand deletes everything but the newest retainFull full backups and the WAL they need
+func (t *Target) PruneCommand(retainFull int32) []string {
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		return []string{"pgbackrest", "expire", "--repo1-retention-full=" + strconv.Itoa(int(retainFull))}
+	}
+	return []string{"wal-g", "delete", "retain", "FULL", strconv.Itoa(int(retainFull)), "--confirm"}
+}
+
+// RestoreCommand restores a base backup into an empty data directory, the recovery settings
+// are left to Patroni
+func (t *Target) RestoreCommand(backupID, dataDir string) []string {
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		command := []string{"pgbackrest", "restore", "--type=none"}
+		if backupID != "" {
+			command = append(command, "--set="+backupID)
+		}
+		return command
+	}
+	if backupID == "" {
+		backupID = "LATEST"
+	}
+	return []string{"wal-g", "backup-fetch", dataDir, backupID}
+}
+
+// WALFetchCommand fetches an archived WAL file for recovery
+func (t *Target) WALFetchCommand(name, path string) []string {
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		return []string{"pgbackrest", "archive-get", name, path}
+	}
+	return []string{"wal-g", "wal-fetch", name, path}
+}
+
+// SameLocation reports whether both targets write to the same place in the same storage
+func (t *Target) SameLocation(other *Target) bool {
+	if t.Storage.Filesystem != nil && other.Storage.Filesystem != nil {
+		return t.ClaimName() == other.ClaimName() && t.Prefix() == other.Prefix()
+	}
+	if t.Storage.S3 == nil || other.Storage.S3 == nil {
+		return false
+	}
+	return t.Storage.S3.Endpoint == other.Storage.S3.Endpoint &&
+		t.Storage.S3.Bucket == other.Storage.S3.Bucket &&
+		t.Prefix() == other.Prefix()
+}
+
+// Info describes a backup in the storage
+type Info struct {
+	ID              string
+	StartLSN        string
+	StopLSN         string
+	SizeBytes       int64
+	StoredSizeBytes int64
+	StartTime       time.Time
+	StopTime        time.Time
+}
+
+// ParseBackupList parses the output of the ListCommand, oldest backup first
+func (t *Target) ParseBackupList(output []byte) ([]Info, error) {
+	var backups []Info
+	if t.Method == bestgresv1.BackupMethodPgBackRest {
+		var stanzas []struct {
+			Backup []struct {
+				Label     string `json:"label"`
+				Timestamp struct {
+					Start int64 `json:"start"`
+					Stop  int64 `json:"stop"`
+				} `json:"timestamp"`
+				LSN struct {
+					Start string `json:"start"`
+					Stop  string `json:"stop"`
+				} `json:"lsn"`
+				Info struct {
+					Size       int64 `json:"size"`
+					Repository struct {
+						Delta int64 `json:"delta"`
+					} `json:"repository"`
+				} `json:"info"`
+			} `json:"backup"`
+		}
+		if err := json.Unmarshal(output, &stanzas); err != nil {
+			return nil, fmt.Errorf("failed to parse pgbackrest info: %w", err)
+		}
+		for _, stanza := range stanzas {
+			for _, b := range stanza.Backup {
+				backups = append(backups, Info{
+					ID:              b.Label,
+					StartLSN:        b.LSN.Start,
+					StopLSN:         b.LSN.Stop,
+					SizeBytes:       b.Info.Size,
+					StoredSizeBytes: b.Info.Repository.Delta,
+					StartTime:       time.Unix(b.Timestamp.Start, 0).UTC(),
+					StopTime:        time.Unix(b.Timestamp.Stop, 0).UTC(),
+				})
+			}
+		}
+	} else {
+		var list []struct {
+			BackupName       string    `json:"backup_name"`
+			StartTime        time.Time `json:"start_time"`
+			FinishTime       time.Time `json:"finish_time"`
+			StartLSN         uint64    `json:"start_lsn"`
+			FinishLSN        uint64    `json:"finish_lsn"`
+			UncompressedSize int64     `json:"uncompressed_size"`
+			CompressedSize   int64     `json:"compressed_size"`
+		}
+		// an empty storage lists nothing at all
+		if len(strings.TrimSpace(string(output))) == 0 {
+			return nil, nil
+		}
+		if err := json.Unmarshal(output, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse wal-g backup-list: %w", err)
+		}
+		for _, b := range list {
+			backups = append(backups, Info{
+				ID:              b.BackupName,
+				StartLSN:        FormatLSN(b.StartLSN),
+				StopLSN:         FormatLSN(b.FinishLSN),
+				SizeBytes:       b.UncompressedSize,
+				StoredSizeBytes: b.CompressedSize,
+				StartTime:       b.StartTime,
+				StopTime:        b.FinishTime,
+			})
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].StartTime.Before(backups[j].StartTime) })
+	return backups, nil
+}
+
+// SelectBackup picks the newest backup that completed before the recovery target, backups
+// must be sorted oldest first. Restore points can't be compared, the newest backup is used.
+func SelectBackup(backups []Info, target *bestgresv1.RecoveryTarget) (*Info, error) {
+	for i := len(backups) - 1; i >= 0; i-- {
+		switch {
+		case target == nil:
+		case target.Time != nil:
+			if backups[i].StopTime.After(target.Time.Time) {
+				continue
+			}
+		case target.LSN != "":
+			targetLSN, err := ParseLSN(target.LSN)
+			if err != nil {
+				return nil, err
+			}
+			stopLSN, err := ParseLSN(backups[i].StopLSN)
+			if err != nil || stopLSN > targetLSN {
+				continue
+			}
+		}
+		return &backups[i], nil
+	}
+	return nil, fmt.Errorf("no backup completed before the recovery target")
+}
+
+// ParseLSN parses a WAL location such as 0/3000060
+func ParseLSN(lsn string) (uint64, error) {
+	parts := strings.SplitN(lsn, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	high, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	low, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	return high<<32 | low, nil
+}
+
+// FormatLSN formats a WAL location the way postgres does
+func FormatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, lsn&0xFFFFFFFF)
+}
+
+// EnvList turns an environment map into the KEY=value form of exec.Cmd.Env
+func EnvList(env map[string]string) []string {
+	var list []string
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
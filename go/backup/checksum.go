@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ChecksumManifest is the file in the directory of filesystem storage that records the
+// SHA-256 of every file the backup tools wrote
+const ChecksumManifest = "bestgres-checksums.json"
+
+type checksumEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	SHA256  string `json:"sha256"`
+}
+
+// Verification is the result of checking filesystem storage against its manifest
+type Verification struct {
+	// Verified is the number of files checked against their manifest entry
+	Verified int
+	// Corrupt are the files that changed although the backup tools never rewrite them,
+	// relative to the directory of the storage
+	Corrupt []string
+	// Manifest is the updated manifest, it records the files written since the last check
+	// and drops the ones that were pruned
+	Manifest []byte
+}
+
+// VerifyChecksums checks the files in dir against the manifest in it and checksums the files
+// written since the last check. The backup tools never rewrite archived WAL or the files of a
+// finished backup, such a file whose size or modification time changed is reported as corrupt
+// and keeps its old entry, other changed files were rewritten by the tools and are checksummed
+// again. Files that look unchanged are only checksummed with rehash, which also finds content
+// that changed in place.
+func VerifyChecksums(dir string, rehash bool) (*Verification, error) {
+	recorded := map[string]checksumEntry{}
+	content, err := os.ReadFile(filepath.Join(dir, ChecksumManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &recorded); err != nil {
+			return nil, fmt.Errorf("invalid checksum manifest: %w", err)
+		}
+	}
+
+	files := map[string]fs.FileInfo{}
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == ChecksumManifest {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// pruned while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		files[filepath.ToSlash(name)] = info
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum %s: %w", dir, err)
+	}
+
+	verification := &Verification{}
+	current := map[string]checksumEntry{}
+	finished := finishedBackups(files)
+	for name, info := range files {
+		found := checksumEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		previous, ok := recorded[name]
+		unchanged := ok && previous.Size == found.Size && previous.ModTime == found.ModTime
+		switch {
+		case unchanged && !rehash:
+			verification.Verified++
+			current[name] = previous
+			continue
+		case ok && !unchanged && immutable(name, finished):
+			verification.Verified++
+			verification.Corrupt = append(verification.Corrupt, name)
+			current[name] = previous
+			continue
+		}
+		sum, err := fileSHA256(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to checksum %s: %w", dir, err)
+		}
+		found.SHA256 = sum
+		if unchanged {
+			verification.Verified++
+			if previous.SHA256 != found.SHA256 {
+				verification.Corrupt = append(verification.Corrupt, name)
+				found = previous
+			}
+		}
+		current[name] = found
+	}
+	sort.Strings(verification.Corrupt)
+
+	verification.Manifest, err = json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+// walFileName matches archived WAL segments, backup history and timeline history files with
+// the suffixes the tools add for compression and checksums
+var walFileName = regexp.MustCompile(`^([0-9A-F]{24}|[0-9A-F]{8}\.history)`)
+
+// walgStopSentinel is the suffix of the file WAL-G writes next to a backup once it finished
+const walgStopSentinel = "_backup_stop_sentinel.json"
+
+// finishedBackups returns the directories of the backups the tools finished writing: WAL-G
+// writes a stop sentinel next to them, pgBackRest a backup.manifest into them
+func finishedBackups(files map[string]fs.FileInfo) map[string]bool {
+	finished := map[string]bool{}
+	for name := range files {
+		dir, base := path.Split(name)
+		switch {
+		case strings.HasSuffix(base, walgStopSentinel) && inDirectory(dir, "basebackups_005"):
+			finished[dir+strings.TrimSuffix(base, walgStopSentinel)] = true
+		case base == "backup.manifest" && inDirectory(dir, "backup"):
+			finished[strings.TrimSuffix(dir, "/")] = true
+		}
+	}
+	return finished
+}
+
+// immutable reports whether the backup tools never rewrite the file once it is written
+func immutable(name string, finished map[string]bool) bool {
+	dir, base := path.Split(name)
+	if walFileName.MatchString(base) && (inDirectory(dir, "wal_005") || inDirectory(dir, "archive")) {
+		return true
+	}
+	if strings.HasSuffix(base, walgStopSentinel) {
+		return true
+	}
+	// wal-g backup-mark rewrites the metadata of a finished backup
+	if base == "metadata.json" {
+		return false
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if finished[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// inDirectory reports whether dir, a slash separated relative path, has the given component
+func inDirectory(dir, component string) bool {
+	return strings.Contains("/"+dir, "/"+component+"/")
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeStorageFile writes a file of the storage with a fixed modification time
+func writeStorageFile(t *testing.T, dir, name, content string, modTime time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verify runs VerifyChecksums and writes the updated manifest like the backup operation does
+func verify(t *testing.T, dir string, rehash bool) *Verification {
+	t.Helper()
+	verification, err := VerifyChecksums(dir, rehash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ChecksumManifest), verification.Manifest, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return verification
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := t.TempDir()
+	written := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rewritten := written.Add(time.Hour)
+	files := map[string]string{
+		"wal_005/000000010000000000000001.lz4":                                        "segment",
+		"basebackups_005/base_000000010000000000000002/metadata.json":                 "{}",
+		"basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4": "data",
+		"basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json":     "{}",
+		"basebackups_005/base_000000010000000000000004/tar_partitions/part_1.tar.lz4": "partial",
+		"backup/db/20240101-000000F/backup.manifest":                                  "manifest",
+		"backup/db/20240101-000000F/pg_data/base/1/1259.gz":                           "data",
+		"backup/db/backup.info": "info",
+		"archive/db/16-1/0000000100000000/000000010000000000000001-abc.gz": "segment",
+		"archive/db/archive.info": "info",
+	}
+	for name, content := range files {
+		writeStorageFile(t, dir, name, content, written)
+	}
+
+	first := verify(t, dir, false)
+	if first.Verified != 0 || len(first.Corrupt) != 0 {
+		t.Fatalf("first check: %d verified, corrupt %v", first.Verified, first.Corrupt)
+	}
+	if again := verify(t, dir, false); again.Verified != len(files) || len(again.Corrupt) != 0 {
+		t.Fatalf("unchanged storage: %d verified, corrupt %v", again.Verified, again.Corrupt)
+	}
+
+	// the tools rewrite these
+	for _, name := range []string{
+		"basebackups_005/base_000000010000000000000002/metadata.json",
+		"basebackups_005/base_000000010000000000000004/tar_partitions/part_1.tar.lz4",
+		"backup/db/backup.info",
+		"archive/db/archive.info",
+	} {
+		writeStorageFile(t, dir, name, "rewritten", rewritten)
+	}
+	// and never these
+	immutableFiles := []string{
+		"archive/db/16-1/0000000100000000/000000010000000000000001-abc.gz",
+		"backup/db/20240101-000000F/pg_data/base/1/1259.gz",
+		"basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4",
+		"wal_005/000000010000000000000001.lz4",
+	}
+	for _, name := range immutableFiles {
+		writeStorageFile(t, dir, name, "rewritten", rewritten)
+	}
+	// a file written since the last check is checksummed
+	writeStorageFile(t, dir, "wal_005/000000010000000000000002.lz4", "segment", rewritten)
+
+	changed := verify(t, dir, false)
+	if !reflect.DeepEqual(changed.Corrupt, immutableFiles) {
+		t.Errorf("corrupt %v, want %v", changed.Corrupt, immutableFiles)
+	}
+	if after := verify(t, dir, false); !reflect.DeepEqual(after.Corrupt, immutableFiles) {
+		t.Errorf("corrupt files became the new baseline, corrupt %v", after.Corrupt)
+	}
+}
+
+func TestVerifyChecksumsRehash(t *testing.T) {
+	dir := t.TempDir()
+	written := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	name := "wal_005/000000010000000000000001.lz4"
+	writeStorageFile(t, dir, name, "segment", written)
+	verify(t, dir, false)
+
+	// same size and modification time, only reading the content finds the change
+	writeStorageFile(t, dir, name, "SEGMENT", written)
+	if verification := verify(t, dir, false); len(verification.Corrupt) != 0 {
+		t.Errorf("corrupt %v without rehash", verification.Corrupt)
+	}
+	if verification := verify(t, dir, true); !reflect.DeepEqual(verification.Corrupt, []string{name}) {
+		t.Errorf("corrupt %v with rehash, want %s", verification.Corrupt, name)
+	}
+}
@@ -0,0 +1,354 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/backup"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// backupConfigFile holds the backup tool and its environment for archive-wal, postgres may
+// not inherit the environment of the container so it can't be read from there. It lives
+// next to the controller binary on the controller volume.
+const backupConfigFile = "/app/backup.json"
+
+type backupConfig struct {
+	Method string            `json:"method"`
+	Env    map[string]string `json:"env"`
+}
+
+// writeBackupConfig writes the backup configuration of the cluster for archive-wal, it is
+// removed when backups are not configured
+func writeBackupConfig(bgCluster *bestgresv1.BGCluster) error {
+	target := backup.TargetFor(bgCluster)
+	if target == nil {
+		if err := os.Remove(backupConfigFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	env, err := target.Env(dataDirectory())
+	if err != nil {
+		return err
+	}
+	if target.Storage.Filesystem != nil {
+		if err := prepareBackupDirectory(target.Path()); err != nil {
+			return err
+		}
+	}
+	content, err := json.Marshal(backupConfig{Method: target.Method, Env: env})
+	if err != nil {
+		return err
+	}
+	changed, err := writePostgresFile(backupConfigFile, content)
+	if changed {
+		log.Printf("Wrote the %s backup configuration", target.Method)
+	}
+	return err
+}
+
+// writePostgresFile writes a file only postgres can read, it reports whether the content
+// changed. The files hold storage credentials.
+func writePostgresFile(path string, content []byte) (bool, error) {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return false, err
+	}
+	if credential, _ := postgresCredential(); credential != nil {
+		if err := os.Chown(path, int(credential.Uid), int(credential.Gid)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// prepareBackupDirectory creates the directory of filesystem storage on its volume, which
+// belongs to root when it is mounted
+func prepareBackupDirectory(path string) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return fmt.Errorf("failed to create the backup directory: %w", err)
+	}
+	if credential, _ := postgresCredential(); credential != nil {
+		if err := os.Chown(path, int(credential.Uid), int(credential.Gid)); err != nil {
+			return fmt.Errorf("failed to hand the backup directory to postgres: %w", err)
+		}
+	}
+	return nil
+}
+
+// verifyBackupDirectory checks the files of filesystem storage against their checksums and
+// records the checksums of the files written since the last check
+func verifyBackupDirectory(path string) (*backup.Verification, error) {
+	verification, err := backup.VerifyChecksums(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writePostgresFile(filepath.Join(path, backup.ChecksumManifest), verification.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to write the checksum manifest: %w", err)
+	}
+	return verification, nil
+}
+
+// ArchiveWAL is the archive_command of clusters with backups configured, it pushes the WAL
+// segment at args[0] to the backup storage and returns the exit code for postgres
+func ArchiveWAL(args []string) int {
+	if len(args) != 1 {
+		log.Println("usage: archive-wal <path>")
+		return 2
+	}
+	content, err := os.ReadFile(backupConfigFile)
+	if err != nil {
+		log.Printf("Failed to read the backup configuration: %v", err)
+		return 1
+	}
+	config := backupConfig{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		log.Printf("Invalid backup configuration: %v", err)
+		return 1
+	}
+
+	target := backup.Target{Method: config.Method}
+	if err := runForPostgres(config.Env, target.WALPushCommand(args[0])); err != nil {
+		log.Printf("Failed to archive %s: %v", args[0], err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// runForPostgres runs a backup tool on behalf of postgres with its output going to the
+// postgres log
+func runForPostgres(env map[string]string, command []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), backup.EnvList(env)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// exitCode passes the exit code of a failed tool on, postgres and Patroni only look at
+// whether it is zero
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// initBackupStorage prepares the backup storage from the primary, which pgBackRest needs
+// before it accepts WAL
+func initBackupStorage(bgCluster *bestgresv1.BGCluster) error {
+	target := backup.TargetFor(bgCluster)
+	if target == nil || target.InitCommand() == nil {
+		return nil
+	}
+	primary, err := isLocalPrimary()
+	if err != nil || !primary {
+		return err
+	}
+	env, err := target.Env(dataDirectory())
+	if err != nil {
+		return err
+	}
+	_, err = runBackupTool(context.Background(), env, target.InitCommand())
+	return err
+}
+
+// handleBackup takes a base backup from the primary and records it on the BGDbOps, replicas
+// complete without doing anything
+func handleBackup(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	target := backup.TargetFor(bgCluster)
+	if target == nil {
+		return fmt.Errorf("BGCluster %s has no backup storage configured", bgCluster.Name)
+	}
+	backupType := bestgresv1.BackupTypeFull
+	var retainFull *int32
+	if dbOpsSpec.Backup != nil {
+		if dbOpsSpec.Backup.Type != "" {
+			backupType = dbOpsSpec.Backup.Type
+		}
+		retainFull = dbOpsSpec.Backup.RetainFull
+	}
+
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		log.Println("Not the primary, the backup is taken from the primary")
+		return nil
+	}
+
+	// a BackupResult without a backup ID records that the backup tool succeeded, a retry only
+	// looks the backup up in the storage instead of taking another one
+	bgDbOps, err := getBGDbOps(c, bgCluster)
+	if err != nil {
+		return err
+	}
+	alreadyTaken := bgDbOps.Status.BackupResult != nil && bgDbOps.Status.BackupResult.BackupID == "" && bgDbOps.Status.StartTime != nil
+	start := metav1.Now()
+	if alreadyTaken {
+		start = *bgDbOps.Status.StartTime
+		log.Printf("The backup was taken by a previous attempt, looking it up")
+	} else if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Pod = podName
+		status.StartTime = &start
+		status.BackupResult = nil
+	}); err != nil {
+		log.Printf("Failed to record the start of the operation: %v", err)
+	}
+
+	env, err := target.Env(dataDirectory())
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	if !alreadyTaken {
+		if init := target.InitCommand(); init != nil {
+			if _, err := runBackupTool(ctx, env, init); err != nil {
+				return err
+			}
+		}
+
+		// the new backup is the one that wasn't in the storage before
+		before, err := listBackups(ctx, target, env)
+		if err != nil {
+			return err
+		}
+		for _, info := range before {
+			existing[info.ID] = true
+		}
+
+		log.Printf("Taking a %s backup with %s", backupType, target.Method)
+		if _, err := runBackupTool(ctx, env, target.BackupCommand(backupType, dataDirectory())); err != nil {
+			return err
+		}
+		if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+			status.BackupResult = &bestgresv1.BackupResult{Method: target.Method}
+		}); err != nil {
+			log.Printf("Failed to record that the backup was taken: %v", err)
+		}
+	}
+
+	after, err := listBackups(ctx, target, env)
+	if err != nil {
+		return err
+	}
+	var taken *backup.Info
+	for i := len(after) - 1; i >= 0; i-- {
+		if existing[after[i].ID] {
+			continue
+		}
+		// without the list from before the backup, it is the newest one started since
+		if alreadyTaken && after[i].StartTime.Before(start.Truncate(time.Second)) {
+			continue
+		}
+		taken = &after[i]
+		break
+	}
+	if taken == nil {
+		return fmt.Errorf("backup finished but no new backup is listed in the storage")
+	}
+
+	result := &bestgresv1.BackupResult{
+		Method:          target.Method,
+		BackupID:        taken.ID,
+		StartLSN:        taken.StartLSN,
+		StopLSN:         taken.StopLSN,
+		SizeBytes:       taken.SizeBytes,
+		StoredSizeBytes: taken.StoredSizeBytes,
+		Duration:        &metav1.Duration{Duration: time.Since(start.Time).Round(time.Second)},
+	}
+	log.Printf("Backup %s finished: %s to %s, %d bytes stored", result.BackupID, result.StartLSN, result.StopLSN, result.StoredSizeBytes)
+
+	// the backup is taken, failing to prune or verify must not take another one
+	if retainFull != nil {
+		log.Printf("Keeping the newest %d full backups", *retainFull)
+		if _, err := runBackupTool(ctx, env, target.PruneCommand(*retainFull)); err != nil {
+			log.Printf("Failed to delete old backups: %v", err)
+		}
+	}
+	if target.Storage.Filesystem != nil {
+		verification, err := verifyBackupDirectory(target.Path())
+		if err != nil {
+			log.Printf("Failed to verify the backup checksums: %v", err)
+		} else {
+			result.VerifiedFiles = int32(verification.Verified)
+			result.CorruptFiles = verification.Corrupt
+			if len(verification.Corrupt) > 0 {
+				log.Printf("%d files in the backup storage fail their checksum: %s", len(verification.Corrupt), strings.Join(verification.Corrupt, ", "))
+			}
+		}
+	}
+
+	return updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.BackupResult = result
+	})
+}
+
+// listBackups lists the backups in the storage, oldest first
+func listBackups(ctx context.Context, target *backup.Target, env map[string]string) ([]backup.Info, error) {
+	output, err := runBackupTool(ctx, env, target.ListCommand())
+	if err != nil {
+		return nil, err
+	}
+	return target.ParseBackupList(output)
+}
+
+// runBackupTool runs a backup tool as postgres and returns its standard output, the error
+// carries the last line it logged
+func runBackupTool(ctx context.Context, env map[string]string, command []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), backup.EnvList(env)...)
+	if credential, home := postgresCredential(); credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		cmd.Env = append(cmd.Env, "HOME="+home)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runWaited(cmd); err != nil {
+		return stdout.Bytes(), fmt.Errorf("%s failed: %s", strings.Join(command[:2], " "), lastLine(stderr.String(), err))
+	}
+	return stdout.Bytes(), nil
+}
+
+// postgresCredential returns the credential and home directory of the postgres user when the
+// controller runs as root, the backup tools refuse to or shouldn't run as root
+func postgresCredential() (*syscall.Credential, string) {
+	if os.Geteuid() != 0 {
+		return nil, ""
+	}
+	postgres, err := user.Lookup("postgres")
+	if err != nil {
+		return nil, ""
+	}
+	uid, err := strconv.Atoi(postgres.Uid)
+	if err != nil {
+		return nil, ""
+	}
+	gid, err := strconv.Atoi(postgres.Gid)
+	if err != nil {
+		return nil, ""
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, postgres.HomeDir
+}
@@ -0,0 +1,324 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bestgres/pgclient"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// benchmarkDatabase is the scratch database pgbench initializes and runs against
+	benchmarkDatabase = "bestgres_benchmark"
+	// pgbenchBytesPerScale is roughly how much one pgbench scale factor adds to the database
+	pgbenchBytesPerScale = 16 * 1024 * 1024
+)
+
+var (
+	pgbenchTransactionsPattern = regexp.MustCompile(`number of transactions actually processed: (\d+)`)
+	pgbenchFailedPattern       = regexp.MustCompile(`number of failed transactions: (\d+)`)
+	pgbenchLatencyPattern      = regexp.MustCompile(`latency average = ([0-9.]+) ms`)
+	pgbenchStddevPattern       = regexp.MustCompile(`latency stddev = ([0-9.]+) ms`)
+	pgbenchTPSPattern          = regexp.MustCompile(`tps = ([0-9.]+) \((?:without initial connection time|excluding connections establishing)\)`)
+)
+
+// handleBenchmark runs pgbench from the primary against a scratch database and records the
+// results on the BGDbOps, replicas complete without doing anything
+func handleBenchmark(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	if dbOpsSpec.Benchmark == nil {
+		return fmt.Errorf("benchmark operation without benchmark details")
+	}
+	benchmarkSpec := dbOpsSpec.Benchmark
+
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		log.Println("Not the primary, the benchmark runs from the primary")
+		return nil
+	}
+
+	scale, err := pgbenchScale(benchmarkSpec.PgBench.DatabaseSize)
+	if err != nil {
+		return err
+	}
+	duration, err := pgbenchDuration(benchmarkSpec.PgBench.Duration)
+	if err != nil {
+		return err
+	}
+
+	start := metav1.Now()
+	if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Pod = podName
+		status.StartTime = &start
+		status.BenchmarkResult = nil
+	}); err != nil {
+		log.Printf("Failed to record the start of the operation: %v", err)
+	}
+
+	binary, err := postgresBinary(ctx, "pgbench")
+	if err != nil {
+		return err
+	}
+
+	// start from an empty scratch database and always drop it again
+	if err := dropBenchmarkDatabase(ctx); err != nil {
+		return err
+	}
+	if _, err := queryLocal(ctx, "CREATE DATABASE "+pgclient.QuoteIdentifier(benchmarkDatabase)); err != nil {
+		return fmt.Errorf("failed to create the benchmark database: %w", err)
+	}
+	defer func() {
+		// the scratch database goes even when the operation ran out of time
+		dropCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := dropBenchmarkDatabase(dropCtx); err != nil {
+			log.Printf("Failed to drop the benchmark database: %v", err)
+		}
+	}()
+
+	socketDir := localDBConfig("postgres").Host
+	log.Printf("Initializing pgbench with scale %d", scale)
+	if output, err := runPgbench(ctx, binary, "-i", "-q", "-s", strconv.Itoa(int(scale)), "-h", socketDir, "-U", "postgres", benchmarkDatabase); err != nil {
+		return fmt.Errorf("pgbench initialization failed: %s", lastLine(output, err))
+	}
+
+	host := socketDir
+	args := []string{}
+	if benchmarkSpec.ConnectionType == "replicas" {
+		// replicas only take read-only transactions
+		host = bgCluster.Name + "-repl"
+		args = append(args, "-S")
+		if err := waitForReplicaBenchmarkDatabase(ctx, host, 2*time.Minute); err != nil {
+			return err
+		}
+	}
+
+	logDir, err := os.MkdirTemp("", "pgbench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(logDir)
+
+	args = append(args,
+		"-c", strconv.Itoa(benchmarkSpec.PgBench.ConcurrentClients),
+		"-j", strconv.Itoa(benchmarkSpec.PgBench.Threads),
+		"-T", strconv.Itoa(int(duration.Seconds())),
+		"-l", "--log-prefix", filepath.Join(logDir, "pgbench_log"),
+		"-h", host,
+		"-p", "5432",
+		"-U", "postgres",
+		benchmarkDatabase,
+	)
+	log.Printf("Running pgbench against %s for %v", benchmarkSpec.ConnectionType, duration)
+	output, err := runPgbench(ctx, binary, args...)
+	if err != nil {
+		return fmt.Errorf("pgbench failed: %s", lastLine(output, err))
+	}
+
+	result, err := parsePgbenchOutput(output)
+	if err != nil {
+		return err
+	}
+	result.ConnectionType = benchmarkSpec.ConnectionType
+	result.Scale = scale
+	result.Clients = benchmarkSpec.PgBench.ConcurrentClients
+	result.Threads = benchmarkSpec.PgBench.Threads
+	result.Duration = metav1.Duration{Duration: duration}
+	if err := pgbenchPercentiles(logDir, result); err != nil {
+		log.Printf("Failed to compute latency percentiles: %v", err)
+	}
+	log.Printf("pgbench finished: %s tps, %v average latency, %d failed transactions", result.TPS, result.LatencyAverage.Duration, result.FailedTransactions)
+
+	return updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.BenchmarkResult = result
+	})
+}
+
+// runPgbench runs pgbench with the superuser password and returns its combined output
+func runPgbench(ctx context.Context, binary string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+passwordForUser("postgres"))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := runWaited(cmd)
+	return output.String(), err
+}
+
+// dropBenchmarkDatabase removes the scratch database, disconnecting leftover sessions
+func dropBenchmarkDatabase(ctx context.Context) error {
+	if _, err := queryLocal(ctx, "DROP DATABASE IF EXISTS "+pgclient.QuoteIdentifier(benchmarkDatabase)+" WITH (FORCE)"); err != nil {
+		return fmt.Errorf("failed to drop the benchmark database: %w", err)
+	}
+	return nil
+}
+
+// waitForReplicaBenchmarkDatabase waits until the initialized tables replicated to the replicas
+func waitForReplicaBenchmarkDatabase(ctx context.Context, host string, timeout time.Duration) error {
+	config := localDBConfig("postgres")
+	config.Host = host
+	config.Database = benchmarkDatabase
+
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := pgclient.Connect(ctx, config)
+		if err == nil {
+			_, err = conn.Query(ctx, "SELECT count(*) FROM pgbench_branches")
+			conn.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("benchmark database not available on the replicas through %s: %w", host, err)
+		}
+		log.Printf("Waiting for the benchmark database to replicate: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// pgbenchScale turns the requested database size into a pgbench scale factor
+func pgbenchScale(databaseSize string) (int32, error) {
+	if scale, err := strconv.Atoi(databaseSize); err == nil {
+		if scale < 1 {
+			return 0, fmt.Errorf("invalid databaseSize %q, the scale factor must be at least 1", databaseSize)
+		}
+		return int32(scale), nil
+	}
+	size, err := resource.ParseQuantity(databaseSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid databaseSize %q: %w", databaseSize, err)
+	}
+	scale := size.Value() / pgbenchBytesPerScale
+	if scale < 1 {
+		scale = 1
+	}
+	return int32(scale), nil
+}
+
+// pgbenchDuration parses the benchmark duration, plain numbers are seconds
+func pgbenchDuration(duration string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(duration); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	parsed, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", duration, err)
+	}
+	if parsed < time.Second {
+		return 0, fmt.Errorf("invalid duration %q, the benchmark must run for at least a second", duration)
+	}
+	return parsed, nil
+}
+
+// parsePgbenchOutput reads the summary pgbench prints at the end of a run
+func parsePgbenchOutput(output string) (*bestgresv1.BenchmarkResult, error) {
+	result := &bestgresv1.BenchmarkResult{}
+
+	match := pgbenchTPSPattern.FindStringSubmatch(output)
+	if match == nil {
+		return nil, fmt.Errorf("pgbench output has no tps: %s", lastLine(output, fmt.Errorf("no output")))
+	}
+	result.TPS = match[1]
+
+	if match := pgbenchTransactionsPattern.FindStringSubmatch(output); match != nil {
+		result.Transactions, _ = strconv.ParseInt(match[1], 10, 64)
+	}
+	// only reported by pgbench 15 and newer
+	if match := pgbenchFailedPattern.FindStringSubmatch(output); match != nil {
+		result.FailedTransactions, _ = strconv.ParseInt(match[1], 10, 64)
+	}
+	if match := pgbenchLatencyPattern.FindStringSubmatch(output); match != nil {
+		result.LatencyAverage = metav1.Duration{Duration: parseMilliseconds(match[1])}
+	}
+	if match := pgbenchStddevPattern.FindStringSubmatch(output); match != nil {
+		result.LatencyStddev = metav1.Duration{Duration: parseMilliseconds(match[1])}
+	}
+	return result, nil
+}
+
+// pgbenchPercentiles computes latency percentiles from the per-transaction logs
+func pgbenchPercentiles(logDir string, result *bestgresv1.BenchmarkResult) error {
+	files, err := filepath.Glob(filepath.Join(logDir, "pgbench_log.*"))
+	if err != nil {
+		return err
+	}
+
+	var latencies []int64
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// client_id transaction_no time script_no time_epoch time_us, time is the
+			// latency in microseconds or "failed"/"skipped"
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 3 {
+				continue
+			}
+			latency, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			latencies = append(latencies, latency)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	if len(latencies) == 0 {
+		return fmt.Errorf("no transactions in the pgbench logs")
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) metav1.Duration {
+		index := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		return metav1.Duration{Duration: time.Duration(latencies[index]) * time.Microsecond}
+	}
+	result.LatencyP50 = percentile(50)
+	result.LatencyP95 = percentile(95)
+	result.LatencyP99 = percentile(99)
+	return nil
+}
+
+// parseMilliseconds converts a decimal number of milliseconds to a duration
+func parseMilliseconds(value string) time.Duration {
+	ms, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
@@ -2,12 +2,10 @@ package controller
 
 import (
 	bestgresv1 "bestgres/api/v1"
-	"encoding/json"
-	"fmt"
+	"bestgres/patroni"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
 	"strings"
 	"syscall"
 	"time"
@@ -15,57 +13,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// hackConfigs modifies the Spilo configuration for sharded clusters
-func hackConfigs(bgCluster *bestgresv1.BGCluster) {
-	filePath := "/scripts/configure_spilo.py"
-	input, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Printf("Error reading file %s: %v", filePath, err)
-		os.Exit(1)
-	}
-	content := string(input)
-	
-	if _, exists := bgCluster.Labels[bgClusterPartOfLabel]; exists {
-		sharedPreloadConfig := "shared_preload_libraries: 'citus,bg_mon"
-		re := regexp.MustCompile(`(?i)shared_preload_libraries:\s*.bg_mon`)
-		content = re.ReplaceAllString(content, sharedPreloadConfig)
-	} else {
-		log.Println("BGCluster is not part of a sharded cluster. No modifications needed.")
-	}
-	// Replace pg_hba lines with regex
-	pgHbaReplacements := []struct {
-		oldPattern *regexp.Regexp
-		newLine    string
-	}{
-		{
-			oldPattern: regexp.MustCompile(`- host\s+all\s+all\s+127\.0\.0\.1/32\s+md5\s*`),
-			newLine:    `- host  all  all  10.0.0.0/8  trust` + "\n"+ `    - host  all  all  127.0.0.1/32  trust`,
-		},
-		{
-			oldPattern: regexp.MustCompile(`- host\s+all\s+all\s+::1/128\s+md5\s*$`),
-			newLine:    `- host  all  all  ::1/128  trust`,
-		},
-	}
-
-	for _, replacement := range pgHbaReplacements {
-		content = replacement.oldPattern.ReplaceAllString(content, replacement.newLine)
-	}
-
-	// Check if any changes were made to the file
-	if content == string(input) {
-		log.Println("No changes were made to the file.")
-		return
-	}
-
-	err = os.WriteFile(filePath, []byte(content), 0755)
-	if err != nil {
-		log.Printf("Error writing file %s: %v", filePath, err)
-		os.Exit(1)
-	}
-	log.Println("File updated successfully.")
-}
-
-// runCommand executes the main container command
+// runContainerCommand starts the main container command and supervises it in the background,
+// the controller exits when the command does
 func runContainerCommand(bgCluster *bestgresv1.BGCluster) {
 	command := bgCluster.Spec.Image.Command
 	workingDir := bgCluster.Spec.Image.WorkingDir
@@ -91,6 +40,7 @@ func runContainerCommand(bgCluster *bestgresv1.BGCluster) {
 	}
 
 	log.Printf("Started command: %s", strings.Join(command, " "))
+	go supervise(cmd)
 }
 
 func bootstrapStandaloneBGCluster(bgCluster *bestgresv1.BGCluster, c client.Client) {
@@ -98,21 +48,28 @@ func bootstrapStandaloneBGCluster(bgCluster *bestgresv1.BGCluster, c client.Clie
 	// after a restart. In that case, we don't need to run the bootstrap commands again.
 	if checkAnnotation(bgCluster, bgClusterInitializedAnnotation) == "true" {
 		log.Println("BGCluster already initialized")
-		// If there is a pending operation to restart the cluster, we need to mark it complete
-		if checkAnnotation(bgCluster, bgDbOpsPendingAnnotation) == "true" && checkAnnotation(bgCluster, bgDbOpsOpAnnotation) == "restart" {
-			log.Println("Marking restart operation as complete")
-			updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+		// If there is a pending operation recreating the pods, the pod was recreated for it
+		if recreatedForBGDbOps(bgCluster) {
+			log.Println("Marking the pod as restarted")
+			updateAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation, checkAnnotation(bgCluster, bgDbOpsInProgressAnnotation))
 		}
 	} else {
 		userBootstrap := bgCluster.Spec.BootstrapSQL
 		time.Sleep(5 * time.Second)
 		// TODO remove the sleep after fixing db readiness check
 		// wait for postgres to actually be ready
-		log.Println("Running BGCluster bootstrap")
-		if err := runPsqlCommands(userBootstrap); err != nil {
-			log.Printf("Failed to run bootstrap SQL commands: %v", err)
-			// may want to exit here if the bootstrap commands are critical
-			// os.Exit(1)
+		if isRestoring(bgCluster) {
+			// the restored data already went through the bootstrap of the source cluster
+			if err := reportRecovery(c); err != nil {
+				log.Printf("Failed to report the recovery: %v", err)
+			}
+		} else {
+			log.Println("Running BGCluster bootstrap")
+			if err := runSQLCommands(userBootstrap); err != nil {
+				log.Printf("Failed to run bootstrap SQL commands: %v", err)
+				// may want to exit here if the bootstrap commands are critical
+				// os.Exit(1)
+			}
 		}
 
 		if err := updateAnnotation(c, podName, namespace, bgClusterInitializedAnnotation, "true"); err != nil {
@@ -126,10 +83,10 @@ func bootstrapWorkerNode(bgCluster *bestgresv1.BGCluster, c client.Client) {
 	// after a restart. In that case, we don't need to run the bootstrap commands again.
 	if checkAnnotation(bgCluster, bgClusterInitializedAnnotation) == "true" {
 		log.Println("Worker node already initialized")
-		// If there is a pending operation to restart the cluster, we need to mark it complete
-		if checkAnnotation(bgCluster, bgDbOpsPendingAnnotation) == "true" && checkAnnotation(bgCluster, bgDbOpsOpAnnotation) == "restart" {
-			log.Println("Marking restart operation as complete")
-			updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+		// If there is a pending operation recreating the pods, the pod was recreated for it
+		if recreatedForBGDbOps(bgCluster) {
+			log.Println("Marking the pod as restarted")
+			updateAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation, checkAnnotation(bgCluster, bgDbOpsInProgressAnnotation))
 		}
 	} else {
 		var systemCommands []string
@@ -145,12 +102,17 @@ func bootstrapWorkerNode(bgCluster *bestgresv1.BGCluster, c client.Client) {
 		// Add any user-defined commands
 
 		// Run the SQL system commands
-		if err := runPsqlCommands(systemCommands); err != nil {
+		if err := runSQLCommands(systemCommands); err != nil {
 			log.Printf("Failed to run system bootstrap SQL commands: %v", err)
 			os.Exit(1)
 		}
+		// The coordinator connects to this node as the internal Citus user
+		if err := bootstrapCitusUser(false); err != nil {
+			log.Printf("Failed to create the internal Citus user: %v", err)
+			os.Exit(1)
+		}
 		// Run the SQL user commands
-		if err := runPsqlCommands(userCommands); err != nil {
+		if err := runSQLCommands(userCommands); err != nil {
 			log.Printf("Failed to run user bootstrap SQL commands: %v", err)
 		}
 
@@ -165,10 +127,10 @@ func bootstrapCoordinatorNode(bgCluster *bestgresv1.BGCluster, c client.Client)
 	// after a restart. In that case, we don't need to run the bootstrap commands again.
 	if checkAnnotation(bgCluster, bgClusterInitializedAnnotation) == "true" {
 		log.Println("Coordinator node already initialized")
-		// If there is a pending operation to restart the cluster, we need to mark it complete
-		if checkAnnotation(bgCluster, bgDbOpsPendingAnnotation) == "true" && checkAnnotation(bgCluster, bgDbOpsOpAnnotation) == "restart" {
-			log.Println("Marking restart operation as complete")
-			updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+		// If there is a pending operation recreating the pods, the pod was recreated for it
+		if recreatedForBGDbOps(bgCluster) {
+			log.Println("Marking the pod as restarted")
+			updateAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation, checkAnnotation(bgCluster, bgDbOpsInProgressAnnotation))
 		}
 	} else {
 		var systemCommands []string
@@ -180,47 +142,33 @@ func bootstrapCoordinatorNode(bgCluster *bestgresv1.BGCluster, c client.Client)
 
 		// Add the Citus extension
 		systemCommands = append(systemCommands, "CREATE EXTENSION IF NOT EXISTS citus;")
-		// Set the coordinator host
-		coordinatorHost := bgCluster.Name + "-coordinator"
-		systemCommands = append(systemCommands, fmt.Sprintf("SELECT citus_set_coordinator_host('%s', 5432);", coordinatorHost))
 		
 		// Run the SQL system commands
-		if err := runPsqlCommands(systemCommands); err != nil {
+		if err := runSQLCommands(systemCommands); err != nil {
 			log.Printf("Failed to run system bootstrap SQL commands: %v", err)
 			os.Exit(1)
 		}
-		
-		// TODO fix the logic here, right now it waits for workers in sequence
-		// it should loop over the workers and add them as they become ready
-		// Wait for workers to init and add them to the coordinator
-		workerListJSON, exists := bgCluster.Annotations[bgShardedClusterWorkersAnnotation]
-		if !exists {
-			log.Printf("annotation %s does not exist", bgShardedClusterWorkersAnnotation)
-		}
-		// Unmarshal the JSON array into a slice of strings
-		var workerList []string
-		if err := json.Unmarshal([]byte(workerListJSON), &workerList); err != nil {
-			log.Printf("failed to unmarshal worker list from annotation: %v", err)
+		// Citus connections to the other nodes authenticate as the internal Citus user
+		if err := bootstrapCitusUser(true); err != nil {
+			log.Printf("Failed to create the internal Citus user: %v", err)
+			os.Exit(1)
 		}
 
-		for _, worker := range workerList {
-			log.Printf("List of workers:\n%s", bgCluster.Annotations[bgShardedClusterWorkersAnnotation])
-			log.Printf("Adding worker node %s to coordinator", worker)
-		
-			// calculate the correct annotation to wait for
-			annotation := fmt.Sprintf("bgshardedcluster.bestgres.io/%s-initialized", worker)
-			// wait for that annotation to bet set to true
-			waitForInitilizatedAnnotation(bgCluster, c, 2 * time.Minute, annotation)
-			// calculate the sql command to add the worker to the coordinator
-			command := fmt.Sprintf("SELECT * FROM citus_add_node('%s', 5432);", worker)
-			// run the command
-			if err := runPsqlCommand(command, 5, 5 * time.Second); err != nil {
-				log.Printf("Failed to add worker node %s to coordinator: %v", worker, err)
+		// Set the coordinator host, the primary service is named after the coordinator BGCluster
+		// Patroni sets it in patroni-native mode and follows the failovers of the coordinator
+		if _, native := patroni.CitusGroup(bgCluster); !native {
+			coordinatorHost := bgCluster.Name
+			if err := runSQLCommandAs(patroni.CitusUser, 5, 5 * time.Second, "SELECT citus_set_coordinator_host($1, $2)", coordinatorHost, 5432); err != nil {
+				log.Printf("Failed to set coordinator host: %v", err)
+				os.Exit(1)
 			}
 		}
-		
+
+		// the workers are added by reconcileCitusNodes as they become ready, or by Patroni in
+		// patroni-native mode
+
 		// Run the SQL user commands
-		if err := runPsqlCommands(userCommands); err != nil {
+		if err := runSQLCommands(userCommands); err != nil {
 			log.Printf("Failed to run user bootstrap SQL commands: %v", err)
 		}
 		if err := updateAnnotation(c, podName, namespace, bgClusterInitializedAnnotation, "true"); err != nil {
@@ -229,6 +177,26 @@ func bootstrapCoordinatorNode(bgCluster *bestgresv1.BGCluster, c client.Client)
 	}
 }
 
+// bootstrapCitusUser creates the internal Citus user on the primary, replicas get it
+// through replication. The coordinator also stores its password for Citus connections.
+func bootstrapCitusUser(coordinator bool) error {
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		log.Println("Not the primary, skipping the internal Citus user")
+		return nil
+	}
+	if err := ensureCitusUser(); err != nil {
+		return err
+	}
+	if coordinator {
+		return ensureCitusAuthInfo()
+	}
+	return nil
+}
+
 func isPartOfShardedCluster(bgCluster *bestgresv1.BGCluster) bool {
 	_, exists := bgCluster.Labels[bgClusterPartOfLabel]
 	log.Printf("isPartOfShardedCluster: %v", exists)
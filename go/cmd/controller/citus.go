@@ -0,0 +1,521 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	bgShardedClusterDrainingAnnotation     = "bgshardedcluster.bestgres.io/draining"
+	bgShardedClusterDrainedAnnotation      = "bgshardedcluster.bestgres.io/drained"
+	bgShardedClusterTransferModeAnnotation = "bgshardedcluster.bestgres.io/shard-transfer-mode"
+	// bgShardedClusterUnregisteredAnnotation lists the workers that aren't active in pg_dist_node yet
+	bgShardedClusterUnregisteredAnnotation = "bgshardedcluster.bestgres.io/unregistered"
+	// bgShardedClusterWorkerSecondariesAnnotation is true when the workers run replicas
+	bgShardedClusterWorkerSecondariesAnnotation = "bgshardedcluster.bestgres.io/worker-secondaries"
+
+	// citusSecondaryCluster is the node cluster of the worker replicas, reads go to them on
+	// connections that set citus.use_secondary_nodes to always and citus.cluster_name to it
+	citusSecondaryCluster = "secondaries"
+
+	// citusNodeTimeout bounds the node management functions, the shards of a draining worker
+	// are moved by a background rebalance job
+	citusNodeTimeout = 2 * time.Minute
+	// citusRetryInterval is the first wait before registering a failed worker again, it doubles
+	// with every failure up to citusMaxRetryInterval
+	citusRetryInterval    = 2 * time.Second
+	citusMaxRetryInterval = time.Minute
+)
+
+// citusNode is a worker registered in pg_dist_node
+type citusNode struct {
+	name             string
+	port             int
+	group            int64
+	active           bool
+	shouldHaveShards bool
+	// placements is the number of shard placements on the node, reference tables aside as
+	// every worker holds those
+	placements int64
+}
+
+// citusRetry is the backoff of a worker that failed to register
+type citusRetry struct {
+	attempts int
+	next     time.Time
+}
+
+// citusRetries holds the workers that failed to register, by name
+var citusRetries = map[string]*citusRetry{}
+
+// reconcileCitusNodes makes pg_dist_node match the workers of the sharded cluster from the
+// coordinator primary: initialized workers are registered, workers that are scaled down are
+// drained by a background rebalance job and removed. The removed ones are reported on the pod
+// for the operator to delete, along with the workers that aren't registered yet. Registering a
+// worker, or a drained one being wanted again, requests a rebalance that moves shards to it, and
+// worker replicas are registered as secondaries for reads. In patroni-native mode Patroni
+// registers the workers.
+func reconcileCitusNodes(bgCluster *bestgresv1.BGCluster, c client.Client) error {
+	// the labels are checked directly, the is*Node helpers log on every call
+	if bgCluster.Labels[bgClusterRoleLabel] != "coordinator" ||
+		checkAnnotation(bgCluster, bgClusterInitializedAnnotation) != "true" {
+		return nil
+	}
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		// only the primary reports, a stale list could get a worker deleted after a failover
+		for _, annotation := range []string{bgShardedClusterDrainedAnnotation, bgShardedClusterUnregisteredAnnotation} {
+			if checkPodAnnotation(c, podName, namespace, annotation) != "" {
+				if err := deleteAnnotation(c, podName, namespace, annotation); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	var workers, draining []string
+	if value := bgCluster.Annotations[bgShardedClusterWorkersAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &workers); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", bgShardedClusterWorkersAnnotation, err)
+		}
+	}
+	if value := bgCluster.Annotations[bgShardedClusterDrainingAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &draining); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", bgShardedClusterDrainingAnnotation, err)
+		}
+	}
+
+	_, native := patroni.CitusGroup(bgCluster)
+	nodes, err := listCitusNodes(c, bgCluster.Labels[bgClusterPartOfLabel], native)
+	if err != nil {
+		return err
+	}
+
+	var added bool
+	registered := map[string]bool{}
+	if native {
+		// Patroni registers the primary of every group, workers that were unregistered before
+		// are new
+		var previous []string
+		if value := checkPodAnnotation(c, podName, namespace, bgShardedClusterUnregisteredAnnotation); value != "" {
+			if err := json.Unmarshal([]byte(value), &previous); err != nil {
+				log.Printf("Ignoring invalid %s annotation: %v", bgShardedClusterUnregisteredAnnotation, err)
+			}
+		}
+		for _, worker := range previous {
+			if node, ok := nodes[worker]; ok && node.active {
+				log.Printf("Patroni registered worker node %s", worker)
+				added = true
+			}
+		}
+	} else {
+		// workers are registered as soon as the operator copied their initialized annotation,
+		// in whatever order that happens
+		pending := map[string]bool{}
+		for _, worker := range workers {
+			if checkAnnotation(bgCluster, fmt.Sprintf("bgshardedcluster.bestgres.io/%s-initialized", worker)) != "true" {
+				continue
+			}
+			if node, registered := nodes[worker]; !registered || !node.active {
+				pending[worker] = registered
+			}
+		}
+		registered = registerCitusWorkers(pending)
+		added = len(registered) > 0
+	}
+
+	unregistered := []string{}
+	for _, worker := range workers {
+		if node, ok := nodes[worker]; (!ok || !node.active) && !registered[worker] {
+			unregistered = append(unregistered, worker)
+		}
+	}
+	if err := reportCitusWorkers(c, bgShardedClusterUnregisteredAnnotation, unregistered); err != nil {
+		return err
+	}
+
+	// a worker drained by a scale down that was reverted before it was removed
+	for _, worker := range workers {
+		node, ok := nodes[worker]
+		if !ok || !node.active || node.shouldHaveShards {
+			continue
+		}
+		log.Printf("Worker node %s takes shards again", worker)
+		if err := runCitusCommand("SELECT citus_set_node_property($1, $2, 'shouldhaveshards', true)", node.name, node.port); err != nil {
+			log.Printf("Failed to let worker node %s take shards: %v", worker, err)
+			continue
+		}
+		added = true
+	}
+
+	// new workers hold no shards until a rebalance moves some to them
+	if added {
+		if err := requestRebalance(bgCluster, c); err != nil {
+			log.Printf("Failed to request a rebalance: %v", err)
+		}
+	}
+
+	// secondaries are removed before their worker is drained, Citus keeps them in its group
+	reconcileCitusSecondaries(bgCluster, nodes, workers)
+
+	drained := []string{}
+	moving := false
+	for _, worker := range draining {
+		if node, registered := nodes[worker]; registered {
+			// Patroni would add a removed node again while its worker runs, so patroni-native
+			// workers stay in pg_dist_node without shards until they are deleted
+			empty, err := drainCitusNode(node, !native)
+			if err != nil {
+				log.Printf("Failed to drain worker node %s: %v", worker, err)
+				continue
+			}
+			if !empty {
+				moving = true
+				continue
+			}
+		}
+		drained = append(drained, worker)
+	}
+	if moving {
+		if err := startCitusDrain(shardTransferMode(bgCluster, "")); err != nil {
+			log.Printf("Failed to start draining the worker nodes: %v", err)
+		}
+	}
+	if native {
+		removeDeletedCitusNodes(c, nodes, workers, draining)
+	}
+
+	if err := reportCitusWorkers(c, bgShardedClusterDrainedAnnotation, drained); err != nil {
+		return err
+	}
+	return reconcileRebalance(bgCluster, c, len(drained) < len(draining))
+}
+
+// registerCitusWorkers adds the workers that aren't registered and activates the inactive ones
+// in parallel, so a slow worker doesn't hold up the others. It returns the workers that are
+// registered now, failed ones are retried with backoff.
+func registerCitusWorkers(pending map[string]bool) map[string]bool {
+	for worker := range citusRetries {
+		if _, ok := pending[worker]; !ok {
+			delete(citusRetries, worker)
+		}
+	}
+
+	type result struct {
+		worker string
+		err    error
+	}
+	results := make(chan result, len(pending))
+	var wg sync.WaitGroup
+	for worker, inactive := range pending {
+		if retry := citusRetries[worker]; retry != nil && time.Now().Before(retry.next) {
+			continue
+		}
+		wg.Add(1)
+		go func(worker string, inactive bool) {
+			defer wg.Done()
+			results <- result{worker: worker, err: registerCitusWorker(worker, inactive)}
+		}(worker, inactive)
+	}
+	wg.Wait()
+	close(results)
+
+	registered := map[string]bool{}
+	for result := range results {
+		if result.err == nil {
+			delete(citusRetries, result.worker)
+			registered[result.worker] = true
+			continue
+		}
+		retry := citusRetries[result.worker]
+		if retry == nil {
+			retry = &citusRetry{}
+			citusRetries[result.worker] = retry
+		}
+		retry.attempts++
+		interval := min(citusRetryInterval<<min(retry.attempts-1, 10), citusMaxRetryInterval)
+		retry.next = time.Now().Add(interval)
+		log.Printf("Failed to register worker node %s (attempt %d), retrying in %s: %v", result.worker, retry.attempts, interval, result.err)
+	}
+	return registered
+}
+
+// registerCitusWorker adds a worker to pg_dist_node, or activates it when it's already there
+func registerCitusWorker(worker string, inactive bool) error {
+	if inactive {
+		log.Printf("Activating worker node %s", worker)
+		return runCitusCommand("SELECT citus_activate_node($1, $2)", worker, 5432)
+	}
+	log.Printf("Adding worker node %s to the coordinator", worker)
+	return runCitusCommand("SELECT citus_add_node($1, $2)", worker, 5432)
+}
+
+// reportCitusWorkers annotates the pod with a sorted list of workers for the operator
+func reportCitusWorkers(c client.Client, annotation string, workers []string) error {
+	sort.Strings(workers)
+	workersJSON, err := json.Marshal(workers)
+	if err != nil {
+		return err
+	}
+	if checkPodAnnotation(c, podName, namespace, annotation) == string(workersJSON) {
+		return nil
+	}
+	return updateAnnotation(c, podName, namespace, annotation, string(workersJSON))
+}
+
+// listCitusNodes returns the primary workers in pg_dist_node by the name of their BGCluster
+func listCitusNodes(c client.Client, shardedCluster string, native bool) (map[string]citusNode, error) {
+	var groups map[int64]string
+	if native {
+		var err error
+		if groups, err = citusWorkerGroups(c, shardedCluster); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := queryLocal(ctx, `SELECT n.nodename, n.nodeport, n.groupid, n.isactive, n.shouldhaveshards,
+		(SELECT count(*) FROM pg_dist_placement p
+			JOIN pg_dist_shard s ON s.shardid = p.shardid
+			JOIN pg_dist_partition t ON t.logicalrelid = s.logicalrelid
+			WHERE p.groupid = n.groupid AND NOT (t.partmethod = 'n' AND t.repmodel = 't'))
+		FROM pg_dist_node n WHERE n.groupid <> 0 AND n.noderole = 'primary'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the Citus nodes: %w", err)
+	}
+	var nodes []citusNode
+	for _, row := range result.Rows {
+		port, err := row.Int64(1)
+		if err != nil {
+			return nil, err
+		}
+		placements, err := row.Int64(5)
+		if err != nil {
+			return nil, err
+		}
+		group, err := row.Int64(2)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, citusNode{
+			name:             row.String(0),
+			port:             int(port),
+			group:            group,
+			active:           row.Bool(3),
+			shouldHaveShards: row.Bool(4),
+			placements:       placements,
+		})
+	}
+	return citusNodesByWorker(nodes, groups), nil
+}
+
+// citusNodesByWorker keys the primary nodes by the BGCluster of their worker. The operator
+// registers the workers by name, Patroni registers the address of the primary of a group,
+// which is resolved to the worker through groups when they're given. Nodes of a group
+// without a worker keep their address, the worker was deleted.
+func citusNodesByWorker(nodes []citusNode, groups map[int64]string) map[string]citusNode {
+	byWorker := map[string]citusNode{}
+	for _, node := range nodes {
+		worker := node.name
+		if name, ok := groups[node.group]; ok {
+			worker = name
+		}
+		byWorker[worker] = node
+	}
+	return byWorker
+}
+
+// citusWorkerGroups returns the workers of a patroni-native sharded cluster by the Citus group
+// the operator labelled them with
+func citusWorkerGroups(c client.Client, shardedCluster string) (map[int64]string, error) {
+	bgClusters := &bestgresv1.BGClusterList{}
+	if err := c.List(context.TODO(), bgClusters, client.InNamespace(namespace), client.MatchingLabels{
+		bgClusterPartOfLabel: shardedCluster,
+		bgClusterRoleLabel:   "worker",
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list the workers: %w", err)
+	}
+	groups := map[int64]string{}
+	for i := range bgClusters.Items {
+		if group, ok := patroni.CitusGroup(&bgClusters.Items[i]); ok {
+			groups[int64(group)] = bgClusters.Items[i].Name
+		}
+	}
+	return groups, nil
+}
+
+// reconcileCitusSecondaries registers the <worker>-repl Service of every active worker as a
+// secondary of the worker's group when the workers run replicas, and removes the secondaries
+// of workers that are gone. The Service targets the pods Patroni labels as replicas, so the
+// secondaries follow failovers without touching pg_dist_node.
+func reconcileCitusSecondaries(bgCluster *bestgresv1.BGCluster, nodes map[string]citusNode, workers []string) {
+	secondaries, err := listCitusSecondaries()
+	if err != nil {
+		log.Printf("Failed to list the Citus secondaries: %v", err)
+		return
+	}
+
+	desired := desiredCitusSecondaries(nodes, workers, bgCluster.Annotations[bgShardedClusterWorkerSecondariesAnnotation] == "true")
+	for name, secondary := range secondaries {
+		// a worker that was removed and added again has a new group
+		if primary, ok := desired[name]; ok && primary.group == secondary.group {
+			continue
+		}
+		log.Printf("Removing secondary node %s", name)
+		if err := runCitusCommand("SELECT citus_remove_node($1, $2)", name, secondary.port); err != nil {
+			log.Printf("Failed to remove secondary node %s: %v", name, err)
+			continue
+		}
+		delete(secondaries, name)
+	}
+	for name, primary := range desired {
+		if _, ok := secondaries[name]; ok {
+			continue
+		}
+		log.Printf("Adding secondary node %s for worker node %s", name, primary.name)
+		if err := runCitusCommand("SELECT citus_add_secondary_node($1, $2, $3, $4, nodecluster => $5)",
+			name, 5432, primary.name, primary.port, citusSecondaryCluster); err != nil {
+			log.Printf("Failed to add secondary node %s: %v", name, err)
+		}
+	}
+}
+
+// desiredCitusSecondaries returns the secondaries of the active workers by name along with
+// the primary of their group, none when the workers run without replicas
+func desiredCitusSecondaries(nodes map[string]citusNode, workers []string, replicas bool) map[string]citusNode {
+	desired := map[string]citusNode{}
+	if !replicas {
+		return desired
+	}
+	for _, worker := range workers {
+		if node, ok := nodes[worker]; ok && node.active {
+			desired[worker+"-repl"] = node
+		}
+	}
+	return desired
+}
+
+// listCitusSecondaries returns the secondaries in the node cluster of the worker replicas by name
+func listCitusSecondaries() (map[string]citusNode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := queryLocal(ctx, "SELECT nodename, nodeport, groupid FROM pg_dist_node WHERE noderole = 'secondary' AND nodecluster = $1",
+		citusSecondaryCluster)
+	if err != nil {
+		return nil, err
+	}
+	secondaries := map[string]citusNode{}
+	for _, row := range result.Rows {
+		port, err := row.Int64(1)
+		if err != nil {
+			return nil, err
+		}
+		group, err := row.Int64(2)
+		if err != nil {
+			return nil, err
+		}
+		secondaries[row.String(0)] = citusNode{name: row.String(0), port: int(port), group: group}
+	}
+	return secondaries, nil
+}
+
+// drainCitusNode stops placing shards on a worker and reports whether it holds none anymore,
+// the empty worker is optionally removed from the cluster. The shards are moved by
+// startCitusDrain.
+func drainCitusNode(node citusNode, remove bool) (bool, error) {
+	if node.shouldHaveShards {
+		log.Printf("Draining worker node %s", node.name)
+		if err := runCitusCommand("SELECT citus_set_node_property($1, $2, 'shouldhaveshards', false)", node.name, node.port); err != nil {
+			return false, err
+		}
+	}
+	if node.placements > 0 {
+		return false, nil
+	}
+	if !remove {
+		return true, nil
+	}
+	log.Printf("Removing worker node %s", node.name)
+	return true, runCitusCommand("SELECT citus_remove_node($1, $2)", node.name, node.port)
+}
+
+// startCitusDrain starts a background rebalance that moves the shards off the workers that
+// shouldn't have any, unless a rebalance is running already. Its progress is reported like any
+// other rebalance, a drain that failed or was cancelled is started again after a pause.
+func startCitusDrain(transferMode string) error {
+	ctx := context.Background()
+	status, err := rebalanceStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if status != nil {
+		if rebalanceActive(status.State) {
+			return nil
+		}
+		if (status.State == "failed" || status.State == "cancelled") && status.FinishedAt != nil &&
+			time.Since(status.FinishedAt.Time) < citusMaxRetryInterval {
+			return nil
+		}
+	}
+	jobID, err := startRebalance(ctx, "", transferMode, true)
+	if err != nil {
+		return err
+	}
+	if jobID != 0 {
+		log.Printf("Started rebalance job %d to drain the worker nodes", jobID)
+	}
+	return nil
+}
+
+// removeDeletedCitusNodes removes the nodes of drained patroni-native workers once their
+// BGCluster is gone, Patroni only adds and updates nodes. The nodes of deleted workers are
+// keyed by their address, which names no BGCluster.
+func removeDeletedCitusNodes(c client.Client, nodes map[string]citusNode, workers, draining []string) {
+	keep := map[string]bool{}
+	for _, worker := range workers {
+		keep[worker] = true
+	}
+	for _, worker := range draining {
+		keep[worker] = true
+	}
+	for worker, node := range nodes {
+		if keep[worker] {
+			continue
+		}
+		err := c.Get(context.TODO(), types.NamespacedName{Name: worker, Namespace: namespace}, &bestgresv1.BGCluster{})
+		if !errors.IsNotFound(err) {
+			continue
+		}
+		log.Printf("Removing worker node %s of the deleted BGCluster %s", node.name, worker)
+		if err := runCitusCommand("SELECT citus_remove_node($1, $2)", node.name, node.port); err != nil {
+			log.Printf("Failed to remove worker node %s: %v", node.name, err)
+		}
+	}
+}
+
+// runCitusCommand runs a Citus node management function as the internal Citus user, which
+// is the user Citus connects to the workers as
+func runCitusCommand(sql string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), citusNodeTimeout)
+	defer cancel()
+	_, err := queryLocalAs(ctx, patroni.CitusUser, sql, args...)
+	return err
+}
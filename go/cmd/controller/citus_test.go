@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// workerTopology is what pg_dist_node holds for a worker
+type workerTopology struct {
+	group     int64
+	active    bool
+	secondary string
+}
+
+func TestCitusTopologyModes(t *testing.T) {
+	workers := []string{"sharded-worker-0", "sharded-worker-1", "sharded-worker-2"}
+	// the groups don't follow the worker names, only the labels tell them apart
+	labelled := map[string]int{"sharded-worker-0": 3, "sharded-worker-1": 1, "sharded-worker-2": 2}
+
+	tests := []struct {
+		mode string
+		// the primaries as the mode registers them in pg_dist_node
+		nodes []citusNode
+	}{
+		{
+			mode: bestgresv1.ShardedClusterModeOperator,
+			nodes: []citusNode{
+				{name: "sharded-worker-0", port: 5432, group: 3, active: true, shouldHaveShards: true},
+				{name: "sharded-worker-1", port: 5432, group: 1, active: true, shouldHaveShards: true},
+				{name: "sharded-worker-2", port: 5432, group: 2, active: true, shouldHaveShards: true},
+			},
+		},
+		{
+			mode: bestgresv1.ShardedClusterModePatroniNative,
+			nodes: []citusNode{
+				{name: "10.0.0.11", port: 5432, group: 3, active: true, shouldHaveShards: true},
+				{name: "10.0.1.12", port: 5432, group: 1, active: true, shouldHaveShards: true},
+				{name: "10.0.2.13", port: 5432, group: 2, active: true, shouldHaveShards: true},
+			},
+		},
+	}
+	want := map[string]workerTopology{
+		"sharded-worker-0": {group: 3, active: true, secondary: "sharded-worker-0-repl"},
+		"sharded-worker-1": {group: 1, active: true, secondary: "sharded-worker-1-repl"},
+		"sharded-worker-2": {group: 2, active: true, secondary: "sharded-worker-2-repl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			native := tt.mode == bestgresv1.ShardedClusterModePatroniNative
+			var objs []runtime.Object
+			for _, worker := range workers {
+				objs = append(objs, newTestWorker(worker, labelled[worker], native))
+			}
+			c := newTestClient(t, objs...)
+
+			var groups map[int64]string
+			if native {
+				var err error
+				if groups, err = citusWorkerGroups(c, "sharded"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			nodes := citusNodesByWorker(tt.nodes, groups)
+			secondaries := desiredCitusSecondaries(nodes, workers, true)
+
+			got := map[string]workerTopology{}
+			for _, worker := range workers {
+				node, ok := nodes[worker]
+				if !ok {
+					t.Errorf("worker %s has no primary", worker)
+					continue
+				}
+				topology := workerTopology{group: node.group, active: node.active}
+				for name, primary := range secondaries {
+					if primary.group == node.group {
+						topology.secondary = name
+					}
+				}
+				got[worker] = topology
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("topology %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCitusNodesOfDeletedWorkers(t *testing.T) {
+	c := newTestClient(t, newTestWorker("sharded-worker-0", 1, true))
+	groups, err := citusWorkerGroups(c, "sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := citusNodesByWorker([]citusNode{
+		{name: "10.0.0.11", port: 5432, group: 1, active: true},
+		{name: "10.0.1.12", port: 5432, group: 2, active: true},
+	}, groups)
+
+	if _, ok := nodes["sharded-worker-0"]; !ok {
+		t.Error("worker of group 1 wasn't resolved")
+	}
+	// removeDeletedCitusNodes finds no BGCluster by the address
+	if node, ok := nodes["10.0.1.12"]; !ok || node.group != 2 {
+		t.Errorf("node of the deleted worker keyed as %v", nodes)
+	}
+}
+
+// newTestWorker returns a worker BGCluster of the sharded cluster as the operator creates it
+func newTestWorker(name string, group int, native bool) *bestgresv1.BGCluster {
+	bgCluster := &bestgresv1.BGCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				bgClusterPartOfLabel: "sharded",
+				bgClusterRoleLabel:   "worker",
+			},
+		},
+	}
+	if native {
+		bgCluster.Labels[patroni.CitusGroupLabel] = strconv.Itoa(group)
+	}
+	return bgCluster
+}
+
+func newTestClient(t *testing.T, objs ...runtime.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := bestgresv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build()
+}
@@ -0,0 +1,221 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+	"bestgres/pgclient"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// spiloConfiguration is the part of SPILO_CONFIGURATION the controller checks before starting the image
+type spiloConfiguration struct {
+	Postgresql struct {
+		Parameters map[string]interface{} `yaml:"parameters"`
+		PgHBA      []string               `yaml:"pg_hba"`
+	} `yaml:"postgresql"`
+}
+
+// verifySpiloConfiguration makes sure the configuration rendered by the operator reached
+// the container, the image is configured from it instead of patching its scripts
+func verifySpiloConfiguration(bgCluster *bestgresv1.BGCluster) error {
+	raw := os.Getenv("SPILO_CONFIGURATION")
+	if raw == "" {
+		return fmt.Errorf("SPILO_CONFIGURATION is not set, check the %s-postgres-config ConfigMap", bgCluster.Name)
+	}
+
+	var config spiloConfiguration
+	if err := yaml.Unmarshal([]byte(raw), &config); err != nil {
+		return fmt.Errorf("failed to parse SPILO_CONFIGURATION: %w", err)
+	}
+
+	configured := patroni.ParseSharedPreloadLibraries(fmt.Sprint(config.Postgresql.Parameters["shared_preload_libraries"]))
+	if missing := missingLibraries(expectedLibraries(bgCluster), configured); len(missing) > 0 {
+		return fmt.Errorf("SPILO_CONFIGURATION does not preload %s, the %s-postgres-config ConfigMap is out of date",
+			strings.Join(missing, ", "), bgCluster.Name)
+	}
+	if len(config.Postgresql.PgHBA) == 0 {
+		return fmt.Errorf("SPILO_CONFIGURATION has no pg_hba rules, the %s-postgres-config ConfigMap is out of date", bgCluster.Name)
+	}
+
+	return nil
+}
+
+// verifyPreloadedLibraries checks that postgres actually loaded the configured libraries,
+// images that ignore SPILO_CONFIGURATION or don't ship a library fail here
+func verifyPreloadedLibraries(bgCluster *bestgresv1.BGCluster) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := queryLocal(ctx, "SHOW shared_preload_libraries")
+	if err != nil {
+		return fmt.Errorf("failed to read shared_preload_libraries: %w", err)
+	}
+	if len(result.Rows) == 0 {
+		return fmt.Errorf("SHOW shared_preload_libraries returned no rows")
+	}
+
+	loaded := patroni.ParseSharedPreloadLibraries(result.Rows[0].String(0))
+	if missing := missingLibraries(expectedLibraries(bgCluster), loaded); len(missing) > 0 {
+		return fmt.Errorf("image %s did not load %s (loaded: %s), it must read SPILO_CONFIGURATION and ship these libraries",
+			bgCluster.Spec.Image.Tag, strings.Join(missing, ", "), strings.Join(loaded, ","))
+	}
+	return nil
+}
+
+// expectedLibraries returns the libraries the operator configured for this cluster
+func expectedLibraries(bgCluster *bestgresv1.BGCluster) []string {
+	return patroni.SharedPreloadLibraries(bgCluster, isPartOfShardedCluster(bgCluster))
+}
+
+// missingLibraries returns the libraries in expected that are not in actual
+func missingLibraries(expected, actual []string) []string {
+	present := make(map[string]bool, len(actual))
+	for _, library := range actual {
+		present[library] = true
+	}
+	var missing []string
+	for _, library := range expected {
+		if !present[library] {
+			missing = append(missing, library)
+		}
+	}
+	return missing
+}
+
+// patroniConfigFile is where the image writes the Patroni configuration it starts with
+func patroniConfigFile() string {
+	if path := os.Getenv("PATRONI_CONFIG_FILE"); path != "" {
+		return path
+	}
+	return "/home/postgres/postgres.yml"
+}
+
+// reconcilePgHBA brings the pg_hba rules in the Patroni configuration file in line with the
+// spec and reloads Patroni, which rewrites pg_hba.conf without restarting postgres
+func reconcilePgHBA(bgCluster *bestgresv1.BGCluster) error {
+	_, sharded := bgCluster.Labels[bgClusterPartOfLabel]
+	desired := patroni.PgHBA(bgCluster, sharded)
+
+	path := patroniConfigFile()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read Patroni configuration: %w", err)
+	}
+
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return fmt.Errorf("failed to parse Patroni configuration: %w", err)
+	}
+
+	postgresqlIndex := -1
+	for i, item := range config {
+		if item.Key == "postgresql" {
+			postgresqlIndex = i
+			break
+		}
+	}
+	if postgresqlIndex < 0 {
+		return fmt.Errorf("Patroni configuration %s has no postgresql section", path)
+	}
+	postgresql, ok := config[postgresqlIndex].Value.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("Patroni configuration %s has an invalid postgresql section", path)
+	}
+
+	if pgHBAEqual(postgresql["pg_hba"], desired) {
+		return nil
+	}
+
+	log.Printf("Updating pg_hba rules in %s", path)
+	postgresql["pg_hba"] = desired
+	config[postgresqlIndex].Value = postgresql
+	updated, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Patroni configuration: %w", err)
+	}
+	// write in place so the file keeps its owner and mode
+	if err := os.WriteFile(path, updated, 0600); err != nil {
+		return fmt.Errorf("failed to write Patroni configuration: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := patroni.NewClient("localhost").Reload(ctx); err != nil {
+		return fmt.Errorf("failed to reload Patroni: %w", err)
+	}
+	log.Println("Patroni reloaded with the new pg_hba rules")
+	return nil
+}
+
+// pgHBAEqual compares the pg_hba rules read from the configuration file with the desired ones
+func pgHBAEqual(current interface{}, desired []string) bool {
+	rules, ok := current.([]interface{})
+	if !ok || len(rules) != len(desired) {
+		return false
+	}
+	for i, rule := range rules {
+		if fmt.Sprint(rule) != desired[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isLocalPrimary reports whether the local postgres instance accepts writes
+func isLocalPrimary() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := queryLocal(ctx, "SELECT pg_is_in_recovery()")
+	if err != nil {
+		return false, err
+	}
+	if len(result.Rows) == 0 {
+		return false, fmt.Errorf("pg_is_in_recovery() returned no rows")
+	}
+	return !result.Rows[0].Bool(0), nil
+}
+
+// ensureCitusUser creates the internal role Citus nodes authenticate with, or resets its
+// password to the shared one. It has to be a superuser: citus_add_node, the metadata sync to
+// the workers and the logical replication subscriptions of shard moves all require one. The
+// pg_hba rules only let it in from the networks of the pods.
+func ensureCitusUser() error {
+	password := os.Getenv("PGPASSWORD_CITUS")
+	if password == "" {
+		return fmt.Errorf("PGPASSWORD_CITUS is not set")
+	}
+
+	role := pgclient.QuoteIdentifier(patroni.CitusUser)
+	commands := []string{
+		fmt.Sprintf("DO $$BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = %s) THEN CREATE ROLE %s; END IF; END$$",
+			pgclient.QuoteLiteral(patroni.CitusUser), role),
+		fmt.Sprintf("ALTER ROLE %s WITH LOGIN SUPERUSER PASSWORD %s", role, pgclient.QuoteLiteral(password)),
+	}
+	for _, command := range commands {
+		if err := runSQLCommand(5, 5*time.Second, command); err != nil {
+			return fmt.Errorf("failed to create %s role: %w", patroni.CitusUser, err)
+		}
+	}
+	return nil
+}
+
+// ensureCitusAuthInfo stores the internal user's password in pg_dist_authinfo so the
+// coordinator can authenticate to every node, Citus syncs it to the workers
+func ensureCitusAuthInfo() error {
+	authInfo := "password=" + os.Getenv("PGPASSWORD_CITUS")
+	if err := runSQLCommand(5, 5*time.Second, "DELETE FROM pg_dist_authinfo WHERE nodeid = 0 AND rolename = $1", patroni.CitusUser); err != nil {
+		return fmt.Errorf("failed to clear pg_dist_authinfo: %w", err)
+	}
+	if err := runSQLCommand(5, 5*time.Second, "INSERT INTO pg_dist_authinfo (nodeid, rolename, authinfo) VALUES (0, $1, $2)", patroni.CitusUser, authInfo); err != nil {
+		return fmt.Errorf("failed to set pg_dist_authinfo: %w", err)
+	}
+	return nil
+}
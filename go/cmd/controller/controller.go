@@ -8,9 +8,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
-	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -39,18 +39,49 @@ func RunController() {
 	c := createClient()
 	bgCluster := getResources(podName, namespace, c)
 	
-	// first we need to modify the spilo configuration
-	hackConfigs(bgCluster)
+	// the image is configured through SPILO_CONFIGURATION, make sure it's usable before starting
+	if err := verifySpiloConfiguration(bgCluster); err != nil {
+		log.Printf("Invalid Patroni configuration: %v", err)
+		os.Exit(1)
+	}
+	// archive-wal reads the backup configuration from a file as postgres is started without
+	// the container environment
+	if err := writeBackupConfig(bgCluster); err != nil {
+		log.Printf("Failed to write the backup configuration: %v", err)
+	}
+	if err := writeRestoreConfig(bgCluster); err != nil {
+		log.Printf("Failed to write the restore configuration: %v", err)
+	}
 	// then we run the main container command
 	runContainerCommand(bgCluster)
+	// the upgraded primary is recreated with Patroni paused, which leaves postgres stopped
+	// until it's resumed, a failure restarts the container to try again
+	if err := resumeUpgrade(bgCluster, c); err != nil {
+		log.Printf("Failed to resume the upgraded primary: %v", err)
+		os.Exit(1)
+	}
 
 	// wait for the database to be ready
 	// otherwise we can't run any SQL commands
-	err := waitForDatabase(5 * time.Minute)
+	// a restore takes as long as the backup and the WAL replay need, the replicas of an
+	// upgrade wait for the primary and are rebuilt from it
+	timeout := 5 * time.Minute
+	if isRestoring(bgCluster) || checkAnnotation(bgCluster, bgDbOpsOpAnnotation) == "upgrade" && checkAnnotation(bgCluster, bgDbOpsPendingAnnotation) == "true" {
+		timeout = 0
+	}
+	err := waitForDatabase(timeout)
 	if err != nil {
 		log.Printf("Error waiting for database: %v", err)
+		log.Printf("Check that image %s can load shared_preload_libraries %s", bgCluster.Spec.Image.Tag, strings.Join(expectedLibraries(bgCluster), ","))
 		os.Exit(1)
 	}
+	if err := verifyPreloadedLibraries(bgCluster); err != nil {
+		log.Printf("Image can't honour the Patroni configuration: %v", err)
+		os.Exit(1)
+	}
+	if err := initBackupStorage(bgCluster); err != nil {
+		log.Printf("Failed to initialize the backup storage: %v", err)
+	}
 
 	// run the appropriate bootstrap commands based on the BGCluster type
 	switch {
@@ -74,36 +105,78 @@ func reconciliationLoop(bgCluster *bestgresv1.BGCluster, c client.Client) {
         // Refresh the BGCluster object
         bgCluster := refreshContext(bgCluster, c)
 
+        // the cluster is being deleted, stop postgres cleanly and leave everything else alone
+        if bgCluster.Annotations[bgClusterShutdownAnnotation] != "" {
+            handleShutdown(c)
+            time.Sleep(2 * time.Second)
+            continue
+        }
+
+        if err := writeBackupConfig(bgCluster); err != nil {
+            log.Printf("Failed to write the backup configuration: %v", err)
+        }
+
+        // pg_hba changes are applied with a reload, not a restart
+        if err := reconcilePgHBA(bgCluster); err != nil {
+            log.Printf("Failed to reconcile pg_hba rules: %v", err)
+        }
+
+        // the coordinator keeps pg_dist_node in line with the workers of the sharded cluster
+        if err := reconcileCitusNodes(bgCluster, c); err != nil {
+            log.Printf("Failed to reconcile the Citus nodes: %v", err)
+        }
+
+        // the primary drops the slots of the members a scale down removed
+        if err := dropRemovedMemberSlots(bgCluster, c); err != nil {
+            log.Printf("Failed to drop the slots of removed members: %v", err)
+        }
+
         // Check if there's a pending operation
         if bgCluster.Annotations[bgDbOpsPendingAnnotation] == "true" {
-            if err := handleBgDbOps(bgCluster, c); err != nil {
-                log.Printf("Failed to handle BGDbOps: %v", err)
-            }
+            runBgDbOps(bgCluster, c)
         } else {
-            // make sure to remove any old completed annotations
+            // make sure to remove any old completed, attempts, cancelled, restarted and upgrade annotations
             deleteAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation)
+            deleteAnnotation(c, podName, namespace, bgDbOpsAttemptsAnnotation)
+            deleteAnnotation(c, podName, namespace, bgDbOpsCancelledAnnotation)
+            deleteAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation)
+            deleteAnnotation(c, podName, namespace, bgDbOpsUpgradeAnnotation)
         }
         // TODO remove this sleep (not sure why this is here tbh)
         time.Sleep(2 * time.Second)
     }
 }
 
-func handleBgDbOps(bgCluster *bestgresv1.BGCluster, c client.Client) error {
+// handleBgDbOps runs the pending operation, ctx ends at the deadline of the operation
+func handleBgDbOps(ctx context.Context, bgCluster *bestgresv1.BGCluster, c client.Client) error {
     op := bgCluster.Annotations[bgDbOpsOpAnnotation]
     spec := bgCluster.Annotations[bgDbOpsSpecAnnotation]
 
+    // restart tracks its own progress across the pod restart, everything else runs once per pod
+    if op != "restart" && checkPodAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation) == "true" {
+        return nil
+    }
+
     var err error
     switch op {
     case "restart":
-        err = handleRestart(c, bgCluster, spec)
+        // the restart marks the pod completed once the member is healthy again
+        return handleRestart(ctx, c, bgCluster, spec)
+    case "upgrade":
+        // the upgrade marks the pod completed once it runs the new version
+        return handleUpgrade(ctx, c, bgCluster, spec)
     case "backup":
-        err = handleBackup(c, bgCluster, spec)
+        err = handleBackup(ctx, c, bgCluster, spec)
     case "benchmark":
-        err = handleBenchmark(c, bgCluster, spec)
+        err = handleBenchmark(ctx, c, bgCluster, spec)
     case "repack":
-        err = handleRepack(c, bgCluster, spec)
+        err = handleRepack(ctx, c, bgCluster, spec)
     case "vacuum":
-        err = handleVacuum(c, bgCluster, spec)
+        err = handleVacuum(ctx, c, bgCluster, spec)
+    case "analyze":
+        err = handleAnalyze(ctx, c, bgCluster, spec)
+    case "rebalance":
+        err = handleRebalance(ctx, c, bgCluster, spec)
     default:
         return fmt.Errorf("unknown operation: %s", op)
     }
@@ -115,62 +188,3 @@ func handleBgDbOps(bgCluster *bestgresv1.BGCluster, c client.Client) error {
     // Set the BGDbOps completed annotation
     return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
 }
-
-func handleRestart(c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
-	// TODO also need to check if this is a replica or master and handle accordingly
-    if checkPodAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation) != "true" {
-        log.Printf("Handling restart operation for %s", bgCluster.Name)
-        runCommand("sv stop patroni", 0, 1*time.Second)
-        deletePod(c, podName, namespace)
-    } else {
-        // update the bgdbop object to indicate that the operation is complete
-        // we have to get the name of the bgdbop object from the bgcluster object's in-progress annotation
-        bgDbOpsName := bgCluster.Annotations[bgDbOpsInProgressAnnotation]
-        bgDbOps := &bestgresv1.BGDbOps{}
-        // get the BGDbOps object
-        err := c.Get(context.TODO(), types.NamespacedName{Name: bgDbOpsName, Namespace: namespace}, bgDbOps)
-        if err != nil {
-            return fmt.Errorf("failed to get BGDbOps: %v", err)
-        }
-        // create an annotation on the bgdbop to indicate that the operation is complete
-        podCompletedAnnotation := string("bgcluster.bestgres.io/" + podName )
-        
-        // Initialize the Annotations map if it's nil
-        if bgDbOps.Annotations == nil {
-            bgDbOps.Annotations = make(map[string]string)
-        }
-        
-        // Set the annotation to true
-        bgDbOps.Annotations[podCompletedAnnotation] = "true"
-
-        // Update the BGDbOps object
-        if err := c.Update(context.TODO(), bgDbOps); err != nil {
-            return fmt.Errorf("failed to update BGDbOps: %v", err)
-        }
-    }
-    return nil
-}
-
-func handleBackup(c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
-    // Placeholder function for backup operation
-    log.Printf("Handling backup operation for %s", bgCluster.Name)
-    return nil
-}
-
-func handleBenchmark(c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
-    // Placeholder function for benchmark operation
-    log.Printf("Handling benchmark operation for %s", bgCluster.Name)
-    return nil
-}
-
-func handleRepack(c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
-    // Placeholder function for repack operation
-    log.Printf("Handling repack operation for %s", bgCluster.Name)
-    return nil
-}
-
-func handleVacuum(c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
-    // Placeholder function for vacuum operation
-    log.Printf("Handling vacuum operation for %s", bgCluster.Name)
-    return nil
-}
@@ -11,12 +11,15 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"strings"
 	"time"
 
+	"bestgres/patroni"
+	"bestgres/pgclient"
+
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
@@ -105,7 +108,7 @@ func deleteAnnotation(c client.Client, podName, namespace, key string) error {
 		return fmt.Errorf("failed to get pod: %v", err)
 	}
 
-	if pod.Annotations != nil {
+	if _, exists := pod.Annotations[key]; exists {
 		delete(pod.Annotations, key)
 
 		if err := c.Update(context.TODO(), pod); err != nil {
@@ -143,14 +146,78 @@ func getResources(podName, namespace string, c client.Client) *bestgresv1.BGClus
 	return bgCluster
 }
 
-// runAllPsqlCommands executes all SQL commands with error handling and retries
-func runPsqlCommands(commands []string) error {
+// localDBConfig returns the settings for connecting to the postgres instance in this pod
+func localDBConfig(user string) pgclient.Config {
+	socketDir := os.Getenv("PGHOST")
+	if socketDir == "" {
+		socketDir = "/var/run/postgresql"
+	}
+	return pgclient.Config{
+		Host:            socketDir,
+		Port:            5432,
+		User:            user,
+		Password:        passwordForUser(user),
+		Database:        "postgres",
+		ApplicationName: "bestgres-controller",
+		ConnectTimeout:  10 * time.Second,
+	}
+}
+
+// passwordForUser returns the password of the roles the controller connects as
+func passwordForUser(user string) string {
+	if user == patroni.CitusUser {
+		return os.Getenv("PGPASSWORD_CITUS")
+	}
+	return os.Getenv("PGPASSWORD_SUPERUSER")
+}
+
+// queryLocal runs a statement against the local postgres instance on a fresh connection
+// and returns its rows, args are sent as query parameters
+func queryLocal(ctx context.Context, sql string, args ...interface{}) (*pgclient.Result, error) {
+	return queryLocalAs(ctx, "postgres", sql, args...)
+}
+
+// queryLocalAs is queryLocal connecting as the given user
+func queryLocalAs(ctx context.Context, user string, sql string, args ...interface{}) (*pgclient.Result, error) {
+	conn, err := pgclient.Connect(ctx, localDBConfig(user))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Query(ctx, sql, args...)
+}
+
+// connectLocal opens a connection to a database of the local postgres instance as the superuser
+func connectLocal(ctx context.Context, database string) (*pgclient.Conn, error) {
+	config := localDBConfig("postgres")
+	config.Database = database
+	return pgclient.Connect(ctx, config)
+}
+
+// updateBGDbOpsStatus applies mutate to the status of the BGDbOps in progress on the cluster
+func updateBGDbOpsStatus(c client.Client, bgCluster *bestgresv1.BGCluster, mutate func(status *bestgresv1.BGDbOpsStatus)) error {
+	bgDbOpsName := bgCluster.Annotations[bgDbOpsInProgressAnnotation]
+	if bgDbOpsName == "" {
+		return fmt.Errorf("no BGDbOps in progress on %s", bgCluster.Name)
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		bgDbOps := &bestgresv1.BGDbOps{}
+		if err := c.Get(context.TODO(), types.NamespacedName{Name: bgDbOpsName, Namespace: namespace}, bgDbOps); err != nil {
+			return err
+		}
+		mutate(&bgDbOps.Status)
+		return c.Status().Update(context.TODO(), bgDbOps)
+	})
+}
+
+// runSQLCommands executes all SQL commands with error handling and retries
+func runSQLCommands(commands []string) error {
 	maxRetries := 5
 	retryInterval := 5 * time.Second
 
 	for _, command := range commands {
 		log.Printf("Executing command: %s", command)
-		if err := runPsqlCommand(command, maxRetries, retryInterval); err != nil {
+		if err := runSQLCommand(maxRetries, retryInterval, command); err != nil {
 			log.Printf("Failed to execute command '%s': %v", command, err)
 			return err
 		}
@@ -158,73 +225,53 @@ func runPsqlCommands(commands []string) error {
 	return nil
 }
 
-// runPsqlCommand executes a single SQL command with retries
-func runPsqlCommand(sqlCommand string, maxRetries int, retryInterval time.Duration) error {
-	var stdout, stderr bytes.Buffer
+// runSQLCommand executes a single SQL statement with retries, args are sent as query parameters
+func runSQLCommand(maxRetries int, retryInterval time.Duration, sqlCommand string, args ...interface{}) error {
+	return runSQLCommandAs("postgres", maxRetries, retryInterval, sqlCommand, args...)
+}
 
+// runSQLCommandAs is runSQLCommand connecting as the given user
+func runSQLCommandAs(user string, maxRetries int, retryInterval time.Duration, sqlCommand string, args ...interface{}) error {
+	var err error
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		cmd := exec.Command("psql", "-U", "postgres", "-c", sqlCommand)
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		err := cmd.Run()
+		_, err = queryLocalAs(context.TODO(), user, sqlCommand, args...)
 		if err == nil {
 			// Command succeeded
 			return nil
 		}
 
-		_, ok := err.(*exec.ExitError)
-		if !ok {
-			// This is not an ExitError, so it's likely a more severe issue
-			return fmt.Errorf("failed to execute psql command: %v", err)
-		}
-
-		// Log the error, including stdout and stderr
-		// log.Printf("Command failed (attempt %d/%d): %s\nStdout: %s\nStderr: %s\n",
-			// attempt+1, maxRetries, err, stdout.String(), stderr.String())
-
-		// Check if the error is retryable
-		if isRetryableError(stderr.String()) {
-			log.Printf("Retryable error detected. Retrying in %v...", retryInterval)
-			time.Sleep(retryInterval)
-			continue
+		// If it's not a retryable error, return immediately
+		if !isRetryableError(err) {
+			return fmt.Errorf("SQL error: %w", err)
 		}
 
-		// If it's not a retryable error, return immediately
-		return fmt.Errorf("SQL error: %s", stderr.String())
+		log.Printf("Retryable error detected (attempt %d/%d): %v. Retrying in %v...", attempt+1, maxRetries, err, retryInterval)
+		time.Sleep(retryInterval)
 	}
 
-	return fmt.Errorf("failed to execute psql command after %d attempts: %s", maxRetries, stderr.String())
+	return fmt.Errorf("failed to execute SQL command after %d attempts: %w", maxRetries, err)
 }
 
-// isRetryableError checks if the error message indicates a retryable error
-func isRetryableError(errMsg string) bool {
-	retryableErrors := []string{
-		"connection refused",
-		"connection marked as essential",
-		"connection timed out",
-		"temporary failure",
-		"No function matches the given name and argument types",
-	}
-
-	for _, retryableErr := range retryableErrors {
-		if strings.Contains(strings.ToLower(errMsg), strings.ToLower(retryableErr)) {
-			return true
-		}
+// isRetryableError checks if a failed SQL statement is worth retrying
+func isRetryableError(err error) bool {
+	if pgclient.IsTransient(err) {
+		return true
 	}
-	return false
+	// citus functions can't be resolved until the extension has finished loading
+	return pgclient.SQLState(err) == pgclient.UndefinedFunction
 }
 
 // runCommand executes a single linux command with retries
 func runCommand(command string, maxRetries int, retryInterval time.Duration) error {
-	var stdout, stderr bytes.Buffer
+	var lastStderr string
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
+		var stdout, stderr bytes.Buffer
 		cmd := exec.Command(command)
 		cmd.Stdout = &stdout
 		cmd.Stderr = &stderr
 
-		err := cmd.Run()
+		err := runWaited(cmd)
 		if err == nil {
 			// Command succeeded
 			return nil
@@ -241,11 +288,12 @@ func runCommand(command string, maxRetries int, retryInterval time.Duration) err
 			return fmt.Errorf("Error: %s", stderr.String())
 		}
 
-		log.Printf("Command failed (attempt %d/%d): %s\nRetrying in %v...", attempt+1, maxRetries, stderr.String(), retryInterval)
+		lastStderr = stderr.String()
+		log.Printf("Command failed (attempt %d/%d): %s\nRetrying in %v...", attempt+1, maxRetries, lastStderr, retryInterval)
 		time.Sleep(retryInterval)
 	}
 
-	return fmt.Errorf("failed to execute command after %d attempts: %s", maxRetries, stderr.String())
+	return fmt.Errorf("failed to execute command after %d attempts: %s", maxRetries, lastStderr)
 }
 
 func waitForInitilizatedAnnotation(bgCluster *bestgresv1.BGCluster, c client.Client, timeout time.Duration, annotation string) error {
@@ -260,7 +308,7 @@ func waitForInitilizatedAnnotation(bgCluster *bestgresv1.BGCluster, c client.Cli
 			log.Printf("Waiting for %s", annotation)
 			time.Sleep(5 * time.Second)
 		}
-		if time.Since(start) > timeout {
+		if timeout > 0 && time.Since(start) > timeout {
 			return fmt.Errorf("timeout waiting for database to be ready")
 		}
 		time.Sleep(2 * time.Second)
@@ -269,7 +317,7 @@ func waitForInitilizatedAnnotation(bgCluster *bestgresv1.BGCluster, c client.Cli
 	}
 }
 
-// waitForDatabase waits for the database to be ready
+// waitForDatabase waits for the database to be ready, a zero timeout waits forever
 func waitForDatabase(timeout time.Duration) error {
 	start := time.Now()
 	for {
@@ -281,7 +329,7 @@ func waitForDatabase(timeout time.Duration) error {
 		if err != nil {
 			time.Sleep(5 * time.Second)
 		}
-		if time.Since(start) > timeout {
+		if timeout > 0 && time.Since(start) > timeout {
 			return fmt.Errorf("timeout waiting for database to be ready")
 		}
 		time.Sleep(2 * time.Second)
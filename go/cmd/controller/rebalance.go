@@ -0,0 +1,289 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// the operator copies spec.rebalance of the sharded cluster to the coordinator BGCluster
+	bgShardedClusterRebalanceAutoAnnotation     = "bgshardedcluster.bestgres.io/rebalance-auto"
+	bgShardedClusterRebalanceStrategyAnnotation = "bgshardedcluster.bestgres.io/rebalance-strategy"
+	// bgShardedClusterRebalancePendingAnnotation is set on the coordinator pod when a worker
+	// was added and removed once the rebalance for it started
+	bgShardedClusterRebalancePendingAnnotation = "bgshardedcluster.bestgres.io/rebalance-pending"
+	// bgShardedClusterRebalanceAnnotation holds the last rebalance job of the coordinator pod
+	bgShardedClusterRebalanceAnnotation = "bgshardedcluster.bestgres.io/rebalance"
+
+	rebalancePollInterval = 10 * time.Second
+)
+
+// requestRebalance marks the coordinator pod for a rebalance after a worker was added, unless
+// the sharded cluster disabled it
+func requestRebalance(bgCluster *bestgresv1.BGCluster, c client.Client) error {
+	if bgCluster.Annotations[bgShardedClusterRebalanceAutoAnnotation] == "false" {
+		return nil
+	}
+	return updateAnnotation(c, podName, namespace, bgShardedClusterRebalancePendingAnnotation, "true")
+}
+
+// reconcileRebalance starts a requested rebalance once no other one is running and no worker
+// is draining, and reports the progress of the last rebalance job on the pod
+func reconcileRebalance(bgCluster *bestgresv1.BGCluster, c client.Client, draining bool) error {
+	ctx := context.Background()
+	status, err := rebalanceStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	if checkPodAnnotation(c, podName, namespace, bgShardedClusterRebalancePendingAnnotation) == "true" {
+		switch {
+		case bgCluster.Annotations[bgShardedClusterRebalanceAutoAnnotation] == "false":
+			if err := deleteAnnotation(c, podName, namespace, bgShardedClusterRebalancePendingAnnotation); err != nil {
+				return err
+			}
+		case draining || (status != nil && rebalanceActive(status.State)):
+			// the running job planned without the new worker, another one follows it
+		default:
+			jobID, err := startRebalance(ctx, bgCluster.Annotations[bgShardedClusterRebalanceStrategyAnnotation], shardTransferMode(bgCluster, ""), false)
+			if err != nil {
+				return fmt.Errorf("failed to start the rebalance: %w", err)
+			}
+			if err := deleteAnnotation(c, podName, namespace, bgShardedClusterRebalancePendingAnnotation); err != nil {
+				return err
+			}
+			if jobID != 0 {
+				if status, err = rebalanceStatus(ctx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return reportRebalance(c, status)
+}
+
+// handleRebalance moves shards to balance the workers from the coordinator primary and waits
+// for the background job, replicas complete without doing anything
+func handleRebalance(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	if bgCluster.Labels[bgClusterRoleLabel] != "coordinator" {
+		return fmt.Errorf("BGCluster %s is not the coordinator of a sharded cluster", bgCluster.Name)
+	}
+	rebalanceSpec := dbOpsSpec.Rebalance
+	if rebalanceSpec == nil {
+		rebalanceSpec = &bestgresv1.RebalanceOpSpec{}
+	}
+	strategy := rebalanceSpec.Strategy
+	if strategy == "" {
+		strategy = bgCluster.Annotations[bgShardedClusterRebalanceStrategyAnnotation]
+	}
+
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		log.Println("Not the primary, the rebalance runs on the primary")
+		return nil
+	}
+
+	start := metav1.Now()
+	if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Pod = podName
+		status.StartTime = &start
+		status.Progress = ""
+	}); err != nil {
+		log.Printf("Failed to record the start of the operation: %v", err)
+	}
+
+	// Citus runs one rebalance at a time, e.g. one started for a new worker
+	status, err := rebalanceStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if status != nil && rebalanceActive(status.State) {
+		log.Printf("Waiting for rebalance job %d to finish", status.JobID)
+		if err := waitForRebalance(ctx, c, bgCluster, status.JobID, false); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("Rebalance job %d did not finish: %v", status.JobID, err)
+		}
+	}
+
+	jobID, err := startRebalance(ctx, strategy, shardTransferMode(bgCluster, rebalanceSpec.ShardTransferMode), rebalanceSpec.DrainOnly)
+	if err != nil {
+		return err
+	}
+	if jobID == 0 {
+		log.Println("The shards are balanced, nothing to move")
+		return nil
+	}
+	return waitForRebalance(ctx, c, bgCluster, jobID, true)
+}
+
+// waitForRebalance polls a rebalance job until it ended and reports its progress on the
+// BGDbOps and the pod. The job runs in the background, so once ctx is done a job the operation
+// started is cancelled rather than left moving shards.
+func waitForRebalance(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, jobID int64, owned bool) error {
+	for {
+		status, err := rebalanceStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if status == nil || status.JobID != jobID {
+			return fmt.Errorf("rebalance job %d is no longer the last rebalance", jobID)
+		}
+		if err := reportRebalance(c, status); err != nil {
+			log.Printf("Failed to report the rebalance: %v", err)
+		}
+		if err := updateBGDbOpsStatus(c, bgCluster, func(dbOpsStatus *bestgresv1.BGDbOpsStatus) {
+			dbOpsStatus.Progress = status.Progress
+		}); err != nil {
+			log.Printf("Failed to report rebalance progress: %v", err)
+		}
+
+		switch status.State {
+		case "finished":
+			log.Printf("Rebalance job %d finished", jobID)
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("rebalance job %d %s", jobID, status.State)
+		}
+		select {
+		case <-ctx.Done():
+			if owned {
+				cancelRebalance(jobID)
+			}
+			return fmt.Errorf("stopped waiting for rebalance job %d: %w", jobID, ctx.Err())
+		case <-time.After(rebalancePollInterval):
+		}
+	}
+}
+
+// cancelRebalance cancels a rebalance job, the shard moves that already finished stay
+func cancelRebalance(jobID int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	log.Printf("Cancelling rebalance job %d", jobID)
+	if _, err := queryLocalAs(ctx, patroni.CitusUser, "SELECT citus_job_cancel($1)", jobID); err != nil {
+		log.Printf("Failed to cancel rebalance job %d: %v", jobID, err)
+	}
+}
+
+// startRebalance schedules a background rebalance and returns its job id, zero when no shard
+// has to move
+func startRebalance(ctx context.Context, strategy, transferMode string, drainOnly bool) (int64, error) {
+	log.Printf("Starting a shard rebalance, moving shards with %s", transferMode)
+	ctx, cancel := context.WithTimeout(ctx, citusNodeTimeout)
+	defer cancel()
+
+	// the background tasks connect to the workers as the user that started the job
+	result, err := queryLocalAs(ctx, patroni.CitusUser,
+		"SELECT citus_rebalance_start(rebalance_strategy => NULLIF($1, '')::name, drain_only => $2, shard_transfer_mode => $3::citus.shard_transfer_mode)",
+		strategy, drainOnly, transferMode)
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Rows) == 0 {
+		return 0, nil
+	}
+	return result.Rows[0].Int64(0)
+}
+
+// rebalanceStatus returns the last rebalance job, nil when no rebalance ever ran
+func rebalanceStatus(ctx context.Context) (*bestgresv1.RebalanceStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := queryLocalAs(ctx, patroni.CitusUser,
+		"SELECT job_id, state::text, extract(epoch FROM started_at)::float8, extract(epoch FROM finished_at)::float8, coalesce(details->'task_state_counts', '{}')::text FROM citus_rebalance_status()")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the rebalance status: %w", err)
+	}
+	if len(result.Rows) == 0 {
+		return nil, nil
+	}
+	row := result.Rows[0]
+	jobID, err := row.Int64(0)
+	if err != nil {
+		return nil, err
+	}
+	status := &bestgresv1.RebalanceStatus{
+		JobID:      jobID,
+		State:      row.String(1),
+		StartedAt:  epochTime(row.Float64(2)),
+		FinishedAt: epochTime(row.Float64(3)),
+	}
+
+	var counts map[string]int64
+	if err := json.Unmarshal([]byte(row.String(4)), &counts); err != nil {
+		return nil, fmt.Errorf("invalid task state counts: %w", err)
+	}
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	if total > 0 {
+		status.Progress = fmt.Sprintf("%d/%d tasks", counts["done"], total)
+	}
+	return status, nil
+}
+
+// reportRebalance annotates the pod with the rebalance job for the operator
+func reportRebalance(c client.Client, status *bestgresv1.RebalanceStatus) error {
+	if status == nil {
+		return nil
+	}
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if checkPodAnnotation(c, podName, namespace, bgShardedClusterRebalanceAnnotation) == string(statusJSON) {
+		return nil
+	}
+	return updateAnnotation(c, podName, namespace, bgShardedClusterRebalanceAnnotation, string(statusJSON))
+}
+
+// rebalanceActive reports whether a job in the given state still moves or will move shards
+func rebalanceActive(state string) bool {
+	switch state {
+	case "scheduled", "running", "cancelling", "failing":
+		return true
+	}
+	return false
+}
+
+// shardTransferMode returns the requested mode, falling back to the one of the sharded cluster
+func shardTransferMode(bgCluster *bestgresv1.BGCluster, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if mode := bgCluster.Annotations[bgShardedClusterTransferModeAnnotation]; mode != "" {
+		return mode
+	}
+	return "auto"
+}
+
+// epochTime converts seconds since the epoch to a time, a NULL timestamp reads as zero
+func epochTime(epoch float64, err error) *metav1.Time {
+	if err != nil || epoch == 0 {
+		return nil
+	}
+	seconds, fraction := math.Modf(epoch)
+	t := metav1.NewTime(time.Unix(int64(seconds), int64(fraction*1e9)).UTC())
+	return &t
+}
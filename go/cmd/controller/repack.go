@@ -0,0 +1,261 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"bestgres/pgclient"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// repackTarget is a table of a database selected for repacking
+type repackTarget struct {
+	database string
+	table    string
+}
+
+// handleRepack rebuilds the requested or bloated tables with pg_repack on the primary
+func handleRepack(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	repackSpec := dbOpsSpec.Repack
+	if repackSpec == nil {
+		repackSpec = &bestgresv1.RepackSpec{}
+	}
+	if repackSpec.BloatThreshold == 0 {
+		repackSpec.BloatThreshold = 20
+	}
+
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		log.Println("Not the primary, nothing to repack")
+		return nil
+	}
+
+	start := metav1.Now()
+	if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Pod = podName
+		status.StartTime = &start
+		status.Progress = ""
+		status.Tables = nil
+	}); err != nil {
+		log.Printf("Failed to record the start of the operation: %v", err)
+	}
+
+	databases := repackSpec.Databases
+	if len(databases) == 0 {
+		databases, err = listDatabases(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// collect the tables first so progress can be reported against a total
+	var results []bestgresv1.TableResult
+	var targets []repackTarget
+	for _, database := range databases {
+		tables, err := repackTables(ctx, database, repackSpec)
+		if err != nil {
+			log.Printf("Skipping database %s: %v", database, err)
+			results = append(results, bestgresv1.TableResult{Database: database, Result: bestgresv1.TableResultFailed, Message: err.Error()})
+			continue
+		}
+		for _, table := range tables {
+			targets = append(targets, repackTarget{database: database, table: table})
+		}
+	}
+	log.Printf("Repacking %d tables", len(targets))
+
+	binary, err := postgresBinary(ctx, "pg_repack")
+	if err != nil {
+		return err
+	}
+
+	for i, target := range targets {
+		result := repackTable(ctx, binary, target, repackSpec)
+		results = append(results, result)
+		progress := fmt.Sprintf("%d/%d tables", i+1, len(targets))
+		if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+			status.Progress = progress
+			status.Tables = results
+		}); err != nil {
+			log.Printf("Failed to report repack progress: %v", err)
+		}
+	}
+
+	return updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Progress = fmt.Sprintf("%d/%d tables", len(targets), len(targets))
+		status.Tables = results
+	})
+}
+
+// repackTables makes sure pg_repack is usable in the database and returns the tables to repack
+func repackTables(ctx context.Context, database string, repackSpec *bestgresv1.RepackSpec) ([]string, error) {
+	conn, err := connectLocal(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := ensureRepackExtension(ctx, conn, repackSpec.CreateExtension); err != nil {
+		return nil, err
+	}
+
+	if len(repackSpec.Tables) > 0 {
+		var tables []string
+		for _, table := range repackSpec.Tables {
+			// resolve the name through regclass so it's safely quoted for pg_repack
+			row, err := conn.QueryRow(ctx, "SELECT to_regclass($1)::text", table)
+			if err != nil {
+				return nil, err
+			}
+			if row.IsNull(0) {
+				return nil, fmt.Errorf("table %s not found", table)
+			}
+			tables = append(tables, row.String(0))
+		}
+		return tables, nil
+	}
+
+	result, err := conn.Query(ctx, `SELECT relid::regclass::text
+		FROM pg_stat_user_tables
+		WHERE n_live_tup + n_dead_tup > 0
+		  AND n_dead_tup * 100 >= $1 * (n_live_tup + n_dead_tup)
+		ORDER BY pg_total_relation_size(relid) DESC`, repackSpec.BloatThreshold)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find bloated tables: %w", err)
+	}
+	var tables []string
+	for _, row := range result.Rows {
+		tables = append(tables, row.String(0))
+	}
+	return tables, nil
+}
+
+// ensureRepackExtension checks the pg_repack extension is installed, creating it if allowed
+func ensureRepackExtension(ctx context.Context, conn *pgclient.Conn, create bool) error {
+	row, err := conn.QueryRow(ctx, `SELECT
+		EXISTS (SELECT FROM pg_extension WHERE extname = 'pg_repack'),
+		EXISTS (SELECT FROM pg_available_extensions WHERE name = 'pg_repack')`)
+	if err != nil {
+		return err
+	}
+	installed, available := row.Bool(0), row.Bool(1)
+
+	switch {
+	case installed:
+		return nil
+	case !available:
+		return fmt.Errorf("the image does not ship the pg_repack extension")
+	case !create:
+		return fmt.Errorf("the pg_repack extension is not installed, set repack.createExtension to create it")
+	}
+
+	log.Println("Creating the pg_repack extension")
+	if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS pg_repack"); err != nil {
+		return fmt.Errorf("failed to create the pg_repack extension: %w", err)
+	}
+	return nil
+}
+
+// repackTable runs pg_repack on a single table and measures its size before and after
+func repackTable(ctx context.Context, binary string, target repackTarget, repackSpec *bestgresv1.RepackSpec) bestgresv1.TableResult {
+	result := bestgresv1.TableResult{Database: target.database, Table: target.table}
+
+	sizeBefore, err := tableSize(ctx, target)
+	if err != nil {
+		result.Result = bestgresv1.TableResultFailed
+		result.Message = err.Error()
+		return result
+	}
+	result.SizeBeforeBytes = sizeBefore
+
+	args := []string{
+		"--host", localDBConfig("postgres").Host,
+		"--username", "postgres",
+		"--dbname", target.database,
+		"--table", target.table,
+		"--wait-timeout", "60",
+	}
+	if repackSpec.Jobs != nil {
+		args = append(args, "--jobs", fmt.Sprint(*repackSpec.Jobs))
+	}
+
+	log.Printf("Repacking %s.%s", target.database, target.table)
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+passwordForUser("postgres"))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = runWaited(cmd)
+	result.Duration = metav1.Duration{Duration: time.Since(start).Round(time.Millisecond)}
+	if err != nil {
+		result.Result = bestgresv1.TableResultFailed
+		result.Message = lastLine(output.String(), err)
+		log.Printf("Failed to repack %s.%s: %s", target.database, target.table, result.Message)
+		return result
+	}
+
+	result.Result = bestgresv1.TableResultSucceeded
+	if sizeAfter, err := tableSize(ctx, target); err == nil {
+		result.SizeAfterBytes = sizeAfter
+	}
+	log.Printf("Repacked %s.%s from %d to %d bytes", target.database, target.table, result.SizeBeforeBytes, result.SizeAfterBytes)
+	return result
+}
+
+// tableSize returns the size of a table including its indexes and toast
+func tableSize(ctx context.Context, target repackTarget) (int64, error) {
+	conn, err := connectLocal(ctx, target.database)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	row, err := conn.QueryRow(ctx, "SELECT pg_total_relation_size($1::regclass)", target.table)
+	if err != nil {
+		return 0, err
+	}
+	return row.Int64(0)
+}
+
+// postgresBinary finds a client program matching the running server version, the image
+// may ship several postgres versions
+func postgresBinary(ctx context.Context, name string) (string, error) {
+	result, err := queryLocal(ctx, "SELECT current_setting('server_version_num')::int / 10000")
+	if err == nil && len(result.Rows) > 0 {
+		path := fmt.Sprintf("/usr/lib/postgresql/%s/bin/%s", result.Rows[0].String(0), name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("the image does not ship %s: %w", name, err)
+	}
+	return path, nil
+}
+
+// lastLine returns the last non-empty line of a command's output, or the error if there is none
+func lastLine(output string, err error) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return err.Error()
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// bgDbOpsRestartedAnnotation is set on the pod to the restart operation it restarted for, the
+// restart completes once the member is healthy again
+const bgDbOpsRestartedAnnotation = "bgdbops.bestgres.io/restarted"
+
+// handleRestart restarts the members one at a time: the replicas in name order, each waiting
+// for the previous one to stream again, then the leader switches over to a healthy replica and
+// restarts last. Postgres is restarted through Patroni unless the restart is forced, which
+// recreates the pod. It's called on every loop until the pod completed the restart.
+func handleRestart(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	bgDbOpsName := bgCluster.Annotations[bgDbOpsInProgressAnnotation]
+	if checkPodAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation) == "true" {
+		return recordRestart(c, bgDbOpsName)
+	}
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	restartSpec := dbOpsSpec.Restart
+	if restartSpec == nil {
+		restartSpec = &bestgresv1.RestartSpec{}
+	}
+
+	statusCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	local := patroni.NewClient("localhost")
+	status, err := local.Status(statusCtx)
+	if err != nil {
+		log.Printf("Waiting for Patroni to restart: %v", err)
+		return nil
+	}
+
+	if checkPodAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation) == bgDbOpsName {
+		if !memberHealthy(status) {
+			log.Printf("Waiting for the member to be healthy again, state %s %s", status.State, status.ReplicationState)
+			return nil
+		}
+		log.Println("Member restarted")
+		return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+	}
+	if restartSpec.PendingRestartOnly && !status.PendingRestart {
+		log.Println("No restart pending, nothing to restart")
+		return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+	}
+
+	cluster, err := local.Cluster(statusCtx)
+	if err != nil {
+		return fmt.Errorf("failed to get Patroni cluster: %w", err)
+	}
+	cluster = patroni.ClusterFor(bgCluster, cluster)
+	sort.Slice(cluster.Members, func(i, j int) bool { return cluster.Members[i].Name < cluster.Members[j].Name })
+
+	if status.IsLeader() {
+		for _, member := range cluster.Members {
+			if member.Name != podName && !restartCompleted(c, member.Name) {
+				log.Printf("Waiting for replica %s to restart before the leader", member.Name)
+				return nil
+			}
+		}
+		if replica := cluster.HealthiestReplica(); replica != "" {
+			log.Printf("Switching over to %s before restarting", replica)
+			if err := local.Switchover(ctx, podName, replica); err != nil {
+				return fmt.Errorf("failed to switch over to %s: %w", replica, err)
+			}
+			// the member restarts as a replica on the next loop
+			return nil
+		}
+		log.Println("No healthy replica to switch over to, restarting the leader")
+	} else {
+		for _, member := range cluster.Members {
+			if member.Name == podName {
+				break
+			}
+			if !member.IsLeader() && !restartCompleted(c, member.Name) {
+				log.Printf("Waiting for replica %s to restart first", member.Name)
+				return nil
+			}
+		}
+	}
+
+	if restartSpec.Force {
+		// the new pod marks the restart when it comes back up
+		log.Printf("Handling restart operation for %s by recreating the pod", bgCluster.Name)
+		if err := stopPatroni(); err != nil {
+			return err
+		}
+		deletePod(c, podName, namespace)
+		return nil
+	}
+	log.Printf("Restarting postgres of %s through Patroni", bgCluster.Name)
+	if err := local.Restart(ctx, restartSpec.PendingRestartOnly); err != nil {
+		return fmt.Errorf("failed to restart postgres: %w", err)
+	}
+	return updateAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation, bgDbOpsName)
+}
+
+// stopPatroni stops Patroni through runit, which shuts postgres down cleanly before the pod is
+// deleted, and makes sure postgres is gone
+func stopPatroni() error {
+	var output bytes.Buffer
+	cmd := exec.Command("sv", "-w", strconv.Itoa(int(postgresStopTimeout.Seconds())), "stop", "patroni")
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := runWaited(cmd); err != nil {
+		return fmt.Errorf("failed to stop Patroni: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+	return stopPostgres(postgresStopTimeout)
+}
+
+// recreatedForBGDbOps reports whether the pod was recreated by the operation in progress, a
+// restart or the last steps of an upgrade
+func recreatedForBGDbOps(bgCluster *bestgresv1.BGCluster) bool {
+	if checkAnnotation(bgCluster, bgDbOpsPendingAnnotation) != "true" {
+		return false
+	}
+	op := checkAnnotation(bgCluster, bgDbOpsOpAnnotation)
+	return op == "restart" || op == "upgrade"
+}
+
+// memberHealthy reports whether the member runs again, replicas also have to stream from the
+// leader. Patroni before 3.0 doesn't report the replication state.
+func memberHealthy(status *patroni.Status) bool {
+	if status.State != "running" {
+		return false
+	}
+	return status.IsLeader() || status.ReplicationState == "" || status.ReplicationState == "streaming"
+}
+
+// restartCompleted reports whether the pod of a member completed the restart
+func restartCompleted(c client.Client, member string) bool {
+	return checkPodAnnotation(c, member, namespace, bgDbOpsCompletedAnnotation) == "true"
+}
+
+// recordRestart records on the BGDbOps that this pod completed the restart
+func recordRestart(c client.Client, bgDbOpsName string) error {
+	bgDbOps := &bestgresv1.BGDbOps{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Name: bgDbOpsName, Namespace: namespace}, bgDbOps); err != nil {
+		return fmt.Errorf("failed to get BGDbOps: %v", err)
+	}
+	podCompletedAnnotation := "bgcluster.bestgres.io/" + podName
+	if bgDbOps.Annotations[podCompletedAnnotation] == "true" {
+		return nil
+	}
+	if bgDbOps.Annotations == nil {
+		bgDbOps.Annotations = make(map[string]string)
+	}
+	bgDbOps.Annotations[podCompletedAnnotation] = "true"
+	if err := c.Update(context.TODO(), bgDbOps); err != nil {
+		return fmt.Errorf("failed to update BGDbOps: %v", err)
+	}
+	return nil
+}
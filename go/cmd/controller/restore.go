@@ -0,0 +1,255 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/backup"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// restoreConfigFile holds the restore source and its environment for the restore-backup
+	// and restore-wal commands Patroni runs during the custom bootstrap
+	restoreConfigFile = "/app/restore.json"
+
+	// bgClusterRecoveryAnnotation is set on the restored member once it was promoted, it holds
+	// a RecoveryStatus as JSON for the operator to report
+	bgClusterRecoveryAnnotation = "bgcluster.bestgres.io/recovery"
+)
+
+type restoreConfig struct {
+	Method   string                     `json:"method"`
+	Env      map[string]string          `json:"env"`
+	BackupID string                     `json:"backupId,omitempty"`
+	Target   *bestgresv1.RecoveryTarget `json:"target,omitempty"`
+	// Path is the directory of filesystem storage, its checksums are verified before restoring
+	Path string `json:"path,omitempty"`
+}
+
+// isRestoring reports whether the cluster is bootstrapped from a backup and didn't complete
+// its bootstrap yet
+func isRestoring(bgCluster *bestgresv1.BGCluster) bool {
+	return bgCluster.Spec.Bootstrap != nil && bgCluster.Spec.Bootstrap.Recovery != nil &&
+		checkAnnotation(bgCluster, bgClusterInitializedAnnotation) != "true"
+}
+
+// writeRestoreConfig writes the source the operator resolved for the custom bootstrap, it is
+// removed once the cluster is initialized
+func writeRestoreConfig(bgCluster *bestgresv1.BGCluster) error {
+	sourceJSON := os.Getenv(backup.RestoreSourceEnv)
+	if !isRestoring(bgCluster) || sourceJSON == "" {
+		if err := os.Remove(restoreConfigFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	source := backup.Source{}
+	if err := json.Unmarshal([]byte(sourceJSON), &source); err != nil {
+		return fmt.Errorf("invalid %s: %w", backup.RestoreSourceEnv, err)
+	}
+	env, err := source.Env(dataDirectory())
+	if err != nil {
+		return err
+	}
+	config := restoreConfig{
+		Method:   source.Method,
+		Env:      env,
+		BackupID: source.BackupID,
+		Target:   bgCluster.Spec.Bootstrap.Recovery.Target,
+	}
+	if source.Storage.Filesystem != nil {
+		config.Path = source.Path()
+	}
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	changed, err := writePostgresFile(restoreConfigFile, content)
+	if changed {
+		log.Printf("Wrote the restore configuration for %s backups of %s", source.Method, source.Cluster)
+	}
+	return err
+}
+
+// readRestoreConfig reads the configuration written by writeRestoreConfig
+func readRestoreConfig() (*restoreConfig, error) {
+	content, err := os.ReadFile(restoreConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the restore configuration: %w", err)
+	}
+	config := &restoreConfig{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("invalid restore configuration: %w", err)
+	}
+	return config, nil
+}
+
+// RestoreBackup is the command of the Patroni custom bootstrap, it restores the base backup
+// into the data directory Patroni passes with --datadir. Patroni replays WAL afterwards.
+func RestoreBackup(args []string) int {
+	dataDir := ""
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--datadir=") {
+			dataDir = strings.TrimPrefix(arg, "--datadir=")
+		}
+	}
+	if dataDir == "" {
+		log.Println("usage: restore-backup --datadir=<path>")
+		return 2
+	}
+	config, err := readRestoreConfig()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	target := backup.Target{Method: config.Method}
+	// the data directory Patroni restores into may differ from the one in the environment
+	env := map[string]string{}
+	for key, value := range config.Env {
+		env[key] = value
+	}
+	env["PGDATA"] = dataDir
+	env["PGBACKREST_PG1_PATH"] = dataDir
+
+	// the storage is mounted read-only, the manifest is checked but not updated
+	if config.Path != "" {
+		verification, err := backup.VerifyChecksums(config.Path, true)
+		if err != nil {
+			log.Printf("Failed to verify the backup checksums: %v", err)
+			return 1
+		}
+		if len(verification.Corrupt) > 0 {
+			log.Printf("Refusing to restore, %d files in the backup storage fail their checksum: %s", len(verification.Corrupt), strings.Join(verification.Corrupt, ", "))
+			return 1
+		}
+		log.Printf("Verified the checksums of %d files in %s", verification.Verified, config.Path)
+	}
+
+	backupID := config.BackupID
+	if backupID == "" {
+		output, err := runBackupTool(context.Background(), env, target.ListCommand())
+		if err != nil {
+			log.Printf("Failed to list the backups: %v", err)
+			return 1
+		}
+		backups, err := target.ParseBackupList(output)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		selected, err := backup.SelectBackup(backups, config.Target)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		backupID = selected.ID
+	}
+
+	log.Printf("Restoring backup %s into %s", backupID, dataDir)
+	if err := runForPostgres(env, target.RestoreCommand(backupID, dataDir)); err != nil {
+		log.Printf("Failed to restore backup %s: %v", backupID, err)
+		return exitCode(err)
+	}
+	// the restored backup is reported once the member was promoted
+	if err := os.WriteFile(restoredBackupFile(dataDir), []byte(backupID), 0600); err != nil {
+		log.Printf("Failed to record the restored backup: %v", err)
+	}
+	return 0
+}
+
+// RestoreWAL is the restore_command of the restored member, it fetches the WAL file args[0]
+// into args[1]. A missing file ends recovery, which postgres learns from the exit code.
+func RestoreWAL(args []string) int {
+	if len(args) != 2 {
+		log.Println("usage: restore-wal <file> <path>")
+		return 2
+	}
+	config, err := readRestoreConfig()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	target := backup.Target{Method: config.Method}
+	if err := runForPostgres(config.Env, target.WALFetchCommand(args[0], args[1])); err != nil {
+		return exitCode(err)
+	}
+	return 0
+}
+
+// restoredBackupFile records the backup that was restored next to the data directory, the
+// data directory itself is replaced by the restore
+func restoredBackupFile(dataDir string) string {
+	return filepath.Join(filepath.Dir(dataDir), "restored-backup")
+}
+
+// reportRecovery records where WAL replay stopped on the restored member once it was
+// promoted, replicas of the restored cluster report nothing
+func reportRecovery(c client.Client) error {
+	if checkPodAnnotation(c, podName, namespace, bgClusterRecoveryAnnotation) != "" {
+		return nil
+	}
+	content, err := os.ReadFile(restoredBackupFile(dataDirectory()))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for {
+		primary, err := isLocalPrimary()
+		if err != nil {
+			return err
+		}
+		if primary {
+			break
+		}
+		log.Println("Waiting for the restored member to reach the recovery target")
+		time.Sleep(10 * time.Second)
+	}
+
+	result, err := queryLocal(ctx, "SELECT pg_last_wal_replay_lsn()::text, extract(epoch FROM pg_last_xact_replay_timestamp())::float8, ('x' || substr(pg_walfile_name(pg_current_wal_lsn()), 1, 8))::bit(32)::int8")
+	if err != nil {
+		return err
+	}
+	if len(result.Rows) == 0 {
+		return fmt.Errorf("recovery query returned no rows")
+	}
+	row := result.Rows[0]
+	promotionTime := metav1.Now()
+	recovery := bestgresv1.RecoveryStatus{
+		Phase:         bestgresv1.RecoveryPhasePromoted,
+		BackupID:      strings.TrimSpace(string(content)),
+		ReplayedLSN:   row.String(0),
+		PromotionTime: &promotionTime,
+	}
+	if !row.IsNull(1) {
+		if epoch, err := row.Float64(1); err == nil {
+			seconds, fraction := math.Modf(epoch)
+			replayed := metav1.NewTime(time.Unix(int64(seconds), int64(fraction*1e9)).UTC())
+			recovery.LastReplayedTransactionTime = &replayed
+		}
+	}
+	if timeline, err := row.Int64(2); err == nil {
+		recovery.Timeline = timeline
+	}
+
+	recoveryJSON, err := json.Marshal(recovery)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored backup %s, replayed WAL up to %s and promoted", recovery.BackupID, recovery.ReplayedLSN)
+	return updateAnnotation(c, podName, namespace, bgClusterRecoveryAnnotation, string(recoveryJSON))
+}
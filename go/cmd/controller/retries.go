@@ -0,0 +1,136 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// bgDbOpsAttemptsAnnotation holds the BGDbOpsAttempts of this pod as JSON
+	bgDbOpsAttemptsAnnotation = "bgdbops.bestgres.io/attempts"
+	// bgDbOpsDeadlineAnnotation is set by the operator on the BGCluster to the time the
+	// operation in progress runs out of time
+	bgDbOpsDeadlineAnnotation = "bgdbops.bestgres.io/deadline"
+	// bgDbOpsCancelAnnotation is set by the operator on the BGCluster to the operation it gave
+	// up on, the pods confirm with bgDbOpsCancelledAnnotation that they no longer run it
+	bgDbOpsCancelAnnotation    = "bgdbops.bestgres.io/cancel"
+	bgDbOpsCancelledAnnotation = "bgdbops.bestgres.io/cancelled"
+
+	// the backoff between attempts doubles from bgDbOpsInitialBackoff up to bgDbOpsMaxBackoff
+	bgDbOpsInitialBackoff = 10 * time.Second
+	bgDbOpsMaxBackoff     = 5 * time.Minute
+)
+
+// runBgDbOps runs the pending operation unless this pod is backing off or gave up on it,
+// failed attempts are recorded on the pod for the operator to pick up
+func runBgDbOps(bgCluster *bestgresv1.BGCluster, c client.Client) {
+	bgDbOpsName := bgCluster.Annotations[bgDbOpsInProgressAnnotation]
+	// past the point of no return an upgrade is carried through whatever goes wrong
+	irreversible := upgradeIrreversible(c, bgCluster)
+	if !irreversible && bgCluster.Annotations[bgDbOpsCancelAnnotation] == bgDbOpsName {
+		// the loop only gets here between two runs of the operation
+		if checkPodAnnotation(c, podName, namespace, bgDbOpsCancelledAnnotation) != bgDbOpsName {
+			log.Printf("BGDbOps %s was cancelled", bgDbOpsName)
+			if err := updateAnnotation(c, podName, namespace, bgDbOpsCancelledAnnotation, bgDbOpsName); err != nil {
+				log.Printf("Failed to confirm the cancellation of BGDbOps %s: %v", bgDbOpsName, err)
+			}
+		}
+		return
+	}
+	if irreversible {
+		if err := handleBgDbOps(context.Background(), bgCluster, c); err != nil {
+			log.Printf("Failed to handle BGDbOps, retrying as the upgrade can't be rolled back: %v", err)
+		}
+		return
+	}
+	attempts := podAttempts(c, bgDbOpsName)
+	if attempts.Failed {
+		return
+	}
+	if attempts.NextAttempt != nil && time.Now().Before(attempts.NextAttempt.Time) {
+		return
+	}
+
+	ctx, cancel := bgDbOpsContext(bgCluster)
+	defer cancel()
+	if ctx.Err() != nil {
+		// the operator cancels the operation once it sees it ran out of time
+		return
+	}
+	err := handleBgDbOps(ctx, bgCluster, c)
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to handle BGDbOps: %v", err)
+
+	maxRetries := 0
+	if dbOpsSpec, specErr := parseBGDbOpsSpec(bgCluster.Annotations[bgDbOpsSpecAnnotation]); specErr == nil {
+		maxRetries = dbOpsSpec.MaxRetries
+	}
+	attempts.Attempts++
+	attempts.LastError = err.Error()
+	if attempts.Attempts > maxRetries {
+		log.Printf("BGDbOps %s failed after %d attempts", bgDbOpsName, attempts.Attempts)
+		attempts.Failed = true
+		attempts.NextAttempt = nil
+	} else {
+		next := metav1.NewTime(time.Now().Add(bgDbOpsBackoff(attempts.Attempts)))
+		log.Printf("Retrying BGDbOps %s at %s (retry %d/%d)", bgDbOpsName, next.Format(time.RFC3339), attempts.Attempts, maxRetries)
+		attempts.NextAttempt = &next
+	}
+
+	attemptsJSON, err := json.Marshal(attempts)
+	if err != nil {
+		log.Printf("Failed to marshal BGDbOps attempts: %v", err)
+		return
+	}
+	if err := updateAnnotation(c, podName, namespace, bgDbOpsAttemptsAnnotation, string(attemptsJSON)); err != nil {
+		log.Printf("Failed to record BGDbOps attempt: %v", err)
+	}
+}
+
+// bgDbOpsContext returns the context the operation runs in, it ends at the deadline of the
+// operation so the statements and tools it runs stop with it
+func bgDbOpsContext(bgCluster *bestgresv1.BGCluster) (context.Context, context.CancelFunc) {
+	if value := bgCluster.Annotations[bgDbOpsDeadlineAnnotation]; value != "" {
+		deadline, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			return context.WithDeadline(context.Background(), deadline)
+		}
+		log.Printf("Ignoring invalid %s annotation: %v", bgDbOpsDeadlineAnnotation, err)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// podAttempts returns the attempts of this pod at the given operation, attempts at earlier
+// operations are ignored
+func podAttempts(c client.Client, bgDbOpsName string) bestgresv1.BGDbOpsAttempts {
+	attempts := bestgresv1.BGDbOpsAttempts{}
+	if value := checkPodAnnotation(c, podName, namespace, bgDbOpsAttemptsAnnotation); value != "" {
+		if err := json.Unmarshal([]byte(value), &attempts); err != nil {
+			log.Printf("Ignoring invalid %s annotation: %v", bgDbOpsAttemptsAnnotation, err)
+		}
+	}
+	if attempts.BGDbOps != bgDbOpsName {
+		return bestgresv1.BGDbOpsAttempts{BGDbOps: bgDbOpsName}
+	}
+	return attempts
+}
+
+// bgDbOpsBackoff returns how long to wait after the given number of failed attempts
+func bgDbOpsBackoff(attempts int) time.Duration {
+	backoff := bgDbOpsInitialBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= bgDbOpsMaxBackoff {
+			return bgDbOpsMaxBackoff
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// bgClusterShutdownAnnotation is set on the BGCluster by the operator when the cluster is
+	// deleted, pods report a clean stop by setting it to "completed" on themselves
+	bgClusterShutdownAnnotation = "bgcluster.bestgres.io/shutdown"
+	shutdownCompleted           = "completed"
+
+	// postgresStopTimeout is how long a fast shutdown may take
+	postgresStopTimeout = time.Minute
+)
+
+// handleShutdown stops postgres for the deletion of the cluster. Patroni is paused by the
+// operator beforehand so it leaves the stopped postgres alone.
+func handleShutdown(c client.Client) {
+	if checkPodAnnotation(c, podName, namespace, bgClusterShutdownAnnotation) == shutdownCompleted {
+		return
+	}
+
+	// a checkpoint up front keeps the shutdown checkpoint short
+	if primary, err := isLocalPrimary(); err != nil {
+		log.Printf("Failed to check the role of this member: %v", err)
+	} else if primary {
+		log.Println("Running a checkpoint before shutdown")
+		if err := runSQLCommand(1, 0, "CHECKPOINT"); err != nil {
+			log.Printf("Checkpoint failed: %v", err)
+		}
+	}
+
+	if err := stopPostgres(postgresStopTimeout); err != nil {
+		log.Printf("Failed to stop postgres: %v", err)
+		return
+	}
+	log.Println("Postgres stopped")
+	if err := updateAnnotation(c, podName, namespace, bgClusterShutdownAnnotation, shutdownCompleted); err != nil {
+		log.Printf("Postgres stopped but annotation not updated for Pod: %v", err)
+	}
+}
+
+// stopPostgres requests a fast shutdown from the postmaster and waits for it to remove its pid
+// file, which it does once the shutdown checkpoint is written
+func stopPostgres(timeout time.Duration) error {
+	pidFile := filepath.Join(dataDirectory(), "postmaster.pid")
+	content, err := os.ReadFile(pidFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", pidFile, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0]))
+	if err != nil {
+		return fmt.Errorf("invalid pid in %s: %w", pidFile, err)
+	}
+
+	log.Printf("Stopping postgres (pid %d)", pid)
+	if err := syscall.Kill(pid, syscall.SIGINT); err != nil {
+		if err == syscall.ESRCH {
+			return nil
+		}
+		return fmt.Errorf("failed to signal postgres: %w", err)
+	}
+
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if _, err := os.Stat(pidFile); os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("postgres did not stop within %s", timeout)
+}
+
+// dataDirectory returns the postgres data directory Spilo uses
+func dataDirectory() string {
+	if pgdata := os.Getenv("PGDATA"); pgdata != "" {
+		return pgdata
+	}
+	pgroot := os.Getenv("PGROOT")
+	if pgroot == "" {
+		pgroot = "/home/postgres/pgdata/pgroot"
+	}
+	return filepath.Join(pgroot, "data")
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// memberSlotsChecked is the membership the slots were last checked for, see memberSlotsKey
+var memberSlotsChecked string
+
+// dropRemovedMemberSlots drops the replication slots the primary kept for the instances a
+// scale down removed. Patroni keeps its members on their pods, so their entries go with the
+// pods, but the slots stay and hold back WAL. Only inactive slots of ordinals at or above
+// spec.instances whose pod is gone are dropped, a scale up creates them again. The slots are
+// only checked on the primary and when the membership changed since they were last checked
+// with nothing left to drop.
+func dropRemovedMemberSlots(bgCluster *bestgresv1.BGCluster, c client.Client) error {
+	if checkAnnotation(bgCluster, bgClusterInitializedAnnotation) != "true" || bgCluster.Status.Primary != podName {
+		return nil
+	}
+	key := memberSlotsKey(bgCluster)
+	if key == memberSlotsChecked {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := queryLocal(ctx, `SELECT slot_name, active FROM pg_replication_slots
+		WHERE slot_type = 'physical' AND NOT pg_is_in_recovery()`)
+	if err != nil {
+		return fmt.Errorf("failed to list the replication slots: %w", err)
+	}
+	prefix := memberSlotName(bgCluster.Name + "-")
+	pending := false
+	for _, row := range result.Rows {
+		slot := row.String(0)
+		suffix, ok := strings.CutPrefix(slot, prefix)
+		if !ok {
+			continue
+		}
+		ordinal, err := strconv.ParseInt(suffix, 10, 32)
+		if err != nil || int32(ordinal) < bgCluster.Spec.Instances {
+			continue
+		}
+		member := fmt.Sprintf("%s-%d", bgCluster.Name, ordinal)
+		if row.Bool(1) {
+			// the removed member still streams
+			pending = true
+			continue
+		}
+		err = c.Get(ctx, types.NamespacedName{Name: member, Namespace: namespace}, &corev1.Pod{})
+		if !errors.IsNotFound(err) {
+			pending = true
+			continue
+		}
+		log.Printf("Dropping replication slot %s of the removed member %s", slot, member)
+		if _, err := queryLocal(ctx, "SELECT pg_drop_replication_slot($1)", slot); err != nil {
+			return fmt.Errorf("failed to drop replication slot %s: %w", slot, err)
+		}
+	}
+	if !pending {
+		memberSlotsChecked = key
+	}
+	return nil
+}
+
+// memberSlotsKey sums up what decides which slots are dropped: the primary, spec.instances
+// and the members Patroni reports
+func memberSlotsKey(bgCluster *bestgresv1.BGCluster) string {
+	members := make([]string, 0, len(bgCluster.Status.Members))
+	for _, member := range bgCluster.Status.Members {
+		members = append(members, member.Name)
+	}
+	sort.Strings(members)
+	return fmt.Sprintf("%s/%d/%s", bgCluster.Status.Primary, bgCluster.Spec.Instances, strings.Join(members, ","))
+}
+
+// memberSlotName returns the name Patroni gives the replication slot of a member, pod names
+// only contain lowercase alphanumerics, dashes and dots
+func memberSlotName(member string) string {
+	return strings.NewReplacer("-", "_", ".", "_").Replace(member)
+}
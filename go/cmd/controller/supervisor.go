@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownGracePeriod is used when SHUTDOWN_GRACE_PERIOD is not set
+const defaultShutdownGracePeriod = 60 * time.Second
+
+var (
+	// waitedPids are the commands the controller runs and waits for itself through os/exec,
+	// waitedMu keeps reapOrphans from reaping one before its pid is recorded
+	waitedMu   sync.Mutex
+	waitedPids = map[int]bool{}
+)
+
+// supervise makes the controller the init process of the container: it forwards SIGTERM and
+// SIGINT to the process group of the main command, kills the group once the grace period is
+// over, reaps orphaned processes and exits with the exit status of the main command
+func supervise(cmd *exec.Cmd) {
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGCHLD)
+
+	exited := make(chan int, 1)
+	go func() {
+		exited <- waitForExit(cmd)
+	}()
+
+	gracePeriod := shutdownGracePeriod()
+	var deadline <-chan time.Time
+	for {
+		select {
+		case code := <-exited:
+			log.Printf("Main command exited with status %d", code)
+			reapOrphans(cmd.Process.Pid)
+			os.Exit(code)
+		case sig := <-signals:
+			if sig == syscall.SIGCHLD {
+				reapOrphans(cmd.Process.Pid)
+				continue
+			}
+			log.Printf("Received %s, forwarding to the main command", sig)
+			if err := syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal)); err != nil {
+				log.Printf("Failed to forward %s: %v", sig, err)
+			}
+			if deadline == nil {
+				deadline = time.After(gracePeriod)
+			}
+		case <-deadline:
+			log.Printf("Main command still running after %s, killing it", gracePeriod)
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+				log.Printf("Failed to kill the main command: %v", err)
+			}
+		}
+	}
+}
+
+// waitForExit waits for the command and returns its exit status, 128 plus the signal number
+// when it was killed by a signal like a shell does
+func waitForExit(cmd *exec.Cmd) int {
+	err := cmd.Wait()
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	log.Printf("Failed to wait for the main command: %v", err)
+	return 1
+}
+
+// reapOrphans waits for the exited processes that were re-parented to the controller. The
+// commands the controller runs itself through runWaited are left to os/exec.
+func reapOrphans(mainPid int) {
+	self := os.Getpid()
+	waitedMu.Lock()
+	defer waitedMu.Unlock()
+
+	entries, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		pid, ppid, state, ok := readProcStat(entry)
+		if !ok || ppid != self || state != "Z" || pid == mainPid || waitedPids[pid] {
+			continue
+		}
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err != nil {
+			log.Printf("Failed to reap process %d: %v", pid, err)
+		}
+	}
+}
+
+// runWaited runs cmd and waits for it like cmd.Run, the supervisor doesn't reap it meanwhile
+func runWaited(cmd *exec.Cmd) error {
+	waitedMu.Lock()
+	err := cmd.Start()
+	if err == nil {
+		waitedPids[cmd.Process.Pid] = true
+	}
+	waitedMu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	waitedMu.Lock()
+	delete(waitedPids, cmd.Process.Pid)
+	waitedMu.Unlock()
+	return err
+}
+
+// readProcStat reads the pid, parent pid and state from a /proc/<pid>/stat file
+func readProcStat(path string) (pid, ppid int, state string, ok bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	// the command name is in parentheses and may contain spaces, the fields follow the last one
+	end := bytes.LastIndexByte(content, ')')
+	if end < 0 {
+		return 0, 0, "", false
+	}
+	fields := strings.Fields(string(content[end+1:]))
+	if len(fields) < 2 {
+		return 0, 0, "", false
+	}
+	pid, err = strconv.Atoi(strings.Fields(string(content[:end]))[0])
+	if err != nil {
+		return 0, 0, "", false
+	}
+	ppid, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, "", false
+	}
+	return pid, ppid, fields[0], true
+}
+
+// shutdownGracePeriod returns how long the main command may take to stop after a signal
+func shutdownGracePeriod() time.Duration {
+	value := os.Getenv("SHUTDOWN_GRACE_PERIOD")
+	if value == "" {
+		return defaultShutdownGracePeriod
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		log.Printf("Invalid SHUTDOWN_GRACE_PERIOD %q, using %s", value, defaultShutdownGracePeriod)
+		return defaultShutdownGracePeriod
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,909 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+	"bestgres/pgclient"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// bgDbOpsUpgradeAnnotation tracks a replica through an upgrade: stopped once its postgres
+	// is down, wiped once its data directory was removed so the recreated pod rebuilds it
+	bgDbOpsUpgradeAnnotation = "bgdbops.bestgres.io/upgrade"
+	upgradeStopped           = "stopped"
+	upgradeWiped             = "wiped"
+
+	// upgradeSpaceMargin is the free space the volume needs on top of the system catalogs,
+	// pg_upgrade --link only writes the catalogs and a little WAL of the new cluster
+	upgradeSpaceMargin = 512 << 20
+
+	// upgradeResumeTimeout is how long a recreated primary waits for Patroni to resume it
+	upgradeResumeTimeout = 2 * time.Minute
+)
+
+// handleUpgrade upgrades the cluster to a new major version. The primary runs the pre-flight
+// checks, pauses Patroni and waits for the replicas to stop postgres before it runs pg_upgrade
+// --link into a new data directory, which replaces the old one once pg_upgrade succeeded. Any
+// failure up to there rolls back to the old data directory and resumes Patroni. Past that
+// point the operator moves the cluster onto the new binaries, the replicas remove their data
+// directories and every pod is recreated, the primary last. The replicas are rebuilt from the
+// upgraded primary. The phases are recorded on the BGDbOps as the pods don't outlive them.
+func handleUpgrade(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	upgradeSpec := dbOpsSpec.Upgrade
+	if upgradeSpec == nil {
+		return fmt.Errorf("upgrade operation without upgrade details")
+	}
+	bgDbOps, err := getBGDbOps(c, bgCluster)
+	if err != nil {
+		return err
+	}
+	result := bgDbOps.Status.UpgradeResult
+	if result == nil {
+		result = &bestgresv1.UpgradeResult{}
+	}
+
+	primary := bgDbOps.Status.Pod
+	if primary == "" {
+		// the member that leads when the upgrade starts runs pg_upgrade
+		statusCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		status, err := patroni.NewClient("localhost").Status(statusCtx)
+		if err != nil {
+			return fmt.Errorf("failed to get Patroni status: %w", err)
+		}
+		if !status.IsLeader() {
+			log.Println("Waiting for the primary to start the upgrade")
+			return nil
+		}
+		return updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+			status.Pod = podName
+		})
+	}
+
+	recreated := checkPodAnnotation(c, podName, namespace, bgDbOpsRestartedAnnotation) == bgDbOps.Name
+	if primary == podName {
+		switch result.Phase {
+		case "":
+			return startUpgrade(ctx, c, bgCluster, upgradeSpec)
+		case bestgresv1.UpgradePhaseRolledBack:
+			// the retry of a rollback that didn't get to restore the Citus metadata
+			if err := finishRolledBackUpgrade(); err != nil {
+				return err
+			}
+			return startUpgrade(ctx, c, bgCluster, upgradeSpec)
+		case bestgresv1.UpgradePhaseStopping:
+			return runUpgrade(ctx, c, bgCluster, result)
+		case bestgresv1.UpgradePhaseUpgraded:
+			if recreated {
+				return finishUpgrade(ctx, c, bgCluster, result)
+			}
+			return recreateUpgradedPrimary(c, bgCluster, upgradeSpec, result)
+		}
+		// checked or completed
+		return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+	}
+
+	if (recreated && result.Phase == bestgresv1.UpgradePhaseUpgraded) || result.Phase == bestgresv1.UpgradePhaseCompleted {
+		return finishUpgradedReplica(ctx, c, result)
+	}
+	state := checkPodAnnotation(c, podName, namespace, bgDbOpsUpgradeAnnotation)
+	switch result.Phase {
+	case bestgresv1.UpgradePhaseChecked:
+		// nothing runs on the replicas for a check
+		return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+	case bestgresv1.UpgradePhaseStopping:
+		if state == upgradeStopped {
+			return nil
+		}
+		return stopForUpgrade(ctx, c)
+	case bestgresv1.UpgradePhaseUpgraded:
+		return wipeUpgradedReplica(c, bgCluster, upgradeSpec, result, state)
+	}
+	// the upgrade rolled back, Patroni starts postgres again
+	if state == upgradeStopped {
+		log.Println("Upgrade rolled back, Patroni starts postgres again")
+		return deleteAnnotation(c, podName, namespace, bgDbOpsUpgradeAnnotation)
+	}
+	log.Printf("Waiting for %s to upgrade", primary)
+	return nil
+}
+
+// startUpgrade runs the pre-flight checks and pg_upgrade --check on the primary, then pauses
+// Patroni so the members can be stopped without a failover
+func startUpgrade(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, upgradeSpec *bestgresv1.UpgradeSpec) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	from, err := dataDirectoryVersion(dataDirectory())
+	if err != nil {
+		return err
+	}
+	to := upgradeSpec.PostgresVersion
+	local := patroni.NewClient("localhost")
+	if err := preflightUpgrade(ctx, bgCluster, local, from, to); err != nil {
+		return fmt.Errorf("pre-flight check failed: %w", err)
+	}
+	if err := initNewDataDirectory(ctx, to); err != nil {
+		return err
+	}
+	log.Printf("Checking the upgrade from %s to %s with pg_upgrade --check", from, to)
+	if err := runPgUpgrade(ctx, from, to, true); err != nil {
+		os.RemoveAll(newDataDirectory())
+		return fmt.Errorf("pg_upgrade --check failed: %w", err)
+	}
+
+	result := bestgresv1.UpgradeResult{FromVersion: from, ToVersion: to, Phase: bestgresv1.UpgradePhaseStopping}
+	if upgradeSpec.CheckOnly {
+		os.RemoveAll(newDataDirectory())
+		log.Printf("Upgrade from %s to %s checked", from, to)
+		result.Phase = bestgresv1.UpgradePhaseChecked
+		if err := recordUpgrade(c, bgCluster, result); err != nil {
+			return err
+		}
+		return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+	}
+	if err := recordUpgrade(c, bgCluster, result); err != nil {
+		return err
+	}
+	log.Println("Pausing Patroni for the upgrade")
+	if err := local.PatchConfig(ctx, map[string]interface{}{"pause": true}); err != nil {
+		return fmt.Errorf("failed to pause Patroni: %w", err)
+	}
+	return nil
+}
+
+// runUpgrade stops the primary once every replica stopped and upgrades its data directory,
+// a failure before the upgraded data directory replaces the old one rolls back
+func runUpgrade(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, result *bestgresv1.UpgradeResult) error {
+	from, to := result.FromVersion, result.ToVersion
+
+	version, err := dataDirectoryVersion(dataDirectory())
+	if err != nil {
+		return err
+	}
+	if version == to {
+		// the upgraded data directory already replaced the old one
+		result.Phase = bestgresv1.UpgradePhaseUpgraded
+		return recordUpgrade(c, bgCluster, *result)
+	}
+
+	local := patroni.NewClient("localhost")
+	statusCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	status, err := local.Status(statusCtx)
+	if err != nil {
+		return fmt.Errorf("failed to get Patroni status: %w", err)
+	}
+	if !status.Pause {
+		log.Println("Pausing Patroni for the upgrade")
+		if err := local.PatchConfig(statusCtx, map[string]interface{}{"pause": true}); err != nil {
+			return fmt.Errorf("failed to pause Patroni: %w", err)
+		}
+		return nil
+	}
+	pods, err := clusterPods(c, bgCluster)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Name != podName && pod.Annotations[bgDbOpsUpgradeAnnotation] != upgradeStopped {
+			log.Printf("Waiting for %s to stop postgres", pod.Name)
+			return nil
+		}
+	}
+
+	if err := upgradeDataDirectory(ctx, from, to); err != nil {
+		log.Printf("Upgrade failed, rolling back to %s: %v", from, err)
+		if rollbackErr := rollbackUpgrade(c, bgCluster, local, result); rollbackErr != nil {
+			return fmt.Errorf("upgrade failed: %v, rollback failed: %w", err, rollbackErr)
+		}
+		return fmt.Errorf("upgrade failed, rolled back to %s: %w", from, err)
+	}
+	log.Printf("Data directory upgraded from %s to %s", from, to)
+	result.Phase = bestgresv1.UpgradePhaseUpgraded
+	return recordUpgrade(c, bgCluster, *result)
+}
+
+// upgradeDataDirectory stops postgres, runs pg_upgrade --link into a new data directory and
+// puts it in place of the old one, which is kept next to it until the upgrade completed. The
+// deadline of the operation only applies until postgres is stopped, pg_upgrade interrupted
+// while it links the files would leave neither data directory usable.
+func upgradeDataDirectory(ctx context.Context, from, to string) error {
+	// Citus sets its metadata aside before and restores it after pg_upgrade
+	if err := runCitusUpgradeFunction(ctx, "citus_prepare_for_upgrade"); err != nil {
+		return err
+	}
+	if _, err := queryLocal(ctx, "CHECKPOINT"); err != nil {
+		return fmt.Errorf("checkpoint failed: %w", err)
+	}
+	if err := initNewDataDirectory(ctx, to); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("upgrade ran out of time before postgres was stopped: %w", err)
+	}
+	ctx = context.WithoutCancel(ctx)
+	if err := stopPostgres(postgresStopTimeout); err != nil {
+		return err
+	}
+	log.Printf("Upgrading the data directory from %s to %s with pg_upgrade --link", from, to)
+	if err := runPgUpgrade(ctx, from, to, false); err != nil {
+		return fmt.Errorf("pg_upgrade failed: %w", err)
+	}
+	// from here on the old data directory shares its files with the new one
+	if err := os.Rename(dataDirectory(), oldDataDirectory(from)); err != nil {
+		return fmt.Errorf("failed to move the old data directory aside: %w", err)
+	}
+	if err := os.Rename(newDataDirectory(), dataDirectory()); err != nil {
+		os.Rename(oldDataDirectory(from), dataDirectory())
+		return fmt.Errorf("failed to move the upgraded data directory in place: %w", err)
+	}
+	return nil
+}
+
+// rollbackUpgrade puts the old data directory back into service, pg_upgrade --link leaves it
+// untouched apart from renaming pg_control as long as the new cluster never started. Citus
+// restores the metadata it set aside once postgres runs again.
+func rollbackUpgrade(c client.Client, bgCluster *bestgresv1.BGCluster, local *patroni.Client, result *bestgresv1.UpgradeResult) error {
+	control := filepath.Join(dataDirectory(), "global", "pg_control")
+	if _, err := os.Stat(control + ".old"); err == nil {
+		if err := os.Rename(control+".old", control); err != nil {
+			return fmt.Errorf("failed to restore pg_control: %w", err)
+		}
+	}
+	if err := os.RemoveAll(newDataDirectory()); err != nil {
+		return fmt.Errorf("failed to remove the new data directory: %w", err)
+	}
+	// Patroni starts postgres on every member once it's resumed
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := local.PatchConfig(ctx, map[string]interface{}{"pause": false}); err != nil {
+		return fmt.Errorf("failed to resume Patroni: %w", err)
+	}
+	result.Phase = bestgresv1.UpgradePhaseRolledBack
+	if err := recordUpgrade(c, bgCluster, *result); err != nil {
+		return err
+	}
+	return finishRolledBackUpgrade()
+}
+
+// finishRolledBackUpgrade undoes citus_prepare_for_upgrade on the old data directory once
+// postgres runs again, citus_finish_pg_upgrade restores the metadata Citus set aside. It does
+// nothing when Citus wasn't prepared.
+func finishRolledBackUpgrade() error {
+	if err := waitForDatabase(postgresStopTimeout); err != nil {
+		return fmt.Errorf("postgres didn't start after the rollback: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	return runCitusUpgradeFunction(ctx, "citus_finish_pg_upgrade")
+}
+
+// recreateUpgradedPrimary deletes the pod of the upgraded primary once the replicas are gone
+// and the cluster runs the new binaries, the recreated pod resumes Patroni
+func recreateUpgradedPrimary(c client.Client, bgCluster *bestgresv1.BGCluster, upgradeSpec *bestgresv1.UpgradeSpec, result *bestgresv1.UpgradeResult) error {
+	if configured, reason := upgradeConfigured(c, bgCluster, upgradeSpec, result.ToVersion); !configured {
+		log.Printf("Waiting for %s before recreating the upgraded primary", reason)
+		return nil
+	}
+	pods, err := clusterPods(c, bgCluster)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Name != podName && pod.Annotations[bgDbOpsUpgradeAnnotation] != "" {
+			log.Printf("Waiting for %s to be recreated", pod.Name)
+			return nil
+		}
+	}
+	log.Printf("Recreating the pod to run postgres %s", result.ToVersion)
+	deletePod(c, podName, namespace)
+	return nil
+}
+
+// wipeUpgradedReplica removes the data directory of a replica once the cluster runs the new
+// binaries and recreates its pod, which rebuilds the replica from the upgraded primary
+func wipeUpgradedReplica(c client.Client, bgCluster *bestgresv1.BGCluster, upgradeSpec *bestgresv1.UpgradeSpec, result *bestgresv1.UpgradeResult, state string) error {
+	if state != upgradeWiped {
+		if configured, reason := upgradeConfigured(c, bgCluster, upgradeSpec, result.ToVersion); !configured {
+			log.Printf("Waiting for %s before rebuilding the replica", reason)
+			return nil
+		}
+		if err := stopPostgres(postgresStopTimeout); err != nil {
+			return err
+		}
+		log.Printf("Removing the data directory to rebuild the replica on %s", result.ToVersion)
+		if err := os.RemoveAll(dataDirectory()); err != nil {
+			return fmt.Errorf("failed to remove the data directory: %w", err)
+		}
+		if err := updateAnnotation(c, podName, namespace, bgDbOpsUpgradeAnnotation, upgradeWiped); err != nil {
+			return err
+		}
+	}
+	deletePod(c, podName, namespace)
+	return nil
+}
+
+// stopForUpgrade stops postgres on a replica once it runs paused, Patroni would start it again
+// otherwise
+func stopForUpgrade(ctx context.Context, c client.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	status, err := patroni.NewClient("localhost").Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Patroni status: %w", err)
+	}
+	if !status.Pause {
+		log.Println("Waiting for Patroni to pause")
+		return nil
+	}
+	if err := stopPostgres(postgresStopTimeout); err != nil {
+		return err
+	}
+	log.Println("Postgres stopped for the upgrade")
+	return updateAnnotation(c, podName, namespace, bgDbOpsUpgradeAnnotation, upgradeStopped)
+}
+
+// finishUpgrade completes the upgrade on the recreated primary: Citus restores its metadata,
+// the extensions move to the versions of the new binaries, the statistics pg_upgrade doesn't
+// carry over are rebuilt and the old data directory is removed
+func finishUpgrade(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, result *bestgresv1.UpgradeResult) error {
+	statusCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	status, err := patroni.NewClient("localhost").Status(statusCtx)
+	if err != nil {
+		log.Printf("Waiting for Patroni: %v", err)
+		return nil
+	}
+	if status.Pause {
+		// Patroni keeps postgres stopped until it's resumed
+		log.Println("Resuming Patroni on the upgraded primary")
+		if err := resetUpgradedPrimary(ctx, c, bgCluster, result); err != nil {
+			return err
+		}
+		if err := patroni.NewClient("localhost").PatchConfig(statusCtx, map[string]interface{}{"pause": false}); err != nil {
+			return fmt.Errorf("failed to resume Patroni: %w", err)
+		}
+		return nil
+	}
+	if !status.IsLeader() || !memberHealthy(status) {
+		log.Printf("Waiting for the upgraded primary to run, state %s", status.State)
+		return nil
+	}
+
+	if err := runCitusUpgradeFunction(ctx, "citus_finish_pg_upgrade"); err != nil {
+		return err
+	}
+	updated, err := updateExtensions(ctx)
+	if err != nil {
+		return err
+	}
+	log.Println("Rebuilding the planner statistics")
+	if _, err := runAsPostgres(ctx, filepath.Dir(dataDirectory()), filepath.Join(patroni.BinDir(result.ToVersion), "vacuumdb"),
+		"--all", "--analyze-in-stages", "--username", "postgres"); err != nil {
+		return fmt.Errorf("failed to analyze the upgraded cluster: %w", err)
+	}
+	if err := os.RemoveAll(oldDataDirectory(result.FromVersion)); err != nil {
+		return fmt.Errorf("failed to remove the old data directory: %w", err)
+	}
+
+	result.Phase = bestgresv1.UpgradePhaseCompleted
+	result.ExtensionsUpdated = updated
+	if err := recordUpgrade(c, bgCluster, *result); err != nil {
+		return err
+	}
+	log.Printf("Upgrade to %s completed", result.ToVersion)
+	return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+}
+
+// finishUpgradedReplica completes the upgrade on a rebuilt replica once it streams again
+func finishUpgradedReplica(ctx context.Context, c client.Client, result *bestgresv1.UpgradeResult) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	status, err := patroni.NewClient("localhost").Status(ctx)
+	if err != nil {
+		log.Printf("Waiting for Patroni: %v", err)
+		return nil
+	}
+	version, err := dataDirectoryVersion(dataDirectory())
+	if err != nil || version != result.ToVersion || !memberHealthy(status) {
+		log.Printf("Waiting for the replica to be rebuilt on %s, state %s", result.ToVersion, status.State)
+		return nil
+	}
+	log.Println("Replica rebuilt")
+	return updateAnnotation(c, podName, namespace, bgDbOpsCompletedAnnotation, "true")
+}
+
+// resumeUpgrade resumes Patroni when the pod of the upgraded primary starts. The DCS still
+// holds the system identifier and WAL position of the old cluster, which would keep Patroni
+// from taking the leader lock, they are reset first. Patroni leaves postgres stopped while it
+// is paused, so this runs before the controller waits for the database, which would wait
+// forever if it failed.
+func resumeUpgrade(bgCluster *bestgresv1.BGCluster, c client.Client) error {
+	if checkAnnotation(bgCluster, bgDbOpsPendingAnnotation) != "true" || checkAnnotation(bgCluster, bgDbOpsOpAnnotation) != "upgrade" {
+		return nil
+	}
+	bgDbOps, err := getBGDbOps(c, bgCluster)
+	if err != nil {
+		return fmt.Errorf("failed to check for an upgrade: %w", err)
+	}
+	result := bgDbOps.Status.UpgradeResult
+	if bgDbOps.Status.Pod != podName || result == nil || result.Phase != bestgresv1.UpgradePhaseUpgraded {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeResumeTimeout)
+	defer cancel()
+	if err := resetUpgradedPrimary(ctx, c, bgCluster, result); err != nil {
+		return err
+	}
+	local := patroni.NewClient("localhost")
+	for {
+		status, err := local.Status(ctx)
+		if err == nil {
+			if status.Pause {
+				log.Println("Resuming Patroni on the upgraded primary")
+				if err := local.PatchConfig(ctx, map[string]interface{}{"pause": false}); err != nil {
+					return fmt.Errorf("failed to resume Patroni: %w", err)
+				}
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Patroni didn't start within %s: %w", upgradeResumeTimeout, err)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// resetUpgradedPrimary resets the DCS to the system identifier of the upgraded data directory
+func resetUpgradedPrimary(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, result *bestgresv1.UpgradeResult) error {
+	output, err := runAsPostgres(ctx, filepath.Dir(dataDirectory()), filepath.Join(patroni.BinDir(result.ToVersion), "pg_controldata"), dataDirectory())
+	if err != nil {
+		return fmt.Errorf("failed to read the system identifier of the upgraded cluster: %w", err)
+	}
+	sysid := controlDataValue(string(output), "Database system identifier")
+	if err := resetUpgradedDCS(ctx, c, bgCluster, sysid); err != nil {
+		return fmt.Errorf("failed to reset the DCS for the upgraded cluster: %w", err)
+	}
+	return nil
+}
+
+// resetUpgradedDCS points the Kubernetes DCS of the cluster at the upgraded data directory:
+// the new system identifier, no timeline history and no WAL position or slots of the old leader
+func resetUpgradedDCS(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, sysid string) error {
+	if sysid == "" {
+		return fmt.Errorf("pg_controldata reported no system identifier")
+	}
+	prefix := os.Getenv("SCOPE")
+	// the Citus groups of a patroni-native sharded cluster keep their keys apart
+	if group, ok := patroni.CitusGroup(bgCluster); ok {
+		prefix = fmt.Sprintf("%s-%d", prefix, group)
+	}
+
+	reset := map[string]map[string]string{
+		prefix + "-config": {"initialize": sysid, "history": ""},
+		prefix + "-leader": {"optime": "", "slots": "", "retain_slots": ""},
+	}
+	for name, annotations := range reset {
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, configMap); err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				continue
+			}
+			return fmt.Errorf("failed to get ConfigMap %s: %w", name, err)
+		}
+		if configMap.Annotations == nil {
+			configMap.Annotations = make(map[string]string)
+		}
+		for key, value := range annotations {
+			if value == "" {
+				delete(configMap.Annotations, key)
+			} else {
+				configMap.Annotations[key] = value
+			}
+		}
+		if err := c.Update(ctx, configMap); err != nil {
+			return fmt.Errorf("failed to update ConfigMap %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// preflightUpgrade makes sure the upgrade can run: both binaries are in the image, every
+// member runs, the new binaries ship the installed extensions and preloaded libraries and
+// the volume has room for the new catalogs
+func preflightUpgrade(ctx context.Context, bgCluster *bestgresv1.BGCluster, local *patroni.Client, from, to string) error {
+	if !olderVersion(from, to) {
+		return fmt.Errorf("the data directory is on %s, which isn't older than %s", from, to)
+	}
+	for _, binary := range []string{
+		filepath.Join(patroni.BinDir(from), "postgres"),
+		filepath.Join(patroni.BinDir(to), "postgres"),
+		filepath.Join(patroni.BinDir(to), "initdb"),
+		filepath.Join(patroni.BinDir(to), "pg_upgrade"),
+	} {
+		if _, err := os.Stat(binary); err != nil {
+			return fmt.Errorf("the image doesn't ship %s", binary)
+		}
+	}
+
+	status, err := local.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Patroni status: %w", err)
+	}
+	if !status.IsLeader() {
+		return fmt.Errorf("%s isn't the primary anymore", podName)
+	}
+	if status.Pause {
+		return fmt.Errorf("Patroni is paused")
+	}
+	cluster, err := local.Cluster(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Patroni cluster: %w", err)
+	}
+	cluster = patroni.ClusterFor(bgCluster, cluster)
+	if int32(len(cluster.Members)) != bgCluster.Spec.Instances {
+		return fmt.Errorf("%d of %d members are in the cluster", len(cluster.Members), bgCluster.Spec.Instances)
+	}
+	for _, member := range cluster.Members {
+		if member.State != "running" && member.State != "streaming" {
+			return fmt.Errorf("member %s is %s", member.Name, member.State)
+		}
+	}
+
+	shareDir := filepath.Join("/usr/share/postgresql", to)
+	libDir := filepath.Join(filepath.Dir(patroni.BinDir(to)), "lib")
+	result, err := queryLocal(ctx, "SHOW shared_preload_libraries")
+	if err != nil {
+		return err
+	}
+	if len(result.Rows) > 0 {
+		for _, library := range patroni.ParseSharedPreloadLibraries(result.Rows[0].String(0)) {
+			library = strings.TrimPrefix(library, "$libdir/")
+			if _, err := os.Stat(filepath.Join(libDir, library+".so")); err != nil {
+				return fmt.Errorf("postgres %s doesn't ship the preloaded library %s", to, library)
+			}
+		}
+	}
+
+	databases, err := upgradeDatabases(ctx)
+	if err != nil {
+		return err
+	}
+	var catalogBytes int64
+	for _, database := range databases {
+		conn, err := connectLocal(ctx, database)
+		if err != nil {
+			return err
+		}
+		extensions, err := conn.Query(ctx, "SELECT extname FROM pg_extension ORDER BY extname")
+		if err == nil {
+			for _, row := range extensions.Rows {
+				control := filepath.Join(shareDir, "extension", row.String(0)+".control")
+				if _, statErr := os.Stat(control); statErr != nil {
+					err = fmt.Errorf("postgres %s doesn't ship extension %s installed in database %s", to, row.String(0), database)
+					break
+				}
+			}
+		}
+		if err == nil {
+			var size pgclient.Row
+			size, err = conn.QueryRow(ctx, `SELECT coalesce(sum(pg_total_relation_size(oid)), 0) FROM pg_class
+				WHERE relnamespace = 'pg_catalog'::regnamespace AND relkind = 'r'`)
+			if err == nil {
+				var bytes int64
+				bytes, err = size.Int64(0)
+				catalogBytes += bytes
+			}
+		}
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dataDirectory(), &stat); err != nil {
+		return fmt.Errorf("failed to check the free space of the volume: %w", err)
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	if required := catalogBytes + upgradeSpaceMargin; free < required {
+		return fmt.Errorf("the volume has %d MiB free, the upgrade needs %d MiB", free>>20, required>>20)
+	}
+	return nil
+}
+
+// initNewDataDirectory creates the data directory pg_upgrade upgrades into with the encoding,
+// locale, checksums and WAL segment size of the current one
+func initNewDataDirectory(ctx context.Context, to string) error {
+	result, err := queryLocal(ctx, `SELECT pg_encoding_to_char(d.encoding), d.datcollate, d.datctype,
+		current_setting('data_checksums'), current_setting('wal_segment_size', true)
+		FROM pg_database d WHERE d.datname = 'template0'`)
+	if err != nil {
+		return fmt.Errorf("failed to read the settings of the data directory: %w", err)
+	}
+	if len(result.Rows) == 0 {
+		return fmt.Errorf("template0 is missing")
+	}
+	row := result.Rows[0]
+	args := []string{
+		"--pgdata", newDataDirectory(),
+		"--username", "postgres",
+		"--auth", "trust",
+		"--encoding", row.String(0),
+		"--lc-collate", row.String(1),
+		"--lc-ctype", row.String(2),
+	}
+	if row.String(3) == "on" {
+		args = append(args, "--data-checksums")
+	}
+	if segment := strings.TrimSuffix(row.String(4), "MB"); segment != "" {
+		args = append(args, "--wal-segsize", segment)
+	}
+
+	if err := os.RemoveAll(newDataDirectory()); err != nil {
+		return fmt.Errorf("failed to remove the previous new data directory: %w", err)
+	}
+	if _, err := runAsPostgres(ctx, filepath.Dir(dataDirectory()), filepath.Join(patroni.BinDir(to), "initdb"), args...); err != nil {
+		return fmt.Errorf("initdb failed: %w", err)
+	}
+	return nil
+}
+
+// runPgUpgrade runs pg_upgrade --link from the data directory into the new one. The check
+// runs against the running postgres, the new cluster preloads the same libraries so the
+// extensions that need them can be restored.
+func runPgUpgrade(ctx context.Context, from, to string, check bool) error {
+	libraries, err := preloadedLibraries(ctx, check)
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--link",
+		"--old-bindir", patroni.BinDir(from),
+		"--new-bindir", patroni.BinDir(to),
+		"--old-datadir", dataDirectory(),
+		"--new-datadir", newDataDirectory(),
+		"--username", "postgres",
+		"--new-options", "-c shared_preload_libraries='" + libraries + "'",
+	}
+	if check {
+		args = append(args, "--check", "--old-port", "5432")
+	}
+	_, err = runAsPostgres(ctx, filepath.Dir(dataDirectory()), filepath.Join(patroni.BinDir(to), "pg_upgrade"), args...)
+	return err
+}
+
+// preloadedLibraries returns the shared_preload_libraries of the old cluster, read from the
+// running postgres or from the configuration Patroni wrote once it's stopped
+func preloadedLibraries(ctx context.Context, running bool) (string, error) {
+	if running {
+		result, err := queryLocal(ctx, "SHOW shared_preload_libraries")
+		if err != nil {
+			return "", err
+		}
+		if len(result.Rows) == 0 {
+			return "", nil
+		}
+		return result.Rows[0].String(0), nil
+	}
+	content, err := os.ReadFile(filepath.Join(dataDirectory(), "postgresql.conf"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read postgresql.conf: %w", err)
+	}
+	value := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		key, setting, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(key) == "shared_preload_libraries" {
+			value = strings.Trim(strings.TrimSpace(setting), "'")
+		}
+	}
+	return value, nil
+}
+
+// runCitusUpgradeFunction runs citus_prepare_for_upgrade or citus_finish_pg_upgrade when
+// Citus is installed, finishing only runs when the metadata was set aside
+func runCitusUpgradeFunction(ctx context.Context, function string) error {
+	conn, err := connectLocal(ctx, patroni.CitusDatabase)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	row, err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT FROM pg_extension WHERE extname = 'citus'),
+		to_regclass('public.pg_dist_partition') IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	if !row.Bool(0) || (function == "citus_finish_pg_upgrade" && !row.Bool(1)) {
+		return nil
+	}
+	log.Printf("Running %s", function)
+	if _, err := conn.Exec(ctx, "SELECT "+function+"()"); err != nil {
+		return fmt.Errorf("%s failed: %w", function, err)
+	}
+	return nil
+}
+
+// updateExtensions updates every extension to the default version of the new binaries, Citus
+// first as the other extensions of a sharded cluster may depend on it
+func updateExtensions(ctx context.Context) ([]string, error) {
+	databases, err := upgradeDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var updated []string
+	for _, database := range databases {
+		conn, err := connectLocal(ctx, database)
+		if err != nil {
+			return updated, err
+		}
+		result, err := conn.Query(ctx, `SELECT e.extname FROM pg_extension e
+			JOIN pg_available_extensions a ON a.name = e.extname
+			WHERE a.default_version IS DISTINCT FROM e.extversion
+			ORDER BY e.extname <> 'citus', e.extname`)
+		if err != nil {
+			conn.Close()
+			return updated, err
+		}
+		for _, row := range result.Rows {
+			extension := row.String(0)
+			log.Printf("Updating extension %s in database %s", extension, database)
+			if _, err := conn.Exec(ctx, "ALTER EXTENSION "+pgclient.QuoteIdentifier(extension)+" UPDATE"); err != nil {
+				conn.Close()
+				return updated, fmt.Errorf("failed to update extension %s in database %s: %w", extension, database, err)
+			}
+			updated = append(updated, database+"."+extension)
+		}
+		conn.Close()
+	}
+	return updated, nil
+}
+
+// upgradeDatabases returns every database that accepts connections, including template1
+// which pg_upgrade carries over as well
+func upgradeDatabases(ctx context.Context) ([]string, error) {
+	result, err := queryLocal(ctx, "SELECT datname FROM pg_database WHERE datallowconn ORDER BY datname")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	var databases []string
+	for _, row := range result.Rows {
+		databases = append(databases, row.String(0))
+	}
+	return databases, nil
+}
+
+// upgradeConfigured reports whether the BGCluster, its Patroni configuration and StatefulSet
+// run the new version, pods recreated before would start the old binaries. The reason names
+// what's missing.
+func upgradeConfigured(c client.Client, bgCluster *bestgresv1.BGCluster, upgradeSpec *bestgresv1.UpgradeSpec, to string) (bool, string) {
+	if bgCluster.Spec.Postgresql.Version != to || (upgradeSpec.Image != "" && bgCluster.Spec.Image.Tag != upgradeSpec.Image) {
+		return false, "the operator to move the BGCluster to " + to
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Name: bgCluster.Name + "-postgres-config", Namespace: namespace}, configMap); err != nil ||
+		!strings.Contains(configMap.Data["postgres.yaml"], patroni.BinDir(to)) {
+		return false, "the Patroni configuration to use the binaries of " + to
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Name: bgCluster.Name, Namespace: namespace}, sts); err != nil ||
+		len(sts.Spec.Template.Spec.Containers) == 0 || sts.Spec.Template.Spec.Containers[0].Image != bgCluster.Spec.Image.Tag {
+		return false, "the StatefulSet to run " + bgCluster.Spec.Image.Tag
+	}
+	return true, ""
+}
+
+// recordUpgrade records the progress of the upgrade on the BGDbOps
+func recordUpgrade(c client.Client, bgCluster *bestgresv1.BGCluster, result bestgresv1.UpgradeResult) error {
+	return updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.UpgradeResult = result.DeepCopy()
+	})
+}
+
+// upgradeIrreversible reports whether the pending operation is an upgrade that replaced the old
+// data directory, from there on it can only be carried through
+func upgradeIrreversible(c client.Client, bgCluster *bestgresv1.BGCluster) bool {
+	bgDbOps, err := getBGDbOps(c, bgCluster)
+	if err != nil {
+		log.Printf("Failed to check the upgrade: %v", err)
+		return false
+	}
+	return bgDbOps.UpgradeIrreversible()
+}
+
+// getBGDbOps returns the BGDbOps in progress on the cluster
+func getBGDbOps(c client.Client, bgCluster *bestgresv1.BGCluster) (*bestgresv1.BGDbOps, error) {
+	bgDbOps := &bestgresv1.BGDbOps{}
+	name := bgCluster.Annotations[bgDbOpsInProgressAnnotation]
+	if err := c.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, bgDbOps); err != nil {
+		return nil, fmt.Errorf("failed to get BGDbOps %s: %w", name, err)
+	}
+	return bgDbOps, nil
+}
+
+// clusterPods returns the pods of the cluster
+func clusterPods(c client.Client, bgCluster *bestgresv1.BGCluster) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(context.TODO(), podList, client.InNamespace(namespace), client.MatchingLabels{"cluster-name": bgCluster.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	return podList.Items, nil
+}
+
+// runAsPostgres runs one of the postgres binaries as postgres in dir, the error carries the
+// last line it logged
+func runAsPostgres(ctx context.Context, dir, binary string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+passwordForUser("postgres"))
+	if credential, home := postgresCredential(); credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		cmd.Env = append(cmd.Env, "HOME="+home)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := runWaited(cmd); err != nil {
+		return stdout.Bytes(), fmt.Errorf("%s failed: %s", filepath.Base(binary), lastLine(stderr.String()+stdout.String(), err))
+	}
+	return stdout.Bytes(), nil
+}
+
+// dataDirectoryVersion returns the major version of a data directory
+func dataDirectoryVersion(dir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "PG_VERSION"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the version of the data directory: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// newDataDirectory is where pg_upgrade writes the upgraded cluster
+func newDataDirectory() string {
+	return dataDirectory() + "_new"
+}
+
+// oldDataDirectory is where the data directory of the old version is kept until the upgrade
+// completed
+func oldDataDirectory(version string) string {
+	return dataDirectory() + "_" + version
+}
+
+// controlDataValue returns a field of the pg_controldata output
+func controlDataValue(output, field string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(key) == field {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// olderVersion reports whether major version from is older than to
+func olderVersion(from, to string) bool {
+	if len(from) != len(to) {
+		return len(from) < len(to)
+	}
+	return from < to
+}
@@ -0,0 +1,226 @@
+package controller
+
+import (
+	bestgresv1 "bestgres/api/v1"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"bestgres/pgclient"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// maintenanceTarget is what a vacuum or analyze runs against
+type maintenanceTarget struct {
+	databases []string
+	tables    []string
+}
+
+// handleVacuum vacuums the requested tables on the primary, replicas get the result through replication
+func handleVacuum(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	vacuumSpec := dbOpsSpec.Vacuum
+	if vacuumSpec == nil {
+		vacuumSpec = &bestgresv1.VacuumSpec{}
+	}
+
+	var options []string
+	if vacuumSpec.Full {
+		options = append(options, "FULL")
+	}
+	if vacuumSpec.Freeze {
+		options = append(options, "FREEZE")
+	}
+	if vacuumSpec.Analyze {
+		options = append(options, "ANALYZE")
+	}
+	if vacuumSpec.Verbose {
+		options = append(options, "VERBOSE")
+	}
+	if vacuumSpec.Parallel != nil {
+		if vacuumSpec.Full {
+			log.Println("Ignoring parallel, VACUUM FULL can't use parallel workers")
+		} else {
+			options = append(options, fmt.Sprintf("PARALLEL %d", *vacuumSpec.Parallel))
+		}
+	}
+
+	return runMaintenance(ctx, c, bgCluster, "VACUUM", options, maintenanceTarget{
+		databases: vacuumSpec.Databases,
+		tables:    vacuumSpec.Tables,
+	})
+}
+
+// handleAnalyze updates planner statistics for the requested tables on the primary
+func handleAnalyze(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, spec string) error {
+	dbOpsSpec, err := parseBGDbOpsSpec(spec)
+	if err != nil {
+		return err
+	}
+	analyzeSpec := dbOpsSpec.Analyze
+	if analyzeSpec == nil {
+		analyzeSpec = &bestgresv1.AnalyzeSpec{}
+	}
+
+	var options []string
+	if analyzeSpec.Verbose {
+		options = append(options, "VERBOSE")
+	}
+
+	return runMaintenance(ctx, c, bgCluster, "ANALYZE", options, maintenanceTarget{
+		databases: analyzeSpec.Databases,
+		tables:    analyzeSpec.Tables,
+	})
+}
+
+// runMaintenance runs command with options on every target table of every target database and
+// records the per-table results in the BGDbOps status. Failing tables don't fail the operation.
+func runMaintenance(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster, command string, options []string, target maintenanceTarget) error {
+	primary, err := isLocalPrimary()
+	if err != nil {
+		return err
+	}
+	if !primary {
+		log.Printf("Not the primary, nothing to %s", strings.ToLower(command))
+		return nil
+	}
+
+	start := metav1.Now()
+	if err := updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Pod = podName
+		status.StartTime = &start
+		status.Tables = nil
+	}); err != nil {
+		log.Printf("Failed to record the start of the operation: %v", err)
+	}
+
+	databases := target.databases
+	if len(databases) == 0 {
+		databases, err = listDatabases(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	statement := command
+	if len(options) > 0 {
+		statement += " (" + strings.Join(options, ", ") + ")"
+	}
+
+	var results []bestgresv1.TableResult
+	for _, database := range databases {
+		results = append(results, runMaintenanceOnDatabase(ctx, database, statement, target.tables)...)
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Result == bestgresv1.TableResultFailed {
+			failed++
+		}
+	}
+	log.Printf("%s finished on %d tables, %d failed", command, len(results), failed)
+
+	return updateBGDbOpsStatus(c, bgCluster, func(status *bestgresv1.BGDbOpsStatus) {
+		status.Tables = results
+	})
+}
+
+// runMaintenanceOnDatabase runs statement on the tables of a single database
+func runMaintenanceOnDatabase(ctx context.Context, database string, statement string, tables []string) []bestgresv1.TableResult {
+	conn, err := connectLocal(ctx, database)
+	if err != nil {
+		log.Printf("Failed to connect to database %s: %v", database, err)
+		return []bestgresv1.TableResult{{Database: database, Result: bestgresv1.TableResultFailed, Message: err.Error()}}
+	}
+	defer conn.Close()
+
+	var results []bestgresv1.TableResult
+	if len(tables) == 0 {
+		tables, err = listTables(ctx, conn)
+		if err != nil {
+			log.Printf("Failed to list tables of database %s: %v", database, err)
+			return []bestgresv1.TableResult{{Database: database, Result: bestgresv1.TableResultFailed, Message: err.Error()}}
+		}
+	}
+
+	for _, table := range tables {
+		result := bestgresv1.TableResult{Database: database, Table: table}
+
+		// resolve the name through regclass so it's safely quoted
+		row, err := conn.QueryRow(ctx, "SELECT to_regclass($1)::text", table)
+		switch {
+		case err != nil:
+			result.Result = bestgresv1.TableResultFailed
+			result.Message = err.Error()
+		case row.IsNull(0):
+			result.Result = bestgresv1.TableResultFailed
+			result.Message = "table not found"
+		default:
+			log.Printf("Running %s on %s.%s", statement, database, table)
+			start := time.Now()
+			_, err = conn.Exec(ctx, statement+" "+row.String(0))
+			result.Duration = metav1.Duration{Duration: time.Since(start).Round(time.Millisecond)}
+			if err != nil {
+				result.Result = bestgresv1.TableResultFailed
+				result.Message = err.Error()
+			} else {
+				result.Result = bestgresv1.TableResultSucceeded
+			}
+		}
+
+		if result.Result == bestgresv1.TableResultFailed {
+			log.Printf("%s failed on %s.%s: %s", statement, database, table, result.Message)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// listDatabases returns every database that accepts connections
+func listDatabases(ctx context.Context) ([]string, error) {
+	result, err := queryLocal(ctx, "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	var databases []string
+	for _, row := range result.Rows {
+		databases = append(databases, row.String(0))
+	}
+	return databases, nil
+}
+
+// listTables returns the user tables and materialized views of the connected database
+func listTables(ctx context.Context, conn *pgclient.Conn) ([]string, error) {
+	result, err := conn.Query(ctx, `SELECT c.oid::regclass::text
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'm')
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND n.nspname NOT LIKE 'pg_toast%'
+		  AND n.nspname NOT LIKE 'pg_temp%'
+		ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, row := range result.Rows {
+		tables = append(tables, row.String(0))
+	}
+	return tables, nil
+}
+
+// parseBGDbOpsSpec decodes the spec the operator copied into the BGCluster annotation
+func parseBGDbOpsSpec(spec string) (*bestgresv1.BGDbOpsSpec, error) {
+	dbOpsSpec := &bestgresv1.BGDbOpsSpec{}
+	if err := json.Unmarshal([]byte(spec), dbOpsSpec); err != nil {
+		return nil, fmt.Errorf("failed to parse BGDbOps spec: %w", err)
+	}
+	return dbOpsSpec, nil
+}
@@ -17,6 +17,18 @@ var (
 )
 
 func main() {
+	// postgres and Patroni run the binary to archive and restore WAL and backups
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "archive-wal":
+			os.Exit(controller.ArchiveWAL(os.Args[2:]))
+		case "restore-backup":
+			os.Exit(controller.RestoreBackup(os.Args[2:]))
+		case "restore-wal":
+			os.Exit(controller.RestoreWAL(os.Args[2:]))
+		}
+	}
+
 	mode := os.Getenv("MODE")
 	switch mode {
 	case "operator":
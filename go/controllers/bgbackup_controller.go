@@ -0,0 +1,34 @@
+// bgbackup_controller.go
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	bestgresv1 "bestgres/api/v1"
+)
+
+// BGBackupReconciler reconciles a BGBackup object
+// The backup itself is taken by a BGDbOps the reconciler creates and mirrors
+type BGBackupReconciler struct {
+	client.Client
+	Scheme    *runtime.Scheme
+	Namespace string
+}
+
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackups,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackups/status,verbs=get;update;patch,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackups/finalizers,verbs=update,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgclusters,verbs=get;list;watch,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgdbops,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BGBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&bestgresv1.BGBackup{}).
+		// the BGDbOps status carries the progress of the backup
+		Owns(&bestgresv1.BGDbOps{}).
+		Complete(r)
+}
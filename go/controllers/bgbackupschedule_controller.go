@@ -0,0 +1,32 @@
+// bgbackupschedule_controller.go
+
+package controllers
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	bestgresv1 "bestgres/api/v1"
+)
+
+// BGBackupScheduleReconciler reconciles a BGBackupSchedule object
+type BGBackupScheduleReconciler struct {
+	client.Client
+	Scheme    *runtime.Scheme
+	Namespace string
+}
+
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackupschedules,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackupschedules/status,verbs=get;update;patch,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackupschedules/finalizers,verbs=update,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackups,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BGBackupScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&bestgresv1.BGBackupSchedule{}).
+		// the status lists the backups of the schedule
+		Owns(&bestgresv1.BGBackup{}).
+		Complete(r)
+}
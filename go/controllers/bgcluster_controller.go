@@ -2,18 +2,23 @@ package controllers
 
 import (
 	"context"
-	"reflect"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	bestgresv1 "bestgres/api/v1"
 )
 
+// patroniPollInterval is how often running clusters are checked for pending restarts
+const patroniPollInterval = 30 * time.Second
+
 // BGClusterReconciler reconciles a BGCluster object
 type BGClusterReconciler struct {
     client.Client
@@ -24,9 +29,12 @@ type BGClusterReconciler struct {
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgclusters,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgclusters/status,verbs=get;update;patch,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgclusters/finalizers,verbs=update,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=bestgres.io,resources=bgbackups,verbs=get;list;watch,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=core,resources=pods;services;endpoints;secrets;serviceaccounts;configmaps,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;delete,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create,namespace="{{ .Release.Namespace }}"
 
 func (r *BGClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
     log := ctrl.LoggerFrom(ctx)
@@ -37,10 +45,33 @@ func (r *BGClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
         return ctrl.Result{}, client.IgnoreNotFound(err)
     }
 
+    // Deleted clusters are shut down cleanly before the finalizer lets them go
+    if !bgCluster.DeletionTimestamp.IsZero() {
+        return r.reconcileDeletion(ctx, bgCluster)
+    }
+    if !controllerutil.ContainsFinalizer(bgCluster, bgClusterFinalizer) {
+        controllerutil.AddFinalizer(bgCluster, bgClusterFinalizer)
+        if err := r.Update(ctx, bgCluster); err != nil {
+            return ctrl.Result{}, err
+        }
+    }
+
+    // Restored clusters wait for their backup before any pod is created
+    ready, err := r.reconcileRecoverySource(ctx, bgCluster)
+    if err != nil {
+        return ctrl.Result{}, err
+    }
+    if !ready {
+        return ctrl.Result{RequeueAfter: recoveryPollInterval}, nil
+    }
+
     // Create or update resources
     if err := r.reconcileHeadlessService(ctx, bgCluster); err != nil {
         return ctrl.Result{}, err
     }
+    if err := r.reconcileBackupVolume(ctx, bgCluster); err != nil {
+        return ctrl.Result{}, err
+    }
     if err := r.reconcileStatefulSet(ctx, bgCluster); err != nil {
         return ctrl.Result{}, err
     }
@@ -53,6 +84,9 @@ func (r *BGClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
     if err := r.reconcileReplicaService(ctx, bgCluster); err != nil {
         return ctrl.Result{}, err
     }
+    if err := r.reconcileAnyService(ctx, bgCluster); err != nil {
+        return ctrl.Result{}, err
+    }
     if err := r.reconcileSecret(ctx, bgCluster); err != nil {
         return ctrl.Result{}, err
     }
@@ -65,6 +99,15 @@ func (r *BGClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
     if err := r.reconcileRoleBinding(ctx, bgCluster); err != nil {
         return ctrl.Result{}, err
     }
+    cluster, err := r.reconcilePatroniConfig(ctx, bgCluster)
+    if err != nil {
+        return ctrl.Result{}, err
+    }
+    // Pods that run an outdated pod template are replaced one at a time
+    rollout, err := r.reconcileRollout(ctx, bgCluster, cluster)
+    if err != nil {
+        return ctrl.Result{}, err
+    }
 
     // Update status
     podList := &corev1.PodList{}
@@ -76,13 +119,18 @@ func (r *BGClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
         log.Error(err, "Failed to list pods", "BGCluster.Namespace", bgCluster.Namespace, "BGCluster.Name", bgCluster.Name)
         return ctrl.Result{}, err
     }
-    podNames := getPodNames(podList.Items)
 
     // TODO test this, might break stuff
     bgCluster = refreshContext(bgCluster, r.Client)
+    bgCluster.Status.Rollout = rollout
 
-    if !reflect.DeepEqual(podNames, bgCluster.Status.Nodes) {
-        bgCluster.Status.Nodes = podNames
+    status, err := r.observeBGClusterStatus(ctx, bgCluster, podList.Items, cluster)
+    if err != nil {
+        log.Error(err, "Failed to observe BGCluster status")
+        return ctrl.Result{}, err
+    }
+    if !equality.Semantic.DeepEqual(*status, bgCluster.Status) {
+        bgCluster.Status = *status
         err := r.Status().Update(ctx, bgCluster)
         if err != nil {
             log.Error(err, "Error in bgCluster.Status.Update")
@@ -90,6 +138,13 @@ func (r *BGClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
         }
     }
 
+    if rollout != nil && rollout.Phase == bestgresv1.RolloutPhaseRollingOut {
+        return ctrl.Result{RequeueAfter: rolloutPollInterval}, nil
+    }
+    // members don't trigger reconciles when they restart, poll Patroni to keep the status current
+    if len(podList.Items) > 0 {
+        return ctrl.Result{RequeueAfter: patroniPollInterval}, nil
+    }
     return ctrl.Result{}, nil
 }
 
@@ -3,6 +3,8 @@
 package controllers
 
 import (
+	"sync"
+
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -15,6 +17,9 @@ type BGDbOpsReconciler struct {
 	client.Client
 	Scheme    *runtime.Scheme
 	Namespace string
+
+	// leaderChanges holds the *leaderChange requested by this operator by BGDbOps UID
+	leaderChanges sync.Map
 }
 
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgdbops,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
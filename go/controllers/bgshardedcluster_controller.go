@@ -23,6 +23,7 @@ type BGShardedClusterReconciler struct {
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgshardedclusters/status,verbs=get;update;patch,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgshardedclusters/finalizers,verbs=update,namespace="{{ .Release.Namespace }}"
 //+kubebuilder:rbac:groups=bestgres.io,resources=bgclusters,verbs=get;list;watch;create;update;patch;delete,namespace="{{ .Release.Namespace }}"
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch,namespace="{{ .Release.Namespace }}"
 
 func (r *BGShardedClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
@@ -33,6 +34,12 @@ func (r *BGShardedClusterReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// The internal Citus user's password has to exist before any node starts
+	if err := r.reconcileCitusSecret(ctx, bgShardedCluster); err != nil {
+		logger.Error(err, "Failed to reconcile Citus Secret")
+		return ctrl.Result{}, err
+	}
+
 	// Reconcile coordinator BGCluster
 	if err := r.reconcileCoordinatorBGCluster(ctx, bgShardedCluster); err != nil {
 		logger.Error(err, "Failed to reconcile coordinator BGCluster")
@@ -46,25 +53,78 @@ func (r *BGShardedClusterReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, err
 	}
 
+	// Workers past spec.shards are drained by the coordinator before they are deleted
+	drainingWorkers, err := r.reconcileScaleDown(ctx, bgShardedCluster)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile worker scale down")
+		return ctrl.Result{}, err
+	}
+
+	// The coordinator registers the worker replicas as Citus secondaries for reads
+	if err := r.reconcileSecondaries(ctx, bgShardedCluster); err != nil {
+		logger.Error(err, "Failed to reconcile worker secondaries")
+		return ctrl.Result{}, err
+	}
+
+	// The coordinator registers the workers as they become ready
+	unregisteredWorkers, err := r.unregisteredWorkers(ctx, bgShardedCluster, workerClusters)
+	if err != nil {
+		logger.Error(err, "Failed to get the unregistered workers")
+		return ctrl.Result{}, err
+	}
+
+	// The coordinator rebalances the shards when workers are added
+	rebalance, err := r.reconcileRebalance(ctx, bgShardedCluster)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile shard rebalancing")
+		return ctrl.Result{}, err
+	}
+
 	// Update status
-	if err := r.updateStatus(ctx, bgShardedCluster, workerClusters); err != nil {
+	if err := r.updateStatus(ctx, bgShardedCluster, workerClusters, drainingWorkers, unregisteredWorkers, rebalance); err != nil {
 		logger.Error(err, "Failed to update BGShardedCluster status")
 		return ctrl.Result{}, err
 	}
 
+	// the coordinator reports registered and drained workers and rebalance progress on its
+	// pods, which don't trigger reconciles
+	if len(drainingWorkers) > 0 || len(unregisteredWorkers) > 0 || rebalanceRunning(rebalance) {
+		return ctrl.Result{RequeueAfter: drainPollInterval}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
-func (r *BGShardedClusterReconciler) updateStatus(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster, workerClusters []string) error {
+func (r *BGShardedClusterReconciler) updateStatus(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster, workerClusters, drainingWorkers, unregisteredWorkers []string, rebalance *bestgresv1.RebalanceStatus) error {
 	coordinatorName := bgShardedCluster.Name + "-coordinator"
+	if len(drainingWorkers) == 0 {
+		drainingWorkers = nil
+	}
+	if len(unregisteredWorkers) == 0 {
+		unregisteredWorkers = nil
+	}
+	status := "Ready"
+	switch {
+	case len(drainingWorkers) > 0:
+		status = "ScalingDown"
+	case len(unregisteredWorkers) > 0:
+		status = "RegisteringWorkers"
+	case rebalanceRunning(rebalance):
+		status = "Rebalancing"
+	}
 
 	if !reflect.DeepEqual(workerClusters, bgShardedCluster.Status.WorkerClusters) ||
+		!reflect.DeepEqual(drainingWorkers, bgShardedCluster.Status.DrainingWorkers) ||
+		!reflect.DeepEqual(unregisteredWorkers, bgShardedCluster.Status.UnregisteredWorkers) ||
+		!reflect.DeepEqual(rebalance, bgShardedCluster.Status.Rebalance) ||
 		bgShardedCluster.Status.CoordinatorCluster != coordinatorName ||
-		bgShardedCluster.Status.Status != "Ready" {
+		bgShardedCluster.Status.Status != status {
 
-		bgShardedCluster.Status.Status = "Ready"
+		bgShardedCluster.Status.Status = status
 		bgShardedCluster.Status.CoordinatorCluster = coordinatorName
 		bgShardedCluster.Status.WorkerClusters = workerClusters
+		bgShardedCluster.Status.DrainingWorkers = drainingWorkers
+		bgShardedCluster.Status.UnregisteredWorkers = unregisteredWorkers
+		bgShardedCluster.Status.Rebalance = rebalance
 
 		return r.Status().Update(ctx, bgShardedCluster)
 	}
@@ -0,0 +1,134 @@
+// reconcile_bgbackup.go
+
+package controllers
+
+import (
+	"context"
+
+	bestgresv1 "bestgres/api/v1"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Reconcile runs the backup as a BGDbOps on the target BGCluster and mirrors its progress
+// into the BGBackup status
+func (r *BGBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	bgBackup := &bestgresv1.BGBackup{}
+	if err := r.Get(ctx, req.NamespacedName, bgBackup); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if bgBackup.Status.Phase == bestgresv1.BGBackupPhaseCompleted || bgBackup.Status.Phase == bestgresv1.BGBackupPhaseFailed {
+		return ctrl.Result{}, nil
+	}
+	status := &bestgresv1.BGBackupStatus{}
+	bgBackup.Status.DeepCopyInto(status)
+
+	bgDbOps := &bestgresv1.BGDbOps{}
+	err := r.Get(ctx, types.NamespacedName{Name: bgBackupDbOpsName(bgBackup), Namespace: bgBackup.Namespace}, bgDbOps)
+	switch {
+	case apierrors.IsNotFound(err):
+		bgCluster := &bestgresv1.BGCluster{}
+		if err := r.Get(ctx, types.NamespacedName{Name: bgBackup.Spec.BGCluster, Namespace: bgBackup.Namespace}, bgCluster); err != nil {
+			logger.Error(err, "Unable to fetch BGCluster", "BGCluster", bgBackup.Spec.BGCluster)
+			return ctrl.Result{}, err
+		}
+		if bgCluster.Spec.Backup == nil {
+			now := metav1.Now()
+			status.Phase = bestgresv1.BGBackupPhaseFailed
+			status.Message = "BGCluster " + bgCluster.Name + " has no spec.backup configured"
+			status.CompletionTime = &now
+			break
+		}
+		if err := r.createBackupBGDbOps(ctx, bgBackup); err != nil {
+			return ctrl.Result{}, err
+		}
+		status.Phase = bestgresv1.BGBackupPhasePending
+		status.BGDbOps = bgBackupDbOpsName(bgBackup)
+	case err != nil:
+		logger.Error(err, "Unable to fetch BGDbOps", "BGDbOps", bgBackupDbOpsName(bgBackup))
+		return ctrl.Result{}, err
+	default:
+		mirrorBackupStatus(status, bgDbOps)
+	}
+
+	if !equality.Semantic.DeepEqual(*status, bgBackup.Status) {
+		bgBackup.Status = *status
+		if err := r.Status().Update(ctx, bgBackup); err != nil {
+			logger.Error(err, "Unable to update BGBackup status")
+			return ctrl.Result{}, err
+		}
+		logger.Info("BGBackup status updated", "phase", status.Phase)
+	}
+	return ctrl.Result{}, nil
+}
+
+// bgBackupDbOpsName returns the name of the BGDbOps taking the backup
+func bgBackupDbOpsName(bgBackup *bestgresv1.BGBackup) string {
+	return bgBackup.Name + "-backup"
+}
+
+// createBackupBGDbOps creates the backup operation, it is owned by the BGBackup so it goes
+// away with it
+func (r *BGBackupReconciler) createBackupBGDbOps(ctx context.Context, bgBackup *bestgresv1.BGBackup) error {
+	logger := log.FromContext(ctx)
+
+	bgDbOps := &bestgresv1.BGDbOps{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      bgBackupDbOpsName(bgBackup),
+			Namespace: bgBackup.Namespace,
+		},
+		Spec: bestgresv1.BGDbOpsSpec{
+			BGCluster: bgBackup.Spec.BGCluster,
+			Op:        "backup",
+			Backup: &bestgresv1.BackupOpSpec{
+				Type:       bgBackup.Spec.Type,
+				RetainFull: bgBackup.Spec.RetainFull,
+			},
+		},
+	}
+	if err := ctrl.SetControllerReference(bgBackup, bgDbOps, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, bgDbOps); err != nil && !apierrors.IsAlreadyExists(err) {
+		logger.Error(err, "Unable to create BGDbOps", "BGDbOps", bgDbOps.Name)
+		return err
+	}
+	logger.Info("Created backup BGDbOps", "BGDbOps", bgDbOps.Name)
+	return nil
+}
+
+// mirrorBackupStatus copies the progress of the backup operation into the BGBackup status
+func mirrorBackupStatus(status *bestgresv1.BGBackupStatus, bgDbOps *bestgresv1.BGDbOps) {
+	status.BGDbOps = bgDbOps.Name
+	status.Message = bgDbOps.Status.Message
+	status.StartTime = bgDbOps.Status.StartTime
+	if bgDbOps.Status.BackupResult != nil {
+		status.BackupResult = *bgDbOps.Status.BackupResult
+	}
+
+	switch bgDbOps.Status.Status {
+	case bestgresv1.BGDbOpsStatusCompleted:
+		status.Phase = bestgresv1.BGBackupPhaseCompleted
+		status.CompletionTime = bgDbOps.Status.CompletionTime
+		// the operation completes on every pod, only the primary records a backup
+		if status.BackupID == "" {
+			status.Phase = bestgresv1.BGBackupPhaseFailed
+			status.Message = "the backup operation completed without a backup"
+		}
+	case bestgresv1.BGDbOpsStatusFailed:
+		status.Phase = bestgresv1.BGBackupPhaseFailed
+		status.CompletionTime = bgDbOps.Status.CompletionTime
+	case bestgresv1.BGDbOpsStatusRunning:
+		status.Phase = bestgresv1.BGBackupPhaseRunning
+	default:
+		status.Phase = bestgresv1.BGBackupPhasePending
+	}
+}
@@ -0,0 +1,194 @@
+// reconcile_bgbackupschedule.go
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/cron"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// bgBackupScheduleLabel marks the BGBackups created by a BGBackupSchedule
+const bgBackupScheduleLabel = "bgbackupschedule.bestgres.io/schedule"
+
+// Reconcile creates a BGBackup whenever the schedule is due and deletes the BGBackups past
+// the retention, the backups themselves are pruned from the storage by the backup operation
+func (r *BGBackupScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	bgBackupSchedule := &bestgresv1.BGBackupSchedule{}
+	if err := r.Get(ctx, req.NamespacedName, bgBackupSchedule); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	status := &bestgresv1.BGBackupScheduleStatus{}
+	bgBackupSchedule.Status.DeepCopyInto(status)
+	status.Message = ""
+
+	schedule, err := cron.Parse(bgBackupSchedule.Spec.Schedule)
+	if err != nil {
+		status.Message = fmt.Sprintf("invalid schedule: %v", err)
+		status.NextScheduleTime = nil
+		return ctrl.Result{}, r.updateBGBackupScheduleStatus(ctx, bgBackupSchedule, status)
+	}
+
+	backups, err := r.retainBGBackups(ctx, bgBackupSchedule)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	status.Backups = nil
+	lastSuccessful := false
+	for _, bgBackup := range backups {
+		status.Backups = append(status.Backups, bestgresv1.ScheduledBackup{
+			Name:         bgBackup.Name,
+			Type:         bgBackup.Spec.Type,
+			Phase:        bgBackup.Status.Phase,
+			BackupResult: bgBackup.Status.BackupResult,
+		})
+		if bgBackup.Status.Phase == bestgresv1.BGBackupPhaseCompleted && !lastSuccessful {
+			status.LastSuccessfulTime = bgBackup.Status.CompletionTime
+			lastSuccessful = true
+		}
+	}
+
+	if bgBackupSchedule.Spec.Suspend {
+		status.NextScheduleTime = nil
+		return ctrl.Result{}, r.updateBGBackupScheduleStatus(ctx, bgBackupSchedule, status)
+	}
+
+	// runs missed while the operator was down are folded into a single backup
+	now := time.Now()
+	last := bgBackupSchedule.CreationTimestamp.Time
+	if status.LastScheduleTime != nil {
+		last = status.LastScheduleTime.Time
+	}
+	next := schedule.Next(last)
+	if !next.IsZero() && !next.After(now) {
+		if err := r.createScheduledBGBackup(ctx, bgBackupSchedule, next); err != nil {
+			return ctrl.Result{}, err
+		}
+		scheduled := metav1.NewTime(now)
+		status.LastScheduleTime = &scheduled
+		next = schedule.Next(now)
+	}
+	if next.IsZero() {
+		status.Message = "the schedule never fires"
+		status.NextScheduleTime = nil
+		return ctrl.Result{}, r.updateBGBackupScheduleStatus(ctx, bgBackupSchedule, status)
+	}
+	nextScheduleTime := metav1.NewTime(next)
+	status.NextScheduleTime = &nextScheduleTime
+
+	if err := r.updateBGBackupScheduleStatus(ctx, bgBackupSchedule, status); err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.Info("Next backup scheduled", "time", next.Format(time.RFC3339))
+	return ctrl.Result{RequeueAfter: time.Until(next)}, nil
+}
+
+// createScheduledBGBackup creates the BGBackup of the run at the given time, it is named
+// after the run so a repeated reconcile doesn't take a second backup
+func (r *BGBackupScheduleReconciler) createScheduledBGBackup(ctx context.Context, bgBackupSchedule *bestgresv1.BGBackupSchedule, run time.Time) error {
+	logger := log.FromContext(ctx)
+
+	retainFull := bgBackupSchedule.Spec.RetainFull
+	bgBackup := &bestgresv1.BGBackup{
+		ObjectMeta: ctrl.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", bgBackupSchedule.Name, run.Unix()),
+			Namespace: bgBackupSchedule.Namespace,
+			Labels:    map[string]string{bgBackupScheduleLabel: bgBackupSchedule.Name},
+		},
+		Spec: bestgresv1.BGBackupSpec{
+			BGCluster:  bgBackupSchedule.Spec.BGCluster,
+			Type:       bgBackupSchedule.Spec.Type,
+			RetainFull: &retainFull,
+		},
+	}
+	if err := ctrl.SetControllerReference(bgBackupSchedule, bgBackup, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, bgBackup); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		logger.Error(err, "Unable to create BGBackup", "BGBackup", bgBackup.Name)
+		return err
+	}
+	logger.Info("Created scheduled BGBackup", "BGBackup", bgBackup.Name)
+	return nil
+}
+
+// retainBGBackups deletes the finished BGBackups older than the oldest retained full backup,
+// or past the retained incremental backups, and returns the remaining ones, newest first
+func (r *BGBackupScheduleReconciler) retainBGBackups(ctx context.Context, bgBackupSchedule *bestgresv1.BGBackupSchedule) ([]bestgresv1.BGBackup, error) {
+	logger := log.FromContext(ctx)
+
+	bgBackupList := &bestgresv1.BGBackupList{}
+	if err := r.List(ctx, bgBackupList, client.InNamespace(bgBackupSchedule.Namespace), client.MatchingLabels{bgBackupScheduleLabel: bgBackupSchedule.Name}); err != nil {
+		logger.Error(err, "Unable to list BGBackups")
+		return nil, err
+	}
+	backups := bgBackupList.Items
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[j].CreationTimestamp.Before(&backups[i].CreationTimestamp)
+	})
+
+	retainFull := int(bgBackupSchedule.Spec.RetainFull)
+	retainIncremental := int(bgBackupSchedule.Spec.RetainIncremental)
+	fullBackups, incrementalBackups := 0, 0
+	for i, bgBackup := range backups {
+		// incremental schedules never take a full backup, their runs are counted on their own
+		incremental := bgBackup.Spec.Type == bestgresv1.BackupTypeIncremental
+		if fullBackups < retainFull && (!incremental || incrementalBackups < retainIncremental) {
+			if bgBackup.Status.Phase == bestgresv1.BGBackupPhaseCompleted {
+				if incremental {
+					incrementalBackups++
+				} else {
+					fullBackups++
+				}
+			}
+			continue
+		}
+		// past the retention, anything still running is left to finish first
+		if bgBackup.Status.Phase != bestgresv1.BGBackupPhaseCompleted && bgBackup.Status.Phase != bestgresv1.BGBackupPhaseFailed {
+			continue
+		}
+		if err := r.Delete(ctx, &backups[i]); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "Unable to delete BGBackup", "BGBackup", bgBackup.Name)
+			return nil, err
+		}
+		logger.Info("Deleted BGBackup past the retention", "BGBackup", bgBackup.Name)
+		backups[i].Name = ""
+	}
+
+	var retained []bestgresv1.BGBackup
+	for _, bgBackup := range backups {
+		if bgBackup.Name != "" {
+			retained = append(retained, bgBackup)
+		}
+	}
+	return retained, nil
+}
+
+// updateBGBackupScheduleStatus writes the status when it changed
+func (r *BGBackupScheduleReconciler) updateBGBackupScheduleStatus(ctx context.Context, bgBackupSchedule *bestgresv1.BGBackupSchedule, status *bestgresv1.BGBackupScheduleStatus) error {
+	if equality.Semantic.DeepEqual(*status, bgBackupSchedule.Status) {
+		return nil
+	}
+	bgBackupSchedule.Status = *status
+	if err := r.Status().Update(ctx, bgBackupSchedule); err != nil {
+		log.FromContext(ctx).Error(err, "Unable to update BGBackupSchedule status")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// newTestScheduledBGBackup returns a BGBackup of the schedule created age hours ago
+func newTestScheduledBGBackup(age int, backupType, phase string) *bestgresv1.BGBackup {
+	return &bestgresv1.BGBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("schedule-%d", age),
+			Namespace:         "default",
+			Labels:            map[string]string{bgBackupScheduleLabel: "schedule"},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Duration(age) * time.Hour)),
+		},
+		Spec:   bestgresv1.BGBackupSpec{BGCluster: "bgcluster", Type: backupType},
+		Status: bestgresv1.BGBackupStatus{Phase: phase},
+	}
+}
+
+func TestRetainBGBackups(t *testing.T) {
+	const (
+		full        = bestgresv1.BackupTypeFull
+		incremental = bestgresv1.BackupTypeIncremental
+		completed   = bestgresv1.BGBackupPhaseCompleted
+		failed      = bestgresv1.BGBackupPhaseFailed
+		running     = bestgresv1.BGBackupPhaseRunning
+	)
+	tests := []struct {
+		name    string
+		backups []*bestgresv1.BGBackup
+		want    []string
+	}{
+		{
+			name: "full backups",
+			backups: []*bestgresv1.BGBackup{
+				newTestScheduledBGBackup(1, full, completed),
+				newTestScheduledBGBackup(2, full, failed),
+				newTestScheduledBGBackup(3, full, completed),
+				newTestScheduledBGBackup(4, full, completed),
+				newTestScheduledBGBackup(5, full, failed),
+			},
+			want: []string{"schedule-1", "schedule-2", "schedule-3"},
+		},
+		{
+			name: "incremental backups",
+			backups: []*bestgresv1.BGBackup{
+				newTestScheduledBGBackup(1, incremental, running),
+				newTestScheduledBGBackup(2, incremental, completed),
+				newTestScheduledBGBackup(3, incremental, failed),
+				newTestScheduledBGBackup(4, incremental, completed),
+				newTestScheduledBGBackup(5, incremental, completed),
+				newTestScheduledBGBackup(6, incremental, completed),
+			},
+			want: []string{"schedule-1", "schedule-2", "schedule-3", "schedule-4", "schedule-5"},
+		},
+		{
+			// the full backup is counted against retainFull only
+			name: "incremental backups after a switch from full",
+			backups: []*bestgresv1.BGBackup{
+				newTestScheduledBGBackup(1, incremental, completed),
+				newTestScheduledBGBackup(2, incremental, completed),
+				newTestScheduledBGBackup(3, incremental, completed),
+				newTestScheduledBGBackup(4, incremental, completed),
+				newTestScheduledBGBackup(5, full, completed),
+			},
+			want: []string{"schedule-1", "schedule-2", "schedule-3", "schedule-5"},
+		},
+		{
+			name: "unfinished backups past the retention",
+			backups: []*bestgresv1.BGBackup{
+				newTestScheduledBGBackup(1, full, completed),
+				newTestScheduledBGBackup(2, full, completed),
+				newTestScheduledBGBackup(3, full, running),
+			},
+			want: []string{"schedule-1", "schedule-2", "schedule-3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bgBackupSchedule := &bestgresv1.BGBackupSchedule{
+				ObjectMeta: metav1.ObjectMeta{Name: "schedule", Namespace: "default"},
+				Spec:       bestgresv1.BGBackupScheduleSpec{RetainFull: 2, RetainIncremental: 3},
+			}
+			objs := []runtime.Object{bgBackupSchedule}
+			for _, bgBackup := range tt.backups {
+				objs = append(objs, bgBackup)
+			}
+			clusterReconciler := newTestBGClusterReconciler(t, objs...)
+			r := &BGBackupScheduleReconciler{Client: clusterReconciler.Client, Scheme: clusterReconciler.Scheme}
+
+			retained, err := r.retainBGBackups(context.Background(), bgBackupSchedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, bgBackup := range retained {
+				names = append(names, bgBackup.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("retained %v, want %v", names, tt.want)
+			}
+
+			remaining := &bestgresv1.BGBackupList{}
+			if err := r.List(context.Background(), remaining); err != nil {
+				t.Fatal(err)
+			}
+			if len(remaining.Items) != len(tt.want) {
+				t.Errorf("%d BGBackups left, want %d", len(remaining.Items), len(tt.want))
+			}
+		})
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 
 	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,11 +21,13 @@ import (
 const (
 	workerListAnnotation = "bgshardedcluster.bestgres.io/workers"
 	initializedAnnotation = "bgcluster.bestgres.io/initialized"
+	// bgClusterPartOfLabel marks the BGClusters that make up a sharded cluster
+	bgClusterPartOfLabel = "bgcluster.bestgres.io/part-of"
 )
 
 func (r *BGShardedClusterReconciler) reconcileCoordinatorBGCluster(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster) error {
 	coordinatorName := fmt.Sprintf("%s-coordinator", bgShardedCluster.Name)
-	err := r.reconcileBGCluster(ctx, bgShardedCluster, coordinatorName, bgShardedCluster.Spec.Coordinator, true)
+	err := r.reconcileBGCluster(ctx, bgShardedCluster, coordinatorName, coordinatorSpec(bgShardedCluster), true)
 	if err != nil {
 		return err
 	}
@@ -76,6 +81,10 @@ func (r *BGShardedClusterReconciler) createBGCluster(ctx context.Context, bgShar
 		},
 		Spec: spec,
 	}
+	// Patroni registers the workers of a patroni-native cluster as Citus groups
+	if bgShardedCluster.Spec.Mode == bestgresv1.ShardedClusterModePatroniNative {
+		bgCluster.Labels[patroni.CitusGroupLabel] = strconv.Itoa(citusGroup(bgShardedCluster, name))
+	}
 
 	if err := ctrl.SetControllerReference(bgShardedCluster, bgCluster, r.Scheme); err != nil {
 		return err
@@ -85,6 +94,16 @@ func (r *BGShardedClusterReconciler) createBGCluster(ctx context.Context, bgShar
 	return r.Create(ctx, bgCluster)
 }
 
+// citusGroup returns the Citus group of a BGCluster of the sharded cluster, the coordinator is
+// group 0 and worker-<n> is group n+1
+func citusGroup(bgShardedCluster *bestgresv1.BGShardedCluster, name string) int {
+	index, err := strconv.Atoi(strings.TrimPrefix(name, bgShardedCluster.Name+"-worker-"))
+	if err != nil {
+		return 0
+	}
+	return index + 1
+}
+
 func (r *BGShardedClusterReconciler) updateBGCluster(ctx context.Context, bgCluster *bestgresv1.BGCluster, spec bestgresv1.BGClusterSpec) error {
 	logger := log.FromContext(ctx)
 
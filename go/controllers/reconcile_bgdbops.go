@@ -3,10 +3,13 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	bestgresv1 "bestgres/api/v1"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -19,6 +22,16 @@ const (
 	bgDbOpsInProgressAnnotation = "bgdbops.bestgres.io/in-progress"
 	bgDbOpsSpecAnnotation       = "bgdbops.bestgres.io/spec"
 	bgDbOpsOpAnnotation         = "bgdbops.bestgres.io/op"
+	bgDbOpsAttemptsAnnotation   = "bgdbops.bestgres.io/attempts"
+	// bgDbOpsDeadlineAnnotation tells the pods when the operation runs out of time
+	bgDbOpsDeadlineAnnotation = "bgdbops.bestgres.io/deadline"
+	// bgDbOpsCancelAnnotation names the operation the operator gave up on, each pod confirms
+	// with bgDbOpsCancelledAnnotation once it no longer runs it
+	bgDbOpsCancelAnnotation    = "bgdbops.bestgres.io/cancel"
+	bgDbOpsCancelledAnnotation = "bgdbops.bestgres.io/cancelled"
+
+	// bgDbOpsPollInterval is how often running operations are checked for completion
+	bgDbOpsPollInterval = 10 * time.Second
 )
 
 func (r *BGDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -36,6 +49,10 @@ func (r *BGDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		logger.Info("BGDbOps completed")
 		return ctrl.Result{}, nil
 	}
+	if bgDbOps.Status.Status == bestgresv1.BGDbOpsStatusFailed {
+		logger.Info("BGDbOps failed", "message", bgDbOps.Status.Message)
+		return ctrl.Result{}, nil
+	}
 
 	// Fetch the target BGCluster
 	bgCluster := &bestgresv1.BGCluster{}
@@ -45,6 +62,18 @@ func (r *BGDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
+	// Switchovers and failovers are carried out by the operator through the Patroni REST API
+	if isLeaderChangeOp(bgDbOps.Spec.Op) {
+		return r.reconcileLeaderChange(ctx, bgDbOps, bgCluster)
+	}
+	// An upgrade moves the BGCluster to the new version once the data directory was upgraded
+	if bgDbOps.Spec.Op == "upgrade" {
+		if err := r.reconcileUpgradedVersion(ctx, bgDbOps, bgCluster); err != nil {
+			logger.Error(err, "Unable to move BGCluster to the upgraded version")
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Check if all pods that are members of the BGCluster have completed the operation
 	podList := &corev1.PodList{}
 	clusterLabels := make(map[string]string)
@@ -71,25 +100,78 @@ func (r *BGDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		delete(bgCluster.Annotations, bgDbOpsSpecAnnotation)
 		delete(bgCluster.Annotations, bgDbOpsPendingAnnotation)
 		delete(bgCluster.Annotations, bgDbOpsInProgressAnnotation)
+		delete(bgCluster.Annotations, bgDbOpsDeadlineAnnotation)
+		delete(bgCluster.Annotations, bgDbOpsCancelAnnotation)
 
 		if err := r.Update(ctx, bgCluster); err != nil {
 			logger.Error(err, "Unable to update BGCluster annotations after completion")
 			return ctrl.Result{}, err
 		}
 		// Mark the bgdbops as completed
+		if bgDbOps.Annotations == nil {
+			bgDbOps.Annotations = make(map[string]string)
+		}
 		bgDbOps.Annotations[bgDbOpsCompletedAnnotation] = "true"
 		if err := r.Update(ctx, bgDbOps); err != nil {
 			logger.Error(err, "Unable to update BGDbOps annotations after completion")
 			return ctrl.Result{}, err
 		}
+		bgDbOps.Status.Status = bestgresv1.BGDbOpsStatusCompleted
+		if bgDbOps.Status.CompletionTime == nil {
+			now := metav1.Now()
+			bgDbOps.Status.CompletionTime = &now
+		}
+		if err := r.Status().Update(ctx, bgDbOps); err != nil {
+			logger.Error(err, "Unable to update BGDbOps status after completion")
+			return ctrl.Result{}, err
+		}
 		logger.Info("All pods completed the operation, BGDbOps marked as completed")
 		return ctrl.Result{}, nil
 	}
 
+	// Give up once a pod ran out of retries or the operation ran out of time
+	if bgCluster.Annotations[bgDbOpsInProgressAnnotation] == bgDbOps.Name {
+		retries, message, failed := bgDbOpsAttempts(bgDbOps, podList.Items)
+		if !failed && bgDbOps.Spec.Timeout != nil && bgDbOps.Status.StartTime != nil &&
+			time.Since(bgDbOps.Status.StartTime.Time) > bgDbOps.Spec.Timeout.Duration {
+			message = fmt.Sprintf("timed out after %s", bgDbOps.Spec.Timeout.Duration)
+			failed = true
+		}
+		if bgDbOps.UpgradeIrreversible() {
+			// the old data directory is gone, failing the upgrade would leave the cluster behind
+			if bgCluster.Annotations[bgDbOpsCancelAnnotation] != "" || bgCluster.Annotations[bgDbOpsDeadlineAnnotation] != "" {
+				logger.Info("Carrying the upgrade through, it can no longer be rolled back", "message", message)
+				delete(bgCluster.Annotations, bgDbOpsCancelAnnotation)
+				delete(bgCluster.Annotations, bgDbOpsDeadlineAnnotation)
+				if err := r.Update(ctx, bgCluster); err != nil {
+					logger.Error(err, "Unable to clear the cancellation of the upgrade")
+					return ctrl.Result{}, err
+				}
+			}
+		} else if failed || bgCluster.Annotations[bgDbOpsCancelAnnotation] == bgDbOps.Name {
+			return r.cancelBGDbOps(ctx, bgDbOps, bgCluster, podList.Items, retries, message)
+		}
+		if retries != bgDbOps.Status.Retries || message != bgDbOps.Status.Message {
+			bgDbOps.Status.Retries = retries
+			bgDbOps.Status.Message = message
+			if err := r.Status().Update(ctx, bgDbOps); err != nil {
+				logger.Error(err, "Unable to update BGDbOps retries")
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
 	// If any pod is still in progress, we don't need to start a new operation
-	if anyInProgress {
+	if anyInProgress || bgCluster.Annotations[bgDbOpsInProgressAnnotation] == bgDbOps.Name {
 		logger.Info("Operation still in progress on some pods")
-		return ctrl.Result{}, nil
+		// pod annotations don't trigger a reconcile, check back for completion
+		return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
+	}
+
+	// Only one operation runs on a cluster at a time
+	if inProgress := bgCluster.Annotations[bgDbOpsInProgressAnnotation]; inProgress != "" {
+		logger.Info("Waiting for another operation to finish", "BGDbOps", inProgress)
+		return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
 	}
 
 	// If we reach here, it means not all pods have completed, and no pod is currently in progress
@@ -112,6 +194,19 @@ func (r *BGDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	}
 	bgCluster.Annotations[bgDbOpsSpecAnnotation] = string(specJSON)
 
+	// the pods stop the operation at the deadline on their own
+	startTime := bgDbOps.Status.StartTime
+	if startTime == nil {
+		now := metav1.Now()
+		startTime = &now
+	}
+	if bgDbOps.Spec.Timeout != nil && !bgDbOps.UpgradeIrreversible() {
+		deadline := startTime.Add(bgDbOps.Spec.Timeout.Duration)
+		bgCluster.Annotations[bgDbOpsDeadlineAnnotation] = deadline.UTC().Format(time.RFC3339)
+	} else {
+		delete(bgCluster.Annotations, bgDbOpsDeadlineAnnotation)
+	}
+
 	// Update BGCluster
 	if err := r.Update(ctx, bgCluster); err != nil {
 		logger.Error(err, "Unable to update BGCluster annotations")
@@ -119,5 +214,104 @@ func (r *BGDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	}
 
 	logger.Info("BGCluster annotations updated to continue/start operation")
-	return ctrl.Result{}, nil
-}
\ No newline at end of file
+
+	if bgDbOps.Status.Status != bestgresv1.BGDbOpsStatusRunning {
+		bgDbOps.Status.Status = bestgresv1.BGDbOpsStatusRunning
+		bgDbOps.Status.StartTime = startTime
+		if err := r.Status().Update(ctx, bgDbOps); err != nil {
+			logger.Error(err, "Unable to update BGDbOps status")
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
+}
+
+// bgDbOpsAttempts sums up the retries the pods recorded for the operation and returns the last
+// error, failed is set once a pod used up its retries
+func bgDbOpsAttempts(bgDbOps *bestgresv1.BGDbOps, pods []corev1.Pod) (retries int, message string, failed bool) {
+	for _, pod := range pods {
+		value := pod.Annotations[bgDbOpsAttemptsAnnotation]
+		if value == "" {
+			continue
+		}
+		attempts := bestgresv1.BGDbOpsAttempts{}
+		if err := json.Unmarshal([]byte(value), &attempts); err != nil || attempts.BGDbOps != bgDbOps.Name {
+			continue
+		}
+		if attempts.Failed {
+			// the last attempt wasn't retried
+			retries += attempts.Attempts - 1
+			failed = true
+		} else {
+			retries += attempts.Attempts
+		}
+		if attempts.LastError != "" && (message == "" || attempts.Failed) {
+			message = fmt.Sprintf("%s: %s", pod.Name, attempts.LastError)
+		}
+	}
+	return retries, message, failed
+}
+
+// cancelBGDbOps cancels the operation on the pods and fails it once every running pod
+// confirmed it no longer runs it
+func (r *BGDbOpsReconciler) cancelBGDbOps(ctx context.Context, bgDbOps *bestgresv1.BGDbOps, bgCluster *bestgresv1.BGCluster, pods []corev1.Pod, retries int, message string) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if message == "" {
+		// the reason was recorded when the operation was cancelled
+		message = bgDbOps.Status.Message
+	}
+	if bgCluster.Annotations[bgDbOpsCancelAnnotation] != bgDbOps.Name {
+		bgCluster.Annotations[bgDbOpsCancelAnnotation] = bgDbOps.Name
+		if err := r.Update(ctx, bgCluster); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to cancel BGDbOps on BGCluster %s: %w", bgCluster.Name, err)
+		}
+		bgDbOps.Status.Retries = retries
+		bgDbOps.Status.Message = message
+		if err := r.Status().Update(ctx, bgDbOps); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update BGDbOps status: %w", err)
+		}
+		logger.Info("Cancelling BGDbOps", "message", message)
+		return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
+	}
+	// a pod that isn't running can't be running the operation either
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if pod.Annotations[bgDbOpsCancelledAnnotation] != bgDbOps.Name {
+			logger.Info("Waiting for the pod to stop the cancelled operation", "pod", pod.Name)
+			return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
+		}
+	}
+	return ctrl.Result{}, r.failBGDbOps(ctx, bgDbOps, bgCluster, retries, message)
+}
+
+// failBGDbOps marks the operation as failed and clears it from the BGCluster so the next
+// operation can start
+func (r *BGDbOpsReconciler) failBGDbOps(ctx context.Context, bgDbOps *bestgresv1.BGDbOps, bgCluster *bestgresv1.BGCluster, retries int, message string) error {
+	logger := log.FromContext(ctx)
+
+	delete(bgCluster.Annotations, bgDbOpsOpAnnotation)
+	delete(bgCluster.Annotations, bgDbOpsSpecAnnotation)
+	delete(bgCluster.Annotations, bgDbOpsPendingAnnotation)
+	delete(bgCluster.Annotations, bgDbOpsInProgressAnnotation)
+	delete(bgCluster.Annotations, bgDbOpsDeadlineAnnotation)
+	delete(bgCluster.Annotations, bgDbOpsCancelAnnotation)
+	if err := r.Update(ctx, bgCluster); err != nil {
+		return fmt.Errorf("failed to clear BGDbOps annotations on BGCluster %s: %w", bgCluster.Name, err)
+	}
+
+	bgDbOps.Status.Status = bestgresv1.BGDbOpsStatusFailed
+	bgDbOps.Status.Retries = retries
+	bgDbOps.Status.Message = message
+	if bgDbOps.Status.CompletionTime == nil {
+		now := metav1.Now()
+		bgDbOps.Status.CompletionTime = &now
+	}
+	if err := r.Status().Update(ctx, bgDbOps); err != nil {
+		return fmt.Errorf("failed to update BGDbOps status: %w", err)
+	}
+	logger.Info("BGDbOps failed", "message", message)
+	return nil
+}
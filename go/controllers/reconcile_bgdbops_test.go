@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUpgradeTimeout(t *testing.T) {
+	tests := []struct {
+		phase      string
+		wantCancel bool
+	}{
+		{bestgresv1.UpgradePhaseStopping, true},
+		{bestgresv1.UpgradePhaseUpgraded, false},
+		{bestgresv1.UpgradePhaseCompleted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phase, func(t *testing.T) {
+			ctx := context.Background()
+			bgCluster := newTestBGCluster(false)
+			bgCluster.Spec.Postgresql.Version = "17"
+			bgCluster.Annotations = map[string]string{
+				bgDbOpsPendingAnnotation:    "true",
+				bgDbOpsOpAnnotation:         "upgrade",
+				bgDbOpsInProgressAnnotation: "upgrade",
+				bgDbOpsDeadlineAnnotation:   time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+			}
+			started := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+			bgDbOps := &bestgresv1.BGDbOps{
+				ObjectMeta: metav1.ObjectMeta{Name: "upgrade", Namespace: "default"},
+				Spec: bestgresv1.BGDbOpsSpec{
+					BGCluster: "bgcluster",
+					Op:        "upgrade",
+					Timeout:   &metav1.Duration{Duration: time.Hour},
+					Upgrade:   &bestgresv1.UpgradeSpec{PostgresVersion: "17"},
+				},
+				Status: bestgresv1.BGDbOpsStatus{
+					Status:        bestgresv1.BGDbOpsStatusRunning,
+					StartTime:     &started,
+					UpgradeResult: &bestgresv1.UpgradeResult{FromVersion: "16", ToVersion: "17", Phase: tt.phase},
+				},
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "bgcluster-0", Namespace: "default", Labels: map[string]string{"cluster-name": "bgcluster"}},
+				Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+			scheme := newTestBGClusterReconciler(t).Scheme
+			r := &BGDbOpsReconciler{
+				Client: fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(bgCluster, bgDbOps, pod).
+					WithStatusSubresource(bgDbOps).Build(),
+				Scheme: scheme,
+			}
+
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "upgrade", Namespace: "default"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Get(ctx, types.NamespacedName{Name: "bgcluster", Namespace: "default"}, bgCluster); err != nil {
+				t.Fatal(err)
+			}
+			if cancelled := bgCluster.Annotations[bgDbOpsCancelAnnotation] == "upgrade"; cancelled != tt.wantCancel {
+				t.Errorf("upgrade cancelled: %v, want %v", cancelled, tt.wantCancel)
+			}
+			if !tt.wantCancel && bgCluster.Annotations[bgDbOpsDeadlineAnnotation] != "" {
+				t.Error("irreversible upgrade kept its deadline")
+			}
+			if bgCluster.Annotations[bgDbOpsInProgressAnnotation] != "upgrade" {
+				t.Error("upgrade was cleared from the BGCluster")
+			}
+		})
+	}
+}
@@ -51,8 +51,12 @@ func (r *BGShardedDbOpsReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return ctrl.Result{}, err
 	}
 
-	// Create BGDbOps for all worker clusters
-	for _, workerCluster := range bgShardedCluster.Status.WorkerClusters {
+	// Create BGDbOps for all worker clusters, a rebalance moves shards from the coordinator
+	workerClusters := bgShardedCluster.Status.WorkerClusters
+	if bgShardedDbOps.Spec.BGDbOpsClusterSpec.Op == "rebalance" {
+		workerClusters = nil
+	}
+	for _, workerCluster := range workerClusters {
 		if err := r.createBGDbOps(ctx, bgShardedDbOps, workerCluster); err != nil {
 			return ctrl.Result{}, err
 		}
@@ -86,10 +90,13 @@ func (r *BGShardedDbOpsReconciler) createBGDbOps(ctx context.Context, bgShardedD
 			BGCluster:  bgClusterName,
 			Op:         bgShardedDbOps.Spec.BGDbOpsClusterSpec.Op,
 			MaxRetries: bgShardedDbOps.Spec.BGDbOpsClusterSpec.MaxRetries,
+			Timeout:    bgShardedDbOps.Spec.BGDbOpsClusterSpec.Timeout,
 			Benchmark:  bgShardedDbOps.Spec.BGDbOpsClusterSpec.Benchmark,
 			Repack:     bgShardedDbOps.Spec.BGDbOpsClusterSpec.Repack,
 			Restart:    bgShardedDbOps.Spec.BGDbOpsClusterSpec.Restart,
 			Vacuum:     bgShardedDbOps.Spec.BGDbOpsClusterSpec.Vacuum,
+			Analyze:    bgShardedDbOps.Spec.BGDbOpsClusterSpec.Analyze,
+			Rebalance:  bgShardedDbOps.Spec.BGDbOpsClusterSpec.Rebalance,
 		},
 	}
 
@@ -6,8 +6,8 @@ import (
 	"time"
 
 	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
 
-	"gopkg.in/yaml.v2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -25,8 +25,8 @@ func (r *BGClusterReconciler) reconcileConfigMaps(ctx context.Context, bgCluster
 	}
 
 	configMapNames := []string{
-		bgCluster.Name + "-config",
-		bgCluster.Name + "-leader",
+		dcsConfigMapPrefix(bgCluster) + "-config",
+		dcsConfigMapPrefix(bgCluster) + "-leader",
 	}
 
 	for _, cmName := range configMapNames {
@@ -84,7 +84,7 @@ func (r *BGClusterReconciler) reconcileSpiloConfigMap(ctx context.Context, bgClu
 	log := ctrl.LoggerFrom(ctx)
 	configMapKey := "postgres.yaml"
 
-	spiloConfig, err := r.createSpiloConfiguration()
+	spiloConfig, err := r.createSpiloConfiguration(bgCluster)
 	if err != nil {
 		return err
 	}
@@ -142,29 +142,7 @@ func (r *BGClusterReconciler) reconcileSpiloConfigMap(ctx context.Context, bgClu
 	})
 }
 
-func (r *BGClusterReconciler) createSpiloConfiguration() (string, error) {
-	baseConfig := map[string]interface{}{
-		"bootstrap": map[string]interface{}{
-			"initdb": []map[string]string{
-				{"auth-host": "md5"},
-				{"auth-local": "trust"},
-			},
-		},
-	}
-
-	// TODO enable user-supplied configuration options
-	// // Merge user-supplied configuration
-	// if bgCluster.Spec.PostgresConf != nil {
-	// 	for key, value := range bgCluster.Spec.PostgresConf {
-	// 		baseConfig[key] = value
-	// 	}
-	// }
-	
-	//Convert the final configuration to a YAML string
-	configBytes, err := yaml.Marshal(baseConfig)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal Spilo configuration: %w", err)
-	}
-
-	return string(configBytes), nil
+// createSpiloConfiguration renders the Patroni configuration passed to the pods through SPILO_CONFIGURATION
+func (r *BGClusterReconciler) createSpiloConfiguration(bgCluster *bestgresv1.BGCluster) (string, error) {
+	return patroni.MarshalConfiguration(bgCluster, bgCluster.Labels[bgClusterPartOfLabel] != "")
 }
\ No newline at end of file
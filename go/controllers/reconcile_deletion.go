@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// bgClusterFinalizer holds the deletion of a BGCluster until it was shut down cleanly
+	bgClusterFinalizer = "bgcluster.bestgres.io/finalizer"
+	// bgClusterShutdownAnnotation asks the in-pod controllers to stop postgres, it holds the time
+	// of the request on the BGCluster and is set to "completed" on the pods that stopped
+	bgClusterShutdownAnnotation = "bgcluster.bestgres.io/shutdown"
+	shutdownCompleted           = "completed"
+
+	// shutdownTimeout is how long to wait for the members to stop before deleting them anyway
+	shutdownTimeout = 2 * time.Minute
+	// deletionPollInterval is how often the progress of a deletion is checked
+	deletionPollInterval = 5 * time.Second
+)
+
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+// reconcileDeletion shuts a deleted BGCluster down in order: pause Patroni so it doesn't fail
+// over or restart postgres, stop every member cleanly, remove the pods, remove the Patroni DCS
+// ConfigMaps and apply the deletion policy to the volumes. The finalizer is removed last.
+func (r *BGClusterReconciler) reconcileDeletion(ctx context.Context, bgCluster *bestgresv1.BGCluster) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if !controllerutil.ContainsFinalizer(bgCluster, bgClusterFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	if bgCluster.Status.Phase != bestgresv1.BGClusterPhaseDeleting {
+		bgCluster.Status.Phase = bestgresv1.BGClusterPhaseDeleting
+		if err := r.Status().Update(ctx, bgCluster); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update BGCluster status: %w", err)
+		}
+	}
+
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList,
+		client.InNamespace(bgCluster.Namespace),
+		client.MatchingLabels(labelsForBGCluster(bgCluster.Name)),
+	); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	// Pause Patroni and ask the members to stop
+	requestedAt := bgCluster.Annotations[bgClusterShutdownAnnotation]
+	if requestedAt == "" {
+		if err := r.pausePatroni(ctx, bgCluster); err != nil {
+			return ctrl.Result{}, err
+		}
+		if bgCluster.Annotations == nil {
+			bgCluster.Annotations = make(map[string]string)
+		}
+		bgCluster.Annotations[bgClusterShutdownAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		if err := r.Update(ctx, bgCluster); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to request shutdown of BGCluster %s: %w", bgCluster.Name, err)
+		}
+		log.Info("Requested clean shutdown", "BGCluster.Name", bgCluster.Name)
+		return ctrl.Result{RequeueAfter: deletionPollInterval}, nil
+	}
+
+	// Wait for the members to stop
+	if running := runningMembers(podList.Items); len(running) > 0 {
+		requested, err := time.Parse(time.RFC3339, requestedAt)
+		if err == nil && time.Since(requested) < shutdownTimeout {
+			log.Info("Waiting for members to shut down", "Pods", running)
+			return ctrl.Result{RequeueAfter: deletionPollInterval}, nil
+		}
+		log.Info("Members did not shut down in time, deleting them anyway", "Pods", running)
+	}
+
+	// Remove the pods before the DCS, Patroni would recreate its ConfigMaps otherwise
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: bgCluster.Name, Namespace: bgCluster.Namespace}}
+	if err := r.Delete(ctx, sts); err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, fmt.Errorf("failed to delete StatefulSet %s: %w", sts.Name, err)
+	}
+	if len(podList.Items) > 0 {
+		log.Info("Waiting for pods to terminate", "BGCluster.Name", bgCluster.Name)
+		return ctrl.Result{RequeueAfter: deletionPollInterval}, nil
+	}
+
+	if err := r.deleteDCSConfigMaps(ctx, bgCluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	done, err := r.applyDeletionPolicy(ctx, bgCluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !done {
+		return ctrl.Result{RequeueAfter: deletionPollInterval}, nil
+	}
+
+	controllerutil.RemoveFinalizer(bgCluster, bgClusterFinalizer)
+	if err := r.Update(ctx, bgCluster); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to remove finalizer from BGCluster %s: %w", bgCluster.Name, err)
+	}
+	log.Info("BGCluster shut down", "BGCluster.Name", bgCluster.Name, "DeletionPolicy", bgCluster.Spec.DeletionPolicy)
+	return ctrl.Result{}, nil
+}
+
+// pausePatroni puts the cluster in maintenance mode, nothing to do when no member is running
+func (r *BGClusterReconciler) pausePatroni(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
+	patroniClient, err := patroniClientForBGCluster(ctx, r.Client, bgCluster)
+	if err != nil {
+		return err
+	}
+	if patroniClient == nil {
+		ctrl.LoggerFrom(ctx).Info("No running member, skipping Patroni pause", "BGCluster.Name", bgCluster.Name)
+		return nil
+	}
+	if err := patroniClient.PatchConfig(ctx, map[string]interface{}{"pause": true}); err != nil {
+		return fmt.Errorf("failed to pause Patroni: %w", err)
+	}
+	return nil
+}
+
+// runningMembers returns the running pods that haven't reported a clean shutdown yet
+func runningMembers(pods []corev1.Pod) []string {
+	var running []string
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodRunning && pod.Annotations[bgClusterShutdownAnnotation] != shutdownCompleted {
+			running = append(running, pod.Name)
+		}
+	}
+	return running
+}
+
+// deleteDCSConfigMaps removes the ConfigMaps Patroni keeps the cluster state in
+func (r *BGClusterReconciler) deleteDCSConfigMaps(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
+	for _, suffix := range []string{"-config", "-leader", "-failover", "-sync"} {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: dcsConfigMapPrefix(bgCluster) + suffix, Namespace: bgCluster.Namespace}}
+		if err := r.Delete(ctx, cm); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete ConfigMap %s: %w", cm.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyDeletionPolicy keeps, snapshots or deletes the volumes of the cluster and reports
+// whether it is done
+func (r *BGClusterReconciler) applyDeletionPolicy(ctx context.Context, bgCluster *bestgresv1.BGCluster) (bool, error) {
+	policy := bgCluster.Spec.DeletionPolicy
+	if policy == "" || policy == bestgresv1.DeletionPolicyRetain {
+		return true, nil
+	}
+
+	pvcList := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcList,
+		client.InNamespace(bgCluster.Namespace),
+		client.MatchingLabels(labelsForBGCluster(bgCluster.Name)),
+	); err != nil {
+		return false, fmt.Errorf("failed to list PersistentVolumeClaims: %w", err)
+	}
+
+	done := true
+	for i := range pvcList.Items {
+		pvc := &pvcList.Items[i]
+		if policy == bestgresv1.DeletionPolicySnapshot && strings.HasPrefix(pvc.Name, "pgdata-") {
+			ready, err := r.snapshotVolume(ctx, bgCluster, pvc)
+			if err != nil {
+				return false, err
+			}
+			if !ready {
+				ctrl.LoggerFrom(ctx).Info("Waiting for VolumeSnapshot", "PersistentVolumeClaim", pvc.Name)
+				done = false
+				continue
+			}
+		}
+		if err := r.Delete(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to delete PersistentVolumeClaim %s: %w", pvc.Name, err)
+		}
+	}
+	return done, nil
+}
+
+// snapshotVolume takes a VolumeSnapshot of the claim, it isn't owned by the BGCluster so it
+// outlives it. Returns whether the snapshot is ready to use.
+func (r *BGClusterReconciler) snapshotVolume(ctx context.Context, bgCluster *bestgresv1.BGCluster, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	name := pvc.Name + "-" + strconv.FormatInt(bgCluster.DeletionTimestamp.Unix(), 10)
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: pvc.Namespace}, snapshot)
+	if errors.IsNotFound(err) {
+		snapshot = &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		snapshot.SetName(name)
+		snapshot.SetNamespace(pvc.Namespace)
+		snapshot.SetLabels(labelsForBGCluster(bgCluster.Name))
+		if err := unstructured.SetNestedField(snapshot.Object, pvc.Name, "spec", "source", "persistentVolumeClaimName"); err != nil {
+			return false, err
+		}
+		if class := bgCluster.Spec.VolumeSpec.VolumeSnapshotClassName; class != "" {
+			if err := unstructured.SetNestedField(snapshot.Object, class, "spec", "volumeSnapshotClassName"); err != nil {
+				return false, err
+			}
+		}
+		if err := r.Create(ctx, snapshot); err != nil {
+			return false, fmt.Errorf("failed to create VolumeSnapshot %s: %w", name, err)
+		}
+		ctrl.LoggerFrom(ctx).Info("Created VolumeSnapshot", "VolumeSnapshot", name, "PersistentVolumeClaim", pvc.Name)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get VolumeSnapshot %s: %w", name, err)
+	}
+
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	return ready, nil
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// dcsConfigAnnotation holds the dynamic configuration last pushed to the Patroni DCS,
+	// so keys removed from the spec can be removed from the DCS as well
+	dcsConfigAnnotation = "bgcluster.bestgres.io/dcs-config"
+)
+
+// reconcilePatroniConfig pushes the dynamic configuration rendered from the spec to the DCS
+// of a running cluster and returns the cluster as Patroni sees it, or nil if no member runs.
+// Clusters that aren't running yet pick the configuration up from bootstrap.dcs instead.
+func (r *BGClusterReconciler) reconcilePatroniConfig(ctx context.Context, bgCluster *bestgresv1.BGCluster) (*patroni.Cluster, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	patroniClient, err := patroniClientForBGCluster(ctx, r.Client, bgCluster)
+	if err != nil {
+		return nil, err
+	}
+	if patroniClient == nil {
+		log.Info("No running members to configure", "BGCluster.Name", bgCluster.Name)
+		return nil, nil
+	}
+
+	desired := patroni.DynamicConfiguration(bgCluster)
+	desiredJSON, err := json.Marshal(desired)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal Patroni configuration: %w", err)
+	}
+
+	if bgCluster.Annotations[dcsConfigAnnotation] != string(desiredJSON) {
+		applied := map[string]interface{}{}
+		if previous, ok := bgCluster.Annotations[dcsConfigAnnotation]; ok {
+			if err := json.Unmarshal([]byte(previous), &applied); err != nil {
+				log.Error(err, "Ignoring invalid annotation", "Annotation", dcsConfigAnnotation)
+				applied = map[string]interface{}{}
+			}
+		}
+
+		log.Info("Updating Patroni configuration", "BGCluster.Namespace", bgCluster.Namespace, "BGCluster.Name", bgCluster.Name)
+		if err := patroniClient.PatchConfig(ctx, patroni.ConfigPatch(applied, desired)); err != nil {
+			return nil, fmt.Errorf("failed to patch Patroni configuration: %w", err)
+		}
+
+		patch := client.MergeFrom(bgCluster.DeepCopy())
+		if bgCluster.Annotations == nil {
+			bgCluster.Annotations = make(map[string]string)
+		}
+		bgCluster.Annotations[dcsConfigAnnotation] = string(desiredJSON)
+		if err := r.Patch(ctx, bgCluster, patch); err != nil {
+			return nil, fmt.Errorf("failed to record applied Patroni configuration: %w", err)
+		}
+	}
+
+	cluster, err := patroniClient.Cluster(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Patroni cluster: %w", err)
+	}
+	return patroni.ClusterFor(bgCluster, cluster), nil
+}
+
+// patroniClientForBGCluster returns a client for a running member of the cluster, preferring
+// the primary, or nil if no member is running
+func patroniClientForBGCluster(ctx context.Context, c client.Client, bgCluster *bestgresv1.BGCluster) (*patroni.Client, error) {
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList,
+		client.InNamespace(bgCluster.Namespace),
+		client.MatchingLabels(labelsForBGCluster(bgCluster.Name)),
+	); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var candidates []corev1.Pod
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if pod.Labels[roleLabel] == primaryRoleLabelValue {
+			candidates = append([]corev1.Pod{pod}, candidates...)
+		} else {
+			candidates = append(candidates, pod)
+		}
+	}
+
+	for _, pod := range candidates {
+		patroniClient := patroni.NewClient(pod.Status.PodIP)
+		if _, err := patroniClient.Status(ctx); err != nil {
+			ctrl.LoggerFrom(ctx).Info("Patroni API not reachable", "Pod.Name", pod.Name, "error", err.Error())
+			continue
+		}
+		return patroniClient, nil
+	}
+	return nil, nil
+}
+
+// pendingRestartsFromCluster lists the members Patroni flags as pending restart
+func pendingRestartsFromCluster(cluster *patroni.Cluster) []bestgresv1.PendingRestart {
+	var pending []bestgresv1.PendingRestart
+	for _, member := range cluster.Members {
+		if !member.PendingRestart {
+			continue
+		}
+		entry := bestgresv1.PendingRestart{Member: member.Name}
+		for parameter := range member.PendingRestartReason {
+			entry.Parameters = append(entry.Parameters, parameter)
+		}
+		sort.Strings(entry.Parameters)
+		pending = append(pending, entry)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Member < pending[j].Member })
+	return pending
+}
@@ -61,6 +61,11 @@ func (r *BGClusterReconciler) reconcileRole(ctx context.Context, bgCluster *best
                 Resources: []string{"bgdbops"},
                 Verbs:     []string{"get", "list", "update"},
             },
+            {
+                APIGroups: []string{"bestgres.io"},
+                Resources: []string{"bgdbops/status"},
+                Verbs:     []string{"get", "update"},
+            },
         },
     }
     
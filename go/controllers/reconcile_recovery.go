@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/backup"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// bgClusterRecoverySourceAnnotation holds the backup.Source a restored cluster starts from,
+	// it is resolved once before the StatefulSet is created so the pods don't depend on the
+	// BGBackup afterwards
+	bgClusterRecoverySourceAnnotation = "bgcluster.bestgres.io/recovery-source"
+	// bgClusterRecoveryAnnotation is set by the in-pod controller on the restored member once
+	// it was promoted
+	bgClusterRecoveryAnnotation = "bgcluster.bestgres.io/recovery"
+
+	// recoveryPollInterval is how often a restored cluster checks whether its source is usable
+	recoveryPollInterval = 10 * time.Second
+)
+
+// reconcileRecoverySource resolves the backup a restored cluster starts from, it returns false
+// while the pods can't be created yet
+func (r *BGClusterReconciler) reconcileRecoverySource(ctx context.Context, bgCluster *bestgresv1.BGCluster) (bool, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	if bgCluster.Spec.Bootstrap == nil || bgCluster.Spec.Bootstrap.Recovery == nil {
+		return true, nil
+	}
+	if bgCluster.Annotations[bgClusterRecoverySourceAnnotation] != "" {
+		return true, nil
+	}
+	// a recovery section added to an existing cluster is ignored, nothing is restored over it
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, types.NamespacedName{Name: bgCluster.Name, Namespace: bgCluster.Namespace}, sts); err == nil {
+		return true, nil
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	status := bgCluster.Status.DeepCopy()
+	status.Recovery = &bestgresv1.RecoveryStatus{
+		Phase:  bestgresv1.RecoveryPhasePending,
+		Source: recoverySourceDescription(bgCluster.Spec.Bootstrap.Recovery),
+	}
+	source, err := r.resolveRecoverySource(ctx, bgCluster)
+	if err != nil {
+		log.Info("Waiting for the recovery source", "reason", err.Error())
+		status.Recovery.Message = err.Error()
+		if !equality.Semantic.DeepEqual(*status, bgCluster.Status) {
+			bgCluster.Status = *status
+			if err := r.Status().Update(ctx, bgCluster); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	sourceJSON, err := json.Marshal(source)
+	if err != nil {
+		return false, err
+	}
+	if bgCluster.Annotations == nil {
+		bgCluster.Annotations = make(map[string]string)
+	}
+	bgCluster.Annotations[bgClusterRecoverySourceAnnotation] = string(sourceJSON)
+	if err := r.Update(ctx, bgCluster); err != nil {
+		return false, err
+	}
+	log.Info("Resolved the recovery source", "source", status.Recovery.Source, "backup", source.BackupID)
+	return true, nil
+}
+
+// resolveRecoverySource returns the storage and backup the cluster is restored from, the
+// error says why it can't be restored yet
+func (r *BGClusterReconciler) resolveRecoverySource(ctx context.Context, bgCluster *bestgresv1.BGCluster) (*backup.Source, error) {
+	recovery := bgCluster.Spec.Bootstrap.Recovery
+	if bgCluster.Labels[bgClusterPartOfLabel] != "" {
+		return nil, fmt.Errorf("restoring the clusters of a BGShardedCluster is not supported")
+	}
+	if (recovery.BGBackup == "") == (recovery.Source == nil) {
+		return nil, fmt.Errorf("set exactly one of bgBackup and source")
+	}
+	if target := recovery.Target; target != nil {
+		set := 0
+		for _, isSet := range []bool{target.Time != nil, target.LSN != "", target.Name != ""} {
+			if isSet {
+				set++
+			}
+		}
+		if set > 1 {
+			return nil, fmt.Errorf("set at most one of time, lsn and name as the recovery target")
+		}
+		if target.LSN != "" {
+			if _, err := backup.ParseLSN(target.LSN); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	source := &backup.Source{}
+	if recovery.BGBackup != "" {
+		bgBackup := &bestgresv1.BGBackup{}
+		if err := r.Get(ctx, types.NamespacedName{Name: recovery.BGBackup, Namespace: bgCluster.Namespace}, bgBackup); err != nil {
+			return nil, fmt.Errorf("failed to get BGBackup %s: %w", recovery.BGBackup, err)
+		}
+		if bgBackup.Status.Phase != bestgresv1.BGBackupPhaseCompleted {
+			return nil, fmt.Errorf("BGBackup %s is not completed", bgBackup.Name)
+		}
+		if target := recovery.Target; target != nil && target.Time != nil && bgBackup.Status.CompletionTime != nil &&
+			bgBackup.Status.CompletionTime.After(target.Time.Time) {
+			return nil, fmt.Errorf("BGBackup %s completed after the recovery target time", bgBackup.Name)
+		}
+		sourceCluster := &bestgresv1.BGCluster{}
+		if err := r.Get(ctx, types.NamespacedName{Name: bgBackup.Spec.BGCluster, Namespace: bgCluster.Namespace}, sourceCluster); err != nil {
+			return nil, fmt.Errorf("failed to get BGCluster %s of BGBackup %s, restore from its storage instead: %w", bgBackup.Spec.BGCluster, bgBackup.Name, err)
+		}
+		target := backup.TargetFor(sourceCluster)
+		if target == nil {
+			return nil, fmt.Errorf("BGCluster %s has no backup storage configured", sourceCluster.Name)
+		}
+		source.Target = *target
+		source.Method = bgBackup.Status.Method
+		source.BackupID = bgBackup.Status.BackupID
+	} else {
+		source.Method = recovery.Source.Method
+		if source.Method == "" {
+			source.Method = bestgresv1.BackupMethodWALG
+		}
+		source.Storage = recovery.Source.Storage
+		source.Cluster = recovery.Source.BGCluster
+		source.BackupID = recovery.Source.BackupID
+	}
+	if (source.Storage.S3 == nil) == (source.Storage.Filesystem == nil) {
+		return nil, fmt.Errorf("set exactly one of s3 and filesystem as the storage of the recovery source")
+	}
+	source.Restore = true
+
+	// the restored cluster archives to its own storage, never into the one it is restored from
+	if own := backup.TargetFor(bgCluster); own != nil && own.SameLocation(&source.Target) {
+		return nil, fmt.Errorf("spec.backup points at the storage location the cluster is restored from, use another prefix")
+	}
+	return source, nil
+}
+
+// recoverySourceDescription names the source of a restore for the status
+func recoverySourceDescription(recovery *bestgresv1.RecoverySpec) string {
+	if recovery.BGBackup != "" {
+		return "bgbackup/" + recovery.BGBackup
+	}
+	if recovery.Source != nil {
+		target := backup.Target{Storage: recovery.Source.Storage, Cluster: recovery.Source.BGCluster}
+		return target.Location()
+	}
+	return ""
+}
+
+// observeRecovery reports the restore of the cluster from the annotation of its restored member
+func observeRecovery(status *bestgresv1.BGClusterStatus, bgCluster *bestgresv1.BGCluster, pods []corev1.Pod) {
+	if bgCluster.Annotations[bgClusterRecoverySourceAnnotation] == "" || bgCluster.Spec.Bootstrap == nil || bgCluster.Spec.Bootstrap.Recovery == nil {
+		return
+	}
+	if status.Recovery != nil && status.Recovery.Phase == bestgresv1.RecoveryPhasePromoted {
+		return
+	}
+
+	recovery := &bestgresv1.RecoveryStatus{
+		Phase:  bestgresv1.RecoveryPhaseRestoring,
+		Source: recoverySourceDescription(bgCluster.Spec.Bootstrap.Recovery),
+	}
+	if source := recoverySource(bgCluster); source != nil {
+		recovery.BackupID = source.BackupID
+	}
+	for _, pod := range pods {
+		value := pod.Annotations[bgClusterRecoveryAnnotation]
+		if value == "" {
+			continue
+		}
+		reported := bestgresv1.RecoveryStatus{}
+		if err := json.Unmarshal([]byte(value), &reported); err != nil {
+			continue
+		}
+		reported.Phase = bestgresv1.RecoveryPhasePromoted
+		reported.Source = recovery.Source
+		recovery = &reported
+		break
+	}
+	status.Recovery = recovery
+}
+
+// recoveryEnvironmentVariables hands the resolved recovery source and the credentials of its
+// storage to the in-pod controller
+func recoveryEnvironmentVariables(bgCluster *bestgresv1.BGCluster) []corev1.EnvVar {
+	source := recoverySource(bgCluster)
+	if source == nil {
+		return nil
+	}
+	env := []corev1.EnvVar{{Name: backup.RestoreSourceEnv, Value: bgCluster.Annotations[bgClusterRecoverySourceAnnotation]}}
+	if source.Storage.S3 != nil {
+		credentials := source.Storage.S3.CredentialsSecret
+		env = append(env,
+			corev1.EnvVar{Name: backup.RestoreAccessKeyIDEnv, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: credentials}, Key: "accessKeyId"}}},
+			corev1.EnvVar{Name: backup.RestoreSecretAccessKeyEnv, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: credentials}, Key: "secretAccessKey"}}},
+		)
+	}
+	return env
+}
+
+// recoverySource returns the resolved recovery source of the cluster, nil when it isn't
+// restored from a backup
+func recoverySource(bgCluster *bestgresv1.BGCluster) *backup.Source {
+	sourceJSON := bgCluster.Annotations[bgClusterRecoverySourceAnnotation]
+	if sourceJSON == "" {
+		return nil
+	}
+	source := &backup.Source{}
+	if err := json.Unmarshal([]byte(sourceJSON), source); err != nil {
+		return nil
+	}
+	return source
+}
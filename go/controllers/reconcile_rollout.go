@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// rolloutPollInterval is how often a rollout checks whether it can take the next step
+	rolloutPollInterval = 10 * time.Second
+	// rolloutPodTimeout is how long a replaced pod may take to run as a healthy member before
+	// the rollout pauses
+	rolloutPodTimeout = 10 * time.Minute
+)
+
+// reconcileRollout replaces the pods that don't run the update revision of the OnDelete
+// StatefulSet one at a time: the replicas first, then the primary after a switchover to an
+// updated replica. Each step waits for every member to be healthy. It returns the rollout
+// status, a step that fails pauses the rollout until the pod template changes again.
+func (r *BGClusterReconciler) reconcileRollout(ctx context.Context, bgCluster *bestgresv1.BGCluster, cluster *patroni.Cluster) (*bestgresv1.RolloutStatus, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, types.NamespacedName{Name: bgCluster.Name, Namespace: bgCluster.Namespace}, sts); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	revision := sts.Status.UpdateRevision
+	if sts.Status.ObservedGeneration < sts.Generation || revision == "" {
+		return bgCluster.Status.Rollout, nil
+	}
+
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList,
+		client.InNamespace(bgCluster.Namespace),
+		client.MatchingLabels(labelsForBGCluster(bgCluster.Name)),
+	); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	pods := map[string]*corev1.Pod{}
+	var stale []string
+	var updated int32
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		pods[pod.Name] = pod
+		if pod.Labels[appsv1.ControllerRevisionHashLabelKey] == revision {
+			updated++
+		} else if pod.DeletionTimestamp == nil {
+			stale = append(stale, pod.Name)
+		}
+	}
+	sort.Strings(stale)
+
+	rollout := bgCluster.Status.Rollout.DeepCopy()
+	if rollout == nil || rollout.Revision != revision {
+		if len(stale) == 0 {
+			return bgCluster.Status.Rollout, nil
+		}
+		now := metav1.Now()
+		rollout = &bestgresv1.RolloutStatus{Phase: bestgresv1.RolloutPhaseRollingOut, Revision: revision, StartTime: &now}
+		log.Info("Rolling out a new pod template", "Revision", revision, "StalePods", stale)
+	}
+	rollout.UpdatedPods = updated
+
+	if rollout.Phase == bestgresv1.RolloutPhasePaused {
+		return rollout, nil
+	}
+
+	// the replaced pod has to come back as a healthy member before the next step
+	if rollout.CurrentPod != "" {
+		pod := pods[rollout.CurrentPod]
+		var member *patroni.Member
+		if cluster != nil {
+			member = cluster.Member(rollout.CurrentPod)
+		}
+		if pod == nil || pod.DeletionTimestamp != nil || pod.Labels[appsv1.ControllerRevisionHashLabelKey] != revision ||
+			member == nil || !memberRunning(member) {
+			if rollout.CurrentPodDeletedAt != nil && time.Since(rollout.CurrentPodDeletedAt.Time) > rolloutPodTimeout {
+				rollout.Phase = bestgresv1.RolloutPhasePaused
+				rollout.Message = fmt.Sprintf("%s isn't a healthy member %s after it was replaced", rollout.CurrentPod, rolloutPodTimeout)
+				log.Info("Rollout paused", "Reason", rollout.Message)
+				return rollout, nil
+			}
+			rollout.Message = fmt.Sprintf("Waiting for %s to run the new revision", rollout.CurrentPod)
+			return rollout, nil
+		}
+		rollout.CurrentPod = ""
+		rollout.CurrentPodDeletedAt = nil
+	}
+
+	if len(stale) == 0 {
+		if rollout.Phase != bestgresv1.RolloutPhaseCompleted {
+			now := metav1.Now()
+			rollout.Phase = bestgresv1.RolloutPhaseCompleted
+			rollout.CompletionTime = &now
+			rollout.Message = ""
+			log.Info("Rollout completed", "Revision", revision)
+		}
+		return rollout, nil
+	}
+	rollout.Phase = bestgresv1.RolloutPhaseRollingOut
+	rollout.CompletionTime = nil
+
+	if inProgress := bgCluster.Annotations[bgDbOpsInProgressAnnotation]; inProgress != "" {
+		rollout.Message = fmt.Sprintf("Waiting for BGDbOps %s to finish", inProgress)
+		return rollout, nil
+	}
+	if healthy, message := clusterHealthy(bgCluster, cluster, pods); !healthy {
+		rollout.Message = message
+		return rollout, nil
+	}
+
+	leader := cluster.Leader()
+	next := ""
+	for _, name := range stale {
+		if leader == nil || name != leader.Name {
+			next = name
+			break
+		}
+	}
+	if next == "" && leader != nil {
+		// only the primary is left, hand its role to an updated replica first
+		if candidate := updatedReplica(cluster, pods, revision); candidate != "" {
+			leaderPod := pods[leader.Name]
+			if leaderPod == nil || leaderPod.Status.PodIP == "" {
+				rollout.Message = fmt.Sprintf("Waiting for the address of %s", leader.Name)
+				return rollout, nil
+			}
+			log.Info("Switching over before replacing the primary", "Primary", leader.Name, "Candidate", candidate)
+			if err := patroni.NewClient(leaderPod.Status.PodIP).Switchover(ctx, leader.Name, candidate); err != nil {
+				rollout.Phase = bestgresv1.RolloutPhasePaused
+				rollout.Message = fmt.Sprintf("Switchover from %s to %s failed: %v", leader.Name, candidate, err)
+				log.Info("Rollout paused", "Reason", rollout.Message)
+				return rollout, nil
+			}
+			rollout.Message = fmt.Sprintf("Switched over from %s to %s", leader.Name, candidate)
+			return rollout, nil
+		}
+		// a single instance has nobody to switch over to
+		next = leader.Name
+	}
+
+	log.Info("Replacing pod", "Pod.Name", next, "Revision", revision)
+	if err := r.Delete(ctx, pods[next]); client.IgnoreNotFound(err) != nil {
+		return nil, fmt.Errorf("failed to delete pod %s: %w", next, err)
+	}
+	now := metav1.Now()
+	rollout.CurrentPod = next
+	rollout.CurrentPodDeletedAt = &now
+	rollout.Message = fmt.Sprintf("Replacing %s", next)
+	return rollout, nil
+}
+
+// clusterHealthy reports whether every instance runs as a member of the cluster with a leader,
+// along with what's missing otherwise
+func clusterHealthy(bgCluster *bestgresv1.BGCluster, cluster *patroni.Cluster, pods map[string]*corev1.Pod) (bool, string) {
+	if cluster == nil || cluster.Leader() == nil {
+		return false, "Waiting for a leader"
+	}
+	running := int32(0)
+	for _, member := range cluster.Members {
+		if pod := pods[member.Name]; pod != nil && pod.DeletionTimestamp == nil && memberRunning(&member) {
+			running++
+		}
+	}
+	if running != bgCluster.Spec.Instances {
+		return false, fmt.Sprintf("Waiting for all members to be healthy, %d/%d running", running, bgCluster.Spec.Instances)
+	}
+	return true, ""
+}
+
+// updatedReplica returns the running replica on the revision with the least replication lag,
+// or an empty name when there is none
+func updatedReplica(cluster *patroni.Cluster, pods map[string]*corev1.Pod, revision string) string {
+	updated := &patroni.Cluster{}
+	for _, member := range cluster.Members {
+		if pod := pods[member.Name]; pod != nil && pod.Labels[appsv1.ControllerRevisionHashLabelKey] == revision {
+			updated.Members = append(updated.Members, member)
+		}
+	}
+	return updated.HealthiestReplica()
+}
+
+// memberRunning reports whether Patroni runs postgres on the member, replicas report streaming
+// once they replicate from the leader
+func memberRunning(member *patroni.Member) bool {
+	return member.State == "running" || member.State == "streaming"
+}
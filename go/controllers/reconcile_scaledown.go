@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// scaleDownReplicas returns the replicas the StatefulSet runs. Lowering instances removes the
+// highest ordinals, so the StatefulSet keeps its pods until the primary runs on an ordinal that
+// stays, a switchover to the healthiest of those replicas moves it there first.
+func (r *BGClusterReconciler) scaleDownReplicas(ctx context.Context, bgCluster *bestgresv1.BGCluster, foundSts *appsv1.StatefulSet) (int32, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	desired := bgCluster.Spec.Instances
+	if foundSts.Spec.Replicas == nil || *foundSts.Spec.Replicas <= desired || desired == 0 {
+		return desired, nil
+	}
+	current := *foundSts.Spec.Replicas
+
+	if inProgress := bgCluster.Annotations[bgDbOpsInProgressAnnotation]; inProgress != "" {
+		log.Info("Waiting for BGDbOps to finish before scaling down", "BGDbOps", inProgress)
+		return current, nil
+	}
+
+	patroniClient, err := patroniClientForBGCluster(ctx, r.Client, bgCluster)
+	if err != nil {
+		return current, err
+	}
+	// there is no primary to protect when nothing runs
+	if patroniClient == nil {
+		return desired, nil
+	}
+	cluster, err := patroniClient.Cluster(ctx)
+	if err != nil {
+		return current, fmt.Errorf("failed to get Patroni cluster: %w", err)
+	}
+	cluster = patroni.ClusterFor(bgCluster, cluster)
+
+	leader := cluster.Leader()
+	if leader == nil {
+		log.Info("Waiting for a leader before scaling down", "Instances", desired)
+		return current, nil
+	}
+	if ordinal, ok := podOrdinal(bgCluster, leader.Name); ok && ordinal < desired {
+		log.Info("Scaling down", "Replicas", current, "Instances", desired)
+		return desired, nil
+	}
+
+	kept := &patroni.Cluster{}
+	for _, member := range cluster.Members {
+		if ordinal, ok := podOrdinal(bgCluster, member.Name); ok && ordinal < desired {
+			kept.Members = append(kept.Members, member)
+		}
+	}
+	candidate := kept.HealthiestReplica()
+	if candidate == "" {
+		log.Info("Waiting for a healthy replica that is kept to switch over to before scaling down", "Primary", leader.Name)
+		return current, nil
+	}
+
+	leaderPod := &corev1.Pod{}
+	if err := r.Get(ctx, types.NamespacedName{Name: leader.Name, Namespace: bgCluster.Namespace}, leaderPod); err != nil {
+		return current, fmt.Errorf("failed to get pod %s: %w", leader.Name, err)
+	}
+	if leaderPod.Status.PodIP == "" {
+		log.Info("Waiting for the address of the primary before scaling down", "Primary", leader.Name)
+		return current, nil
+	}
+	log.Info("Switching over before scaling down", "Primary", leader.Name, "Candidate", candidate, "Instances", desired)
+	if err := patroni.NewClient(leaderPod.Status.PodIP).Switchover(ctx, leader.Name, candidate); err != nil {
+		// the rest of the StatefulSet is still updated, the switchover is retried on the next poll
+		log.Error(err, "Switchover before scaling down failed", "Primary", leader.Name, "Candidate", candidate)
+		return current, nil
+	}
+	// the pods are removed on the next reconcile, once the cluster reports the new leader
+	return current, nil
+}
+
+// reconcileScaledDownVolumes deletes the volumes of the ordinals the StatefulSet no longer runs
+// when the scale down policy asks for it
+func (r *BGClusterReconciler) reconcileScaledDownVolumes(ctx context.Context, bgCluster *bestgresv1.BGCluster, replicas int32) error {
+	if bgCluster.Spec.ScaleDownPolicy != bestgresv1.ScaleDownPolicyDelete {
+		return nil
+	}
+
+	pvcList := &corev1.PersistentVolumeClaimList{}
+	if err := r.List(ctx, pvcList,
+		client.InNamespace(bgCluster.Namespace),
+		client.MatchingLabels(labelsForBGCluster(bgCluster.Name)),
+	); err != nil {
+		return fmt.Errorf("failed to list PersistentVolumeClaims: %w", err)
+	}
+
+	for i := range pvcList.Items {
+		pvc := &pvcList.Items[i]
+		if pvc.DeletionTimestamp != nil {
+			continue
+		}
+		ordinal, ok := volumeOrdinal(bgCluster, pvc.Name)
+		if !ok || ordinal < replicas {
+			continue
+		}
+		// the pod may still be shutting down, its volumes go once it's gone
+		pod := &corev1.Pod{}
+		err := r.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("%s-%d", bgCluster.Name, ordinal), Namespace: bgCluster.Namespace}, pod)
+		if err == nil {
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to get pod: %w", err)
+		}
+		ctrl.LoggerFrom(ctx).Info("Deleting the volume of a removed instance", "PersistentVolumeClaim", pvc.Name)
+		if err := r.Delete(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete PersistentVolumeClaim %s: %w", pvc.Name, err)
+		}
+	}
+	return nil
+}
+
+// podOrdinal returns the StatefulSet ordinal of a pod of the cluster, Patroni names the members
+// after their pods
+func podOrdinal(bgCluster *bestgresv1.BGCluster, name string) (int32, bool) {
+	suffix, ok := strings.CutPrefix(name, bgCluster.Name+"-")
+	if !ok {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseInt(suffix, 10, 32)
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return int32(ordinal), true
+}
+
+// volumeOrdinal returns the StatefulSet ordinal of a volume created from one of the claim
+// templates of the cluster
+func volumeOrdinal(bgCluster *bestgresv1.BGCluster, name string) (int32, bool) {
+	for _, template := range []string{"pgdata", "controller"} {
+		if podName, ok := strings.CutPrefix(name, template+"-"); ok {
+			if ordinal, ok := podOrdinal(bgCluster, podName); ok {
+				return ordinal, true
+			}
+		}
+	}
+	return 0, false
+}
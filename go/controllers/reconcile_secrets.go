@@ -2,6 +2,7 @@ package controllers
 
 import (
 	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
 	"context"
 	"fmt"
 
@@ -31,6 +32,20 @@ func (r *BGClusterReconciler) reconcileSecret(ctx context.Context, bgCluster *be
         secret.Data = existingSecret.Data
     }
 
+    // Patroni stores the superuser password in pg_dist_authinfo for connections to every
+    // node, so all groups of a patroni-native sharded cluster share it
+    if _, ok := patroni.CitusGroup(bgCluster); ok {
+        citusSecret := &corev1.Secret{}
+        if err := r.Get(ctx, client.ObjectKey{Name: citusSecretName(bgCluster.Labels[bgClusterPartOfLabel]), Namespace: bgCluster.Namespace}, citusSecret); err != nil {
+            return fmt.Errorf("failed to get the shared superuser password: %w", err)
+        }
+        password, exists := citusSecret.Data["superuser-password"]
+        if !exists {
+            return fmt.Errorf("secret %s has no superuser-password yet", citusSecret.Name)
+        }
+        secret.Data["superuser-password"] = password
+    }
+
     // Generate passwords if they don't exist
     if _, exists := secret.Data["superuser-password"]; !exists {
         password, err := generateRandomPassword(16)
@@ -87,3 +102,70 @@ func (r *BGClusterReconciler) reconcileSecret(ctx context.Context, bgCluster *be
 
     return nil
 }
+
+
+// citusSecretName is the Secret holding the password of the internal Citus user,
+// shared by every BGCluster of a sharded cluster
+func citusSecretName(bgShardedClusterName string) string {
+    return bgShardedClusterName + "-citus"
+}
+
+// reconcileCitusSecret creates the password of the internal Citus user once, it must
+// exist before the coordinator and worker pods start. Patroni-native sharded clusters also
+// keep their shared superuser password in it.
+func (r *BGShardedClusterReconciler) reconcileCitusSecret(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster) error {
+    log := ctrl.LoggerFrom(ctx)
+
+    native := bgShardedCluster.Spec.Mode == bestgresv1.ShardedClusterModePatroniNative
+
+    existingSecret := &corev1.Secret{}
+    err := r.Get(ctx, client.ObjectKey{Name: citusSecretName(bgShardedCluster.Name), Namespace: bgShardedCluster.Namespace}, existingSecret)
+    if err == nil {
+        if _, exists := existingSecret.Data["superuser-password"]; !native || exists {
+            return nil
+        }
+        superuserPassword, err := generateRandomPassword(32)
+        if err != nil {
+            return err
+        }
+        if existingSecret.Data == nil {
+            existingSecret.Data = map[string][]byte{}
+        }
+        existingSecret.Data["superuser-password"] = []byte(superuserPassword)
+        return r.Update(ctx, existingSecret)
+    }
+    if client.IgnoreNotFound(err) != nil {
+        return err
+    }
+
+    password, err := generateRandomPassword(32)
+    if err != nil {
+        return err
+    }
+    secret := &corev1.Secret{
+        ObjectMeta: metav1.ObjectMeta{
+            Name:      citusSecretName(bgShardedCluster.Name),
+            Namespace: bgShardedCluster.Namespace,
+            Labels:    map[string]string{bgClusterPartOfLabel: bgShardedCluster.Name},
+        },
+        Type: corev1.SecretTypeOpaque,
+        Data: map[string][]byte{
+            "username": []byte(patroni.CitusUser),
+            "password": []byte(password),
+        },
+    }
+    // the superuser password shared by the groups of a patroni-native sharded cluster
+    if native {
+        superuserPassword, err := generateRandomPassword(32)
+        if err != nil {
+            return err
+        }
+        secret.Data["superuser-password"] = []byte(superuserPassword)
+    }
+    if err := ctrl.SetControllerReference(bgShardedCluster, secret, r.Scheme); err != nil {
+        return err
+    }
+
+    log.Info("Creating a new Secret", "Secret.Namespace", secret.Namespace, "Secret.Name", secret.Name)
+    return r.Create(ctx, secret)
+}
@@ -10,6 +10,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 
@@ -58,60 +59,49 @@ func (r *BGClusterReconciler) reconcileHeadlessService(ctx context.Context, bgCl
     return nil
 }
 
+// reconcileService manages the <name> Service, which only targets the pod that
+// Patroni has labelled as the leader so that writes always land on the primary
 func (r *BGClusterReconciler) reconcileService(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
+    svc := clusterServiceForRole(bgCluster, bgCluster.Name, primaryRoleLabelValue)
+    return r.reconcileClusterService(ctx, bgCluster, svc, "Service")
+}
+
+// reconcileReplicaService manages the <name>-repl Service, which targets the
+// streaming replicas of the cluster
+func (r *BGClusterReconciler) reconcileReplicaService(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
+    svc := clusterServiceForRole(bgCluster, bgCluster.Name+"-repl", replicaRoleLabelValue)
+    return r.reconcileClusterService(ctx, bgCluster, svc, "Replica Service")
+}
+
+// reconcileAnyService manages the optional <name>-any Service, which targets every
+// member of the cluster regardless of role for read-anywhere traffic
+func (r *BGClusterReconciler) reconcileAnyService(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
     log := ctrl.LoggerFrom(ctx)
-    svc := &corev1.Service{
-        ObjectMeta: metav1.ObjectMeta{
-            Name:      bgCluster.Name,
-            Namespace: bgCluster.Namespace,
-            Labels:    labelsForBGCluster(bgCluster.Name),
-        },
-        Spec: corev1.ServiceSpec{
-            Ports: []corev1.ServicePort{{
-                Port:       5432,
-                TargetPort: intstr.FromInt(5432),
-            }},
-            Selector: labelsForBGCluster(bgCluster.Name),
-            Type:     corev1.ServiceTypeClusterIP,
-        },
-    }
-    
-    if err := ctrl.SetControllerReference(bgCluster, svc, r.Scheme); err != nil {
-        return err
+    svc := clusterServiceForRole(bgCluster, bgCluster.Name+"-any", "")
+
+    if bgCluster.Spec.Services.Any {
+        return r.reconcileClusterService(ctx, bgCluster, svc, "Any Service")
     }
 
+    // The Service is disabled, remove it if it was created previously
     foundSvc := &corev1.Service{}
     err := r.Get(ctx, types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, foundSvc)
     if err != nil {
-        if errors.IsNotFound(err) {
-            log.Info("Creating a new Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
-            err = r.Create(ctx, svc)
-            if err != nil {
-                log.Error(err, "Failed to create new Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
-                return err
-            }
-        } else {
-            log.Error(err, "Failed to get Service")
-            return err
-        }
-    } else {
-        // log.Info("Updating existing Service", "Service.Namespace", foundSvc.Namespace, "Service.Name", foundSvc.Name)
-        svc.ResourceVersion = foundSvc.ResourceVersion
-        err = r.Update(ctx, svc)
-        if err != nil {
-            log.Error(err, "Failed to update Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
-            return err
-        }
+        return client.IgnoreNotFound(err)
     }
-
-    return nil
+    if !isOwnedByBGCluster(foundSvc, bgCluster) {
+        return nil
+    }
+    log.Info("Deleting disabled Any Service", "Service.Namespace", foundSvc.Namespace, "Service.Name", foundSvc.Name)
+    return client.IgnoreNotFound(r.Delete(ctx, foundSvc))
 }
 
-func (r *BGClusterReconciler) reconcileReplicaService(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
-    log := ctrl.LoggerFrom(ctx)
-    svc := &corev1.Service{
+// clusterServiceForRole builds a ClusterIP Service for the postgres port that selects
+// the members of the cluster with the given Patroni role, or all members if role is empty
+func clusterServiceForRole(bgCluster *bestgresv1.BGCluster, name string, role string) *corev1.Service {
+    return &corev1.Service{
         ObjectMeta: metav1.ObjectMeta{
-            Name:      bgCluster.Name + "-repl",
+            Name:      name,
             Namespace: bgCluster.Namespace,
             Labels:    labelsForBGCluster(bgCluster.Name),
         },
@@ -120,15 +110,16 @@ func (r *BGClusterReconciler) reconcileReplicaService(ctx context.Context, bgClu
                 Port:       5432,
                 TargetPort: intstr.FromInt(5432),
             }},
-            Selector: map[string]string{
-                "application":  "patroni",
-                "cluster-name": bgCluster.Name,
-                "role":         "replica",
-            },
-            Type: corev1.ServiceTypeClusterIP,
+            Selector: selectorForBGClusterRole(bgCluster.Name, role),
+            Type:     corev1.ServiceTypeClusterIP,
         },
     }
-    
+}
+
+// reconcileClusterService creates the given Service or updates the existing one to match it
+func (r *BGClusterReconciler) reconcileClusterService(ctx context.Context, bgCluster *bestgresv1.BGCluster, svc *corev1.Service, kind string) error {
+    log := ctrl.LoggerFrom(ctx)
+
     if err := ctrl.SetControllerReference(bgCluster, svc, r.Scheme); err != nil {
         return err
     }
@@ -137,22 +128,24 @@ func (r *BGClusterReconciler) reconcileReplicaService(ctx context.Context, bgClu
     err := r.Get(ctx, types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}, foundSvc)
     if err != nil {
         if errors.IsNotFound(err) {
-            log.Info("Creating a new Replica Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
+            log.Info("Creating a new "+kind, "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
             err = r.Create(ctx, svc)
             if err != nil {
-                log.Error(err, "Failed to create new Replica Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
+                log.Error(err, "Failed to create new "+kind, "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
                 return err
             }
         } else {
-            log.Error(err, "Failed to get Replica Service")
+            log.Error(err, "Failed to get "+kind)
             return err
         }
     } else {
-        // log.Info("Updating existing Replica Service", "Service.Namespace", foundSvc.Namespace, "Service.Name", foundSvc.Name)
         svc.ResourceVersion = foundSvc.ResourceVersion
+        // keep the allocated cluster IP, it is immutable once set
+        svc.Spec.ClusterIP = foundSvc.Spec.ClusterIP
+        svc.Spec.ClusterIPs = foundSvc.Spec.ClusterIPs
         err = r.Update(ctx, svc)
         if err != nil {
-            log.Error(err, "Failed to update Replica Service", "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
+            log.Error(err, "Failed to update "+kind, "Service.Namespace", svc.Namespace, "Service.Name", svc.Name)
             return err
         }
     }
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	bestgresv1 "bestgres/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newTestBGClusterReconciler returns a reconciler backed by a fake client holding objs
+func newTestBGClusterReconciler(t *testing.T, objs ...runtime.Object) *BGClusterReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := bestgresv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return &BGClusterReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build(),
+		Scheme: scheme,
+	}
+}
+
+func newTestBGCluster(anyService bool) *bestgresv1.BGCluster {
+	return &bestgresv1.BGCluster{
+		TypeMeta:   metav1.TypeMeta{APIVersion: bestgresv1.GroupVersion.String(), Kind: "BGCluster"},
+		ObjectMeta: metav1.ObjectMeta{Name: "bgcluster", Namespace: "default", UID: "uid"},
+		Spec: bestgresv1.BGClusterSpec{
+			Instances: 3,
+			Services:  bestgresv1.ServicesSpec{Any: anyService},
+		},
+	}
+}
+
+func TestClusterServiceSelectors(t *testing.T) {
+	ctx := context.Background()
+	bgCluster := newTestBGCluster(true)
+	r := newTestBGClusterReconciler(t, bgCluster)
+
+	if err := r.reconcileService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileReplicaService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileAnyService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		selector map[string]string
+	}{
+		{"bgcluster", map[string]string{"application": "spilo", "cluster-name": "bgcluster", "role": "master"}},
+		{"bgcluster-repl", map[string]string{"application": "spilo", "cluster-name": "bgcluster", "role": "replica"}},
+		{"bgcluster-any", map[string]string{"application": "spilo", "cluster-name": "bgcluster"}},
+	}
+	for _, tt := range tests {
+		svc := &corev1.Service{}
+		if err := r.Get(ctx, types.NamespacedName{Name: tt.name, Namespace: "default"}, svc); err != nil {
+			t.Fatalf("Service %s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(svc.Spec.Selector, tt.selector) {
+			t.Errorf("Service %s selector = %v, want %v", tt.name, svc.Spec.Selector, tt.selector)
+		}
+		if svc.Spec.Type != corev1.ServiceTypeClusterIP || len(svc.Spec.Ports) != 1 || svc.Spec.Ports[0].Port != 5432 {
+			t.Errorf("Service %s = %v %v, want a ClusterIP Service on 5432", tt.name, svc.Spec.Type, svc.Spec.Ports)
+		}
+		if !isOwnedByBGCluster(svc, bgCluster) {
+			t.Errorf("Service %s isn't owned by the BGCluster", tt.name)
+		}
+	}
+}
+
+func TestAnyServiceOnlyWhenEnabled(t *testing.T) {
+	ctx := context.Background()
+	bgCluster := newTestBGCluster(false)
+	r := newTestBGClusterReconciler(t, bgCluster)
+	key := types.NamespacedName{Name: "bgcluster-any", Namespace: "default"}
+
+	if err := r.reconcileAnyService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &corev1.Service{}); !errors.IsNotFound(err) {
+		t.Fatalf("disabled Any Service: got %v, want NotFound", err)
+	}
+
+	bgCluster.Spec.Services.Any = true
+	if err := r.reconcileAnyService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &corev1.Service{}); err != nil {
+		t.Fatalf("enabled Any Service: %v", err)
+	}
+
+	// disabling it again removes the Service
+	bgCluster.Spec.Services.Any = false
+	if err := r.reconcileAnyService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, key, &corev1.Service{}); !errors.IsNotFound(err) {
+		t.Fatalf("Any Service after disabling: got %v, want NotFound", err)
+	}
+}
+
+func TestAnyServiceKeepsForeignService(t *testing.T) {
+	ctx := context.Background()
+	bgCluster := newTestBGCluster(false)
+	foreign := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "bgcluster-any", Namespace: "default"}}
+	r := newTestBGClusterReconciler(t, bgCluster, foreign)
+
+	if err := r.reconcileAnyService(ctx, bgCluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: "bgcluster-any", Namespace: "default"}, &corev1.Service{}); err != nil {
+		t.Fatalf("a Service the BGCluster doesn't own was removed: %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// drainingWorkersAnnotation lists the workers the coordinator has to drain and remove from
+	// pg_dist_node, drainedWorkersAnnotation is set on the coordinator pod that did it
+	drainingWorkersAnnotation = "bgshardedcluster.bestgres.io/draining"
+	drainedWorkersAnnotation  = "bgshardedcluster.bestgres.io/drained"
+	// shardTransferModeAnnotation tells the coordinator how to move shards
+	shardTransferModeAnnotation = "bgshardedcluster.bestgres.io/shard-transfer-mode"
+	// unregisteredWorkersAnnotation is set on the coordinator primary with the workers it
+	// hasn't registered yet
+	unregisteredWorkersAnnotation = "bgshardedcluster.bestgres.io/unregistered"
+
+	// rebalanceAutoAnnotation and rebalanceStrategyAnnotation pass spec.rebalance to the
+	// coordinator, rebalanceStatusAnnotation is set on the coordinator primary with its last
+	// rebalance job
+	rebalanceAutoAnnotation     = "bgshardedcluster.bestgres.io/rebalance-auto"
+	rebalanceStrategyAnnotation = "bgshardedcluster.bestgres.io/rebalance-strategy"
+	rebalanceStatusAnnotation   = "bgshardedcluster.bestgres.io/rebalance"
+	// workerSecondariesAnnotation tells the coordinator whether the workers have replicas to
+	// register as Citus secondaries
+	workerSecondariesAnnotation = "bgshardedcluster.bestgres.io/worker-secondaries"
+	// maxBackgroundTaskExecutorsParameter limits the shard moves of a rebalance on each node
+	maxBackgroundTaskExecutorsParameter = "citus.max_background_task_executors_per_node"
+
+	// drainPollInterval is how often the reports of the coordinator pods are checked
+	drainPollInterval = 10 * time.Second
+)
+
+// reconcileScaleDown hands the workers past spec.shards to the coordinator for draining and
+// deletes their BGClusters once their shards moved, it returns the workers still draining
+func (r *BGShardedClusterReconciler) reconcileScaleDown(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster) ([]string, error) {
+	logger := log.FromContext(ctx)
+
+	desired := map[string]bool{}
+	for i := 0; i < int(bgShardedCluster.Spec.Shards); i++ {
+		desired[fmt.Sprintf("%s-worker-%d", bgShardedCluster.Name, i)] = true
+	}
+	workerList := &bestgresv1.BGClusterList{}
+	if err := r.List(ctx, workerList, client.InNamespace(bgShardedCluster.Namespace), client.MatchingLabels{
+		bgClusterPartOfLabel:         bgShardedCluster.Name,
+		"bgcluster.bestgres.io/role": "worker",
+	}); err != nil {
+		return nil, err
+	}
+
+	coordinatorName := fmt.Sprintf("%s-coordinator", bgShardedCluster.Name)
+	drained, err := r.drainedWorkers(ctx, bgShardedCluster.Namespace, coordinatorName)
+	if err != nil {
+		return nil, err
+	}
+
+	draining := []string{}
+	for i := range workerList.Items {
+		worker := &workerList.Items[i]
+		if desired[worker.Name] || !worker.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if !drained[worker.Name] {
+			draining = append(draining, worker.Name)
+			continue
+		}
+		logger.Info("Deleting drained worker BGCluster", "BGCluster.Name", worker.Name)
+		if err := r.Delete(ctx, worker); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(draining)
+
+	coordinator := &bestgresv1.BGCluster{}
+	if err := r.Get(ctx, types.NamespacedName{Name: coordinatorName, Namespace: bgShardedCluster.Namespace}, coordinator); err != nil {
+		return nil, err
+	}
+	drainingJSON, err := json.Marshal(draining)
+	if err != nil {
+		return nil, err
+	}
+	transferMode := bgShardedCluster.Spec.ShardTransferMode
+	if transferMode == "" {
+		transferMode = "auto"
+	}
+	if coordinator.Annotations[drainingWorkersAnnotation] != string(drainingJSON) ||
+		coordinator.Annotations[shardTransferModeAnnotation] != transferMode {
+		if coordinator.Annotations == nil {
+			coordinator.Annotations = make(map[string]string)
+		}
+		coordinator.Annotations[drainingWorkersAnnotation] = string(drainingJSON)
+		coordinator.Annotations[shardTransferModeAnnotation] = transferMode
+		// the coordinator registers every worker it holds an initialized annotation for
+		for worker := range drained {
+			delete(coordinator.Annotations, fmt.Sprintf("bgshardedcluster.bestgres.io/%s-initialized", worker))
+		}
+		if err := r.Update(ctx, coordinator); err != nil {
+			return nil, err
+		}
+		if len(draining) > 0 {
+			logger.Info("Draining workers", "Workers", draining)
+		}
+	}
+	return draining, nil
+}
+
+// reconcileSecondaries tells the coordinator to register the replicas of the workers as Citus
+// secondaries when the workers run more than one instance
+func (r *BGShardedClusterReconciler) reconcileSecondaries(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster) error {
+	secondaries := fmt.Sprint(bgShardedCluster.Spec.Workers.Instances > 1)
+
+	coordinatorName := fmt.Sprintf("%s-coordinator", bgShardedCluster.Name)
+	coordinator := &bestgresv1.BGCluster{}
+	if err := r.Get(ctx, types.NamespacedName{Name: coordinatorName, Namespace: bgShardedCluster.Namespace}, coordinator); err != nil {
+		return err
+	}
+	if coordinator.Annotations[workerSecondariesAnnotation] == secondaries {
+		return nil
+	}
+	if coordinator.Annotations == nil {
+		coordinator.Annotations = make(map[string]string)
+	}
+	coordinator.Annotations[workerSecondariesAnnotation] = secondaries
+	return r.Update(ctx, coordinator)
+}
+
+// drainedWorkers returns the workers the coordinator removed from pg_dist_node
+func (r *BGShardedClusterReconciler) drainedWorkers(ctx context.Context, namespace, coordinatorName string) (map[string]bool, error) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabels(labelsForBGCluster(coordinatorName))); err != nil {
+		return nil, err
+	}
+	drained := map[string]bool{}
+	for _, pod := range podList.Items {
+		var workers []string
+		if err := json.Unmarshal([]byte(pod.Annotations[drainedWorkersAnnotation]), &workers); err != nil {
+			continue
+		}
+		for _, worker := range workers {
+			drained[worker] = true
+		}
+	}
+	return drained, nil
+}
+
+// unregisteredWorkers returns the workers the coordinator primary hasn't registered, all of them
+// before the coordinator reported any. The current status is kept while there is no primary.
+func (r *BGShardedClusterReconciler) unregisteredWorkers(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster, workerClusters []string) ([]string, error) {
+	coordinatorName := fmt.Sprintf("%s-coordinator", bgShardedCluster.Name)
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(bgShardedCluster.Namespace),
+		client.MatchingLabels(selectorForBGClusterRole(coordinatorName, primaryRoleLabelValue))); err != nil {
+		return nil, err
+	}
+	if len(podList.Items) == 0 {
+		return bgShardedCluster.Status.UnregisteredWorkers, nil
+	}
+	value, ok := podList.Items[0].Annotations[unregisteredWorkersAnnotation]
+	if !ok {
+		return workerClusters, nil
+	}
+	var workers []string
+	if err := json.Unmarshal([]byte(value), &workers); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on pod %s: %w", unregisteredWorkersAnnotation, podList.Items[0].Name, err)
+	}
+	return workers, nil
+}
+
+// coordinatorSpec returns the spec of the coordinator BGCluster, with the rebalance concurrency
+// applied to its postgres parameters
+func coordinatorSpec(bgShardedCluster *bestgresv1.BGShardedCluster) bestgresv1.BGClusterSpec {
+	spec := *bgShardedCluster.Spec.Coordinator.DeepCopy()
+	rebalance := bgShardedCluster.Spec.Rebalance
+	if rebalance == nil || rebalance.MaxConcurrency == nil {
+		return spec
+	}
+	if spec.Postgresql.Parameters == nil {
+		spec.Postgresql.Parameters = make(map[string]string)
+	}
+	spec.Postgresql.Parameters[maxBackgroundTaskExecutorsParameter] = fmt.Sprint(*rebalance.MaxConcurrency)
+	return spec
+}
+
+// reconcileRebalance passes the rebalance settings to the coordinator and returns the last
+// rebalance job its primary reported, the current status is kept while there is no primary
+func (r *BGShardedClusterReconciler) reconcileRebalance(ctx context.Context, bgShardedCluster *bestgresv1.BGShardedCluster) (*bestgresv1.RebalanceStatus, error) {
+	auto, strategy := "true", ""
+	if rebalance := bgShardedCluster.Spec.Rebalance; rebalance != nil {
+		if rebalance.Auto != nil && !*rebalance.Auto {
+			auto = "false"
+		}
+		strategy = rebalance.Strategy
+	}
+
+	coordinatorName := fmt.Sprintf("%s-coordinator", bgShardedCluster.Name)
+	coordinator := &bestgresv1.BGCluster{}
+	if err := r.Get(ctx, types.NamespacedName{Name: coordinatorName, Namespace: bgShardedCluster.Namespace}, coordinator); err != nil {
+		return nil, err
+	}
+	if coordinator.Annotations[rebalanceAutoAnnotation] != auto ||
+		coordinator.Annotations[rebalanceStrategyAnnotation] != strategy {
+		if coordinator.Annotations == nil {
+			coordinator.Annotations = make(map[string]string)
+		}
+		coordinator.Annotations[rebalanceAutoAnnotation] = auto
+		coordinator.Annotations[rebalanceStrategyAnnotation] = strategy
+		if err := r.Update(ctx, coordinator); err != nil {
+			return nil, err
+		}
+	}
+
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList, client.InNamespace(bgShardedCluster.Namespace),
+		client.MatchingLabels(selectorForBGClusterRole(coordinatorName, primaryRoleLabelValue))); err != nil {
+		return nil, err
+	}
+	for _, pod := range podList.Items {
+		value := pod.Annotations[rebalanceStatusAnnotation]
+		if value == "" {
+			continue
+		}
+		status := &bestgresv1.RebalanceStatus{}
+		if err := json.Unmarshal([]byte(value), status); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on pod %s: %w", rebalanceStatusAnnotation, pod.Name, err)
+		}
+		return status, nil
+	}
+	return bgShardedCluster.Status.Rebalance, nil
+}
+
+// rebalanceRunning reports whether the rebalance job still has shards to move
+func rebalanceRunning(status *bestgresv1.RebalanceStatus) bool {
+	if status == nil {
+		return false
+	}
+	switch status.State {
+	case "scheduled", "running", "cancelling", "failing":
+		return true
+	}
+	return false
+}
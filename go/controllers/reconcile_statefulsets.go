@@ -2,8 +2,11 @@ package controllers
 
 import (
 	bestgresv1 "bestgres/api/v1"
+	"bestgres/backup"
+	"bestgres/patroni"
 	"context"
 	"fmt"
+	"strconv"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -15,6 +18,13 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const (
+	// defaultShutdownGracePeriodSeconds matches the default of spec.shutdownGracePeriodSeconds
+	defaultShutdownGracePeriodSeconds = 60
+	// shutdownGraceMarginSeconds is added to the pod's termination grace period
+	shutdownGraceMarginSeconds = 10
+)
+
 func (r *BGClusterReconciler) reconcileStatefulSet(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
 	log := ctrl.LoggerFrom(ctx)
 	sts := r.createStatefulSetObject(bgCluster)
@@ -33,9 +43,19 @@ func (r *BGClusterReconciler) reconcileStatefulSet(ctx context.Context, bgCluste
 		return err
 	}
 
+	// the primary is moved off the ordinals a scale down removes before they go
+	replicas, err := r.scaleDownReplicas(ctx, bgCluster, foundSts)
+	if err != nil {
+		return err
+	}
+	sts.Spec.Replicas = &replicas
+
 	if err := r.updateStatefulSet(ctx, sts, foundSts); err != nil {
 		return err
 	}
+	if err := r.reconcileScaledDownVolumes(ctx, bgCluster, replicas); err != nil {
+		return err
+	}
 
 	// Check if all pods are initialized and update BGCluster annotation
 	return r.reconcileBGClusterInitialization(ctx, bgCluster, foundSts)
@@ -100,6 +120,10 @@ func (r *BGClusterReconciler) createStatefulSetObject(bgCluster *bestgresv1.BGCl
 		Spec: appsv1.StatefulSetSpec{
 			MinReadySeconds: 10,
 			Replicas:    &replicas,
+			// pods are replaced by the operator, which knows the primary and switches over
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type: appsv1.OnDeleteStatefulSetStrategyType,
+			},
 			ServiceName: bgCluster.Name,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
@@ -112,6 +136,7 @@ func (r *BGClusterReconciler) createStatefulSetObject(bgCluster *bestgresv1.BGCl
 
 func (r *BGClusterReconciler) createPodTemplateSpec(bgCluster *bestgresv1.BGCluster) corev1.PodTemplateSpec {
 	labels := r.getLabelsAndAnnotations(bgCluster)
+	volumes, _ := backupVolumes(bgCluster)
 
 	return corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
@@ -119,9 +144,11 @@ func (r *BGClusterReconciler) createPodTemplateSpec(bgCluster *bestgresv1.BGClus
 			Annotations: labels,
 		},
 		Spec: corev1.PodSpec{
-			ServiceAccountName: bgCluster.Name,
-			Containers:         []corev1.Container{r.createMainContainer(bgCluster)},
-			InitContainers:     []corev1.Container{r.createInitContainer(bgCluster)},
+			ServiceAccountName:            bgCluster.Name,
+			Containers:                    []corev1.Container{r.createMainContainer(bgCluster)},
+			InitContainers:                []corev1.Container{r.createInitContainer(bgCluster)},
+			TerminationGracePeriodSeconds: terminationGracePeriod(bgCluster),
+			Volumes:                       volumes,
 		},
 	}
 }
@@ -133,7 +160,7 @@ func (r *BGClusterReconciler) createMainContainer(bgCluster *bestgresv1.BGCluste
 		ImagePullPolicy: corev1.PullIfNotPresent,
 		Ports:           r.createContainerPorts(),
 		Command:         []string{"/app/controller"},
-		VolumeMounts:    r.createVolumeMounts(),
+		VolumeMounts:    r.createVolumeMounts(bgCluster),
 		Env:             r.createEnvironmentVariables(bgCluster),
 	}
 }
@@ -156,20 +183,22 @@ func (r *BGClusterReconciler) createContainerPorts() []corev1.ContainerPort {
 	}
 }
 
-func (r *BGClusterReconciler) createVolumeMounts() []corev1.VolumeMount {
-	return []corev1.VolumeMount{
+func (r *BGClusterReconciler) createVolumeMounts(bgCluster *bestgresv1.BGCluster) []corev1.VolumeMount {
+	_, backupMounts := backupVolumes(bgCluster)
+	return append([]corev1.VolumeMount{
 		{Name: "pgdata", MountPath: "/home/postgres/pgdata"},
 		{Name: "controller", MountPath: "/app"},
-	}
+	}, backupMounts...)
 }
 
 func (r *BGClusterReconciler) createEnvironmentVariables(bgCluster *bestgresv1.BGCluster) []corev1.EnvVar {
-	return []corev1.EnvVar{
+	scope, scopeLabel := patroniScope(bgCluster)
+	env := []corev1.EnvVar{
 		{Name: "MODE", Value: "controller"},
 		{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
 		{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
 		{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
-		{Name: "SCOPE", Value: bgCluster.Name},
+		{Name: "SCOPE", Value: scope},
 		{Name: "DCS_ENABLE_KUBERNETES_API", Value: "true"},
 		// TODO see if this works or remove
 		// {Name: "PATRONI_KUBERNETES_LABELS", Value: "{application: bestgres, cluster-name: " + bgCluster.Name + "}"},
@@ -180,15 +209,55 @@ func (r *BGClusterReconciler) createEnvironmentVariables(bgCluster *bestgresv1.B
 		// {Name: "PATRONI_KUBERNETES_BYPASS_API_SERVICE", Value: "false"},
 		{Name: "BGMON_LISTEN_IP", Value: "*"},
 		{Name: "KUBERNETES_USE_CONFIGMAPS", Value: "true"},
-		{Name: "KUBERNETES_SCOPE_LABEL", Value: "cluster-name"},
-		{Name: "KUBERNETES_ROLE_LABEL", Value: "role"},
+		{Name: "KUBERNETES_SCOPE_LABEL", Value: scopeLabel},
+		{Name: "KUBERNETES_ROLE_LABEL", Value: roleLabel},
+		{Name: "PATRONI_KUBERNETES_LEADER_LABEL_VALUE", Value: primaryRoleLabelValue},
+		{Name: "PATRONI_KUBERNETES_FOLLOWER_LABEL_VALUE", Value: replicaRoleLabelValue},
 		{Name: "PGUSER_ADMIN", Value: "admin"},
 		{Name: "PGPASSWORD_SUPERUSER", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: bgCluster.Name}, Key: "superuser-password"}}},
 		{Name: "PGPASSWORD_STANDBY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: bgCluster.Name}, Key: "replication-password"}}},
 		{Name: "PGPASSWORD_ADMIN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: bgCluster.Name}, Key: "admin-password"}}},
 		{Name: "PGROOT", Value: "/home/postgres/pgdata/pgroot"},
+		{Name: "SHUTDOWN_GRACE_PERIOD", Value: strconv.FormatInt(shutdownGracePeriod(bgCluster), 10)},
 		{Name: "SPILO_CONFIGURATION", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: bgCluster.Name + "-postgres-config"}, Key: "postgres.yaml"}}},
 	}
+
+	// the in-pod controller hands the credentials of the backup storage to the backup tool
+	if bgCluster.Spec.Backup != nil && bgCluster.Spec.Backup.Storage.S3 != nil {
+		credentials := bgCluster.Spec.Backup.Storage.S3.CredentialsSecret
+		env = append(env,
+			corev1.EnvVar{Name: backup.AccessKeyIDEnv, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: credentials}, Key: "accessKeyId"}}},
+			corev1.EnvVar{Name: backup.SecretAccessKeyEnv, ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: credentials}, Key: "secretAccessKey"}}},
+		)
+	}
+
+	// restored clusters read the backup they start from with the credentials of its storage
+	env = append(env, recoveryEnvironmentVariables(bgCluster)...)
+
+	// nodes of a sharded cluster authenticate to each other with the shared internal Citus user
+	if shardedCluster := bgCluster.Labels[bgClusterPartOfLabel]; shardedCluster != "" {
+		env = append(env,
+			corev1.EnvVar{Name: "PGUSER_CITUS", Value: patroni.CitusUser},
+			corev1.EnvVar{Name: "PGPASSWORD_CITUS", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: citusSecretName(shardedCluster)}, Key: "password"}}},
+		)
+	}
+
+	return env
+}
+
+// shutdownGracePeriod returns the seconds the in-pod controller waits for Patroni to stop
+func shutdownGracePeriod(bgCluster *bestgresv1.BGCluster) int64 {
+	if bgCluster.Spec.ShutdownGracePeriodSeconds > 0 {
+		return bgCluster.Spec.ShutdownGracePeriodSeconds
+	}
+	return defaultShutdownGracePeriodSeconds
+}
+
+// terminationGracePeriod leaves the in-pod controller time to kill the main command and exit
+// after the shutdown grace period, before the kubelet kills the container
+func terminationGracePeriod(bgCluster *bestgresv1.BGCluster) *int64 {
+	seconds := shutdownGracePeriod(bgCluster) + shutdownGraceMarginSeconds
+	return &seconds
 }
 
 func (r *BGClusterReconciler) createVolumeClaimTemplates(bgCluster *bestgresv1.BGCluster) []corev1.PersistentVolumeClaim {
@@ -226,14 +295,19 @@ func (r *BGClusterReconciler) getLabelsAndAnnotations(bgCluster *bestgresv1.BGCl
 		"cluster-name": bgCluster.Name,
 	}
 
-	if bgCluster.Labels["bgcluster.bestgres.io/part-of"] != "" {
-		labels["bgcluster.bestgres.io/part-of"] = bgCluster.Labels["bgcluster.bestgres.io/part-of"]
+	if bgCluster.Labels[bgClusterPartOfLabel] != "" {
+		labels[bgClusterPartOfLabel] = bgCluster.Labels[bgClusterPartOfLabel]
 	}
 
 	if bgCluster.Labels["bgcluster.bestgres.io/role"] != "" {
 		labels["bgcluster.bestgres.io/role"] = bgCluster.Labels["bgcluster.bestgres.io/role"]
 	}
 
+	// Patroni tells the Citus groups of a patroni-native sharded cluster apart by this label
+	if group, ok := patroni.CitusGroup(bgCluster); ok {
+		labels[patroni.CitusGroupPodLabel] = strconv.Itoa(group)
+	}
+
 	return labels
 }
 
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// observeBGClusterStatus computes the status of the cluster from its pods, its StatefulSet
+// and the Patroni view of the cluster, which is nil when no member is reachable
+func (r *BGClusterReconciler) observeBGClusterStatus(ctx context.Context, bgCluster *bestgresv1.BGCluster, pods []corev1.Pod, cluster *patroni.Cluster) (*bestgresv1.BGClusterStatus, error) {
+	status := bgCluster.Status.DeepCopy()
+	status.ObservedGeneration = bgCluster.Generation
+	status.Nodes = getPodNames(pods)
+	status.Members = nil
+	status.Primary = ""
+	status.PendingRestart = nil
+
+	runningMembers := 0
+	if cluster != nil {
+		for _, member := range cluster.Members {
+			memberStatus := bestgresv1.MemberStatus{
+				Name:     member.Name,
+				Role:     member.Role,
+				State:    member.State,
+				Timeline: member.Timeline,
+			}
+			if !member.IsLeader() && member.Lag.Known {
+				lag := member.Lag.Bytes
+				memberStatus.LagBytes = &lag
+			}
+			if member.IsLeader() {
+				status.Primary = member.Name
+			}
+			if member.State == "running" || member.State == "streaming" {
+				runningMembers++
+			}
+			status.Members = append(status.Members, memberStatus)
+		}
+		sort.Slice(status.Members, func(i, j int) bool { return status.Members[i].Name < status.Members[j].Name })
+		status.PendingRestart = pendingRestartsFromCluster(cluster)
+	}
+
+	observeRecovery(status, bgCluster, pods)
+
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, types.NamespacedName{Name: bgCluster.Name, Namespace: bgCluster.Namespace}, sts); err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		sts = nil
+	}
+
+	instances := bgCluster.Spec.Instances
+	initialized := bgCluster.Annotations[initializedAnnotation] == "true"
+	primaryElected := status.Primary != ""
+	progressing, progressingMessage := statefulSetProgressing(sts, instances)
+	rolloutPaused := status.Rollout != nil && status.Rollout.Phase == bestgresv1.RolloutPhasePaused
+	if rollout := status.Rollout; rollout != nil && rollout.Phase == bestgresv1.RolloutPhaseRollingOut && rollout.Message != "" {
+		progressingMessage = rollout.Message
+	}
+	ready := initialized && primaryElected && int32(runningMembers) == instances && instances > 0
+
+	setCondition(status, bestgresv1.BGClusterInitialized, initialized,
+		"BootstrapComplete", "All pods completed their bootstrap",
+		"BootstrapPending", "Waiting for the pods to complete their bootstrap")
+	setCondition(status, bestgresv1.BGClusterPrimaryElected, primaryElected,
+		"LeaderElected", fmt.Sprintf("%s holds the leader lock", status.Primary),
+		"NoLeader", "No member holds the leader lock")
+	stableReason, stableMessage := "Stable", "The StatefulSet is up to date"
+	if rolloutPaused {
+		// a paused rollout doesn't progress until the pod template changes again
+		progressing = false
+		stableReason, stableMessage = "RolloutPaused", status.Rollout.Message
+	}
+	setCondition(status, bestgresv1.BGClusterProgressing, progressing,
+		"RollingOut", progressingMessage,
+		stableReason, stableMessage)
+	setCondition(status, bestgresv1.BGClusterReady, ready,
+		"AllMembersRunning", fmt.Sprintf("%d/%d members running", runningMembers, instances),
+		"MembersNotReady", fmt.Sprintf("%d/%d members running", runningMembers, instances))
+
+	degraded := initialized && instances > 0 && ((!ready && !progressing) || rolloutPaused)
+	degradedMessage := fmt.Sprintf("%d/%d members running", runningMembers, instances)
+	if degraded && !primaryElected {
+		degradedMessage = "No member holds the leader lock"
+	} else if rolloutPaused {
+		degradedMessage = "Rollout paused: " + status.Rollout.Message
+	}
+	setCondition(status, bestgresv1.BGClusterDegraded, degraded,
+		"MembersUnavailable", degradedMessage,
+		"Healthy", "No members are missing")
+
+	switch {
+	case instances == 0:
+		status.Phase = bestgresv1.BGClusterPhaseStopped
+	case len(pods) == 0:
+		status.Phase = bestgresv1.BGClusterPhaseCreating
+	case !initialized:
+		status.Phase = bestgresv1.BGClusterPhaseInitializing
+	case rolloutPaused:
+		status.Phase = bestgresv1.BGClusterPhaseDegraded
+	case ready && !progressing:
+		status.Phase = bestgresv1.BGClusterPhaseRunning
+	case progressing:
+		status.Phase = bestgresv1.BGClusterPhaseUpdating
+	default:
+		status.Phase = bestgresv1.BGClusterPhaseDegraded
+	}
+
+	return status, nil
+}
+
+// statefulSetProgressing reports whether the StatefulSet is still rolling out or scaling
+func statefulSetProgressing(sts *appsv1.StatefulSet, instances int32) (bool, string) {
+	if sts == nil {
+		return true, "Waiting for the StatefulSet to be created"
+	}
+	if sts.Status.ObservedGeneration < sts.Generation {
+		return true, "Waiting for the StatefulSet controller to observe the update"
+	}
+	// the StatefulSet controller doesn't move the current revision of OnDelete StatefulSets,
+	// the pods are updated once they all run the update revision
+	if sts.Status.UpdateRevision != "" && sts.Status.UpdatedReplicas < sts.Status.Replicas {
+		return true, fmt.Sprintf("%d/%d pods updated to %s", sts.Status.UpdatedReplicas, instances, sts.Status.UpdateRevision)
+	}
+	if sts.Status.ReadyReplicas != instances || sts.Status.Replicas != instances {
+		return true, fmt.Sprintf("%d/%d pods ready", sts.Status.ReadyReplicas, instances)
+	}
+	return false, ""
+}
+
+// setCondition sets a condition to True or False with the matching reason and message
+func setCondition(status *bestgresv1.BGClusterStatus, conditionType string, value bool, trueReason, trueMessage, falseReason, falseMessage string) {
+	condition := metav1.Condition{
+		Type:               conditionType,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: status.ObservedGeneration,
+		Reason:             trueReason,
+		Message:            trueMessage,
+	}
+	if !value {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = falseReason
+		condition.Message = falseMessage
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// leaderChangePollInterval is how often the members are polled while the leader changes,
+	// it bounds the precision of the measured write unavailability
+	leaderChangePollInterval = 100 * time.Millisecond
+	// leaderChangeTimeout is how long the operator waits for a new leader
+	leaderChangeTimeout = 2 * time.Minute
+)
+
+// leaderChange is a switchover or failover requested by this operator, the operator polls the
+// members every leaderChangePollInterval until it completes to measure the write
+// unavailability. It's lost when the operator restarts.
+type leaderChange struct {
+	// lastWritable is the last time a leader on the old timeline was seen running
+	lastWritable time.Time
+	// done receives the outcome of the request
+	done chan error
+}
+
+// isLeaderChangeOp reports whether the operation is carried out by the operator through the
+// Patroni REST API instead of by the in-pod controllers
+func isLeaderChangeOp(op string) bool {
+	return op == "switchover" || op == "failover"
+}
+
+// reconcileLeaderChange carries out a switchover or failover by calling the Patroni REST API of
+// the members over the pod network, and records the old and new leader, the timeline change and
+// how long no member accepted writes
+func (r *BGDbOpsReconciler) reconcileLeaderChange(ctx context.Context, bgDbOps *bestgresv1.BGDbOps, bgCluster *bestgresv1.BGCluster) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if bgDbOps.Status.SwitchoverResult != nil {
+		// the change was requested, wait for the new leader
+		return r.checkLeaderChange(ctx, bgDbOps, bgCluster)
+	}
+
+	// Only one operation runs on a cluster at a time
+	if inProgress := bgCluster.Annotations[bgDbOpsInProgressAnnotation]; inProgress != "" && inProgress != bgDbOps.Name {
+		logger.Info("Waiting for another operation to finish", "BGDbOps", inProgress)
+		return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
+	}
+	if spec := bgDbOps.Spec.Switchover; bgDbOps.Spec.Op == "switchover" && spec != nil && spec.ScheduledAt != nil {
+		if wait := time.Until(spec.ScheduledAt.Time); wait > 0 {
+			logger.Info("Switchover scheduled", "ScheduledAt", spec.ScheduledAt.Time)
+			return ctrl.Result{RequeueAfter: wait}, nil
+		}
+	}
+
+	clients, err := r.patroniMemberClients(ctx, bgCluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	cluster, err := patroniClusterFromMembers(ctx, bgCluster, clients)
+	if err != nil {
+		return ctrl.Result{}, r.failBGDbOps(ctx, bgDbOps, bgCluster, 0, err.Error())
+	}
+	statuses := pollPatroniMembers(ctx, clients)
+	leader, candidate, err := leaderChangeMembers(bgDbOps, cluster, statuses)
+	if err != nil {
+		return ctrl.Result{}, r.failBGDbOps(ctx, bgDbOps, bgCluster, 0, err.Error())
+	}
+
+	result := &bestgresv1.SwitchoverResult{}
+	for name, status := range statuses {
+		if name == leader {
+			result.OldLeader = name
+		}
+		if status != nil && status.Timeline > result.OldTimeline {
+			result.OldTimeline = status.Timeline
+		}
+	}
+
+	// claim the cluster, the in-pod controllers only act on pending operations
+	if bgCluster.Annotations == nil {
+		bgCluster.Annotations = make(map[string]string)
+	}
+	if bgCluster.Annotations[bgDbOpsInProgressAnnotation] != bgDbOps.Name {
+		bgCluster.Annotations[bgDbOpsInProgressAnnotation] = bgDbOps.Name
+		if err := r.Update(ctx, bgCluster); err != nil {
+			logger.Error(err, "Unable to update BGCluster annotations")
+			return ctrl.Result{}, err
+		}
+	}
+	now := metav1.Now()
+	bgDbOps.Status.Status = bestgresv1.BGDbOpsStatusRunning
+	bgDbOps.Status.StartTime = &now
+	bgDbOps.Status.SwitchoverResult = result
+	if err := r.Status().Update(ctx, bgDbOps); err != nil {
+		logger.Error(err, "Unable to update BGDbOps status")
+		return ctrl.Result{}, err
+	}
+
+	logger.Info("Changing the leader", "Op", bgDbOps.Spec.Op, "Leader", leader, "Candidate", candidate)
+	r.leaderChanges.Store(bgDbOps.UID, requestLeaderChange(bgDbOps.Spec.Op, leader, candidate, clients))
+	return ctrl.Result{RequeueAfter: leaderChangePollInterval}, nil
+}
+
+// requestLeaderChange sends the switchover or failover request in the background, Patroni
+// only answers once the new leader took over
+func requestLeaderChange(op, leader, candidate string, clients map[string]*patroni.Client) *leaderChange {
+	change := &leaderChange{lastWritable: time.Now(), done: make(chan error, 1)}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), leaderChangeTimeout)
+		defer cancel()
+		if op == "switchover" {
+			change.done <- clients[leader].Switchover(ctx, leader, candidate)
+		} else {
+			change.done <- clients[candidate].Failover(ctx, candidate)
+		}
+	}()
+	return change
+}
+
+// checkLeaderChange completes the operation once a leader runs on a later timeline. The write
+// unavailability is only measured when this operator requested the change, after a restart
+// the members are polled less often and the window is left out.
+func (r *BGDbOpsReconciler) checkLeaderChange(ctx context.Context, bgDbOps *bestgresv1.BGDbOps, bgCluster *bestgresv1.BGCluster) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	clients, err := r.patroniMemberClients(ctx, bgCluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	var change *leaderChange
+	if value, ok := r.leaderChanges.Load(bgDbOps.UID); ok {
+		change = value.(*leaderChange)
+	}
+
+	result := bgDbOps.Status.SwitchoverResult.DeepCopy()
+	polled := time.Now()
+	for name, status := range pollPatroniMembers(ctx, clients) {
+		if status == nil || !status.IsLeader() || status.State != "running" {
+			continue
+		}
+		if status.Timeline <= result.OldTimeline {
+			if change != nil {
+				change.lastWritable = polled
+			}
+			continue
+		}
+		result.NewLeader = name
+		result.NewTimeline = status.Timeline
+		if change != nil {
+			result.WriteUnavailability = &metav1.Duration{Duration: polled.Sub(change.lastWritable).Round(time.Millisecond)}
+		}
+		r.leaderChanges.Delete(bgDbOps.UID)
+		logger.Info("Leader changed", "OldLeader", result.OldLeader, "NewLeader", result.NewLeader, "WriteUnavailability", result.WriteUnavailability)
+		return ctrl.Result{}, r.completeLeaderChange(ctx, bgDbOps, bgCluster, result)
+	}
+
+	if change != nil {
+		select {
+		case err := <-change.done:
+			var apiErr *patroni.APIError
+			if err != nil && !(errors.As(err, &apiErr) && apiErr.IsUnknownOutcome()) {
+				r.leaderChanges.Delete(bgDbOps.UID)
+				return ctrl.Result{}, r.failBGDbOps(ctx, bgDbOps, bgCluster, 0, fmt.Sprintf("%s failed: %v", bgDbOps.Spec.Op, err))
+			}
+		default:
+		}
+	}
+	if bgDbOps.Status.StartTime != nil && time.Since(bgDbOps.Status.StartTime.Time) > leaderChangeTimeout {
+		r.leaderChanges.Delete(bgDbOps.UID)
+		return ctrl.Result{}, r.failBGDbOps(ctx, bgDbOps, bgCluster, 0,
+			fmt.Sprintf("no new leader %s after the %s was requested", leaderChangeTimeout, bgDbOps.Spec.Op))
+	}
+	if change != nil {
+		return ctrl.Result{RequeueAfter: leaderChangePollInterval}, nil
+	}
+	return ctrl.Result{RequeueAfter: bgDbOpsPollInterval}, nil
+}
+
+// completeLeaderChange marks the operation as completed with its result and releases the cluster
+func (r *BGDbOpsReconciler) completeLeaderChange(ctx context.Context, bgDbOps *bestgresv1.BGDbOps, bgCluster *bestgresv1.BGCluster, result *bestgresv1.SwitchoverResult) error {
+	if bgCluster.Annotations[bgDbOpsInProgressAnnotation] == bgDbOps.Name {
+		delete(bgCluster.Annotations, bgDbOpsInProgressAnnotation)
+		if err := r.Update(ctx, bgCluster); err != nil {
+			return fmt.Errorf("failed to clear BGDbOps annotations on BGCluster %s: %w", bgCluster.Name, err)
+		}
+	}
+
+	if bgDbOps.Annotations == nil {
+		bgDbOps.Annotations = make(map[string]string)
+	}
+	bgDbOps.Annotations[bgDbOpsCompletedAnnotation] = "true"
+	if err := r.Update(ctx, bgDbOps); err != nil {
+		return fmt.Errorf("failed to update BGDbOps annotations: %w", err)
+	}
+	now := metav1.Now()
+	bgDbOps.Status.Status = bestgresv1.BGDbOpsStatusCompleted
+	bgDbOps.Status.CompletionTime = &now
+	bgDbOps.Status.SwitchoverResult = result
+	if err := r.Status().Update(ctx, bgDbOps); err != nil {
+		return fmt.Errorf("failed to update BGDbOps status: %w", err)
+	}
+	return nil
+}
+
+// leaderChangeMembers returns the current leader and the member to promote, the leader is
+// required for a switchover and the candidate for a failover
+func leaderChangeMembers(bgDbOps *bestgresv1.BGDbOps, cluster *patroni.Cluster, statuses map[string]*patroni.Status) (leader, candidate string, err error) {
+	for name, status := range statuses {
+		if status != nil && status.IsLeader() && status.State == "running" {
+			leader = name
+		}
+	}
+
+	if bgDbOps.Spec.Op == "switchover" {
+		if bgDbOps.Spec.Switchover != nil {
+			candidate = bgDbOps.Spec.Switchover.Candidate
+		}
+		if leader == "" {
+			return "", "", fmt.Errorf("cluster %s has no running leader to switch over from, use a failover", bgDbOps.Spec.BGCluster)
+		}
+		if len(cluster.Members) < 2 {
+			return "", "", fmt.Errorf("cluster %s has no replica to switch over to", bgDbOps.Spec.BGCluster)
+		}
+	} else {
+		if bgDbOps.Spec.Failover != nil {
+			candidate = bgDbOps.Spec.Failover.Candidate
+		}
+		if candidate == "" {
+			candidate = cluster.HealthiestReplica()
+		}
+		if candidate == "" {
+			return "", "", fmt.Errorf("cluster %s has no healthy replica to fail over to", bgDbOps.Spec.BGCluster)
+		}
+	}
+
+	if candidate == "" {
+		return leader, "", nil
+	}
+	if cluster.Member(candidate) == nil || statuses[candidate] == nil {
+		return "", "", fmt.Errorf("candidate %s is not a reachable member of cluster %s", candidate, bgDbOps.Spec.BGCluster)
+	}
+	if candidate == leader {
+		return "", "", fmt.Errorf("candidate %s is already the leader", candidate)
+	}
+	return leader, candidate, nil
+}
+
+// patroniMemberClients returns a client for every running pod of the cluster by member name,
+// Patroni names the members after their pods
+func (r *BGDbOpsReconciler) patroniMemberClients(ctx context.Context, bgCluster *bestgresv1.BGCluster) (map[string]*patroni.Client, error) {
+	podList := &corev1.PodList{}
+	if err := r.List(ctx, podList,
+		client.InNamespace(bgCluster.Namespace),
+		client.MatchingLabels(labelsForBGCluster(bgCluster.Name)),
+	); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	clients := map[string]*patroni.Client{}
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		clients[pod.Name] = patroni.NewClient(pod.Status.PodIP)
+	}
+	return clients, nil
+}
+
+// patroniClusterFromMembers returns the cluster as the first reachable member sees it
+func patroniClusterFromMembers(ctx context.Context, bgCluster *bestgresv1.BGCluster, clients map[string]*patroni.Client) (*patroni.Cluster, error) {
+	for _, patroniClient := range clients {
+		cluster, err := patroniClient.Cluster(ctx)
+		if err != nil {
+			continue
+		}
+		return patroni.ClusterFor(bgCluster, cluster), nil
+	}
+	return nil, fmt.Errorf("no member of cluster %s is reachable", bgCluster.Name)
+}
+
+// pollPatroniMembers gets the state of every member at once, unreachable members are nil
+func pollPatroniMembers(ctx context.Context, clients map[string]*patroni.Client) map[string]*patroni.Status {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	statuses := make(map[string]*patroni.Status, len(clients))
+	for name, patroniClient := range clients {
+		wg.Add(1)
+		go func(name string, patroniClient *patroni.Client) {
+			defer wg.Done()
+			// unreachable members return a nil status
+			status, _ := patroniClient.Status(ctx)
+			mu.Lock()
+			statuses[name] = status
+			mu.Unlock()
+		}(name, patroniClient)
+	}
+	wg.Wait()
+	return statuses
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	bestgresv1 "bestgres/api/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// reconcileUpgradedVersion moves the BGCluster to the new version once the primary upgraded its
+// data directory. The BGCluster reconciler then renders the Patroni configuration with the new
+// binaries and updates the StatefulSet, the in-pod controllers recreate the pods once both ran.
+func (r *BGDbOpsReconciler) reconcileUpgradedVersion(ctx context.Context, bgDbOps *bestgresv1.BGDbOps, bgCluster *bestgresv1.BGCluster) error {
+	upgrade := bgDbOps.Spec.Upgrade
+	result := bgDbOps.Status.UpgradeResult
+	if upgrade == nil || result == nil {
+		return nil
+	}
+	if result.Phase != bestgresv1.UpgradePhaseUpgraded && result.Phase != bestgresv1.UpgradePhaseCompleted {
+		return nil
+	}
+	if bgCluster.Spec.Postgresql.Version == upgrade.PostgresVersion && (upgrade.Image == "" || bgCluster.Spec.Image.Tag == upgrade.Image) {
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Moving BGCluster to the upgraded version", "Version", upgrade.PostgresVersion, "Image", upgrade.Image)
+	patch := client.MergeFrom(bgCluster.DeepCopy())
+	bgCluster.Spec.Postgresql.Version = upgrade.PostgresVersion
+	if upgrade.Image != "" {
+		bgCluster.Spec.Image.Tag = upgrade.Image
+	}
+	if err := r.Patch(ctx, bgCluster, patch); err != nil {
+		return fmt.Errorf("failed to update BGCluster to version %s: %w", upgrade.PostgresVersion, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/backup"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// bgClusterBackupVolumeLabel marks the backup volume the operator created for a cluster, it
+	// doesn't carry the cluster's labels so the deletion policy leaves it alone
+	bgClusterBackupVolumeLabel = "bgcluster.bestgres.io/backup-of"
+
+	// defaultBackupVolumeSize matches the default of spec.backup.storage.filesystem.size
+	defaultBackupVolumeSize = "10Gi"
+)
+
+// reconcileBackupVolume creates the volume of filesystem storage when the cluster doesn't use
+// an existing claim. It isn't owned by the cluster, the backups outlive it. Every member mounts
+// the volume, a volume only one node can mount is refused for clusters with several instances.
+func (r *BGClusterReconciler) reconcileBackupVolume(ctx context.Context, bgCluster *bestgresv1.BGCluster) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	target := backup.TargetFor(bgCluster)
+	if target == nil || target.Storage.Filesystem == nil {
+		return nil
+	}
+	filesystem := target.Storage.Filesystem
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: target.ClaimName(), Namespace: bgCluster.Namespace}, pvc)
+	if err == nil {
+		return checkBackupVolumeAccess(bgCluster, pvc.Name, pvc.Spec.AccessModes)
+	}
+	if !errors.IsNotFound(err) || filesystem.ClaimName != "" {
+		return client.IgnoreNotFound(err)
+	}
+
+	size := filesystem.Size
+	if size == "" {
+		size = defaultBackupVolumeSize
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return fmt.Errorf("invalid backup volume size %q: %w", size, err)
+	}
+	storageClass := filesystem.StorageClass
+	if storageClass == "" {
+		storageClass = bgCluster.Spec.VolumeSpec.StorageClass
+	}
+	accessMode := corev1.ReadWriteMany
+	if filesystem.AccessMode != "" {
+		accessMode = corev1.PersistentVolumeAccessMode(filesystem.AccessMode)
+	}
+	if err := checkBackupVolumeAccess(bgCluster, target.ClaimName(), []corev1.PersistentVolumeAccessMode{accessMode}); err != nil {
+		return err
+	}
+
+	pvc = &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      target.ClaimName(),
+			Namespace: bgCluster.Namespace,
+			Labels:    map[string]string{bgClusterBackupVolumeLabel: bgCluster.Name},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{accessMode},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: quantity},
+			},
+			StorageClassName: &storageClass,
+		},
+	}
+	log.Info("Creating the backup volume", "PersistentVolumeClaim", pvc.Name, "AccessMode", accessMode)
+	return r.Create(ctx, pvc)
+}
+
+// checkBackupVolumeAccess refuses a backup volume the members of the cluster can't all mount,
+// without ReadWriteMany the members on other nodes fail with a Multi-Attach error
+func checkBackupVolumeAccess(bgCluster *bestgresv1.BGCluster, claimName string, accessModes []corev1.PersistentVolumeAccessMode) error {
+	if bgCluster.Spec.Instances <= 1 {
+		return nil
+	}
+	for _, accessMode := range accessModes {
+		if accessMode == corev1.ReadWriteMany {
+			return nil
+		}
+	}
+	return fmt.Errorf("backup volume %s isn't ReadWriteMany, the %d instances of BGCluster %s can't all mount it", claimName, bgCluster.Spec.Instances, bgCluster.Name)
+}
+
+// backupVolumes returns the volumes of filesystem storage, the cluster's own one and the one it
+// is restored from
+func backupVolumes(bgCluster *bestgresv1.BGCluster) ([]corev1.Volume, []corev1.VolumeMount) {
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	if target := backup.TargetFor(bgCluster); target != nil && target.Storage.Filesystem != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name:         "backup",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: target.ClaimName()}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: "backup", MountPath: backup.BackupMountPath})
+	}
+	// the source is only read from
+	if source := recoverySource(bgCluster); source != nil && source.Storage.Filesystem != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name:         "restore",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: source.ClaimName(), ReadOnly: true}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: "restore", MountPath: backup.RestoreMountPath, ReadOnly: true})
+	}
+	return volumes, mounts
+}
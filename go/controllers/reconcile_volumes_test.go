@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	bestgresv1 "bestgres/api/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestBackupVolumeAccessMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		instances  int32
+		accessMode string
+		wantErr    bool
+	}{
+		{"shared volume", 3, "", false},
+		{"single node volume for one instance", 1, "ReadWriteOnce", false},
+		{"single node volume for several instances", 3, "ReadWriteOnce", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			bgCluster := newTestBGCluster(false)
+			bgCluster.Spec.Instances = tt.instances
+			bgCluster.Spec.Backup = &bestgresv1.BackupSpec{Storage: bestgresv1.BackupStorage{
+				Filesystem: &bestgresv1.FilesystemStorage{AccessMode: tt.accessMode},
+			}}
+			r := newTestBGClusterReconciler(t, bgCluster)
+
+			err := r.reconcileBackupVolume(ctx, bgCluster)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reconcileBackupVolume() = %v, want an error: %v", err, tt.wantErr)
+			}
+			getErr := r.Get(ctx, types.NamespacedName{Name: "bgcluster-backup", Namespace: "default"}, &corev1.PersistentVolumeClaim{})
+			if tt.wantErr && !errors.IsNotFound(getErr) {
+				t.Errorf("refused backup volume was created: %v", getErr)
+			}
+			if !tt.wantErr && getErr != nil {
+				t.Errorf("backup volume wasn't created: %v", getErr)
+			}
+		})
+	}
+}
+
+func TestExistingBackupVolumeAccessMode(t *testing.T) {
+	bgCluster := newTestBGCluster(false)
+	bgCluster.Spec.Backup = &bestgresv1.BackupSpec{Storage: bestgresv1.BackupStorage{
+		Filesystem: &bestgresv1.FilesystemStorage{ClaimName: "backups"},
+	}}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "backups", Namespace: "default"},
+		Spec:       corev1.PersistentVolumeClaimSpec{AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}},
+	}
+	r := newTestBGClusterReconciler(t, bgCluster, pvc)
+
+	if err := r.reconcileBackupVolume(context.Background(), bgCluster); err == nil {
+		t.Error("reconcileBackupVolume() accepted an existing ReadWriteOnce claim for 3 instances")
+	}
+}
@@ -2,8 +2,10 @@ package controllers
 
 import (
 	bestgresv1 "bestgres/api/v1"
+	"bestgres/patroni"
 	"context"
 	"crypto/rand"
+	"fmt"
 	"log"
 	"math/big"
 	"os"
@@ -37,6 +39,16 @@ func generateRandomPassword(length int) (string, error) {
     return string(password), nil
 }
 
+const (
+	// roleLabel is the pod label Patroni maintains with the member's current role,
+	// it is passed to the pods through KUBERNETES_ROLE_LABEL
+	roleLabel = "role"
+	// primaryRoleLabelValue is the role label value Patroni sets on the leader
+	primaryRoleLabelValue = "master"
+	// replicaRoleLabelValue is the role label value Patroni sets on every other member
+	replicaRoleLabelValue = "replica"
+)
+
 func labelsForBGCluster(name string) map[string]string {
 	return map[string]string{
 		"application":  "spilo",
@@ -44,6 +56,36 @@ func labelsForBGCluster(name string) map[string]string {
 	}
 }
 
+// selectorForBGClusterRole returns the pod selector for the members of a BGCluster
+// with the given Patroni role, or for all members if role is empty
+func selectorForBGClusterRole(name string, role string) map[string]string {
+	selector := labelsForBGCluster(name)
+	if role != "" {
+		selector[roleLabel] = role
+	}
+	return selector
+}
+
+// patroniScope returns the Patroni scope of the cluster and the pod label Patroni selects the
+// members of the scope by. The groups of a patroni-native sharded cluster share the scope of
+// the sharded cluster.
+func patroniScope(bgCluster *bestgresv1.BGCluster) (string, string) {
+	if _, ok := patroni.CitusGroup(bgCluster); ok {
+		return bgCluster.Labels[bgClusterPartOfLabel], bgClusterPartOfLabel
+	}
+	return bgCluster.Name, "cluster-name"
+}
+
+// dcsConfigMapPrefix returns the prefix of the ConfigMaps Patroni keeps the cluster state in,
+// Patroni adds the Citus group to the scope
+func dcsConfigMapPrefix(bgCluster *bestgresv1.BGCluster) string {
+	scope, _ := patroniScope(bgCluster)
+	if group, ok := patroni.CitusGroup(bgCluster); ok {
+		return fmt.Sprintf("%s-%d", scope, group)
+	}
+	return scope
+}
+
 func getPodNames(pods []corev1.Pod) []string {
 	var podNames []string
 	for _, pod := range pods {
@@ -0,0 +1,102 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		// steps
+		{"every 15 minutes", "*/15 * * * *", date(2024, 1, 1, 10, 7), date(2024, 1, 1, 10, 15)},
+		{"every 15 minutes into the next hour", "*/15 * * * *", date(2024, 1, 1, 10, 45), date(2024, 1, 1, 11, 0)},
+		{"step from a value", "5/20 * * * *", date(2024, 1, 1, 10, 26), date(2024, 1, 1, 10, 45)},
+		{"range with a step", "0 9-17/4 * * *", date(2024, 1, 1, 10, 0), date(2024, 1, 1, 13, 0)},
+		{"range with a step into the next day", "0 9-17/4 * * *", date(2024, 1, 1, 17, 0), date(2024, 1, 2, 9, 0)},
+		{"list", "0 6,18 * * *", date(2024, 1, 1, 7, 0), date(2024, 1, 1, 18, 0)},
+
+		// names
+		{"month and day names", "0 0 * jan-mar mon", date(2024, 3, 31, 0, 0), date(2025, 1, 6, 0, 0)},
+		{"capitalized names", "0 0 * * FRI", date(2024, 1, 1, 0, 0), date(2024, 1, 5, 0, 0)},
+		{"7 is Sunday", "0 0 * * 7", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 0, 0)},
+		{"range ending on 7", "0 0 * * 6-7", date(2024, 1, 1, 0, 0), date(2024, 1, 6, 0, 0)},
+		{"0 is Sunday", "0 0 * * 0", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 0, 0)},
+
+		// day of month and day of week
+		{"either restricted day matches", "0 0 13 * fri", date(2024, 1, 1, 0, 0), date(2024, 1, 5, 0, 0)},
+		{"either restricted day matches, day of month", "0 0 13 * fri", date(2024, 1, 12, 0, 0), date(2024, 1, 13, 0, 0)},
+		{"unrestricted day of week", "0 0 13 * *", date(2024, 1, 1, 0, 0), date(2024, 1, 13, 0, 0)},
+		// a field starting with * counts as unrestricted like in Vixie cron
+		{"starred day of month with a step ands", "0 0 */10 * mon", date(2024, 1, 1, 0, 0), date(2024, 3, 11, 0, 0)},
+		{"starred day of week with a step ands", "0 0 1-7 * */7", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 0, 0)},
+
+		// macros
+		{"hourly", "@hourly", date(2024, 1, 1, 10, 30), date(2024, 1, 1, 11, 0)},
+		{"daily", "@daily", date(2024, 1, 1, 10, 30), date(2024, 1, 2, 0, 0)},
+		{"midnight", "@midnight", date(2024, 1, 1, 10, 30), date(2024, 1, 2, 0, 0)},
+		{"weekly", "@weekly", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 0, 0)},
+		{"monthly", "@monthly", date(2024, 1, 31, 23, 59), date(2024, 2, 1, 0, 0)},
+		{"yearly", "@yearly", date(2024, 6, 1, 0, 0), date(2025, 1, 1, 0, 0)},
+		{"annually", "@annually", date(2024, 6, 1, 0, 0), date(2025, 1, 1, 0, 0)},
+		{"macros ignore case", "@DAILY", date(2024, 1, 1, 10, 30), date(2024, 1, 2, 0, 0)},
+
+		// rollovers
+		{"strictly after", "0 0 * * *", date(2024, 1, 1, 0, 0), date(2024, 1, 2, 0, 0)},
+		{"seconds are dropped", "*/15 * * * *", time.Date(2024, 1, 1, 10, 14, 59, 0, time.UTC), date(2024, 1, 1, 10, 15)},
+		{"end of the year", "0 0 1 1 *", date(2024, 12, 31, 23, 59), date(2025, 1, 1, 0, 0)},
+		{"months without the day", "30 23 31 * *", date(2024, 1, 31, 23, 30), date(2024, 3, 31, 23, 30)},
+		{"leap day", "0 0 29 2 *", date(2024, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		{"evaluated in UTC", "@daily", time.Date(2024, 1, 1, 1, 30, 0, 0, time.FixedZone("CEST", 2*60*60)), date(2024, 1, 1, 0, 0)},
+
+		// impossible dates
+		{"February 30", "0 0 30 2 *", date(2024, 1, 1, 0, 0), time.Time{}},
+		{"April 31", "0 0 31 4 *", date(2024, 1, 1, 0, 0), time.Time{}},
+		{"February 30 or a Monday", "0 0 30 2 mon", date(2024, 1, 1, 0, 0), date(2024, 2, 5, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", tt.spec, err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"foo * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+		"@every 5m",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
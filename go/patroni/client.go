@@ -0,0 +1,321 @@
+// Package patroni talks to the Patroni REST API of cluster members and renders the
+// Patroni configuration the operator manages.
+package patroni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIPort is the port the Patroni REST API listens on in every member
+const APIPort = 8008
+
+// leaderChangeTimeout bounds switchover and failover requests, Patroni answers them once the
+// new leader took over or after about 15 seconds with 503 when the outcome is still unknown
+const leaderChangeTimeout = 30 * time.Second
+
+// restartTimeout bounds restart requests, Patroni answers them once postgres is back up
+const restartTimeout = 5 * time.Minute
+
+// Member roles as reported by the REST API, Patroni 4 reports "primary" where older
+// versions report "master"
+const (
+	RoleLeader        = "leader"
+	RoleStandbyLeader = "standby_leader"
+	RoleReplica       = "replica"
+	RoleSyncStandby   = "sync_standby"
+	RoleMaster        = "master"
+	RolePrimary       = "primary"
+)
+
+// Client calls the REST API of a single Patroni member
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the member listening on host
+func NewClient(host string) *Client {
+	return &Client{
+		BaseURL:    "http://" + net.JoinHostPort(host, strconv.Itoa(APIPort)),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Lag is the replication lag of a member in bytes, Patroni reports "unknown" when it
+// can't be determined
+type Lag struct {
+	Bytes int64
+	Known bool
+}
+
+func (l *Lag) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		// non-numeric values such as "unknown"
+		*l = Lag{}
+		return nil
+	}
+	v, err := n.Int64()
+	if err != nil {
+		*l = Lag{}
+		return nil
+	}
+	*l = Lag{Bytes: v, Known: true}
+	return nil
+}
+
+func (l Lag) MarshalJSON() ([]byte, error) {
+	if !l.Known {
+		return []byte(`"unknown"`), nil
+	}
+	return []byte(strconv.FormatInt(l.Bytes, 10)), nil
+}
+
+// PendingRestartReason is the old and new value of a parameter waiting for a restart
+type PendingRestartReason struct {
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+// Status is the response of GET /patroni
+type Status struct {
+	State    string `json:"state"`
+	Role     string `json:"role"`
+	Timeline int64  `json:"timeline"`
+	// ServerVersion is the numeric postgres version, e.g. 160002
+	ServerVersion        int                             `json:"server_version"`
+	PendingRestart       bool                            `json:"pending_restart"`
+	PendingRestartReason map[string]PendingRestartReason `json:"pending_restart_reason"`
+	ReplicationState     string                          `json:"replication_state"`
+	Pause                bool                            `json:"pause"`
+	Patroni              struct {
+		Version string `json:"version"`
+		Scope   string `json:"scope"`
+		Name    string `json:"name"`
+	} `json:"patroni"`
+}
+
+// IsLeader reports whether the member is the primary of its cluster
+func (s *Status) IsLeader() bool {
+	return s.Role == RoleMaster || s.Role == RolePrimary
+}
+
+// Member is a single member as reported by GET /cluster
+type Member struct {
+	Name           string `json:"name"`
+	Role           string `json:"role"`
+	State          string `json:"state"`
+	APIURL         string `json:"api_url"`
+	Host           string `json:"host"`
+	Port           int    `json:"port"`
+	Timeline       int64  `json:"timeline"`
+	Lag            Lag    `json:"lag"`
+	PendingRestart bool   `json:"pending_restart"`
+	// PendingRestartReason is only reported by Patroni 4 and newer
+	PendingRestartReason map[string]PendingRestartReason `json:"pending_restart_reason"`
+	// Group is the Citus group of the member, the coordinator of a Citus cluster reports
+	// the members of every group
+	Group *int `json:"group,omitempty"`
+}
+
+// IsLeader reports whether the member is the leader of its cluster
+func (m *Member) IsLeader() bool {
+	return m.Role == RoleLeader || m.Role == RoleStandbyLeader
+}
+
+// Cluster is the response of GET /cluster
+type Cluster struct {
+	Members []Member `json:"members"`
+	Pause   bool     `json:"pause"`
+}
+
+// Leader returns the leader member, or nil if the cluster has none
+func (c *Cluster) Leader() *Member {
+	for i := range c.Members {
+		if c.Members[i].IsLeader() {
+			return &c.Members[i]
+		}
+	}
+	return nil
+}
+
+// Group returns the cluster with only the members of the given Citus group, members that
+// don't report a group are kept
+func (c *Cluster) Group(group int) *Cluster {
+	filtered := &Cluster{Pause: c.Pause}
+	for _, member := range c.Members {
+		if member.Group == nil || *member.Group == group {
+			filtered.Members = append(filtered.Members, member)
+		}
+	}
+	return filtered
+}
+
+// Member returns the member with the given name, or nil if it's not part of the cluster
+func (c *Cluster) Member(name string) *Member {
+	for i := range c.Members {
+		if c.Members[i].Name == name {
+			return &c.Members[i]
+		}
+	}
+	return nil
+}
+
+// HealthiestReplica returns the running or streaming replica with the least replication lag,
+// or an empty name when there is none
+func (c *Cluster) HealthiestReplica() string {
+	var best *Member
+	for i := range c.Members {
+		member := &c.Members[i]
+		if member.IsLeader() || (member.State != "running" && member.State != "streaming") {
+			continue
+		}
+		if best == nil || (member.Lag.Known && (!best.Lag.Known || member.Lag.Bytes < best.Lag.Bytes)) {
+			best = member
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Name
+}
+
+// Status returns the state of the member
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	status := &Status{}
+	if err := c.do(ctx, http.MethodGet, "/patroni", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Cluster returns the topology of the cluster the member belongs to
+func (c *Client) Cluster(ctx context.Context) (*Cluster, error) {
+	cluster := &Cluster{}
+	if err := c.do(ctx, http.MethodGet, "/cluster", nil, cluster); err != nil {
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// Config returns the dynamic configuration stored in the DCS
+func (c *Client) Config(ctx context.Context) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	if err := c.do(ctx, http.MethodGet, "/config", nil, &config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// PatchConfig merges patch into the dynamic configuration stored in the DCS, keys set to
+// nil are removed
+func (c *Client) PatchConfig(ctx context.Context, patch map[string]interface{}) error {
+	return c.do(ctx, http.MethodPatch, "/config", patch, nil)
+}
+
+// Reload makes the member re-read its configuration file and reload postgres
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/reload", nil, nil)
+}
+
+// Switchover asks the leader to hand over to candidate, or to the healthiest replica when
+// candidate is empty. It returns once the new leader took over.
+func (c *Client) Switchover(ctx context.Context, leader, candidate string) error {
+	request := map[string]interface{}{"leader": leader}
+	if candidate != "" {
+		request["candidate"] = candidate
+	}
+	return c.withTimeout(leaderChangeTimeout).do(ctx, http.MethodPost, "/switchover", request, nil)
+}
+
+// Failover promotes candidate, also when the cluster has no healthy leader
+func (c *Client) Failover(ctx context.Context, candidate string) error {
+	request := map[string]interface{}{"candidate": candidate}
+	return c.withTimeout(leaderChangeTimeout).do(ctx, http.MethodPost, "/failover", request, nil)
+}
+
+// Restart restarts postgres on the member, only when Patroni flags it as pending restart if
+// pendingOnly is set. It returns once postgres is back up.
+func (c *Client) Restart(ctx context.Context, pendingOnly bool) error {
+	request := map[string]interface{}{}
+	if pendingOnly {
+		request["restart_pending"] = true
+	}
+	return c.withTimeout(restartTimeout).do(ctx, http.MethodPost, "/restart", request, nil)
+}
+
+// withTimeout returns a copy of the client whose requests time out after timeout
+func (c *Client) withTimeout(timeout time.Duration) *Client {
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = timeout
+	return &Client{BaseURL: c.BaseURL, HTTPClient: &httpClient}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// GET /patroni answers 503 for members that are not running but still returns the status
+	if resp.StatusCode >= 300 && !(method == http.MethodGet && resp.StatusCode == http.StatusServiceUnavailable && len(respBody) > 0 && out != nil) {
+		return &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(respBody))}
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// APIError is returned when Patroni answers with an unexpected status code
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+// IsUnknownOutcome reports whether Patroni accepted a switchover or failover but gave up
+// waiting for the new leader, which may still take over
+func (e *APIError) IsUnknownOutcome() bool {
+	return e.StatusCode == http.StatusServiceUnavailable && strings.HasSuffix(e.Body, "status unknown")
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("patroni %s %s returned %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
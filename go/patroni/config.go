@@ -0,0 +1,309 @@
+package patroni
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bestgresv1 "bestgres/api/v1"
+	"bestgres/backup"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultSharedPreloadLibraries are the libraries Spilo preloads out of the box, they are
+// used when the spec doesn't list any
+var DefaultSharedPreloadLibraries = []string{
+	"bg_mon",
+	"pg_stat_statements",
+	"pgextwlist",
+	"pg_auth_mon",
+	"set_user",
+	"timescaledb",
+	"pg_cron",
+	"pg_stat_kcache",
+}
+
+// CitusUser is the role Citus nodes of a sharded cluster use to talk to each other, its
+// password is shared by all nodes through PGPASSWORD_CITUS
+const CitusUser = "bestgres_citus"
+
+// CitusGroupLabel is set on the BGClusters of patroni-native sharded clusters with the Citus
+// group Patroni runs them as, the coordinator is group 0
+const CitusGroupLabel = "bgcluster.bestgres.io/citus-group"
+
+// CitusGroupPodLabel is the pod label Patroni tells the Citus groups of a scope apart by
+const CitusGroupPodLabel = "citus-group"
+
+// CitusDatabase is the database Citus is created in
+const CitusDatabase = "postgres"
+
+// CitusGroup returns the Citus group of a BGCluster whose pg_dist_node Patroni maintains
+func CitusGroup(bgCluster *bestgresv1.BGCluster) (int, bool) {
+	value, ok := bgCluster.Labels[CitusGroupLabel]
+	if !ok {
+		return 0, false
+	}
+	group, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return group, true
+}
+
+// ClusterFor returns the members of cluster that belong to the BGCluster, the Citus groups of a
+// patroni-native sharded cluster share a Patroni cluster
+func ClusterFor(bgCluster *bestgresv1.BGCluster, cluster *Cluster) *Cluster {
+	if group, ok := CitusGroup(bgCluster); ok {
+		return cluster.Group(group)
+	}
+	return cluster
+}
+
+// DefaultPgHBA are the pg_hba rules of clusters that don't set their own, only the local
+// socket is trusted
+var DefaultPgHBA = []string{
+	"local all all trust",
+	"host all all 127.0.0.1/32 scram-sha-256",
+	"host all all ::1/128 scram-sha-256",
+	"local replication standby trust",
+	"host replication standby 0.0.0.0/0 scram-sha-256",
+	"host replication standby ::0/0 scram-sha-256",
+	"host all all 0.0.0.0/0 scram-sha-256",
+	"host all all ::0/0 scram-sha-256",
+}
+
+// DefaultCitusNetworks are the networks the internal Citus user logs in from when the cluster
+// doesn't set its own, the private address ranges pod IPs are assigned from
+var DefaultCitusNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+}
+
+// PgHBA returns the pg_hba rules of the cluster, sharded clusters get the rules for the
+// internal Citus user first so they can't be shadowed. The user is a superuser, it's only
+// allowed in from the networks of the pods.
+func PgHBA(bgCluster *bestgresv1.BGCluster, sharded bool) []string {
+	var rules []string
+	if sharded {
+		networks := bgCluster.Spec.CitusNetworks
+		if len(networks) == 0 {
+			networks = DefaultCitusNetworks
+		}
+		for _, network := range networks {
+			rules = append(rules, "host all "+CitusUser+" "+network+" scram-sha-256")
+		}
+		// anywhere else it can't log in at all
+		rules = append(rules,
+			"host all "+CitusUser+" 0.0.0.0/0 reject",
+			"host all "+CitusUser+" ::0/0 reject",
+		)
+	}
+	if len(bgCluster.Spec.PgHBA) > 0 {
+		return append(rules, bgCluster.Spec.PgHBA...)
+	}
+	return append(rules, DefaultPgHBA...)
+}
+
+// Configuration renders the Patroni configuration handed to the image through
+// SPILO_CONFIGURATION. The image merges it over its own defaults, lists such as pg_hba
+// replace the defaults entirely.
+func Configuration(bgCluster *bestgresv1.BGCluster, sharded bool) map[string]interface{} {
+	bootstrap := map[string]interface{}{
+		"initdb": []map[string]string{
+			{"auth-host": "scram-sha-256"},
+			{"auth-local": "trust"},
+		},
+	}
+
+	// bootstrap.dcs only seeds the DCS of a new cluster, running clusters are updated
+	// through the Patroni API
+	bootstrap["dcs"] = DynamicConfiguration(bgCluster)
+
+	// restored clusters replace initdb with a custom bootstrap, Patroni only runs it on the
+	// member that initializes the cluster
+	if bgCluster.Spec.Bootstrap != nil && bgCluster.Spec.Bootstrap.Recovery != nil {
+		bootstrap["method"] = RestoreBootstrapMethod
+		bootstrap[RestoreBootstrapMethod] = map[string]interface{}{
+			"command":                     backup.RestoreBackupCommand,
+			"keep_existing_recovery_conf": false,
+			"recovery_conf":               RecoveryConfiguration(bgCluster.Spec.Bootstrap.Recovery.Target),
+		}
+	}
+
+	parameters := map[string]interface{}{
+		"shared_preload_libraries": strings.Join(SharedPreloadLibraries(bgCluster, sharded), ","),
+	}
+	// WAL is archived through the controller binary, which knows the configured tool. These
+	// are local settings so they replace the archive settings of the image.
+	if backupSpec := bgCluster.Spec.Backup; backupSpec != nil {
+		parameters["archive_mode"] = "on"
+		parameters["archive_command"] = backup.ArchiveCommand
+		parameters["archive_timeout"] = fmt.Sprintf("%ds", backupSpec.ArchiveTimeout)
+	}
+
+	postgresql := map[string]interface{}{
+		"parameters": parameters,
+		"pg_hba":     PgHBA(bgCluster, sharded),
+	}
+	// upgraded clusters run the binaries of the version their data directory was upgraded to
+	if version := bgCluster.Spec.Postgresql.Version; version != "" {
+		postgresql["bin_dir"] = BinDir(version)
+	}
+	config := map[string]interface{}{
+		"bootstrap":  bootstrap,
+		"postgresql": postgresql,
+	}
+	// the coordinator primary registers the primaries of the other groups in pg_dist_node
+	if group, ok := CitusGroup(bgCluster); ok {
+		config["citus"] = map[string]interface{}{
+			"group":    group,
+			"database": CitusDatabase,
+		}
+	}
+	return config
+}
+
+// BinDir returns the directory Spilo installs the binaries of a major version in
+func BinDir(version string) string {
+	return "/usr/lib/postgresql/" + version + "/bin"
+}
+
+// RestoreBootstrapMethod is the name of the Patroni custom bootstrap of restored clusters
+const RestoreBootstrapMethod = "bestgres_restore"
+
+// RecoveryConfiguration returns the recovery settings Patroni starts the restored member
+// with, it is promoted once WAL replay reached the target
+func RecoveryConfiguration(target *bestgresv1.RecoveryTarget) map[string]interface{} {
+	recoveryConf := map[string]interface{}{
+		"restore_command":          backup.RestoreWALCommand,
+		"recovery_target_action":   "promote",
+		"recovery_target_timeline": "latest",
+	}
+	if target == nil {
+		return recoveryConf
+	}
+	switch {
+	case target.Time != nil:
+		recoveryConf["recovery_target_time"] = target.Time.UTC().Format(time.RFC3339)
+	case target.LSN != "":
+		recoveryConf["recovery_target_lsn"] = target.LSN
+	case target.Name != "":
+		recoveryConf["recovery_target_name"] = target.Name
+	}
+	if target.Exclusive {
+		recoveryConf["recovery_target_inclusive"] = "off"
+	}
+	return recoveryConf
+}
+
+// MarshalConfiguration renders the configuration as the YAML document stored in the
+// -postgres-config ConfigMap
+func MarshalConfiguration(bgCluster *bestgresv1.BGCluster, sharded bool) (string, error) {
+	configBytes, err := yaml.Marshal(Configuration(bgCluster, sharded))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal Patroni configuration: %w", err)
+	}
+	return string(configBytes), nil
+}
+
+// SharedPreloadLibraries returns the libraries the cluster preloads, sharded clusters
+// always load citus first as Citus requires
+func SharedPreloadLibraries(bgCluster *bestgresv1.BGCluster, sharded bool) []string {
+	libraries := bgCluster.Spec.Postgresql.SharedPreloadLibraries
+	if len(libraries) == 0 {
+		libraries = DefaultSharedPreloadLibraries
+	}
+
+	var result []string
+	if sharded {
+		result = append(result, "citus")
+	}
+	for _, library := range libraries {
+		if sharded && library == "citus" {
+			continue
+		}
+		result = append(result, library)
+	}
+	return result
+}
+
+// ParseSharedPreloadLibraries splits a shared_preload_libraries value into library names
+func ParseSharedPreloadLibraries(value string) []string {
+	var libraries []string
+	for _, library := range strings.Split(value, ",") {
+		library = strings.Trim(strings.TrimSpace(library), `"'`)
+		if library != "" {
+			libraries = append(libraries, library)
+		}
+	}
+	return libraries
+}
+
+// DynamicConfiguration renders the part of the Patroni dynamic configuration managed
+// through the BGCluster spec. It is used as bootstrap.dcs when the cluster is created
+// and patched into the DCS of running clusters.
+func DynamicConfiguration(bgCluster *bestgresv1.BGCluster) map[string]interface{} {
+	config := map[string]interface{}{}
+
+	patroniSpec := bgCluster.Spec.Patroni
+	if patroniSpec.LoopWait != nil {
+		config["loop_wait"] = *patroniSpec.LoopWait
+	}
+	if patroniSpec.TTL != nil {
+		config["ttl"] = *patroniSpec.TTL
+	}
+	if patroniSpec.RetryTimeout != nil {
+		config["retry_timeout"] = *patroniSpec.RetryTimeout
+	}
+	if patroniSpec.MaximumLagOnFailover != nil {
+		config["maximum_lag_on_failover"] = *patroniSpec.MaximumLagOnFailover
+	}
+	if patroniSpec.SynchronousMode != nil {
+		config["synchronous_mode"] = *patroniSpec.SynchronousMode
+	}
+
+	// the pg_hba rules use scram-sha-256, so passwords must be stored that way
+	parameters := map[string]interface{}{
+		"password_encryption": "scram-sha-256",
+	}
+	for name, value := range bgCluster.Spec.Postgresql.Parameters {
+		parameters[name] = value
+	}
+	config["postgresql"] = map[string]interface{}{
+		"parameters": parameters,
+	}
+
+	return config
+}
+
+// ConfigPatch returns the PATCH /config body that moves the DCS from the previously
+// applied configuration to the desired one, keys that are no longer managed are removed
+func ConfigPatch(applied, desired map[string]interface{}) map[string]interface{} {
+	patch := map[string]interface{}{}
+	for key, value := range desired {
+		patch[key] = value
+	}
+	for key, value := range applied {
+		appliedMap, isMap := value.(map[string]interface{})
+		desiredValue, exists := desired[key]
+		if !exists {
+			// sections such as postgresql also hold settings the operator doesn't manage,
+			// only remove the keys that were applied
+			if isMap {
+				patch[key] = ConfigPatch(appliedMap, map[string]interface{}{})
+			} else {
+				patch[key] = nil
+			}
+			continue
+		}
+		if desiredMap, ok := desiredValue.(map[string]interface{}); ok && isMap {
+			patch[key] = ConfigPatch(appliedMap, desiredMap)
+		}
+	}
+	return patch
+}
@@ -0,0 +1,338 @@
+// Package pgclient is a small PostgreSQL wire protocol client used by the in-pod
+// controller. It only depends on the standard library and supports the subset of the
+// protocol the controller needs: trust, password, md5 and SCRAM-SHA-256 authentication,
+// simple queries and parameterised queries with text encoded values.
+package pgclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const protocolVersion = 196608 // 3.0
+
+// cancelRequestCode takes the place of the protocol version in a CancelRequest
+const cancelRequestCode = 80877102
+
+// cancelTimeout bounds sending a CancelRequest
+const cancelTimeout = 5 * time.Second
+
+// maxMessageSize bounds the backend messages the client accepts, the controller only reads
+// small result sets so anything larger is a broken or hostile server
+const maxMessageSize = 64 << 20
+
+// Config holds the connection settings for a server
+type Config struct {
+	// Host is a hostname or IP address, or the directory of the unix socket if it starts with a "/"
+	Host string
+	Port int
+	User string
+	// Password is only sent if the server asks for it
+	Password        string
+	Database        string
+	ApplicationName string
+	// ConnectTimeout bounds dialing and authentication, zero means no timeout
+	ConnectTimeout time.Duration
+}
+
+// address returns the network and address to dial for the config
+func (c Config) address() (string, string) {
+	port := c.Port
+	if port == 0 {
+		port = 5432
+	}
+	if strings.HasPrefix(c.Host, "/") {
+		return "unix", fmt.Sprintf("%s/.s.PGSQL.%d", c.Host, port)
+	}
+	return "tcp", net.JoinHostPort(c.Host, strconv.Itoa(port))
+}
+
+// Conn is a single connection to the server, it is not safe for concurrent use
+type Conn struct {
+	config Config
+	conn   net.Conn
+	rd     *bufio.Reader
+	// params holds the ParameterStatus values reported by the server
+	params map[string]string
+	// pid and secret identify the backend in a CancelRequest
+	pid, secret int
+	// mu guards closed, the connection is closed when a context is cancelled mid-query
+	mu     sync.Mutex
+	closed bool
+}
+
+// Connect opens a connection and authenticates with the server
+func Connect(ctx context.Context, config Config) (*Conn, error) {
+	if config.User == "" {
+		return nil, errors.New("pgclient: user is required")
+	}
+	if config.Database == "" {
+		config.Database = config.User
+	}
+
+	if config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+		defer cancel()
+	}
+
+	network, address := config.address()
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, &ConnectError{Address: address, Err: err}
+	}
+
+	c := &Conn{
+		config: config,
+		conn:   netConn,
+		rd:     bufio.NewReader(netConn),
+		params: map[string]string{},
+	}
+
+	stop := c.watch(ctx)
+	err = c.startup()
+	stop()
+	if err != nil {
+		netConn.Close()
+		var pgErr *Error
+		if errors.As(err, &pgErr) {
+			return nil, err
+		}
+		return nil, &ConnectError{Address: address, Err: err}
+	}
+	return c, nil
+}
+
+// Close terminates the connection
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	// Terminate is best effort, the server also cleans up when the socket closes
+	c.conn.Write(newMessage('X').finish())
+	return c.conn.Close()
+}
+
+// ParameterStatus returns a run-time parameter reported by the server, e.g. server_version
+func (c *Conn) ParameterStatus(name string) string {
+	return c.params[name]
+}
+
+// watch closes the connection if ctx is cancelled before the returned stop function is called
+func (c *Conn) watch(ctx context.Context) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			if !c.closed {
+				c.closed = true
+				// closing the socket doesn't stop a running statement such as VACUUM
+				c.cancel()
+				c.conn.Close()
+			}
+			c.mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// cancel asks the server to cancel the statement running on the connection, it's best effort
+// as the server doesn't answer a CancelRequest
+func (c *Conn) cancel() {
+	if c.pid == 0 {
+		return
+	}
+	network, address := c.config.address()
+	netConn, err := net.DialTimeout(network, address, cancelTimeout)
+	if err != nil {
+		return
+	}
+	defer netConn.Close()
+	netConn.SetDeadline(time.Now().Add(cancelTimeout))
+	msg := newMessage(0)
+	msg.int32(cancelRequestCode)
+	msg.int32(c.pid)
+	msg.int32(c.secret)
+	netConn.Write(msg.finish())
+}
+
+func (c *Conn) startup() error {
+	msg := newMessage(0)
+	msg.int32(protocolVersion)
+	msg.cstring("user")
+	msg.cstring(c.config.User)
+	msg.cstring("database")
+	msg.cstring(c.config.Database)
+	if c.config.ApplicationName != "" {
+		msg.cstring("application_name")
+		msg.cstring(c.config.ApplicationName)
+	}
+	msg.buf = append(msg.buf, 0)
+	if err := c.send(msg.finish()); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			r := &reader{buf: body}
+			switch code := r.int32(); code {
+			case 0: // AuthenticationOk
+			case 3: // AuthenticationCleartextPassword
+				if err := c.sendPassword(c.config.Password); err != nil {
+					return err
+				}
+			case 5: // AuthenticationMD5Password
+				salt := r.next(4)
+				if r.err != nil {
+					return r.err
+				}
+				if err := c.sendPassword(md5Password(c.config.User, c.config.Password, salt)); err != nil {
+					return err
+				}
+			case 10: // AuthenticationSASL
+				mechanisms := []string{}
+				for len(r.buf) > 1 {
+					mechanism := r.cstring()
+					if r.err != nil {
+						return r.err
+					}
+					mechanisms = append(mechanisms, mechanism)
+				}
+				if !contains(mechanisms, scramSHA256) {
+					return fmt.Errorf("pgclient: unsupported SASL mechanisms %v", mechanisms)
+				}
+				if scram, err = newScramClient(c.config.Password); err != nil {
+					return err
+				}
+				first := scram.clientFirst()
+				msg := newMessage('p')
+				msg.cstring(scramSHA256)
+				msg.int32(len(first))
+				msg.bytes(first)
+				if err := c.send(msg.finish()); err != nil {
+					return err
+				}
+			case 11: // AuthenticationSASLContinue
+				if scram == nil {
+					return errors.New("pgclient: unexpected SASL continue message")
+				}
+				final, err := scram.clientFinal(r.buf)
+				if err != nil {
+					return err
+				}
+				msg := newMessage('p')
+				msg.bytes(final)
+				if err := c.send(msg.finish()); err != nil {
+					return err
+				}
+			case 12: // AuthenticationSASLFinal
+				if scram == nil {
+					return errors.New("pgclient: unexpected SASL final message")
+				}
+				if err := scram.verifyServerFinal(r.buf); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("pgclient: unsupported authentication method %d", code)
+			}
+		case 'S':
+			r := &reader{buf: body}
+			name := r.cstring()
+			c.params[name] = r.cstring()
+		case 'K':
+			r := &reader{buf: body}
+			c.pid = r.int32()
+			c.secret = r.int32()
+		case 'N':
+			// notices are not used
+		case 'E':
+			return parseError(body)
+		case 'Z':
+			return nil
+		default:
+			return fmt.Errorf("pgclient: unexpected message %q during startup", typ)
+		}
+	}
+}
+
+func (c *Conn) sendPassword(password string) error {
+	msg := newMessage('p')
+	msg.cstring(password)
+	return c.send(msg.finish())
+}
+
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+func (c *Conn) send(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// receive reads the next backend message
+func (c *Conn) receive() (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.rd, header); err != nil {
+		return 0, nil, err
+	}
+	r := &reader{buf: header[1:]}
+	length := r.int32() - 4
+	if length < 0 {
+		return 0, nil, errShortMessage
+	}
+	if length > maxMessageSize {
+		return 0, nil, fmt.Errorf("pgclient: %d byte message from server exceeds the maximum of %d bytes", length, maxMessageSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.rd, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
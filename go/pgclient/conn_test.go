@@ -0,0 +1,230 @@
+package pgclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// backendMessage frames a backend message the way the server sends it
+func backendMessage(typ byte, body []byte) []byte {
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+func int32Bytes(v int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(v))
+}
+
+// pipeConn returns a client connection whose server side reads the startup message and then
+// replies with the given bytes
+func pipeConn(t *testing.T, reply []byte) *Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(server, header); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(server, make([]byte, binary.BigEndian.Uint32(header)-4)); err != nil {
+			return
+		}
+		server.Write(reply)
+		// drain whatever the client sends next
+		io.Copy(io.Discard, server)
+	}()
+	return &Conn{
+		config: Config{User: "postgres", Database: "postgres"},
+		conn:   client,
+		rd:     bufio.NewReader(client),
+		params: map[string]string{},
+	}
+}
+
+func TestWriterFraming(t *testing.T) {
+	typed := newMessage('Q')
+	typed.cstring("SELECT 1")
+	want := append([]byte{'Q', 0, 0, 0, 13}, "SELECT 1\x00"...)
+	if got := typed.finish(); !bytes.Equal(got, want) {
+		t.Errorf("typed message = %q, want %q", got, want)
+	}
+
+	// the length of untyped messages such as the StartupMessage starts at the first byte
+	untyped := newMessage(0)
+	untyped.int32(protocolVersion)
+	untyped.int16(7)
+	want = []byte{0, 0, 0, 10, 0, 3, 0, 0, 0, 7}
+	if got := untyped.finish(); !bytes.Equal(got, want) {
+		t.Errorf("untyped message = %v, want %v", got, want)
+	}
+}
+
+func TestReaderShortMessage(t *testing.T) {
+	r := &reader{buf: []byte{0, 1, 'a'}}
+	if v := r.int16(); v != 1 || r.err != nil {
+		t.Fatalf("int16() = %d, %v", v, r.err)
+	}
+	if s := r.cstring(); s != "" || r.err != errShortMessage {
+		t.Errorf("unterminated cstring() = %q, %v, want errShortMessage", s, r.err)
+	}
+
+	for name, read := range map[string]func(*reader){
+		"byte":  func(r *reader) { r.byte() },
+		"int16": func(r *reader) { r.int16() },
+		"int32": func(r *reader) { r.int32() },
+		"next":  func(r *reader) { r.next(2) },
+	} {
+		r := &reader{buf: []byte{1}}
+		if name == "byte" {
+			r.buf = nil
+		}
+		read(r)
+		if r.err != errShortMessage {
+			t.Errorf("%s on a short buffer: err = %v, want errShortMessage", name, r.err)
+		}
+	}
+}
+
+func TestReceive(t *testing.T) {
+	stream := append(backendMessage('Z', []byte{'I'}), backendMessage('C', []byte("SELECT 1\x00"))...)
+	c := &Conn{rd: bufio.NewReader(bytes.NewReader(stream))}
+
+	typ, body, err := c.receive()
+	if err != nil || typ != 'Z' || !bytes.Equal(body, []byte{'I'}) {
+		t.Fatalf("receive() = %q, %q, %v", typ, body, err)
+	}
+	typ, body, err = c.receive()
+	if err != nil || typ != 'C' || string(body) != "SELECT 1\x00" {
+		t.Fatalf("receive() = %q, %q, %v", typ, body, err)
+	}
+	if _, _, err := c.receive(); err != io.EOF {
+		t.Errorf("receive() at the end of the stream: err = %v, want EOF", err)
+	}
+}
+
+func TestReceiveInvalidLength(t *testing.T) {
+	tests := map[string]uint32{
+		"shorter than its length field": 3,
+		"larger than the maximum":       maxMessageSize + 5,
+		"negative":                      0xffffffff,
+	}
+	for name, length := range tests {
+		header := []byte{'D', 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], length)
+		c := &Conn{rd: bufio.NewReader(bytes.NewReader(header))}
+		if _, _, err := c.receive(); err == nil {
+			t.Errorf("message %s: receive() succeeded", name)
+		}
+	}
+}
+
+func TestStartupTrust(t *testing.T) {
+	var reply []byte
+	reply = append(reply, backendMessage('R', int32Bytes(0))...)
+	reply = append(reply, backendMessage('S', []byte("server_version\x0016.4\x00"))...)
+	reply = append(reply, backendMessage('K', append(int32Bytes(42), int32Bytes(7)...))...)
+	reply = append(reply, backendMessage('Z', []byte{'I'})...)
+	c := pipeConn(t, reply)
+
+	if err := c.startup(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ParameterStatus("server_version"); got != "16.4" {
+		t.Errorf("server_version = %q, want 16.4", got)
+	}
+	if c.pid != 42 || c.secret != 7 {
+		t.Errorf("backend key = %d/%d, want 42/7", c.pid, c.secret)
+	}
+}
+
+func TestStartupError(t *testing.T) {
+	body := []byte("SFATAL\x00C28P01\x00Mpassword authentication failed for user \"postgres\"\x00\x00")
+	c := pipeConn(t, backendMessage('E', body))
+
+	err := c.startup()
+	if SQLState(err) != InvalidPassword {
+		t.Fatalf("startup() = %v, want SQLSTATE %s", err, InvalidPassword)
+	}
+}
+
+func TestStartupSASLMechanisms(t *testing.T) {
+	tests := []struct {
+		name       string
+		mechanisms string
+		wantErr    string
+	}{
+		{"unsupported", "SCRAM-SHA-256-PLUS\x00\x00", "unsupported SASL mechanisms"},
+		// the list misses the NUL terminating the last mechanism
+		{"unterminated", "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256", errShortMessage.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pipeConn(t, backendMessage('R', append(int32Bytes(10), tt.mechanisms...)))
+			done := make(chan error, 1)
+			go func() { done <- c.startup() }()
+
+			err := <-done
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("startup() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueryCancelledContext(t *testing.T) {
+	c := pipeConn(t, nil)
+	// the server never answers, the cancelled context closes the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Query(ctx, "SELECT 1"); err == nil {
+		t.Fatal("Query() on a cancelled context succeeded")
+	}
+}
+
+func TestCancelledContextSendsCancelRequest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg := make([]byte, 16)
+		if _, err := io.ReadFull(conn, msg); err == nil {
+			received <- msg
+		}
+	}()
+
+	c := pipeConn(t, nil)
+	c.config.Host = "127.0.0.1"
+	c.config.Port = listener.Addr().(*net.TCPAddr).Port
+	c.pid, c.secret = 42, 7
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Query(ctx, "VACUUM"); err == nil {
+		t.Fatal("Query() on a cancelled context succeeded")
+	}
+
+	want := []byte{0, 0, 0, 16}
+	want = append(want, int32Bytes(cancelRequestCode)...)
+	want = append(want, int32Bytes(42)...)
+	want = append(want, int32Bytes(7)...)
+	if msg := <-received; !bytes.Equal(msg, want) {
+		t.Errorf("CancelRequest = %v, want %v", msg, want)
+	}
+}
@@ -0,0 +1,146 @@
+package pgclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// SQLSTATE codes the operator inspects when deciding how to handle a failure
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	SerializationFailure = "40001"
+	DeadlockDetected     = "40P01"
+	UndefinedFunction    = "42883"
+	UndefinedObject      = "42704"
+	DuplicateObject      = "42710"
+	DuplicateDatabase    = "42P04"
+	InvalidPassword      = "28P01"
+	InvalidAuthorization = "28000"
+	LockNotAvailable     = "55P03"
+	ObjectInUse          = "55006"
+	AdminShutdown        = "57P01"
+	CrashShutdown        = "57P02"
+	CannotConnectNow     = "57P03"
+	ReadOnlyTransaction  = "25006"
+	QueryCanceled        = "57014"
+)
+
+// Error is an ErrorResponse returned by the server
+type Error struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+	Where    string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Class returns the two character SQLSTATE class of the error
+func (e *Error) Class() string {
+	if len(e.Code) < 2 {
+		return ""
+	}
+	return e.Code[:2]
+}
+
+// SQLState returns the SQLSTATE code of err if it is a server error, otherwise an empty string
+func SQLState(err error) string {
+	var pgErr *Error
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// IsTransient reports whether err is likely to go away if the same statement is retried,
+// either because the server could not be reached or because it returned an error in a
+// class that describes a temporary condition rather than a problem with the statement
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *Error
+	if errors.As(err, &pgErr) {
+		switch pgErr.Class() {
+		case "08", // connection exception
+			"53", // insufficient resources
+			"58": // system error
+			return true
+		}
+		switch pgErr.Code {
+		case SerializationFailure, DeadlockDetected, LockNotAvailable,
+			AdminShutdown, CrashShutdown, CannotConnectNow:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var connErr *ConnectError
+	if errors.As(err, &connErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// ConnectError is returned when a connection to the server could not be established
+type ConnectError struct {
+	Address string
+	Err     error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("failed to connect to %s: %v", e.Address, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoRows is returned by QueryRow when the query returned no rows
+var ErrNoRows = errors.New("pgclient: no rows in result set")
+
+func parseError(body []byte) *Error {
+	e := &Error{}
+	r := &reader{buf: body}
+	for {
+		field := r.byte()
+		if field == 0 || r.err != nil {
+			break
+		}
+		value := r.cstring()
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'V':
+			// non-localized severity, only set the localized one if it's missing
+			if e.Severity == "" {
+				e.Severity = value
+			}
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		case 'H':
+			e.Hint = value
+		case 'W':
+			e.Where = value
+		}
+	}
+	return e
+}
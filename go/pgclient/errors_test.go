@@ -0,0 +1,89 @@
+package pgclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	body := []byte("SERROR\x00VERROR\x00C42P04\x00Mdatabase \"bench\" already exists\x00" +
+		"Dsome detail\x00Hsome hint\x00WSQL statement\x00Fdbcommands.c\x00\x00")
+	e := parseError(body)
+
+	want := Error{
+		Severity: "ERROR",
+		Code:     DuplicateDatabase,
+		Message:  `database "bench" already exists`,
+		Detail:   "some detail",
+		Hint:     "some hint",
+		Where:    "SQL statement",
+	}
+	if *e != want {
+		t.Errorf("parseError() = %+v, want %+v", *e, want)
+	}
+	if e.Class() != "42" {
+		t.Errorf("Class() = %q, want 42", e.Class())
+	}
+	if got := e.Error(); got != `ERROR: database "bench" already exists (SQLSTATE 42P04): some detail` {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestParseErrorLocalizedSeverity(t *testing.T) {
+	// the non-localized severity only fills in a missing localized one
+	e := parseError([]byte("VFATAL\x00SFATAL-DE\x00C57P01\x00\x00"))
+	if e.Severity != "FATAL-DE" || e.Code != AdminShutdown {
+		t.Errorf("parseError() = %+v", *e)
+	}
+	e = parseError([]byte("VPANIC\x00C58000\x00\x00"))
+	if e.Severity != "PANIC" {
+		t.Errorf("Severity = %q, want PANIC", e.Severity)
+	}
+}
+
+func TestParseErrorTruncated(t *testing.T) {
+	// a body without terminators still yields the fields read so far
+	e := parseError([]byte("C40001\x00Mcould not serialize"))
+	if e.Code != SerializationFailure {
+		t.Errorf("Code = %q, want %s", e.Code, SerializationFailure)
+	}
+}
+
+func TestSQLState(t *testing.T) {
+	err := fmt.Errorf("vacuum failed: %w", &Error{Code: LockNotAvailable})
+	if got := SQLState(err); got != LockNotAvailable {
+		t.Errorf("SQLState() = %q, want %s", got, LockNotAvailable)
+	}
+	if got := SQLState(errors.New("plain")); got != "" {
+		t.Errorf("SQLState() of a non-server error = %q", got)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&Error{Code: "08006"}, true},
+		{&Error{Code: "53100"}, true},
+		{&Error{Code: SerializationFailure}, true},
+		{&Error{Code: CannotConnectNow}, true},
+		{&Error{Code: UndefinedFunction}, false},
+		{&Error{Code: InvalidPassword}, false},
+		{&ConnectError{Address: "localhost:5432", Err: errors.New("refused")}, true},
+		{io.ErrUnexpectedEOF, true},
+		{os.NewSyscallError("read", syscall.ECONNRESET), true},
+		{errors.New("read: connection reset by peer"), false},
+		{errors.New("syntax"), false},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pgclient
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// writer builds a single frontend message
+type writer struct {
+	buf []byte
+	// offset of the length field, untyped messages have no type byte
+	lengthAt int
+}
+
+// newMessage starts a message with the given type byte, a zero type starts an
+// untyped message such as the StartupMessage
+func newMessage(typ byte) *writer {
+	w := &writer{}
+	if typ != 0 {
+		w.buf = append(w.buf, typ)
+		w.lengthAt = 1
+	}
+	// placeholder for the length
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	return w
+}
+
+func (w *writer) int16(v int) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v))
+}
+
+func (w *writer) int32(v int) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(v))
+}
+
+func (w *writer) cstring(s string) {
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+}
+
+func (w *writer) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// finish fills in the message length and returns the encoded message
+func (w *writer) finish() []byte {
+	binary.BigEndian.PutUint32(w.buf[w.lengthAt:], uint32(len(w.buf)-w.lengthAt))
+	return w.buf
+}
+
+var errShortMessage = errors.New("pgclient: malformed message from server")
+
+// reader decodes the body of a single backend message
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if len(r.buf) < 1 {
+		r.err = errShortMessage
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) int16() int {
+	if len(r.buf) < 2 {
+		r.err = errShortMessage
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(r.buf))
+	r.buf = r.buf[2:]
+	return int(v)
+}
+
+func (r *reader) int32() int {
+	if len(r.buf) < 4 {
+		r.err = errShortMessage
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return int(v)
+}
+
+func (r *reader) cstring() string {
+	for i, b := range r.buf {
+		if b == 0 {
+			s := string(r.buf[:i])
+			r.buf = r.buf[i+1:]
+			return s
+		}
+	}
+	r.err = errShortMessage
+	return ""
+}
+
+func (r *reader) next(n int) []byte {
+	if n < 0 || len(r.buf) < n {
+		r.err = errShortMessage
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
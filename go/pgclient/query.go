@@ -0,0 +1,275 @@
+package pgclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result holds the rows and command tag of a statement
+type Result struct {
+	Columns []string
+	Rows    []Row
+	// CommandTag is the tag returned by the server, e.g. "INSERT 0 1"
+	CommandTag string
+}
+
+// Row is a single result row with text encoded values, NULLs are nil
+type Row [][]byte
+
+// IsNull reports whether column i is NULL
+func (r Row) IsNull(i int) bool {
+	return r[i] == nil
+}
+
+// String returns column i as a string, NULL is returned as an empty string
+func (r Row) String(i int) string {
+	return string(r[i])
+}
+
+// Int64 parses column i as an integer, NULL is returned as zero
+func (r Row) Int64(i int) (int64, error) {
+	if r[i] == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(r[i]), 10, 64)
+}
+
+// Float64 parses column i as a floating point number, NULL is returned as zero
+func (r Row) Float64(i int) (float64, error) {
+	if r[i] == nil {
+		return 0, nil
+	}
+	return strconv.ParseFloat(string(r[i]), 64)
+}
+
+// Bool parses column i as a boolean, NULL is returned as false
+func (r Row) Bool(i int) bool {
+	return string(r[i]) == "t" || string(r[i]) == "true"
+}
+
+// Exec runs a statement and returns its command tag. Without args the statement is sent
+// with the simple query protocol, which allows utility statements such as VACUUM and
+// multiple statements separated by semicolons. With args the extended query protocol is
+// used and the args are sent as parameters $1, $2, ... and never interpolated into the SQL.
+func (c *Conn) Exec(ctx context.Context, sql string, args ...interface{}) (string, error) {
+	result, err := c.Query(ctx, sql, args...)
+	if err != nil {
+		return "", err
+	}
+	return result.CommandTag, nil
+}
+
+// Query runs a statement and returns all of its rows, see Exec for how args are sent
+func (c *Conn) Query(ctx context.Context, sql string, args ...interface{}) (*Result, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, fmt.Errorf("pgclient: connection is closed")
+	}
+
+	stop := c.watch(ctx)
+	defer stop()
+
+	if len(args) == 0 {
+		msg := newMessage('Q')
+		msg.cstring(sql)
+		if err := c.send(msg.finish()); err != nil {
+			return nil, err
+		}
+		return c.readResult()
+	}
+
+	params := make([][]byte, len(args))
+	for i, arg := range args {
+		value, err := encodeParam(arg)
+		if err != nil {
+			return nil, fmt.Errorf("pgclient: parameter $%d: %w", i+1, err)
+		}
+		params[i] = value
+	}
+
+	parse := newMessage('P')
+	parse.cstring("")
+	parse.cstring(sql)
+	parse.int16(0)
+
+	bind := newMessage('B')
+	bind.cstring("")
+	bind.cstring("")
+	bind.int16(0) // all parameters use the text format
+	bind.int16(len(params))
+	for _, p := range params {
+		if p == nil {
+			bind.int32(-1)
+			continue
+		}
+		bind.int32(len(p))
+		bind.bytes(p)
+	}
+	bind.int16(0) // all results use the text format
+
+	describe := newMessage('D')
+	describe.buf = append(describe.buf, 'P')
+	describe.cstring("")
+
+	execute := newMessage('E')
+	execute.cstring("")
+	execute.int32(0)
+
+	var batch []byte
+	batch = append(batch, parse.finish()...)
+	batch = append(batch, bind.finish()...)
+	batch = append(batch, describe.finish()...)
+	batch = append(batch, execute.finish()...)
+	batch = append(batch, newMessage('S').finish()...)
+	if err := c.send(batch); err != nil {
+		return nil, err
+	}
+	return c.readResult()
+}
+
+// QueryRow runs a statement and returns its first row, or ErrNoRows if there is none
+func (c *Conn) QueryRow(ctx context.Context, sql string, args ...interface{}) (Row, error) {
+	result, err := c.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Rows) == 0 {
+		return nil, ErrNoRows
+	}
+	return result.Rows[0], nil
+}
+
+// readResult reads messages until ReadyForQuery. When several statements were sent in a
+// simple query the rows of the last one that returned any are kept. The first error is
+// returned once the server is ready for the next query, so the connection stays usable.
+func (c *Conn) readResult() (*Result, error) {
+	result := &Result{}
+	var firstErr error
+	for {
+		typ, body, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'T':
+			r := &reader{buf: body}
+			n := r.int16()
+			result.Columns = make([]string, 0, n)
+			result.Rows = nil
+			for i := 0; i < n; i++ {
+				result.Columns = append(result.Columns, r.cstring())
+				// table oid, column number, type oid, type size, type modifier, format
+				r.next(18)
+			}
+			if r.err != nil {
+				return nil, r.err
+			}
+		case 'D':
+			r := &reader{buf: body}
+			n := r.int16()
+			row := make(Row, n)
+			for i := 0; i < n; i++ {
+				length := r.int32()
+				if length < 0 {
+					continue
+				}
+				row[i] = r.next(length)
+			}
+			if r.err != nil {
+				return nil, r.err
+			}
+			result.Rows = append(result.Rows, row)
+		case 'C':
+			r := &reader{buf: body}
+			result.CommandTag = r.cstring()
+		case 'E':
+			if firstErr == nil {
+				firstErr = parseError(body)
+			}
+		case 'Z':
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return result, nil
+		case '1', '2', 'n', 'I', 'N', 'S', 's', 'A':
+			// ParseComplete, BindComplete, NoData, EmptyQueryResponse, notices,
+			// parameter status changes, suspended portals and notifications
+		default:
+			return nil, fmt.Errorf("pgclient: unexpected message %q", typ)
+		}
+	}
+}
+
+// encodeParam converts a Go value to the text representation postgres expects
+func encodeParam(arg interface{}) ([]byte, error) {
+	switch v := arg.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		if v == nil {
+			return nil, nil
+		}
+		return v, nil
+	case bool:
+		return []byte(strconv.FormatBool(v)), nil
+	case int:
+		return []byte(strconv.FormatInt(int64(v), 10)), nil
+	case int32:
+		return []byte(strconv.FormatInt(int64(v), 10)), nil
+	case int64:
+		return []byte(strconv.FormatInt(v, 10)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+	case time.Time:
+		return []byte(v.Format(time.RFC3339Nano)), nil
+	case time.Duration:
+		return []byte(fmt.Sprintf("%d milliseconds", v.Milliseconds())), nil
+	case []string:
+		return []byte(textArray(v)), nil
+	case fmt.Stringer:
+		return []byte(v.String()), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", arg)
+}
+
+// textArray encodes a string slice as a postgres array literal
+func textArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		v = strings.ReplaceAll(v, `"`, `\"`)
+		quoted[i] = `"` + v + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// QuoteIdentifier quotes a name for use as an identifier in a statement, for the
+// places where a parameter cannot be used such as table names in VACUUM
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// QuoteQualifiedIdentifier quotes a possibly schema qualified name such as "public.users"
+func QuoteQualifiedIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// QuoteLiteral quotes a value for use as a string literal, for utility statements such
+// as CREATE ROLE ... PASSWORD that do not accept parameters
+func QuoteLiteral(value string) string {
+	if strings.Contains(value, `\`) {
+		return `E'` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `'`, `''`) + `'`
+	}
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
+}
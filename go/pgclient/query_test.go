@@ -0,0 +1,174 @@
+package pgclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"users":      `"users"`,
+		"Mixed Case": `"Mixed Case"`,
+		`we"ird`:     `"we""ird"`,
+		"":           `""`,
+	}
+	for name, want := range tests {
+		if got := QuoteIdentifier(name); got != want {
+			t.Errorf("QuoteIdentifier(%q) = %s, want %s", name, got, want)
+		}
+	}
+	if got := QuoteQualifiedIdentifier(`public.my"table`); got != `"public"."my""table"` {
+		t.Errorf("QuoteQualifiedIdentifier() = %s", got)
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := map[string]string{
+		"secret":     `'secret'`,
+		"it's":       `'it''s'`,
+		`back\slash`: `E'back\\slash'`,
+		`it's a \ba`: `E'it''s a \\ba'`,
+		"":           `''`,
+	}
+	for value, want := range tests {
+		if got := QuoteLiteral(value); got != want {
+			t.Errorf("QuoteLiteral(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+type stringer struct{}
+
+func (stringer) String() string { return "stringer" }
+
+func TestEncodeParam(t *testing.T) {
+	tests := []struct {
+		arg  interface{}
+		want []byte
+	}{
+		{nil, nil},
+		{[]byte(nil), nil},
+		{"text", []byte("text")},
+		{[]byte("raw"), []byte("raw")},
+		{true, []byte("true")},
+		{42, []byte("42")},
+		{int32(-7), []byte("-7")},
+		{int64(1) << 40, []byte("1099511627776")},
+		{1.5, []byte("1.5")},
+		{time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), []byte("2024-02-29T12:00:00Z")},
+		{90 * time.Second, []byte("90000 milliseconds")},
+		{[]string{"a", `b"c`, `d\e`}, []byte(`{"a","b\"c","d\\e"}`)},
+		{[]string{}, []byte("{}")},
+		{stringer{}, []byte("stringer")},
+	}
+	for _, tt := range tests {
+		got, err := encodeParam(tt.arg)
+		if err != nil {
+			t.Errorf("encodeParam(%#v) = %v", tt.arg, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("encodeParam(%#v) = %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+	if _, err := encodeParam(struct{}{}); err == nil {
+		t.Error("encodeParam() accepted an unsupported type")
+	}
+}
+
+func TestReadResult(t *testing.T) {
+	var rowDescription []byte
+	rowDescription = append(rowDescription, 0, 2)
+	for _, column := range []string{"name", "size"} {
+		rowDescription = append(rowDescription, column...)
+		rowDescription = append(rowDescription, 0)
+		rowDescription = append(rowDescription, make([]byte, 18)...)
+	}
+	var dataRow []byte
+	dataRow = append(dataRow, 0, 2)
+	dataRow = append(dataRow, int32Bytes(5)...)
+	dataRow = append(dataRow, "users"...)
+	dataRow = append(dataRow, int32Bytes(-1)...)
+
+	var stream []byte
+	stream = append(stream, backendMessage('1', nil)...)
+	stream = append(stream, backendMessage('2', nil)...)
+	stream = append(stream, backendMessage('T', rowDescription)...)
+	stream = append(stream, backendMessage('D', dataRow)...)
+	stream = append(stream, backendMessage('C', []byte("SELECT 1\x00"))...)
+	stream = append(stream, backendMessage('Z', []byte{'I'})...)
+	c := &Conn{rd: bufio.NewReader(bytes.NewReader(stream))}
+
+	result, err := c.readResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Columns) != 2 || result.Columns[0] != "name" || result.Columns[1] != "size" {
+		t.Errorf("Columns = %v", result.Columns)
+	}
+	if len(result.Rows) != 1 || result.Rows[0].String(0) != "users" || !result.Rows[0].IsNull(1) {
+		t.Fatalf("Rows = %q", result.Rows)
+	}
+	if size, err := result.Rows[0].Int64(1); size != 0 || err != nil {
+		t.Errorf("Int64() of NULL = %d, %v", size, err)
+	}
+	if result.CommandTag != "SELECT 1" {
+		t.Errorf("CommandTag = %q", result.CommandTag)
+	}
+}
+
+func TestReadResultKeepsConnectionUsableAfterError(t *testing.T) {
+	var stream []byte
+	stream = append(stream, backendMessage('E', []byte("SERROR\x00C42883\x00Mno such function\x00\x00"))...)
+	stream = append(stream, backendMessage('Z', []byte{'I'})...)
+	stream = append(stream, backendMessage('C', []byte("CHECKPOINT\x00"))...)
+	stream = append(stream, backendMessage('Z', []byte{'I'})...)
+	c := &Conn{rd: bufio.NewReader(bytes.NewReader(stream))}
+
+	if _, err := c.readResult(); SQLState(err) != UndefinedFunction {
+		t.Fatalf("readResult() = %v, want SQLSTATE %s", err, UndefinedFunction)
+	}
+	result, err := c.readResult()
+	if err != nil || result.CommandTag != "CHECKPOINT" {
+		t.Fatalf("readResult() after the error = %v, %v", result, err)
+	}
+}
+
+func TestQueryParameters(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c := &Conn{conn: client, rd: bufio.NewReader(client), params: map[string]string{}}
+
+	sent := make(chan []byte, 1)
+	go func() {
+		// Parse, Bind, Describe, Execute and Sync arrive in one write
+		buf := make([]byte, 4096)
+		n, _ := server.Read(buf)
+		sent <- buf[:n]
+		server.Write(backendMessage('C', []byte("SELECT 0\x00")))
+		server.Write(backendMessage('Z', []byte{'I'}))
+	}()
+
+	if _, err := c.Exec(context.Background(), "SELECT $1, $2", "it's", nil); err != nil {
+		t.Fatal(err)
+	}
+	batch := <-sent
+	if batch[0] != 'P' || !bytes.Contains(batch, []byte("SELECT $1, $2\x00")) {
+		t.Errorf("batch doesn't start with a Parse message: %q", batch)
+	}
+	// the value travels as a parameter, NULL as length -1
+	bind := append([]byte{0, 0, 0, 2}, int32Bytes(4)...)
+	bind = append(bind, "it's"...)
+	bind = append(bind, int32Bytes(-1)...)
+	if !bytes.Contains(batch, bind) {
+		t.Errorf("batch doesn't bind the parameters: %q", batch)
+	}
+	if !bytes.HasSuffix(batch, []byte{'S', 0, 0, 0, 4}) {
+		t.Errorf("batch doesn't end with Sync: %q", batch)
+	}
+}
@@ -0,0 +1,131 @@
+package pgclient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const scramSHA256 = "SCRAM-SHA-256"
+
+// scramMaxIterations bounds the PBKDF2 iterations a server can ask for, postgres defaults to
+// 4096 and anything far above would only keep the client busy
+const scramMaxIterations = 1 << 20
+
+// scramClient implements the client side of SCRAM-SHA-256 (RFC 7677) without channel binding
+type scramClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newScramClient(password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scramClient{
+		password:    password,
+		clientNonce: base64.StdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+// clientFirst returns the client-first-message, the user name is sent in the
+// startup message so postgres ignores the one in the SCRAM exchange
+func (s *scramClient) clientFirst() []byte {
+	s.clientFirstBare = "n=,r=" + s.clientNonce
+	return []byte("n,," + s.clientFirstBare)
+}
+
+// clientFinal processes the server-first-message and returns the client-final-message
+func (s *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, s.clientNonce) || salt == "" || iterations <= 0 {
+		return nil, errors.New("pgclient: invalid SCRAM server-first-message")
+	}
+	if iterations > scramMaxIterations {
+		return nil, fmt.Errorf("pgclient: SCRAM iteration count %d exceeds %d", iterations, scramMaxIterations)
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("pgclient: invalid SCRAM salt: %w", err)
+	}
+
+	saltedPassword := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := s.clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof
+
+	clientSignature := hmacSHA256(storedKey[:], []byte(authMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	s.serverSignature = hmacSHA256(serverKey, []byte(authMessage))
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServerFinal checks the server signature in the server-final-message
+func (s *scramClient) verifyServerFinal(serverFinal []byte) error {
+	if !bytes.HasPrefix(serverFinal, []byte("v=")) {
+		return errors.New("pgclient: invalid SCRAM server-final-message")
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(serverFinal[2:]))
+	if err != nil {
+		return fmt.Errorf("pgclient: invalid SCRAM server signature: %w", err)
+	}
+	if !hmac.Equal(signature, s.serverSignature) {
+		return errors.New("pgclient: SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a single SHA-256 sized block, which is all SCRAM-SHA-256 needs
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package pgclient
+
+import (
+	"strings"
+	"testing"
+)
+
+// the SCRAM-SHA-256 exchange of RFC 7677 section 3
+const (
+	rfc7677ClientNonce     = "rOprNGfwEbeRWgbNEkqO"
+	rfc7677ClientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst     = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal     = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal     = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func rfc7677Client() *scramClient {
+	// postgres takes the user from the startup message, the vector names it in the exchange
+	return &scramClient{
+		password:        "pencil",
+		clientNonce:     rfc7677ClientNonce,
+		clientFirstBare: rfc7677ClientFirstBare,
+	}
+}
+
+func TestScramRFC7677(t *testing.T) {
+	s := rfc7677Client()
+	final, err := s.clientFinal([]byte(rfc7677ServerFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(final) != rfc7677ClientFinal {
+		t.Errorf("client-final-message = %q, want %q", final, rfc7677ClientFinal)
+	}
+	if err := s.verifyServerFinal([]byte(rfc7677ServerFinal)); err != nil {
+		t.Errorf("verifyServerFinal() = %v", err)
+	}
+}
+
+func TestScramServerSignatureMismatch(t *testing.T) {
+	s := rfc7677Client()
+	if _, err := s.clientFinal([]byte(rfc7677ServerFirst)); err != nil {
+		t.Fatal(err)
+	}
+	forged := "v=" + strings.Repeat("A", 43) + "="
+	if err := s.verifyServerFinal([]byte(forged)); err == nil {
+		t.Error("verifyServerFinal() accepted a forged signature")
+	}
+	if err := s.verifyServerFinal([]byte("e=invalid-proof")); err == nil {
+		t.Error("verifyServerFinal() accepted a server error")
+	}
+}
+
+func TestScramInvalidServerFirst(t *testing.T) {
+	tests := map[string]string{
+		"foreign nonce":       "r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"missing salt":        "r=rOprNGfwEbeRWgbNEkqOxyz,i=4096",
+		"no iterations":       "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"invalid base64":      "r=rOprNGfwEbeRWgbNEkqOxyz,s=!!!,i=4096",
+		"too many iterations": "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=2147483647",
+	}
+	for name, serverFirst := range tests {
+		if _, err := rfc7677Client().clientFinal([]byte(serverFirst)); err == nil {
+			t.Errorf("%s: clientFinal() succeeded", name)
+		}
+	}
+}
+
+func TestScramClientFirst(t *testing.T) {
+	s, err := newScramClient("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := string(s.clientFirst())
+	if want := "n,,n=,r=" + s.clientNonce; first != want {
+		t.Errorf("client-first-message = %q, want %q", first, want)
+	}
+	if s.clientFirstBare != "n=,r="+s.clientNonce {
+		t.Errorf("client-first-message-bare = %q", s.clientFirstBare)
+	}
+}
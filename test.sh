@@ -4,55 +4,32 @@ set -xeo pipefail
 
 kubectl delete -f examples/bgdbops.yaml || true
 kubectl delete -f examples/bgshardeddbops.yaml || true
-kubectl delete -f examples/bgshardedcluster.yaml --wait || true
-kubectl delete -f examples/bgshardedcluster-replicas.yaml --wait || true
+kubectl delete -f examples/bgshardeddbops-rebalance.yaml || true
+kubectl delete -f examples/bgcluster-restore.yaml --wait || true
+kubectl delete -f examples/bgcluster-backup-pvc.yaml --wait || true
+kubectl delete -f examples/bgbackupschedule.yaml || true
+kubectl delete -f examples/bgbackup.yaml || true
+kubectl delete -f examples/bgcluster-backup.yaml --wait || true
+kubectl delete -f examples/bgshardedcluster.yaml --cascade=foreground --wait || true
+kubectl delete -f examples/bgshardedcluster-replicas.yaml --cascade=foreground --wait || true
+kubectl delete -f examples/bgshardedcluster-patroni-native.yaml --cascade=foreground --wait || true
 kubectl delete -f examples/bgcluster.yaml --wait || true
 sleep 2
 helm uninstall bestgres-operator || true
 sleep 2
 
-# delete bgcluster stuff
-kubectl delete pvc controller-bgcluster-0 || true
-kubectl delete pvc controller-bgcluster-1 || true
-kubectl delete pvc pgdata-bgcluster-0 || true
-kubectl delete pvc pgdata-bgcluster-1 || true
-# kubectl delete cm bgcluster-0-leader || true
-# kubectl delete cm bgcluster-1-leader || true
-
-# delete bgshardedcluster stuff
-kubectl delete pvc pgdata-bgshardedcluster-coordinator-0 || true
-kubectl delete pvc pgdata-bgshardedcluster-coordinator-1 || true
-kubectl delete pvc pgdata-bgshardedcluster-worker-0-0 || true
-kubectl delete pvc pgdata-bgshardedcluster-worker-0-1 || true
-kubectl delete pvc pgdata-bgshardedcluster-worker-1-0 || true
-kubectl delete pvc controller-bgshardedcluster-coordinator-0 || true
-kubectl delete pvc controller-bgshardedcluster-coordinator-1 || true
-kubectl delete pvc controller-bgshardedcluster-worker-0-0 || true
-kubectl delete pvc controller-bgshardedcluster-worker-0-1 || true
-kubectl delete pvc controller-bgshardedcluster-worker-1-0 || true
-# kubectl delete cm bgshardedcluster-worker-0-leader || true
-# kubectl delete cm bgshardedcluster-worker-0-config || true
-# kubectl delete cm bgshardedcluster-worker-1-leader || true
-# kubectl delete cm bgshardedcluster-worker-1-config || true
-# kubectl delete cm bgshardedcluster-coordinator-leader || true
-kubectl delete pvc controller-bgshardedcluster-repl-coordinator-0 || true
-kubectl delete pvc controller-bgshardedcluster-repl-coordinator-1 || true
-kubectl delete pvc controller-bgshardedcluster-repl-worker-0-0 || true
-kubectl delete pvc controller-bgshardedcluster-repl-worker-0-1 || true
-kubectl delete pvc controller-bgshardedcluster-repl-worker-1-0 || true
-kubectl delete pvc controller-bgshardedcluster-repl-worker-1-1 || true
-kubectl delete pvc pgdata-bgshardedcluster-repl-coordinator-0 || true
-kubectl delete pvc pgdata-bgshardedcluster-repl-coordinator-1 || true
-kubectl delete pvc pgdata-bgshardedcluster-repl-worker-0-0 || true
-kubectl delete pvc pgdata-bgshardedcluster-repl-worker-0-1 || true
-kubectl delete pvc pgdata-bgshardedcluster-repl-worker-1-0 || true
-kubectl delete pvc pgdata-bgshardedcluster-repl-worker-1-1 || true
+# the examples use deletionPolicy: Delete, the operator removes their PVCs and Patroni ConfigMaps
+# before letting them go (foreground deletion waits for that on the sharded clusters' BGClusters)
+# backup volumes the operator created outlive their clusters, remove them for a clean run
+kubectl delete pvc -l bgcluster.bestgres.io/backup-of || true
 
 # delete crds
 kubectl delete crd bgclusters.bestgres.io || true
 kubectl delete crd bgshardedclusters.bestgres.io || true
 kubectl delete crd bgdbops.bestgres.io || true
 kubectl delete crd bgshardeddbops.bestgres.io || true
+kubectl delete crd bgbackups.bestgres.io || true
+kubectl delete crd bgbackupschedules.bestgres.io || true
 
 make
 
@@ -60,6 +37,7 @@ helm upgrade --install bestgres-operator go/deploy/helm/bestgres-operator/.
 sleep 2
 # kubectl apply -f examples/bgcluster.yaml
 kubectl apply -f examples/bgshardedcluster.yaml
+kubectl apply -f examples/bgshardedcluster-patroni-native.yaml
 
 # watch 'kubectl get bgcluster -o=json | jq ".items[].metadata.annotations"'
 
@@ -70,9 +48,20 @@ sleep 30
 # kubectl exec -it bgcluster-0 -- psql -U postgres -c 'SELECT * FROM pg_stat_replication;'
 # kubectl exec -it bgcluster-1 -- psql -U postgres -c 'SELECT * FROM pg_stat_wal_receiver;'
 
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c 'SELECT * from pg_dist_node;'
-# kubectl exec -it bgshardedcluster-repl-coordinator-0 -- psql -U postgres -c 'SELECT * from pg_dist_node;'
+# distributed queries authenticate to the workers with scram, so run them as the internal
+# Citus user whose password the coordinator keeps in pg_dist_authinfo
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c 'SELECT * from pg_dist_node;'
+kubectl exec -it bgshardedcluster-native-coordinator-0 -- psql -U bestgres_citus -d postgres -c 'SELECT * from pg_dist_node;'
+# both modes end up with the same topology, the node names differ as Patroni registers the
+# addresses of the primaries instead of the primary Services
+topology='SELECT groupid, noderole, isactive, shouldhaveshards FROM pg_dist_node ORDER BY groupid'
+diff <(kubectl exec bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -Atc "$topology") \
+     <(kubectl exec bgshardedcluster-native-coordinator-0 -- psql -U bestgres_citus -d postgres -Atc "$topology")
+# kubectl exec -it bgshardedcluster-repl-coordinator-0 -- psql -U bestgres_citus -d postgres -c 'SELECT * from pg_dist_node;'
 # kubectl exec -it bgshardedcluster-repl-coordinator-0 -- patronictl list
+# the worker replicas are secondaries in their own node cluster, connections that set
+# citus.use_secondary_nodes=always and citus.cluster_name=secondaries read from them
+# kubectl exec -it bgshardedcluster-repl-coordinator-0 -- psql -U bestgres_citus -d postgres -c 'SELECT nodename, groupid, noderole, nodecluster FROM pg_dist_node;'
 # kubectl exec -it bgcluster-0 -- psql -U postgres -c 'CREATE TABLE test_table (id SERIAL PRIMARY KEY, name VARCHAR(100) NOT NULL, age INT NOT NULL);'
 # kubectl exec -it bgcluster-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Alice', 30);"
 # kubectl exec -it bgcluster-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Bob', 25);"
@@ -81,28 +70,38 @@ kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c 'SELECT *
 # sleep 30
 # kubectl exec -it bgcluster-1 -- psql -U postgres -c "SELECT * FROM test_table;"
 
-# kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "SELECT * FROM citus_add_node('bgshardedcluster-worker-1', 5432);"
+# kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "SELECT * FROM citus_add_node('bgshardedcluster-worker-1', 5432);"
 
 # kubectl apply -f examples/bgdbops.yaml
-
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c 'CREATE TABLE test_table (id SERIAL PRIMARY KEY, name VARCHAR(100) NOT NULL, age INT NOT NULL);'
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Alice', 30);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Bob', 25);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Charlie', 35);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Daniel', 29);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Eve', 27);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Frank', 33);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Grace', 31);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Hank', 28);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Ivy', 34);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Jack', 32);"
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "INSERT INTO test_table (name, age) VALUES ('Katie', 26);"
-
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "SELECT * FROM test_table;"
-
-kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U postgres -c "SELECT create_distributed_table('test_table', 'id');"
-
-kubectl exec -it bgshardedcluster-worker-0-0 -- psql -U postgres -c "SELECT * FROM test_table;"
-# kubectl exec -it bgshardedcluster-worker-1-0 -- psql -U postgres -c "SELECT * FROM test_table;"
+# kubectl apply -f examples/bgdbops-switchover.yaml
+# kubectl get bgdbops bgdbops-switchover -o=jsonpath='{.status.switchoverResult}'
+# pod template changes roll out replicas first and the primary last after a switchover
+# kubectl get bgcluster bgcluster -o=jsonpath='{.status.rollout}'
+# scaling down switches over first when the primary runs on a removed ordinal
+# kubectl patch bgcluster bgcluster --type merge -p '{"spec":{"instances":1}}'
+# major version upgrades pause Patroni, run pg_upgrade on the primary and rebuild the replicas
+# kubectl apply -f examples/bgdbops-upgrade.yaml
+# kubectl get bgdbops bgdbops-upgrade -o=jsonpath='{.status.upgradeResult}'
+
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c 'CREATE TABLE test_table (id SERIAL PRIMARY KEY, name VARCHAR(100) NOT NULL, age INT NOT NULL);'
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Alice', 30);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Bob', 25);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Charlie', 35);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Daniel', 29);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Eve', 27);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Frank', 33);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Grace', 31);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Hank', 28);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Ivy', 34);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Jack', 32);"
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "INSERT INTO test_table (name, age) VALUES ('Katie', 26);"
+
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "SELECT * FROM test_table;"
+
+kubectl exec -it bgshardedcluster-coordinator-0 -- psql -U bestgres_citus -d postgres -c "SELECT create_distributed_table('test_table', 'id');"
+
+kubectl exec -it bgshardedcluster-worker-0-0 -- psql -U bestgres_citus -d postgres -c "SELECT * FROM test_table;"
+# kubectl exec -it bgshardedcluster-worker-1-0 -- psql -U bestgres_citus -d postgres -c "SELECT * FROM test_table;"
 
 # kubectl apply -f examples/bgshardeddbops.yaml
+# kubectl apply -f examples/bgshardeddbops-rebalance.yaml
\ No newline at end of file